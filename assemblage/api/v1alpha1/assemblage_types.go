@@ -10,15 +10,46 @@ import (
 	syncapi "github.com/squaremo/fleeet/pkg/api"
 )
 
+const (
+	// SyncNameLabel is put on the objects created for a sync, to
+	// record which sync they belong to.
+	SyncNameLabel = "fleet.squaremo.dev/sync-name"
+	// DeletionPolicyAnnotation records the deletion policy of a sync
+	// on its Kustomization, since it's needed after the sync has
+	// been removed.
+	DeletionPolicyAnnotation = "fleet.squaremo.dev/deletion-policy"
+	// UpstreamNamespaceLabel is put on an assemblage mirrored from a
+	// management cluster, to record the namespace of the remote
+	// assemblage it mirrors, which may not be the same as its own.
+	UpstreamNamespaceLabel = "fleet.squaremo.dev/upstream-namespace"
+	// DefaultNamespace is the namespace in which an assemblage
+	// mirrored from a management cluster is put, if no other is
+	// given.
+	DefaultNamespace = "fleet-system"
+)
+
 // AssemblageSpec defines the desired state of Assemblage
 type AssemblageSpec struct {
 	// +required
 	Syncs []syncapi.NamedSync `json:"syncs"`
+	// Suspend suspends all the syncs in the assemblage, and stops
+	// the objects for removed syncs from being deleted. Status is
+	// still reported while the assemblage is suspended.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
 }
 
 // AssemblageStatus defines the observed state of Assemblage
 type AssemblageStatus struct {
-	Syncs []syncapi.SyncStatus `json:"syncs,omitempty"`
+	// ObservedGeneration is the most recent generation of the spec
+	// acted upon.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions gives the Ready, Reconciling and Stalled conditions
+	// for the object.
+	// +optional
+	Conditions []metav1.Condition   `json:"conditions,omitempty"`
+	Syncs      []syncapi.SyncStatus `json:"syncs,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -42,6 +73,12 @@ type AssemblageList struct {
 	Items           []Assemblage `json:"items"`
 }
 
+// GetStatusConditions returns a pointer to the conditions in the
+// status, so they can be manipulated in place.
+func (in *Assemblage) GetStatusConditions() *[]metav1.Condition {
+	return &in.Status.Conditions
+}
+
 func init() {
 	SchemeBuilder.Register(&Assemblage{}, &AssemblageList{})
 }
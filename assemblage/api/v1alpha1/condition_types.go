@@ -0,0 +1,25 @@
+/*
+Copyright 2021 Michael Bridgen
+*/
+
+package v1alpha1
+
+// The condition types used are those of kstatus, as given in
+// github.com/fluxcd/pkg/apis/meta: Ready, Reconciling and
+// Stalled. These are the reasons given for them.
+
+const (
+	// SyncSucceededReason means every sync in the assemblage has been
+	// applied successfully.
+	SyncSucceededReason = "SyncSucceeded"
+	// SyncFailedReason means at least one sync in the assemblage has
+	// failed.
+	SyncFailedReason = "SyncFailed"
+	// RolloutInProgressReason means the syncs in the assemblage are
+	// still being applied, or removed.
+	RolloutInProgressReason = "RolloutInProgress"
+	// SuspendedReason means some or all of the syncs in the
+	// assemblage are suspended, and the rest have been applied
+	// successfully.
+	SuspendedReason = "Suspended"
+)
@@ -10,6 +10,7 @@ package v1alpha1
 
 import (
 	"github.com/squaremo/fleeet/pkg/api"
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
@@ -97,6 +98,13 @@ func (in *AssemblageSpec) DeepCopy() *AssemblageSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AssemblageStatus) DeepCopyInto(out *AssemblageStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.Syncs != nil {
 		in, out := &in.Syncs, &out.Syncs
 		*out = make([]api.SyncStatus, len(*in))
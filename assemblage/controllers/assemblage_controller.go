@@ -8,12 +8,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -23,24 +28,47 @@ import (
 
 	asmv1 "github.com/squaremo/fleeet/assemblage/api/v1alpha1"
 	syncapi "github.com/squaremo/fleeet/pkg/api"
+	"github.com/squaremo/fleeet/pkg/apply"
 )
 
 // ErrCircularBinding is the error that will be logged if binding
 // definitions refer to each other recursively.
 var ErrCircularBinding = errors.New("circular definition of binding")
 
+// inventoryInterval is how often the objects applied by each sync are
+// looked at, to detect conflicts between syncs.
+const inventoryInterval = time.Minute
+
+// fieldManager is the field manager for the objects this controller
+// applies.
+const fieldManager = "fleet-assemblage"
+
 // AssemblageReconciler reconciles a Assemblage object
 type AssemblageReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// ListInventoryObjects says whether to list the objects each
+	// sync has applied in its status, as well as counting them.
+	ListInventoryObjects bool
+
+	// DriftCheckInterval gives how often to check the objects each
+	// sync has applied for drift. If zero, drift isn't checked, and
+	// the syncs' drift policies have no effect.
+	DriftCheckInterval time.Duration
+	// ReportDriftFields says whether to give the fields that have
+	// drifted in the status, as well as counting the objects.
+	ReportDriftFields bool
+
+	inventories *inventoryTracker
 }
 
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=assemblages,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=assemblages/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=assemblages/finalizers,verbs=update
-//+kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=gitrepositories,verbs=get;list;watch;create;update;patch
-//+kubebuilder:rbac:groups=kustomize.toolkit.fluxcd.io,resources=kustomizations,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=gitrepositories,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=kustomize.toolkit.fluxcd.io,resources=kustomizations,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -55,32 +83,73 @@ func (r *AssemblageReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 	namespacedClient := client.NewNamespacedClient(r.Client, asm.Namespace)
 
+	// The transition times in the previous status are kept for syncs
+	// that haven't changed state.
+	previous := map[string]syncapi.SyncStatus{}
+	for _, status := range asm.Status.Syncs {
+		previous[status.Sync.Name] = status
+	}
+	now := metav1.Now()
+
+	// Find which syncs have applied the same objects, and which of
+	// those are to be blocked because of it.
+	applied, err := r.appliedObjects(ctx, log, &asm)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	conflicts, blocked := detectConflicts(&asm, applied)
+	tracked := len(applied) > 0
+
+	existing, err := r.existingSyncObjects(ctx, &asm)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
 	// For each sync, make sure the correct GitOps Toolkit objects
 	// exist, and collect the status of any that do.
 	var statuses []syncapi.SyncStatus
+	// the names of the objects for the syncs, so any others can be
+	// cleaned up
+	wanted := map[string]struct{}{}
 	for i, sync := range asm.Spec.Syncs {
 		syncStatus := syncapi.SyncStatus{
 			Sync: sync,
 		}
+		// A sync is suspended if it says so, or if the whole
+		// assemblage is.
+		suspend := sync.Suspend || asm.Spec.Suspend
+
+		// The objects for the sync may already exist, possibly
+		// under a name given by an earlier version.
+		objectName := objectNameForSync(&asm, &sync)
+		exists, ok := existing[sync.Name]
+		if ok {
+			objectName = exists.name
+		}
 
 		// Firstly, a source
 		var source sourcev1.GitRepository
 		source.Namespace = asm.Namespace
-		source.Name = fmt.Sprintf("%s-%d", asm.Name, i) // TODO is the order stable?
+		source.Name = objectName
+		wanted[source.Name] = struct{}{}
 
-		op, err := ctrl.CreateOrUpdate(ctx, r.Client, &source, func() error {
-			if err := syncapi.PopulateGitRepositorySpecFromSync(&source.Spec, &sync.Sync); err != nil {
-				return err
-			}
-			if err := controllerutil.SetControllerReference(&asm, &source, r.Scheme); err != nil {
-				return err
-			}
-			return nil
-		})
-		if err != nil {
+		if err := syncapi.PopulateGitRepositorySpecFromSync(&source.Spec, &sync.Sync); err != nil {
+			return ctrl.Result{}, err
+		}
+		source.Spec.Suspend = suspend
+		if err := controllerutil.SetControllerReference(&asm, &source, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+		setSyncNameLabel(&source, sync.Name)
+		op, err := apply.Apply(ctx, r.Client, &source, fieldManager)
+		if err != nil && !apply.IsConflict(err) {
 			return ctrl.Result{}, err
 		}
-		log.Info("creating/updating source git repository", "name", source.Name, "operation", op)
+		// A conflict means someone else has set some of the fields
+		// differently; that's reported as a failure of the sync,
+		// and the Kustomization isn't touched until it's resolved.
+		fieldConflict := err
+		log.Info("applying source git repository", "name", source.Name, "operation", op, "error", fieldConflict)
 
 		// If the source changed, it's all updating
 		switch op {
@@ -94,35 +163,83 @@ func (r *AssemblageReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			log.V(1).Info("unhandled operation result", "operation", op)
 		}
 
+		// Check the objects applied for the sync for drift, if
+		// it's time to, or the policy has changed; otherwise, keep
+		// what was found last time.
+		var drift *syncapi.SyncDrift
+		if r.checksDrift() {
+			last := previous[sync.Name]
+			drift = last.Drift
+			if a, ok := applied[sync.Name]; ok &&
+				(driftCheckDue(drift, now, r.DriftCheckInterval) || !equality.Semantic.DeepEqual(last.Sync.Drift, sync.Drift)) {
+				objects, fields, err := r.checkDrift(ctx, log, a.live, ignoredFields(&sync))
+				if err != nil {
+					return ctrl.Result{}, err
+				}
+				drift = recordDrift(drift, now, objects, fields, r.ReportDriftFields)
+			}
+		}
+		syncStatus.Drift = drift
+
 		// Secondly, a Kustomization
 		switch {
+		case fieldConflict != nil:
+			break
 		case sync.Package.Kustomize != nil:
 			var kustom kustomv1.Kustomization
 			kustom.Namespace = asm.Namespace
-			kustom.Name = fmt.Sprintf("%s-%d", asm.Name, i)
+			kustom.Name = objectName
 
-			op, err := ctrl.CreateOrUpdate(ctx, r.Client, &kustom, func() error {
-				spec, err := syncapi.KustomizationSpecFromPackage(sync.Package, source.Name, makeBindingFunc(ctx, log, namespacedClient, sync.Bindings, nil))
-				if err != nil {
-					return err
-				}
-				kustom.Spec = spec
-				if err = controllerutil.SetControllerReference(&asm, &kustom, r.Scheme); err != nil {
-					return err
-				}
-				return nil
-			})
+			spec, err := syncapi.KustomizationSpecFromPackage(sync.Package, source.Name, makeBindingFunc(ctx, log, namespacedClient, sync.Bindings, nil))
 			if err != nil {
 				return ctrl.Result{}, err
 			}
-			log.Info("creating/updating kustomization", "name", kustom.Name, "operation", op)
+			// Prune is needed so that removing a sync removes what
+			// was synced. If it's to be orphaned instead, this is
+			// switched off before deleting the kustomization.
+			// Kustomizations adopted from an earlier version were
+			// created without prune, and are left that way, since
+			// switching it on would start deleting things that
+			// weren't going to be deleted before.
+			spec.Prune = true
+			if exists.kustom != nil {
+				spec.Prune = exists.kustom.Spec.Prune
+			}
+			// If drift is to be left in place, the Kustomization
+			// is suspended until there's a new revision to apply.
+			spec.Suspend = suspend || blocked[sync.Name] ||
+				(r.checksDrift() && holdForDrift(&sync, &source, applied[sync.Name], drift))
+			kustom.Spec = spec
+			if err = controllerutil.SetControllerReference(&asm, &kustom, r.Scheme); err != nil {
+				return ctrl.Result{}, err
+			}
+			setSyncNameLabel(&kustom, sync.Name)
+			// The deletion policy is recorded here, since the sync
+			// won't be around to consult when it comes to deleting
+			// the kustomization. Leaving the annotation out when
+			// it's not needed removes it, since it's owned by this
+			// controller.
+			if sync.DeletionPolicy == syncapi.DeletionPolicyOrphan {
+				kustom.SetAnnotations(map[string]string{
+					asmv1.DeletionPolicyAnnotation: string(sync.DeletionPolicy),
+				})
+			}
+
+			op, err := apply.Apply(ctx, r.Client, &kustom, fieldManager)
+			if err != nil && !apply.IsConflict(err) {
+				return ctrl.Result{}, err
+			}
+			fieldConflict = err
+			log.Info("applying kustomization", "name", kustom.Name, "operation", op, "error", fieldConflict)
+			syncStatus.LastAttemptedRevision = kustom.Status.LastAttemptedRevision
+			syncStatus.LastAppliedRevision = kustom.Status.LastAppliedRevision
 			// the source might be unready above, in which case the
 			// aggregate state is updating; but if not, it'll be down
 			// to the kustomization's ready state
 			if syncStatus.State == "" {
 				switch op {
 				case controllerutil.OperationResultNone:
-					syncStatus.State = readyState(&kustom)
+					syncStatus.State, syncStatus.Message = readyState(&kustom)
 				default:
 					syncStatus.State = syncapi.StateUpdating
 				}
@@ -130,33 +247,387 @@ func (r *AssemblageReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		default:
 			log.Info("no sync package present", "sync", i)
 		}
+		// Whatever state the objects are in, nothing more will
+		// happen while the sync is suspended; unless it couldn't be
+		// suspended, because of a conflict.
+		if fieldConflict != nil {
+			syncStatus.State = syncapi.StateFailed
+			syncStatus.Message = fieldConflict.Error()
+		} else if suspend {
+			syncStatus.State = syncapi.StateSuspended
+		} else if blocked[sync.Name] {
+			var others []string
+			for _, c := range conflicts[sync.Name] {
+				if c.Blocked {
+					others = append(others, c.Sync)
+				}
+			}
+			syncStatus.State = syncapi.StateFailed
+			syncStatus.Message = fmt.Sprintf("blocked by conflict with %s", strings.Join(others, ", "))
+		}
+		syncStatus.Conflicts = conflicts[sync.Name]
+		if a, ok := applied[sync.Name]; ok {
+			syncStatus.Inventory = summariseInventory(a.objects, r.ListInventoryObjects)
+		}
+		if prev, ok := previous[sync.Name]; ok && prev.State == syncStatus.State && prev.LastTransitionTime != nil {
+			syncStatus.LastTransitionTime = prev.LastTransitionTime
+		} else {
+			syncStatus.LastTransitionTime = &now
+		}
 		statuses = append(statuses, syncStatus)
 	}
 
+	// Remove the objects for any syncs that are no longer in the
+	// spec. Those that are still being deleted get a status entry, so
+	// it's possible to tell when they are gone. If the assemblage is
+	// suspended, the objects are suspended instead of being deleted,
+	// and stay in the status until the assemblage is resumed.
+	removedState := syncapi.StateDeleting
+	removeSyncs := r.deleteRemovedSyncs
+	if asm.Spec.Suspend {
+		removedState = syncapi.StateSuspended
+		removeSyncs = r.suspendRemovedSyncs
+	}
+	removed, err := removeSyncs(ctx, log, &asm, wanted)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	for _, name := range removed {
+		prev, ok := previous[name]
+		if !ok {
+			// Without the previous status, there's no record of
+			// the sync to report against
+			continue
+		}
+		if prev.State != removedState {
+			prev.State = removedState
+			prev.Message = ""
+			prev.LastTransitionTime = &now
+		}
+		statuses = append(statuses, prev)
+	}
+
 	asm.Status.Syncs = statuses
+	asm.Status.ObservedGeneration = asm.Generation
+	markFromSyncStatus(&asm)
 	if err := r.Status().Update(ctx, &asm); err != nil {
 		return ctrl.Result{}, err
 	}
 
+	// Objects moving between syncs, or drifting, doesn't show up as
+	// a change to anything watched, so look again in a while.
+	if tracked {
+		interval := inventoryInterval
+		if d := r.DriftCheckInterval; r.checksDrift() && d < interval {
+			interval = d
+		}
+		return ctrl.Result{RequeueAfter: interval}, nil
+	}
 	return ctrl.Result{}, nil
 }
 
-func readyState(obj meta.ObjectWithStatusConditions) syncapi.SyncState {
+// appliedSync records what the Kustomization for a sync has been seen
+// to apply.
+type appliedSync struct {
+	created metav1.Time
+	// revision is the revision of the source last applied by the
+	// Kustomization
+	revision string
+	// live are the objects labelled as applied by the Kustomization
+	// now, and objects are the same, as identifiers
+	live    []unstructured.Unstructured
+	objects []string
+	// remembered are all those seen to be applied by the
+	// Kustomization since its manifests last changed
+	remembered map[string]struct{}
+}
+
+// appliedObjects finds the objects applied by the Kustomization for
+// each sync in the spec, keyed by sync name. Syncs whose
+// Kustomization hasn't applied anything yet are left out.
+func (r *AssemblageReconciler) appliedObjects(ctx context.Context, log logr.Logger, asm *asmv1.Assemblage) (map[string]*appliedSync, error) {
+	inSpec := map[string]struct{}{}
+	for i := range asm.Spec.Syncs {
+		inSpec[asm.Spec.Syncs[i].Name] = struct{}{}
+	}
+
+	var kustoms kustomv1.KustomizationList
+	if err := r.List(ctx, &kustoms, client.InNamespace(asm.Namespace)); err != nil {
+		return nil, err
+	}
+	applied := map[string]*appliedSync{}
+	for i := range kustoms.Items {
+		kustom := &kustoms.Items[i]
+		if !metav1.IsControlledBy(kustom, asm) {
+			continue
+		}
+		key := types.NamespacedName{Namespace: kustom.Namespace, Name: kustom.Name}
+		name := kustom.GetLabels()[asmv1.SyncNameLabel]
+		if _, ok := inSpec[name]; !ok || kustom.Status.Snapshot == nil {
+			r.inventories.forget(key)
+			continue
+		}
+		live, err := labelledObjects(ctx, log, r.Client, kustom)
+		if err != nil {
+			return nil, fmt.Errorf("listing objects applied by kustomization %q: %w", kustom.Name, err)
+		}
+		objects := objectIDs(live)
+		applied[name] = &appliedSync{
+			created:    kustom.CreationTimestamp,
+			revision:   kustom.Status.LastAppliedRevision,
+			live:       live,
+			objects:    objects,
+			remembered: r.inventories.observe(key, kustom.Status.Snapshot.Checksum, objects),
+		}
+	}
+	return applied, nil
+}
+
+// detectConflicts finds which syncs have applied the same objects,
+// and which of those are to be blocked because of it. A sync is
+// blocked if its policy says so, and it was created after a sync it
+// conflicts with.
+func detectConflicts(asm *asmv1.Assemblage, applied map[string]*appliedSync) (map[string][]syncapi.SyncConflict, map[string]bool) {
+	inSpec := map[string]*syncapi.NamedSync{}
+	for i := range asm.Spec.Syncs {
+		inSpec[asm.Spec.Syncs[i].Name] = &asm.Spec.Syncs[i]
+	}
+	inventories := make(map[string]map[string]struct{}, len(applied))
+	for name, a := range applied {
+		inventories[name] = a.remembered
+	}
+
+	conflicts := findConflicts(inventories)
+	blocked := map[string]bool{}
+	for name, cs := range conflicts {
+		if inSpec[name].ConflictPolicy != syncapi.ConflictPolicyBlock {
+			continue
+		}
+		this := applied[name].created
+		for i := range cs {
+			other := applied[cs[i].Sync].created
+			if other.Before(&this) || (other.Equal(&this) && cs[i].Sync < name) {
+				cs[i].Blocked = true
+				blocked[name] = true
+			}
+		}
+	}
+	return conflicts, blocked
+}
+
+// objectNameForSync gives the name to use for the GitOps Toolkit
+// objects created for a sync.
+func objectNameForSync(asm *asmv1.Assemblage, sync *syncapi.NamedSync) string {
+	return asm.Name + "-" + sync.Name
+}
+
+// legacyObjectName gives the name earlier versions of this controller
+// used for the GitOps Toolkit objects created for the sync at the
+// index given.
+func legacyObjectName(asm *asmv1.Assemblage, index int) string {
+	return fmt.Sprintf("%s-%d", asm.Name, index)
+}
+
+// syncObjects records the GitOps Toolkit objects that already exist
+// for a sync.
+type syncObjects struct {
+	name string
+	// kustom is the Kustomization, if one has been created
+	kustom *kustomv1.Kustomization
+}
+
+// existingSyncObjects finds the GitOps Toolkit objects controlled by
+// the assemblage that already exist for each sync in the spec, keyed
+// by sync name. Objects are usually found by their sync name label;
+// but earlier versions of this controller named the objects for the
+// index of the sync and didn't label them, so an unlabelled object
+// with the name for a sync's index is adopted by that sync, rather
+// than being deleted and recreated (and pruning what it synced).
+func (r *AssemblageReconciler) existingSyncObjects(ctx context.Context, asm *asmv1.Assemblage) (map[string]syncObjects, error) {
+	var kustoms kustomv1.KustomizationList
+	if err := r.List(ctx, &kustoms, client.InNamespace(asm.Namespace)); err != nil {
+		return nil, err
+	}
+	var sources sourcev1.GitRepositoryList
+	if err := r.List(ctx, &sources, client.InNamespace(asm.Namespace)); err != nil {
+		return nil, err
+	}
+
+	var objs []client.Object
+	for i := range kustoms.Items {
+		objs = append(objs, &kustoms.Items[i])
+	}
+	for i := range sources.Items {
+		objs = append(objs, &sources.Items[i])
+	}
+
+	labelled := map[string]string{}
+	unlabelled := map[string]struct{}{}
+	kustomsByName := map[string]*kustomv1.Kustomization{}
+	for _, obj := range objs {
+		if !metav1.IsControlledBy(obj, asm) {
+			continue
+		}
+		if kustom, ok := obj.(*kustomv1.Kustomization); ok {
+			kustomsByName[kustom.Name] = kustom
+		}
+		if name, ok := obj.GetLabels()[asmv1.SyncNameLabel]; ok {
+			labelled[name] = obj.GetName()
+		} else {
+			unlabelled[obj.GetName()] = struct{}{}
+		}
+	}
+
+	existing := map[string]syncObjects{}
+	for i := range asm.Spec.Syncs {
+		syncName := asm.Spec.Syncs[i].Name
+		name, ok := labelled[syncName]
+		if !ok {
+			name = legacyObjectName(asm, i)
+			if _, ok := unlabelled[name]; !ok {
+				continue
+			}
+		}
+		existing[syncName] = syncObjects{
+			name:   name,
+			kustom: kustomsByName[name],
+		}
+	}
+	return existing, nil
+}
+
+func setSyncNameLabel(obj client.Object, name string) {
+	labels := obj.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[asmv1.SyncNameLabel] = name
+	obj.SetLabels(labels)
+}
+
+// deleteRemovedSyncs deletes the GitOps Toolkit objects controlled by
+// the assemblage that aren't among those wanted. It returns the names
+// of the syncs for which a Kustomization still exists, i.e., that
+// have not finished being deleted.
+func (r *AssemblageReconciler) deleteRemovedSyncs(ctx context.Context, log logr.Logger, asm *asmv1.Assemblage, wanted map[string]struct{}) ([]string, error) {
+	var deleting []string
+
+	var kustoms kustomv1.KustomizationList
+	if err := r.List(ctx, &kustoms, client.InNamespace(asm.Namespace)); err != nil {
+		return nil, err
+	}
+	for i := range kustoms.Items {
+		kustom := &kustoms.Items[i]
+		if _, ok := wanted[kustom.Name]; ok || !metav1.IsControlledBy(kustom, asm) {
+			continue
+		}
+		if name, ok := kustom.GetLabels()[asmv1.SyncNameLabel]; ok {
+			deleting = append(deleting, name)
+		}
+		if kustom.GetDeletionTimestamp() != nil {
+			continue // already on its way
+		}
+		// To orphan what was synced, the kustomization must not
+		// prune when it's deleted.
+		if kustom.GetAnnotations()[asmv1.DeletionPolicyAnnotation] == string(syncapi.DeletionPolicyOrphan) && kustom.Spec.Prune {
+			patch := client.MergeFrom(kustom.DeepCopy())
+			kustom.Spec.Prune = false
+			if err := r.Patch(ctx, kustom, patch); err != nil {
+				return nil, err
+			}
+		}
+		log.Info("deleting kustomization for removed sync", "name", kustom.Name)
+		if err := r.Delete(ctx, kustom); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+	}
+
+	var sources sourcev1.GitRepositoryList
+	if err := r.List(ctx, &sources, client.InNamespace(asm.Namespace)); err != nil {
+		return nil, err
+	}
+	for i := range sources.Items {
+		source := &sources.Items[i]
+		if _, ok := wanted[source.Name]; ok || !metav1.IsControlledBy(source, asm) || source.GetDeletionTimestamp() != nil {
+			continue
+		}
+		log.Info("deleting source for removed sync", "name", source.Name)
+		if err := r.Delete(ctx, source); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+	}
+
+	return deleting, nil
+}
+
+// suspendRemovedSyncs suspends the GitOps Toolkit objects controlled
+// by the assemblage that aren't among those wanted, rather than
+// deleting them. It returns the names of the syncs for which a
+// Kustomization exists.
+func (r *AssemblageReconciler) suspendRemovedSyncs(ctx context.Context, log logr.Logger, asm *asmv1.Assemblage, wanted map[string]struct{}) ([]string, error) {
+	var suspended []string
+
+	var kustoms kustomv1.KustomizationList
+	if err := r.List(ctx, &kustoms, client.InNamespace(asm.Namespace)); err != nil {
+		return nil, err
+	}
+	for i := range kustoms.Items {
+		kustom := &kustoms.Items[i]
+		if _, ok := wanted[kustom.Name]; ok || !metav1.IsControlledBy(kustom, asm) {
+			continue
+		}
+		if name, ok := kustom.GetLabels()[asmv1.SyncNameLabel]; ok {
+			suspended = append(suspended, name)
+		}
+		if kustom.Spec.Suspend || kustom.GetDeletionTimestamp() != nil {
+			continue
+		}
+		log.Info("suspending kustomization for removed sync", "name", kustom.Name)
+		patch := client.MergeFrom(kustom.DeepCopy())
+		kustom.Spec.Suspend = true
+		if err := r.Patch(ctx, kustom, patch); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+	}
+
+	var sources sourcev1.GitRepositoryList
+	if err := r.List(ctx, &sources, client.InNamespace(asm.Namespace)); err != nil {
+		return nil, err
+	}
+	for i := range sources.Items {
+		source := &sources.Items[i]
+		if _, ok := wanted[source.Name]; ok || !metav1.IsControlledBy(source, asm) || source.Spec.Suspend || source.GetDeletionTimestamp() != nil {
+			continue
+		}
+		log.Info("suspending source for removed sync", "name", source.Name)
+		patch := client.MergeFrom(source.DeepCopy())
+		source.Spec.Suspend = true
+		if err := r.Patch(ctx, source, patch); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+	}
+
+	return suspended, nil
+}
+
+// readyState gives the state of a sync according to the Ready
+// condition of the object given, along with the condition's message.
+func readyState(obj meta.ObjectWithStatusConditions) (syncapi.SyncState, string) {
 	conditions := obj.GetStatusConditions()
 	c := apimeta.FindStatusCondition(*conditions, meta.ReadyCondition)
 	switch {
 	case c == nil:
-		return syncapi.StateUpdating
+		return syncapi.StateUpdating, ""
 	case c.Status == metav1.ConditionTrue:
-		return syncapi.StateSucceeded
+		return syncapi.StateSucceeded, c.Message
 	case c.Status == metav1.ConditionFalse:
 		if c.Reason == meta.ReconciliationFailedReason {
-			return syncapi.StateFailed
+			return syncapi.StateFailed, c.Message
 		} else {
-			return syncapi.StateUpdating
+			return syncapi.StateUpdating, c.Message
 		}
 	default: // FIXME possibly StateUnknown?
-		return syncapi.StateUpdating
+		return syncapi.StateUpdating, c.Message
 	}
 }
 
@@ -195,6 +666,7 @@ func makeBindingFunc(ctx context.Context, log logr.Logger, namespacedClient clie
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *AssemblageReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.inventories = newInventoryTracker()
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&asmv1.Assemblage{}).
 		Owns(&sourcev1.GitRepository{}).
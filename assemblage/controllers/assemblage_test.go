@@ -6,21 +6,31 @@ package controllers
 
 import (
 	"context"
+	"fmt"
 	"math/rand"
+	"strings"
 	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
 	kustomv1 "github.com/fluxcd/kustomize-controller/api/v1beta1"
+	"github.com/fluxcd/pkg/apis/meta"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
 
 	asmv1 "github.com/squaremo/fleeet/assemblage/api/v1alpha1"
 	syncapi "github.com/squaremo/fleeet/pkg/api"
+	"github.com/squaremo/fleeet/pkg/apply"
 )
 
 func randomStr(prefix string) string {
@@ -49,6 +59,11 @@ var _ = Describe("assemblage controller", func() {
 			Client: manager.GetClient(),
 			Scheme: scheme.Scheme,
 			Log:    ctrl.Log.WithName("controllers").WithName("Assemblage"),
+
+			// So drift shows up quickly, and can be checked in
+			// detail.
+			DriftCheckInterval: time.Second,
+			ReportDriftFields:  true,
 		}
 		Expect(assemblageReconciler.SetupWithManager(manager)).To(Succeed())
 
@@ -120,7 +135,7 @@ var _ = Describe("assemblage controller", func() {
 		// eventually we should see a git repository source and
 		// kustomization created in the same namespace.
 		expectedGitName := types.NamespacedName{
-			Name:      asm.Name + "-0",
+			Name:      asm.Name + "-app",
 			Namespace: asm.Namespace,
 		}
 		Eventually(func() bool {
@@ -132,7 +147,7 @@ var _ = Describe("assemblage controller", func() {
 		}, "5s", "1s").Should(BeTrue())
 
 		expectedKustomizationName := types.NamespacedName{
-			Name:      asm.Name + "-0",
+			Name:      asm.Name + "-app",
 			Namespace: asm.Namespace,
 		}
 		var kustom kustomv1.Kustomization
@@ -143,6 +158,749 @@ var _ = Describe("assemblage controller", func() {
 			return kustom.Name == expectedGitName.Name
 		}, "5s", "1s").Should(BeTrue())
 		Expect(kustom.Spec.Path).To(Equal(asm.Spec.Syncs[0].Package.Kustomize.Path))
+
+		// When the kustomization fails, the message and revisions
+		// should show up in the assemblage status.
+		kustom.Status.LastAttemptedRevision = "main/bd6ef78"
+		kustom.Status.LastAppliedRevision = "main/a1b2c3d"
+		meta.SetResourceCondition(&kustom, meta.ReadyCondition, metav1.ConditionFalse, meta.ReconciliationFailedReason, "kustomize build failed")
+		Expect(k8sClient.Status().Update(context.Background(), &kustom)).To(Succeed())
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      asm.Name,
+				Namespace: asm.Namespace,
+			}, &asm); err != nil {
+				return false
+			}
+			return len(asm.Status.Syncs) == 1 && asm.Status.Syncs[0].State == syncapi.StateFailed
+		}, "5s", "1s").Should(BeTrue())
+		status := asm.Status.Syncs[0]
+		Expect(status.Message).To(Equal("kustomize build failed"))
+		Expect(status.LastAttemptedRevision).To(Equal("main/bd6ef78"))
+		Expect(status.LastAppliedRevision).To(Equal("main/a1b2c3d"))
+		Expect(status.LastTransitionTime).NotTo(BeNil())
+
+		// Removing the sync should remove the objects created for it.
+		asm.Spec.Syncs = []syncapi.NamedSync{}
+		Expect(k8sClient.Update(context.Background(), &asm)).To(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), expectedKustomizationName, &kustom)
+			return apierrors.IsNotFound(err)
+		}, "5s", "1s").Should(BeTrue())
+		Eventually(func() bool {
+			var source sourcev1.GitRepository
+			err := k8sClient.Get(context.Background(), expectedGitName, &source)
+			return apierrors.IsNotFound(err)
+		}, "5s", "1s").Should(BeTrue())
+	})
+
+	It("sets the Ready, Reconciling and Stalled conditions from the state of its syncs", func() {
+		asm := asmv1.Assemblage{
+			Spec: asmv1.AssemblageSpec{
+				Syncs: []syncapi.NamedSync{
+					{
+						Name: "app",
+						Sync: syncapi.Sync{
+							Source: syncapi.SourceSpec{
+								Git: &syncapi.GitSource{
+									URL: "https://github.com/cuttlefacts-app",
+									Version: syncapi.GitVersion{
+										Revision: "bd6ef78",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		asm.Name = randomStr("asm")
+		asm.Namespace = namespace.Name
+		Expect(k8sClient.Create(context.Background(), &asm)).To(Succeed())
+
+		asmKey := client.ObjectKeyFromObject(&asm)
+		// conditionReason gets the assemblage, and gives the reason
+		// for the condition of the type given, if it's True and the
+		// status is up to date with the spec.
+		conditionReason := func(conditionType string) string {
+			if err := k8sClient.Get(context.Background(), asmKey, &asm); err != nil {
+				return ""
+			}
+			if asm.Status.ObservedGeneration != asm.Generation {
+				return ""
+			}
+			c := apimeta.FindStatusCondition(asm.Status.Conditions, conditionType)
+			if c == nil || c.Status != metav1.ConditionTrue {
+				return ""
+			}
+			return c.Reason
+		}
+
+		// Nothing is running the kustomization, so it will be
+		// waiting to be applied.
+		Eventually(func() string {
+			return conditionReason(meta.ReconcilingCondition)
+		}, "5s", "1s").Should(Equal(asmv1.RolloutInProgressReason))
+		Expect(apimeta.IsStatusConditionFalse(asm.Status.Conditions, meta.ReadyCondition)).To(BeTrue())
+
+		var kustom kustomv1.Kustomization
+		Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+			Namespace: asm.Namespace,
+			Name:      asm.Name + "-app",
+		}, &kustom)).To(Succeed())
+		meta.SetResourceCondition(&kustom, meta.ReadyCondition, metav1.ConditionFalse, meta.ReconciliationFailedReason, "kustomize build failed")
+		Expect(k8sClient.Status().Update(context.Background(), &kustom)).To(Succeed())
+		Eventually(func() string {
+			return conditionReason(meta.StalledCondition)
+		}, "5s", "1s").Should(Equal(asmv1.SyncFailedReason))
+		Expect(apimeta.FindStatusCondition(asm.Status.Conditions, meta.ReconcilingCondition)).To(BeNil())
+		Expect(apimeta.FindStatusCondition(asm.Status.Conditions, meta.StalledCondition).Message).To(ContainSubstring("kustomize build failed"))
+
+		meta.SetResourceCondition(&kustom, meta.ReadyCondition, metav1.ConditionTrue, meta.ReconciliationSucceededReason, "applied")
+		Expect(k8sClient.Status().Update(context.Background(), &kustom)).To(Succeed())
+		Eventually(func() string {
+			return conditionReason(meta.ReadyCondition)
+		}, "5s", "1s").Should(Equal(asmv1.SyncSucceededReason))
+		Expect(apimeta.FindStatusCondition(asm.Status.Conditions, meta.StalledCondition)).To(BeNil())
+	})
+
+	It("suspends GOTK objects", func() {
+		asm := asmv1.Assemblage{
+			Spec: asmv1.AssemblageSpec{
+				Syncs: []syncapi.NamedSync{
+					{
+						Name:    "app",
+						Suspend: true,
+						Sync: syncapi.Sync{
+							Source: syncapi.SourceSpec{
+								Git: &syncapi.GitSource{
+									URL: "https://github.com/cuttlefacts-app",
+									Version: syncapi.GitVersion{
+										Revision: "bd6ef78",
+									},
+								},
+							},
+							Package: &syncapi.PackageSpec{
+								Kustomize: &syncapi.KustomizeSpec{
+									Path: "deploy",
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		asm.Name = randomStr("asm")
+		asm.Namespace = namespace.Name
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		Expect(k8sClient.Create(ctx, &asm)).To(Succeed())
+
+		objName := types.NamespacedName{
+			Name:      asm.Name + "-app",
+			Namespace: asm.Namespace,
+		}
+		var source sourcev1.GitRepository
+		Eventually(func() bool {
+			if err := k8sClient.Get(context.Background(), objName, &source); err != nil {
+				return false
+			}
+			return source.Spec.Suspend
+		}, "5s", "1s").Should(BeTrue())
+		var kustom kustomv1.Kustomization
+		Eventually(func() bool {
+			if err := k8sClient.Get(context.Background(), objName, &kustom); err != nil {
+				return false
+			}
+			return kustom.Spec.Suspend
+		}, "5s", "1s").Should(BeTrue())
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      asm.Name,
+				Namespace: asm.Namespace,
+			}, &asm); err != nil {
+				return false
+			}
+			return len(asm.Status.Syncs) == 1 && asm.Status.Syncs[0].State == syncapi.StateSuspended
+		}, "5s", "1s").Should(BeTrue())
+
+		// Suspending the whole assemblage and removing the sync
+		// should leave the objects in place, still suspended. The
+		// controller may update the status in between, so retry on
+		// conflict.
+		Eventually(func() error {
+			if err := k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      asm.Name,
+				Namespace: asm.Namespace,
+			}, &asm); err != nil {
+				return err
+			}
+			asm.Spec.Syncs[0].Suspend = false
+			asm.Spec.Suspend = true
+			return k8sClient.Update(context.Background(), &asm)
+		}, "5s", "1s").Should(Succeed())
+		Eventually(func() bool {
+			if err := k8sClient.Get(context.Background(), objName, &kustom); err != nil {
+				return false
+			}
+			return kustom.Spec.Suspend
+		}, "5s", "1s").Should(BeTrue())
+
+		Eventually(func() error {
+			if err := k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      asm.Name,
+				Namespace: asm.Namespace,
+			}, &asm); err != nil {
+				return err
+			}
+			asm.Spec.Syncs = []syncapi.NamedSync{}
+			return k8sClient.Update(context.Background(), &asm)
+		}, "5s", "1s").Should(Succeed())
+		Consistently(func() bool {
+			err := k8sClient.Get(context.Background(), objName, &kustom)
+			return err == nil && kustom.GetDeletionTimestamp() == nil && kustom.Spec.Suspend
+		}, "2s", "500ms").Should(BeTrue())
+
+		// Resuming the assemblage lets the removal go ahead.
+		Eventually(func() error {
+			if err := k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      asm.Name,
+				Namespace: asm.Namespace,
+			}, &asm); err != nil {
+				return err
+			}
+			asm.Spec.Suspend = false
+			return k8sClient.Update(context.Background(), &asm)
+		}, "5s", "1s").Should(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), objName, &kustom)
+			return apierrors.IsNotFound(err)
+		}, "5s", "1s").Should(BeTrue())
+	})
+
+	It("adopts GOTK objects named by index, leaving prune as it was", func() {
+		asm := asmv1.Assemblage{
+			Spec: asmv1.AssemblageSpec{
+				Syncs: []syncapi.NamedSync{},
+			},
+		}
+		asm.Name = randomStr("asm")
+		asm.Namespace = namespace.Name
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		Expect(k8sClient.Create(ctx, &asm)).To(Succeed())
+
+		// These are the objects an earlier version would have
+		// created for the first sync: named for the index, not
+		// labelled, and without prune.
+		legacyName := types.NamespacedName{
+			Name:      asm.Name + "-0",
+			Namespace: asm.Namespace,
+		}
+		var source sourcev1.GitRepository
+		source.Name = legacyName.Name
+		source.Namespace = legacyName.Namespace
+		source.Spec.URL = "https://github.com/cuttlefacts-app"
+		source.Spec.Interval = metav1.Duration{Duration: time.Minute}
+		Expect(controllerutil.SetControllerReference(&asm, &source, scheme.Scheme)).To(Succeed())
+		Expect(k8sClient.Create(ctx, &source)).To(Succeed())
+		var kustom kustomv1.Kustomization
+		kustom.Name = legacyName.Name
+		kustom.Namespace = legacyName.Namespace
+		kustom.Spec.Path = "deploy"
+		kustom.Spec.Interval = metav1.Duration{Duration: time.Minute}
+		kustom.Spec.SourceRef = kustomv1.CrossNamespaceSourceReference{
+			Kind: sourcev1.GitRepositoryKind,
+			Name: source.Name,
+		}
+		Expect(controllerutil.SetControllerReference(&asm, &kustom, scheme.Scheme)).To(Succeed())
+		Expect(k8sClient.Create(ctx, &kustom)).To(Succeed())
+
+		Eventually(func() error {
+			if err := k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      asm.Name,
+				Namespace: asm.Namespace,
+			}, &asm); err != nil {
+				return err
+			}
+			asm.Spec.Syncs = []syncapi.NamedSync{
+				{
+					Name: "app",
+					Sync: syncapi.Sync{
+						Source: syncapi.SourceSpec{
+							Git: &syncapi.GitSource{
+								URL: "https://github.com/cuttlefacts-app",
+								Version: syncapi.GitVersion{
+									Revision: "bd6ef78",
+								},
+							},
+						},
+						Package: &syncapi.PackageSpec{
+							Kustomize: &syncapi.KustomizeSpec{
+								Path: "deploy/app",
+							},
+						},
+					},
+				},
+			}
+			return k8sClient.Update(context.Background(), &asm)
+		}, "5s", "1s").Should(Succeed())
+
+		// The sync takes over the objects, rather than creating
+		// new ones.
+		Eventually(func() bool {
+			if err := k8sClient.Get(context.Background(), legacyName, &kustom); err != nil {
+				return false
+			}
+			return kustom.GetLabels()[asmv1.SyncNameLabel] == "app" && kustom.Spec.Path == "deploy/app"
+		}, "5s", "1s").Should(BeTrue())
+		Expect(kustom.Spec.Prune).To(BeFalse())
+		Expect(kustom.Spec.SourceRef.Name).To(Equal(legacyName.Name))
+		Expect(k8sClient.Get(context.Background(), legacyName, &source)).To(Succeed())
+		Expect(source.GetLabels()[asmv1.SyncNameLabel]).To(Equal("app"))
+
+		newName := types.NamespacedName{
+			Name:      asm.Name + "-app",
+			Namespace: asm.Namespace,
+		}
+		Consistently(func() bool {
+			err := k8sClient.Get(context.Background(), newName, &kustom)
+			return apierrors.IsNotFound(err)
+		}, "2s", "500ms").Should(BeTrue())
+	})
+
+	It("reports fields set by others as a failure, unless co-owned", func() {
+		asm := asmv1.Assemblage{
+			Spec: asmv1.AssemblageSpec{
+				Syncs: []syncapi.NamedSync{
+					{
+						Name: "app",
+						Sync: syncapi.Sync{
+							Source: syncapi.SourceSpec{
+								Git: &syncapi.GitSource{
+									URL: "https://github.com/cuttlefacts-app",
+									Version: syncapi.GitVersion{
+										Revision: "bd6ef78",
+									},
+								},
+							},
+							Package: &syncapi.PackageSpec{
+								Kustomize: &syncapi.KustomizeSpec{
+									Path: "deploy",
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+		asm.Name = randomStr("asm")
+		asm.Namespace = namespace.Name
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		Expect(k8sClient.Create(ctx, &asm)).To(Succeed())
+
+		objName := types.NamespacedName{
+			Name:      asm.Name + "-app",
+			Namespace: asm.Namespace,
+		}
+		var source sourcev1.GitRepository
+		Eventually(func() error {
+			return k8sClient.Get(context.Background(), objName, &source)
+		}, "5s", "1s").Should(Succeed())
+
+		// Someone else takes over the URL, so it no longer agrees
+		// with the sync.
+		const otherURL = "https://github.com/someone-else"
+		other := &unstructured.Unstructured{}
+		other.SetGroupVersionKind(sourcev1.GroupVersion.WithKind(sourcev1.GitRepositoryKind))
+		other.SetNamespace(objName.Namespace)
+		other.SetName(objName.Name)
+		Expect(unstructured.SetNestedField(other.Object, otherURL, "spec", "url")).To(Succeed())
+		Expect(k8sClient.Patch(context.Background(), other, client.Apply, client.FieldOwner("someone-else"), client.ForceOwnership)).To(Succeed())
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      asm.Name,
+				Namespace: asm.Namespace,
+			}, &asm); err != nil {
+				return false
+			}
+			return len(asm.Status.Syncs) == 1 &&
+				asm.Status.Syncs[0].State == syncapi.StateFailed &&
+				strings.Contains(asm.Status.Syncs[0].Message, "field conflict")
+		}, "5s", "1s").Should(BeTrue())
+
+		// Marking the URL as co-owned lets it be.
+		other.SetAnnotations(map[string]string{
+			apply.CoOwnedFieldsAnnotation: "spec.url",
+		})
+		Expect(k8sClient.Patch(context.Background(), other, client.Apply, client.FieldOwner("someone-else"), client.ForceOwnership)).To(Succeed())
+
+		Eventually(func() bool {
+			if err := k8sClient.Get(context.Background(), types.NamespacedName{
+				Name:      asm.Name,
+				Namespace: asm.Namespace,
+			}, &asm); err != nil {
+				return false
+			}
+			return len(asm.Status.Syncs) == 1 && asm.Status.Syncs[0].State != syncapi.StateFailed
+		}, "5s", "1s").Should(BeTrue())
+		Expect(k8sClient.Get(context.Background(), objName, &source)).To(Succeed())
+		Expect(source.Spec.URL).To(Equal(otherURL))
+	})
+
+	It("detects syncs that apply the same objects", func() {
+		makeNamedSync := func(name string, policy syncapi.ConflictPolicy) syncapi.NamedSync {
+			return syncapi.NamedSync{
+				Name:           name,
+				ConflictPolicy: policy,
+				Sync: syncapi.Sync{
+					Source: syncapi.SourceSpec{
+						Git: &syncapi.GitSource{
+							URL: "https://github.com/cuttlefacts-app",
+							Version: syncapi.GitVersion{
+								Revision: "bd6ef78",
+							},
+						},
+					},
+					Package: &syncapi.PackageSpec{
+						Kustomize: &syncapi.KustomizeSpec{
+							Path: name,
+						},
+					},
+				},
+			}
+		}
+		asm := asmv1.Assemblage{
+			Spec: asmv1.AssemblageSpec{
+				Syncs: []syncapi.NamedSync{
+					makeNamedSync("first", ""),
+					makeNamedSync("second", syncapi.ConflictPolicyBlock),
+				},
+			},
+		}
+		asm.Name = randomStr("asm")
+		asm.Namespace = namespace.Name
+		Expect(k8sClient.Create(context.Background(), &asm)).To(Succeed())
+
+		var first, second kustomv1.Kustomization
+		for name, kustom := range map[string]*kustomv1.Kustomization{"first": &first, "second": &second} {
+			key := types.NamespacedName{Namespace: asm.Namespace, Name: asm.Name + "-" + name}
+			Eventually(func() error {
+				return k8sClient.Get(context.Background(), key, kustom)
+			}, "5s", "1s").Should(Succeed())
+		}
+
+		// An object applied by the first sync ..
+		configMap := corev1.ConfigMap{}
+		configMap.Namespace = namespace.Name
+		configMap.Name = "shared"
+		configMap.Labels = map[string]string{
+			kustomizationNameLabel:      first.Name,
+			kustomizationNamespaceLabel: first.Namespace,
+		}
+		Expect(k8sClient.Create(context.Background(), &configMap)).To(Succeed())
+		snapshot := &kustomv1.Snapshot{
+			Checksum: "abc123",
+			Entries: []kustomv1.SnapshotEntry{{
+				Namespace: namespace.Name,
+				Kinds: map[string]string{
+					corev1.SchemeGroupVersion.WithKind("ConfigMap").String(): "ConfigMap",
+				},
+			}},
+		}
+		first.Status.Snapshot = snapshot
+		Expect(k8sClient.Status().Update(context.Background(), &first)).To(Succeed())
+
+		// .. is not a conflict by itself.
+		Consistently(func() bool {
+			if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&asm), &asm); err != nil {
+				return false
+			}
+			for _, s := range asm.Status.Syncs {
+				if len(s.Conflicts) > 0 {
+					return false
+				}
+			}
+			return true
+		}, "2s", "500ms").Should(BeTrue())
+
+		// When the second sync applies it too, both syncs are
+		// marked as conflicting, and the second (being later, and
+		// with the Block policy) is stopped.
+		configMap.Labels[kustomizationNameLabel] = second.Name
+		Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+		second.Status.Snapshot = snapshot
+		Expect(k8sClient.Status().Update(context.Background(), &second)).To(Succeed())
+
+		statusFor := func(name string) *syncapi.SyncStatus {
+			for i := range asm.Status.Syncs {
+				if asm.Status.Syncs[i].Sync.Name == name {
+					return &asm.Status.Syncs[i]
+				}
+			}
+			return nil
+		}
+		Eventually(func() bool {
+			if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&asm), &asm); err != nil {
+				return false
+			}
+			s := statusFor("second")
+			return s != nil && len(s.Conflicts) > 0
+		}, "5s", "1s").Should(BeTrue())
+
+		Expect(statusFor("first").Conflicts).To(Equal([]syncapi.SyncConflict{{
+			Sync:    "second",
+			Objects: []string{"ConfigMap/" + namespace.Name + "/shared"},
+		}}))
+		Expect(statusFor("second").Conflicts).To(Equal([]syncapi.SyncConflict{{
+			Sync:    "first",
+			Objects: []string{"ConfigMap/" + namespace.Name + "/shared"},
+			Blocked: true,
+		}}))
+		Expect(statusFor("second").State).To(Equal(syncapi.StateFailed))
+		Expect(statusFor("second").Message).To(Equal("blocked by conflict with first"))
+
+		// The inventory of each sync counts only what it applied
+		// last.
+		Expect(statusFor("second").Inventory).To(Equal(&syncapi.SyncInventory{
+			Total: 1,
+			Kinds: map[string]int{"ConfigMap": 1},
+		}))
+		Expect(statusFor("first").Inventory).To(Equal(&syncapi.SyncInventory{}))
+
+		Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&second), &second)).To(Succeed())
+		Expect(second.Spec.Suspend).To(BeTrue())
+		Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&first), &first)).To(Succeed())
+		Expect(first.Spec.Suspend).To(BeFalse())
+	})
+
+	Context("drift", func() {
+		var (
+			asm       asmv1.Assemblage
+			source    sourcev1.GitRepository
+			kustom    kustomv1.Kustomization
+			configMap corev1.ConfigMap
+		)
+
+		statusFor := func() *syncapi.SyncStatus {
+			if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&asm), &asm); err != nil {
+				return nil
+			}
+			if len(asm.Status.Syncs) != 1 {
+				return nil
+			}
+			return &asm.Status.Syncs[0]
+		}
+
+		// setup creates an assemblage with a sync using the drift
+		// policy given, and pretends the GitOps Toolkit has applied
+		// a ConfigMap for it, which has since been changed.
+		setup := func(drift *syncapi.DriftPolicy) {
+			asm = asmv1.Assemblage{
+				Spec: asmv1.AssemblageSpec{
+					Syncs: []syncapi.NamedSync{{
+						Name:  "app",
+						Drift: drift,
+						Sync: syncapi.Sync{
+							Source: syncapi.SourceSpec{
+								Git: &syncapi.GitSource{
+									URL:     "https://github.com/cuttlefacts-app",
+									Version: syncapi.GitVersion{Tag: "v1.0.0"},
+								},
+							},
+							Package: &syncapi.PackageSpec{
+								Kustomize: &syncapi.KustomizeSpec{Path: "."},
+							},
+						},
+					}},
+				},
+			}
+			asm.Name = randomStr("asm")
+			asm.Namespace = namespace.Name
+			Expect(k8sClient.Create(context.Background(), &asm)).To(Succeed())
+
+			key := types.NamespacedName{Namespace: asm.Namespace, Name: asm.Name + "-app"}
+			Eventually(func() error {
+				return k8sClient.Get(context.Background(), key, &kustom)
+			}, "5s", "1s").Should(Succeed())
+			Expect(k8sClient.Get(context.Background(), key, &source)).To(Succeed())
+
+			configMap = corev1.ConfigMap{}
+			configMap.Namespace = namespace.Name
+			configMap.Name = "drifty"
+			configMap.Labels = map[string]string{
+				kustomizationNameLabel:      kustom.Name,
+				kustomizationNamespaceLabel: kustom.Namespace,
+			}
+			configMap.Annotations = map[string]string{
+				corev1.LastAppliedConfigAnnotation: fmt.Sprintf(`{"apiVersion":"v1","kind":"ConfigMap",`+
+					`"metadata":{"name":"drifty","namespace":%q},"data":{"replicas":"1","colour":"blue"}}`, namespace.Name),
+			}
+			configMap.Data = map[string]string{"replicas": "3", "colour": "blue"}
+			Expect(k8sClient.Create(context.Background(), &configMap)).To(Succeed())
+
+			// These are patched, since the controller may be
+			// writing the objects meanwhile.
+			sourceBefore := source.DeepCopy()
+			source.Status.Artifact = &sourcev1.Artifact{
+				Path:           "gitrepository/app.tar.gz",
+				URL:            "http://source-controller/gitrepository/app.tar.gz",
+				Revision:       "v1.0.0/abc123",
+				Checksum:       "abc123",
+				LastUpdateTime: metav1.Now(),
+			}
+			Expect(k8sClient.Status().Patch(context.Background(), &source, client.MergeFrom(sourceBefore))).To(Succeed())
+			kustomBefore := kustom.DeepCopy()
+			kustom.Status.LastAppliedRevision = "v1.0.0/abc123"
+			kustom.Status.Snapshot = &kustomv1.Snapshot{
+				Checksum: "abc123",
+				Entries: []kustomv1.SnapshotEntry{{
+					Namespace: namespace.Name,
+					Kinds: map[string]string{
+						corev1.SchemeGroupVersion.WithKind("ConfigMap").String(): "ConfigMap",
+					},
+				}},
+			}
+			Expect(k8sClient.Status().Patch(context.Background(), &kustom, client.MergeFrom(kustomBefore))).To(Succeed())
+		}
+
+		It("reports drift, and counts each time it happens", func() {
+			setup(nil)
+
+			Eventually(func() bool {
+				s := statusFor()
+				return s != nil && s.Drift != nil && s.Drift.Objects == 1
+			}, "5s", "500ms").Should(BeTrue())
+			drift := asm.Status.Syncs[0].Drift
+			Expect(drift.Detections).To(Equal(1))
+			Expect(drift.LastDetectionTime).ToNot(BeNil())
+			Expect(drift.Fields).To(Equal([]string{"ConfigMap/" + namespace.Name + "/drifty:data.replicas"}))
+
+			// By default drift is corrected, so the Kustomization is
+			// left to run.
+			Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&kustom), &kustom)).To(Succeed())
+			Expect(kustom.Spec.Suspend).To(BeFalse())
+
+			// Once it's corrected, there's no drift; but it's still
+			// counted as having happened.
+			configMap.Data["replicas"] = "1"
+			Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+			Eventually(func() bool {
+				s := statusFor()
+				return s != nil && s.Drift != nil && s.Drift.Objects == 0
+			}, "5s", "500ms").Should(BeTrue())
+			Expect(asm.Status.Syncs[0].Drift.Detections).To(Equal(1))
+			Expect(asm.Status.Syncs[0].Drift.Fields).To(BeEmpty())
+
+			// Drifting again counts again.
+			configMap.Data["colour"] = "red"
+			Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+			Eventually(func() bool {
+				s := statusFor()
+				return s != nil && s.Drift != nil && s.Drift.Detections == 2
+			}, "5s", "500ms").Should(BeTrue())
+		})
+
+		It("leaves drift in place until there's a new revision, when reporting it", func() {
+			setup(&syncapi.DriftPolicy{Mode: syncapi.DriftModeReport})
+
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&kustom), &kustom)
+				return err == nil && kustom.Spec.Suspend
+			}, "5s", "500ms").Should(BeTrue())
+			Eventually(func() bool {
+				s := statusFor()
+				return s != nil && s.Drift != nil && s.Drift.Objects == 1
+			}, "5s", "500ms").Should(BeTrue())
+			Expect(asm.Status.Syncs[0].State).ToNot(Equal(syncapi.StateSuspended))
+
+			// A new revision is let through.
+			Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&source), &source)).To(Succeed())
+			sourceBefore := source.DeepCopy()
+			source.Status.Artifact.Revision = "v1.0.0/def456"
+			Expect(k8sClient.Status().Patch(context.Background(), &source, client.MergeFrom(sourceBefore))).To(Succeed())
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&kustom), &kustom)
+				return err == nil && !kustom.Spec.Suspend
+			}, "5s", "500ms").Should(BeTrue())
+		})
+
+		It("ignores drift in the fields given", func() {
+			setup(&syncapi.DriftPolicy{
+				Mode:         syncapi.DriftModeIgnoreFields,
+				IgnoreFields: []string{"data.replicas"},
+			})
+
+			// The only drift is ignored, so it's left in place.
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&kustom), &kustom)
+				return err == nil && kustom.Spec.Suspend
+			}, "5s", "500ms").Should(BeTrue())
+			s := statusFor()
+			Expect(s).ToNot(BeNil())
+			Expect(s.Drift).ToNot(BeNil())
+			Expect(s.Drift.Objects).To(Equal(0))
+
+			// Drift elsewhere is reported, and corrected.
+			configMap.Data["colour"] = "red"
+			Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+			Eventually(func() bool {
+				s := statusFor()
+				return s != nil && s.Drift != nil && s.Drift.Objects == 1
+			}, "5s", "500ms").Should(BeTrue())
+			Expect(asm.Status.Syncs[0].Drift.Fields).To(Equal([]string{"ConfigMap/" + namespace.Name + "/drifty:data.colour"}))
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&kustom), &kustom)
+				return err == nil && !kustom.Spec.Suspend
+			}, "5s", "500ms").Should(BeTrue())
+		})
+
+		It("puts back ignored fields when correcting drift elsewhere", func() {
+			setup(&syncapi.DriftPolicy{
+				Mode:         syncapi.DriftModeIgnoreFields,
+				IgnoreFields: []string{"data.replicas"},
+			})
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&kustom), &kustom)
+				return err == nil && kustom.Spec.Suspend
+			}, "5s", "500ms").Should(BeTrue())
+
+			// Both an ignored field and another field have drifted;
+			// only the other is reported, but the Kustomization is
+			// let run to correct it.
+			configMap.Data["colour"] = "red"
+			Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&kustom), &kustom)
+				return err == nil && !kustom.Spec.Suspend
+			}, "5s", "500ms").Should(BeTrue())
+			s := statusFor()
+			Expect(s).ToNot(BeNil())
+			Expect(s.Drift.Fields).To(Equal([]string{"ConfigMap/" + namespace.Name + "/drifty:data.colour"}))
+
+			// The kustomize-controller applies the whole object,
+			// which puts the ignored field back too. (There's no
+			// kustomize-controller here, so do what it would.)
+			Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&configMap), &configMap)).To(Succeed())
+			configMap.Data = map[string]string{"replicas": "1", "colour": "blue"}
+			Expect(k8sClient.Update(context.Background(), &configMap)).To(Succeed())
+
+			// With no drift left, the Kustomization is held again;
+			// the ignored field stays as it was applied.
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&kustom), &kustom)
+				return err == nil && kustom.Spec.Suspend
+			}, "5s", "500ms").Should(BeTrue())
+			Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&configMap), &configMap)).To(Succeed())
+			Expect(configMap.Data["replicas"]).To(Equal("1"))
+		})
 	})
 
 	Context("bindings", func() {
@@ -246,7 +1004,7 @@ var _ = Describe("assemblage controller", func() {
 
 		It("adds a substitution stanza to the kustomization", func() {
 			expectedKustomizationName := types.NamespacedName{
-				Name:      asm.Name + "-0",
+				Name:      asm.Name + "-app",
 				Namespace: asm.Namespace,
 			}
 			var kustom kustomv1.Kustomization
@@ -268,3 +1026,145 @@ var _ = Describe("assemblage controller", func() {
 		})
 	})
 })
+
+var _ = Describe("conflicts between syncs", func() {
+	It("finds the objects each pair of syncs has in common", func() {
+		inventories := map[string]map[string]struct{}{
+			"a": {"ConfigMap/default/x": {}, "Namespace/app": {}},
+			"b": {"ConfigMap/default/x": {}, "Namespace/app": {}, "Deployment/default/y": {}},
+			"c": {"Deployment/default/y": {}},
+			"d": {"Deployment/default/z": {}},
+		}
+		conflicts := findConflicts(inventories)
+		Expect(conflicts).To(Equal(map[string][]syncapi.SyncConflict{
+			"a": {{Sync: "b", Objects: []string{"ConfigMap/default/x", "Namespace/app"}}},
+			"b": {
+				{Sync: "a", Objects: []string{"ConfigMap/default/x", "Namespace/app"}},
+				{Sync: "c", Objects: []string{"Deployment/default/y"}},
+			},
+			"c": {{Sync: "b", Objects: []string{"Deployment/default/y"}}},
+		}))
+	})
+
+	It("remembers objects until the checksum changes", func() {
+		tracker := newInventoryTracker()
+		key := types.NamespacedName{Namespace: "default", Name: "kustom"}
+		tracker.observe(key, "v1", []string{"ConfigMap/default/x"})
+		Expect(tracker.observe(key, "v1", []string{"ConfigMap/default/y"})).To(HaveLen(2))
+		Expect(tracker.observe(key, "v2", []string{"ConfigMap/default/y"})).To(Equal(map[string]struct{}{
+			"ConfigMap/default/y": {},
+		}))
+		tracker.forget(key)
+		Expect(tracker.observe(key, "v2", nil)).To(BeEmpty())
+	})
+})
+
+var _ = Describe("inventory summaries", func() {
+	objects := []string{
+		"Namespace/app",
+		"Deployment/app/web",
+		"ConfigMap/app/web-config",
+		"ConfigMap/app/db-config",
+	}
+
+	It("counts objects by kind", func() {
+		Expect(summariseInventory(objects, false)).To(Equal(&syncapi.SyncInventory{
+			Total: 4,
+			Kinds: map[string]int{"Namespace": 1, "Deployment": 1, "ConfigMap": 2},
+		}))
+	})
+
+	It("lists objects in order when asked to", func() {
+		inventory := summariseInventory(objects, true)
+		Expect(inventory.Objects).To(Equal([]string{
+			"ConfigMap/app/db-config",
+			"ConfigMap/app/web-config",
+			"Deployment/app/web",
+			"Namespace/app",
+		}))
+		Expect(inventory.Truncated).To(BeFalse())
+	})
+
+	It("truncates long lists, but counts everything", func() {
+		var many []string
+		for i := 0; i < syncapi.MaxInventoryObjects+10; i++ {
+			many = append(many, fmt.Sprintf("ConfigMap/app/cm-%03d", i))
+		}
+		inventory := summariseInventory(many, true)
+		Expect(inventory.Total).To(Equal(syncapi.MaxInventoryObjects + 10))
+		Expect(inventory.Kinds).To(Equal(map[string]int{"ConfigMap": syncapi.MaxInventoryObjects + 10}))
+		Expect(inventory.Objects).To(HaveLen(syncapi.MaxInventoryObjects))
+		Expect(inventory.Truncated).To(BeTrue())
+	})
+})
+
+var _ = Describe("drift", func() {
+	It("finds the fields that differ, comparing lists as a whole", func() {
+		applied := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":            "web",
+				"resourceVersion": "2",
+			},
+			"spec": map[string]interface{}{
+				"replicas": int64(1),
+				"template": map[string]interface{}{
+					"containers": []interface{}{"web:v1"},
+				},
+			},
+			"status": map[string]interface{}{"ready": true},
+		}
+		live := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"name":            "web",
+				"resourceVersion": "1",
+			},
+			"spec": map[string]interface{}{
+				"replicas": int64(3),
+				"paused":   true,
+				"template": map[string]interface{}{
+					"containers": []interface{}{"web:v2"},
+				},
+			},
+		}
+		Expect(driftedFields(applied, live, "")).To(Equal([]string{
+			"spec.paused",
+			"spec.replicas",
+			"spec.template.containers",
+		}))
+	})
+
+	It("ignores fields given, and the fields under them", func() {
+		ignore := []string{"spec.replicas", "metadata.annotations"}
+		Expect(isIgnored("spec.replicas", ignore)).To(BeTrue())
+		Expect(isIgnored("metadata.annotations.example.com/note", ignore)).To(BeTrue())
+		Expect(isIgnored("spec.replicasMax", ignore)).To(BeFalse())
+		Expect(isIgnored("spec", ignore)).To(BeFalse())
+	})
+
+	It("counts a detection only when drift follows no drift", func() {
+		then := metav1.NewTime(time.Now().Add(-time.Minute))
+		now := metav1.Now()
+		first := recordDrift(nil, then, 1, []string{"ConfigMap/default/x:data.a"}, false)
+		Expect(first.Detections).To(Equal(1))
+		Expect(first.LastDetectionTime).To(Equal(&then))
+		Expect(first.Fields).To(BeEmpty())
+
+		again := recordDrift(first, now, 2, nil, false)
+		Expect(again.Detections).To(Equal(1))
+		Expect(again.LastDetectionTime).To(Equal(&then))
+
+		corrected := recordDrift(again, now, 0, nil, false)
+		Expect(corrected.Detections).To(Equal(1))
+		Expect(recordDrift(corrected, now, 1, nil, false).Detections).To(Equal(2))
+	})
+
+	It("truncates the fields reported", func() {
+		var fields []string
+		for i := 0; i < syncapi.MaxDriftFields+5; i++ {
+			fields = append(fields, fmt.Sprintf("ConfigMap/default/x:data.k%03d", i))
+		}
+		drift := recordDrift(nil, metav1.Now(), 1, fields, true)
+		Expect(drift.Fields).To(HaveLen(syncapi.MaxDriftFields))
+		Expect(drift.Truncated).To(BeTrue())
+	})
+})
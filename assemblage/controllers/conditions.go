@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Michael Bridgen
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	asmv1 "github.com/squaremo/fleeet/assemblage/api/v1alpha1"
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+)
+
+// These set the kstatus conditions (Ready, Reconciling, Stalled)
+// together, so that they are always consistent with one another.
+
+// markReady records that the object has reached its desired state.
+func markReady(obj meta.ObjectWithStatusConditions, reason, message string) {
+	meta.SetResourceCondition(obj, meta.ReadyCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.ReconcilingCondition)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.StalledCondition)
+}
+
+// markReconciling records that the object is progressing towards
+// its desired state, but is not there yet.
+func markReconciling(obj meta.ObjectWithStatusConditions, reason, message string) {
+	meta.SetResourceCondition(obj, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	meta.SetResourceCondition(obj, meta.ReconcilingCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.StalledCondition)
+}
+
+// markStalled records that the object cannot make progress towards
+// its desired state, e.g., because a sync has failed.
+func markStalled(obj meta.ObjectWithStatusConditions, reason, message string) {
+	meta.SetResourceCondition(obj, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	meta.SetResourceCondition(obj, meta.StalledCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.ReconcilingCondition)
+}
+
+// markFromSyncStatus sets the conditions of the assemblage according
+// to the state of each sync in its status, including those removed
+// but still being deleted.
+func markFromSyncStatus(asm *asmv1.Assemblage) {
+	var succeeded, failed, updating, suspended int
+	var failure string // the message from the first failure, to pass on
+	for _, status := range asm.Status.Syncs {
+		switch status.State {
+		case syncapi.StateSucceeded:
+			succeeded++
+		case syncapi.StateFailed:
+			if failed == 0 && status.Message != "" {
+				failure = fmt.Sprintf("; %s: %s", status.Sync.Name, status.Message)
+			}
+			failed++
+		case syncapi.StateSuspended:
+			suspended++
+		default:
+			updating++
+		}
+	}
+
+	total := len(asm.Status.Syncs)
+	switch {
+	case failed > 0:
+		markStalled(asm, asmv1.SyncFailedReason, fmt.Sprintf("%d of %d syncs failed%s", failed, total, failure))
+	case updating > 0:
+		markReconciling(asm, asmv1.RolloutInProgressReason, fmt.Sprintf("%d of %d syncs succeeded", succeeded, total))
+	case suspended > 0:
+		markReady(asm, asmv1.SuspendedReason, fmt.Sprintf("%d of %d syncs succeeded, %d suspended", succeeded, total, suspended))
+	default:
+		markReady(asm, asmv1.SyncSucceededReason, fmt.Sprintf("%d of %d syncs succeeded", succeeded, total))
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2021 Michael Bridgen
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+)
+
+// driftFieldManager is the field manager for the dry runs used to
+// check for drift. Since they are dry runs, it never owns anything.
+const driftFieldManager = "fleet-drift"
+
+// uncheckedFields are the fields that are written by the API server,
+// or through another endpoint, so are not counted as drift.
+var uncheckedFields = map[string]struct{}{
+	"status":                   {},
+	"metadata.managedFields":   {},
+	"metadata.resourceVersion": {},
+	"metadata.generation":      {},
+}
+
+// checksDrift says whether the controller checks for drift at all.
+// Checking needs permission to patch whatever the syncs apply, so it
+// must be switched on.
+func (r *AssemblageReconciler) checksDrift() bool {
+	return r.DriftCheckInterval > 0
+}
+
+// driftCheckDue says whether it's time to check for drift again,
+// given the last check.
+func driftCheckDue(last *syncapi.SyncDrift, now metav1.Time, interval time.Duration) bool {
+	return last == nil || !now.Before(&metav1.Time{Time: last.LastCheckTime.Add(interval)})
+}
+
+// checkDrift compares each object given with what was last applied to
+// it, by applying that again as a server-side dry run, and comparing
+// the result with the object as it is. It gives the number of objects
+// that have drifted, and the fields in which they have drifted, as
+// `Kind/namespace/name:path`, leaving out those to be ignored.
+//
+// The GitOps Toolkit records what it applied to each object in the
+// last-applied-configuration annotation; objects without it are
+// skipped, as are those that can't be checked, e.g., because the dry
+// run is refused.
+func (r *AssemblageReconciler) checkDrift(ctx context.Context, log logr.Logger, objects []unstructured.Unstructured, ignore []string) (int, []string, error) {
+	var drifted int
+	var fields []string
+	for i := range objects {
+		live := &objects[i]
+		id := objectID(live.GetKind(), live.GetNamespace(), live.GetName())
+		lastApplied, ok := live.GetAnnotations()[corev1.LastAppliedConfigAnnotation]
+		if !ok {
+			continue
+		}
+		applied := &unstructured.Unstructured{}
+		if err := applied.UnmarshalJSON([]byte(lastApplied)); err != nil {
+			log.Info("unable to read last applied configuration", "object", id, "error", err)
+			continue
+		}
+		applied.SetNamespace(live.GetNamespace())
+		applied.SetName(live.GetName())
+		// The object must be compared in the version it was
+		// applied in.
+		if applied.GroupVersionKind() != live.GroupVersionKind() {
+			live = &unstructured.Unstructured{}
+			live.SetGroupVersionKind(applied.GroupVersionKind())
+			if err := r.Get(ctx, client.ObjectKeyFromObject(&objects[i]), live); err != nil {
+				if isUncheckable(err) {
+					log.Info("unable to check object for drift", "object", id, "error", err)
+					continue
+				}
+				return 0, nil, err
+			}
+		}
+
+		// Forcing ownership means the result has everything that
+		// was applied, even if someone else has since set some of
+		// the same fields, which is exactly what's looked for.
+		if err := r.Patch(ctx, applied, client.Apply, client.DryRunAll, client.ForceOwnership, client.FieldOwner(driftFieldManager)); err != nil {
+			if isUncheckable(err) {
+				log.Info("unable to check object for drift", "object", id, "error", err)
+				continue
+			}
+			return 0, nil, err
+		}
+
+		var objectDrifted bool
+		for _, path := range driftedFields(applied.Object, live.Object, "") {
+			if isIgnored(path, ignore) {
+				continue
+			}
+			objectDrifted = true
+			fields = append(fields, id+":"+path)
+		}
+		if objectDrifted {
+			drifted++
+		}
+	}
+	sort.Strings(fields)
+	return drifted, fields, nil
+}
+
+// isUncheckable says whether the error means the object can't be
+// checked for drift, rather than that something has gone wrong with
+// the controller.
+func isUncheckable(err error) bool {
+	_, ok := err.(apierrors.APIStatus)
+	return ok || meta.IsNoMatchError(err)
+}
+
+// driftedFields gives the paths of the fields that differ between the
+// object as it would be with what was applied, and the object as it
+// is. Lists are compared as a whole, so a path never goes into a list.
+func driftedFields(applied, live map[string]interface{}, prefix string) []string {
+	keys := map[string]struct{}{}
+	for k := range applied {
+		keys[k] = struct{}{}
+	}
+	for k := range live {
+		keys[k] = struct{}{}
+	}
+
+	var fields []string
+	for k := range keys {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if _, ok := uncheckedFields[path]; ok {
+			continue
+		}
+		appliedMap, ok1 := applied[k].(map[string]interface{})
+		liveMap, ok2 := live[k].(map[string]interface{})
+		if ok1 && ok2 {
+			fields = append(fields, driftedFields(appliedMap, liveMap, path)...)
+			continue
+		}
+		if !equality.Semantic.DeepEqual(applied[k], live[k]) {
+			fields = append(fields, path)
+		}
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// isIgnored says whether the path given is, or is under, one of the
+// paths to ignore.
+func isIgnored(path string, ignore []string) bool {
+	for _, p := range ignore {
+		if path == p || strings.HasPrefix(path, p+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredFields gives the fields in which drift is to be ignored for
+// the sync.
+func ignoredFields(sync *syncapi.NamedSync) []string {
+	if sync.Drift == nil || sync.Drift.Mode != syncapi.DriftModeIgnoreFields {
+		return nil
+	}
+	return sync.Drift.IgnoreFields
+}
+
+// recordDrift gives the drift status for a check, carrying the
+// detections over from the previous check. Drift is counted as
+// detected when it's found after none was found the time before. The
+// fields are only recorded if asked for.
+func recordDrift(last *syncapi.SyncDrift, now metav1.Time, objects int, fields []string, reportFields bool) *syncapi.SyncDrift {
+	drift := &syncapi.SyncDrift{
+		LastCheckTime: now,
+		Objects:       objects,
+	}
+	if last != nil {
+		drift.Detections = last.Detections
+		drift.LastDetectionTime = last.LastDetectionTime
+	}
+	if objects > 0 && (last == nil || last.Objects == 0) {
+		drift.Detections++
+		drift.LastDetectionTime = &now
+	}
+	if reportFields && len(fields) > 0 {
+		if len(fields) > syncapi.MaxDriftFields {
+			fields = fields[:syncapi.MaxDriftFields]
+			drift.Truncated = true
+		}
+		drift.Fields = fields
+	}
+	return drift
+}
+
+// holdForDrift says whether to suspend the Kustomization for a sync,
+// so that drift is left in place. That's the case once the latest
+// revision of the source has been applied, if the sync is to report
+// drift rather than correct it; or, if it's to ignore drift in some
+// fields, and no drift in other fields was found at the last check.
+func holdForDrift(sync *syncapi.NamedSync, source *sourcev1.GitRepository, applied *appliedSync, drift *syncapi.SyncDrift) bool {
+	if sync.Drift == nil || applied == nil || source.Status.Artifact == nil ||
+		applied.revision != source.Status.Artifact.Revision {
+		return false
+	}
+	switch sync.Drift.Mode {
+	case syncapi.DriftModeReport:
+		return true
+	case syncapi.DriftModeIgnoreFields:
+		return drift != nil && drift.Objects == 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,215 @@
+/*
+Copyright 2021 Michael Bridgen
+*/
+
+package controllers
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+
+	kustomv1 "github.com/fluxcd/kustomize-controller/api/v1beta1"
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+)
+
+// These labels are put on each object applied by a Kustomization, by
+// the GitOps Toolkit kustomize-controller. Since an object can only
+// have one value for each, it's labelled by whichever Kustomization
+// applied it last.
+const (
+	kustomizationNameLabel      = "kustomize.toolkit.fluxcd.io/name"
+	kustomizationNamespaceLabel = "kustomize.toolkit.fluxcd.io/namespace"
+)
+
+// inventoryTracker remembers the objects each Kustomization has been
+// seen to apply, since the manifests it applies last changed. The
+// snapshot in a Kustomization's status gives only the kinds of object
+// in each namespace; and each object is labelled with only the last
+// Kustomization to apply it. So, when two Kustomizations apply the
+// same object, the only way to tell is to notice the object moving
+// from one to the other.
+//
+// This is kept in memory rather than in the status; after a restart,
+// conflicts are detected again the next time an object moves.
+type inventoryTracker struct {
+	mu    sync.Mutex
+	kusts map[types.NamespacedName]*inventory
+}
+
+type inventory struct {
+	checksum string
+	objects  map[string]struct{}
+}
+
+func newInventoryTracker() *inventoryTracker {
+	return &inventoryTracker{
+		kusts: map[types.NamespacedName]*inventory{},
+	}
+}
+
+// observe adds the objects given to those remembered for the
+// Kustomization, or replaces them if the checksum has changed. It
+// returns all the objects remembered.
+func (t *inventoryTracker) observe(kustom types.NamespacedName, checksum string, objects []string) map[string]struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	inv, ok := t.kusts[kustom]
+	if !ok || inv.checksum != checksum {
+		inv = &inventory{checksum: checksum, objects: map[string]struct{}{}}
+		t.kusts[kustom] = inv
+	}
+	for _, obj := range objects {
+		inv.objects[obj] = struct{}{}
+	}
+	result := make(map[string]struct{}, len(inv.objects))
+	for obj := range inv.objects {
+		result[obj] = struct{}{}
+	}
+	return result
+}
+
+// forget drops what is remembered for the Kustomization.
+func (t *inventoryTracker) forget(kustom types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.kusts, kustom)
+}
+
+// labelledObjects lists the objects currently labelled as applied by
+// the Kustomization given, among the kinds and namespaces in its
+// snapshot. Kinds the controller isn't permitted to list are skipped;
+// reading arbitrary kinds needs the role in config/rbac/inventory.
+func labelledObjects(ctx context.Context, log logr.Logger, c client.Reader, kustom *kustomv1.Kustomization) ([]unstructured.Unstructured, error) {
+	snapshot := kustom.Status.Snapshot
+	if snapshot == nil {
+		return nil, nil
+	}
+	selector := client.MatchingLabels{
+		kustomizationNameLabel:      kustom.Name,
+		kustomizationNamespaceLabel: kustom.Namespace,
+	}
+
+	var objects []unstructured.Unstructured
+	list := func(gvk schema.GroupVersionKind, opts ...client.ListOption) error {
+		var items unstructured.UnstructuredList
+		items.SetGroupVersionKind(gvk.GroupVersion().WithKind(gvk.Kind + "List"))
+		if err := c.List(ctx, &items, append(opts, selector)...); err != nil {
+			// A kind that is no longer served has nothing in it to
+			// conflict over.
+			if meta.IsNoMatchError(err) {
+				return nil
+			}
+			if apierrors.IsForbidden(err) {
+				log.V(1).Info("not permitted to list objects applied by kustomization", "kustomization", kustom.Name, "kind", gvk.Kind)
+				return nil
+			}
+			return err
+		}
+		for _, item := range items.Items {
+			item.SetGroupVersionKind(gvk)
+			objects = append(objects, item)
+		}
+		return nil
+	}
+
+	for _, gvk := range snapshot.NonNamespacedKinds() {
+		if err := list(gvk); err != nil {
+			return nil, err
+		}
+	}
+	for ns, kinds := range snapshot.NamespacedKinds() {
+		for _, gvk := range kinds {
+			if err := list(gvk, client.InNamespace(ns)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return objects, nil
+}
+
+// objectIDs gives each object as `Kind/namespace/name`, or
+// `Kind/name` if it's cluster-scoped.
+func objectIDs(objects []unstructured.Unstructured) []string {
+	ids := make([]string, len(objects))
+	for i := range objects {
+		ids[i] = objectID(objects[i].GetKind(), objects[i].GetNamespace(), objects[i].GetName())
+	}
+	return ids
+}
+
+func objectID(kind, namespace, name string) string {
+	if namespace == "" {
+		return kind + "/" + name
+	}
+	return kind + "/" + namespace + "/" + name
+}
+
+// findConflicts gives, for each sync that has objects in common with
+// another sync, the other syncs and the objects in common. The syncs
+// and objects are sorted, and the objects truncated to
+// syncapi.MaxConflictObjects.
+func findConflicts(inventories map[string]map[string]struct{}) map[string][]syncapi.SyncConflict {
+	names := make([]string, 0, len(inventories))
+	for name := range inventories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conflicts := map[string][]syncapi.SyncConflict{}
+	for i, a := range names {
+		for _, b := range names[i+1:] {
+			var common []string
+			for obj := range inventories[a] {
+				if _, ok := inventories[b][obj]; ok {
+					common = append(common, obj)
+				}
+			}
+			if len(common) == 0 {
+				continue
+			}
+			sort.Strings(common)
+			if len(common) > syncapi.MaxConflictObjects {
+				common = common[:syncapi.MaxConflictObjects]
+			}
+			conflicts[a] = append(conflicts[a], syncapi.SyncConflict{Sync: b, Objects: common})
+			conflicts[b] = append(conflicts[b], syncapi.SyncConflict{Sync: a, Objects: append([]string(nil), common...)})
+		}
+	}
+	return conflicts
+}
+
+// summariseInventory counts the objects given by kind, and, if asked
+// to, lists them in order, truncated to syncapi.MaxInventoryObjects.
+func summariseInventory(objects []string, list bool) *syncapi.SyncInventory {
+	inventory := &syncapi.SyncInventory{Total: len(objects)}
+	for _, obj := range objects {
+		kind := obj
+		if i := strings.Index(obj, "/"); i >= 0 {
+			kind = obj[:i]
+		}
+		if inventory.Kinds == nil {
+			inventory.Kinds = map[string]int{}
+		}
+		inventory.Kinds[kind]++
+	}
+	if list && len(objects) > 0 {
+		listed := append([]string(nil), objects...)
+		sort.Strings(listed)
+		if len(listed) > syncapi.MaxInventoryObjects {
+			listed = listed[:syncapi.MaxInventoryObjects]
+			inventory.Truncated = true
+		}
+		inventory.Objects = listed
+	}
+	return inventory
+}
@@ -0,0 +1,418 @@
+/*
+Copyright 2021 Michael Bridgen
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	asmv1 "github.com/squaremo/fleeet/assemblage/api/v1alpha1"
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+	"github.com/squaremo/fleeet/pkg/apply"
+)
+
+// The RemoteAssemblage type is defined in the module API, which this
+// module can't depend on (it depends on this one); so, it's used here
+// as an unstructured object, and these must agree with that API.
+var remoteAssemblageGVK = asmv1.GroupVersion.WithKind("RemoteAssemblage")
+
+const (
+	remoteAssemblageResource  = "remoteassemblages"
+	remoteAssemblageFinalizer = "fleet.squaremo.dev/remote-assemblage"
+)
+
+// remoteAssemblage has the fields of a RemoteAssemblage that the agent
+// uses.
+type remoteAssemblage struct {
+	Spec   remoteAssemblageSpec   `json:"spec"`
+	Status remoteAssemblageStatus `json:"status,omitempty"`
+}
+
+type remoteAssemblageSpec struct {
+	Assemblage          asmv1.AssemblageSpec `json:"assemblage"`
+	DownstreamNamespace string               `json:"downstreamNamespace,omitempty"`
+}
+
+type remoteAssemblageStatus struct {
+	Syncs               []syncapi.SyncStatus `json:"syncs"`
+	LastContactTime     *metav1.Time         `json:"lastContactTime,omitempty"`
+	DownstreamNamespace string               `json:"downstreamNamespace,omitempty"`
+}
+
+// agentFieldManager is the field manager for the assemblage applied
+// by the agent.
+const agentFieldManager = "fleet-agent"
+
+// DefaultHeartbeatInterval is used when UpstreamReconciler is not
+// given a HeartbeatInterval.
+const DefaultHeartbeatInterval = time.Minute
+
+// UpstreamReconciler runs in a downstream cluster in pull mode. It
+// fetches the RemoteAssemblage for this cluster from the management
+// cluster (upstream), mirrors it into an Assemblage in this cluster,
+// and reports the status of the assemblage back upstream. There is
+// only ever the one remote assemblage to reconcile, so requests are
+// all treated as being for it.
+type UpstreamReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// Upstream is the config for connecting to the management
+	// cluster. It need only give access to the remote assemblage
+	// named.
+	Upstream *rest.Config
+	// Namespace and Name identify the remote assemblage upstream,
+	// which has the same name as the Remote for this cluster. The
+	// assemblage here is given the same name.
+	Namespace string
+	Name      string
+
+	// DownstreamNamespace gives the namespace here in which to create
+	// the assemblage, if the remote assemblage doesn't give one. If
+	// empty, asmv1.DefaultNamespace is used.
+	DownstreamNamespace string
+
+	// HeartbeatInterval gives how often to report back upstream,
+	// even if nothing has changed, so the management cluster knows
+	// this cluster is still in touch. If zero,
+	// DefaultHeartbeatInterval is used.
+	HeartbeatInterval time.Duration
+
+	upstream client.Client
+}
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;create
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *UpstreamReconciler) Reconcile(ctx context.Context, _ ctrl.Request) (ctrl.Result, error) {
+	key := types.NamespacedName{Namespace: r.Namespace, Name: r.Name}
+	log := r.Log.WithValues("remoteassemblage", key)
+
+	var upstream unstructured.Unstructured
+	upstream.SetGroupVersionKind(remoteAssemblageGVK)
+	err := r.upstream.Get(ctx, key, &upstream)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return ctrl.Result{}, fmt.Errorf("getting remote assemblage upstream: %w", err)
+	}
+
+	// If the remote assemblage has gone, or is going, so should the
+	// assemblage here.
+	if missing := apierrors.IsNotFound(err); missing || upstream.GetDeletionTimestamp() != nil {
+		gone, err := r.removeLocal(ctx, "")
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("removing local assemblage: %w", err)
+		}
+		// Progress in removing the syncs is reported in the status
+		// of the assemblage here, which is watched.
+		if !gone || missing || !controllerutil.ContainsFinalizer(&upstream, remoteAssemblageFinalizer) {
+			return ctrl.Result{}, nil
+		}
+		log.V(1).Info("local assemblage deleted")
+		controllerutil.RemoveFinalizer(&upstream, remoteAssemblageFinalizer)
+		if err := r.upstream.Update(ctx, &upstream); err != nil {
+			return ctrl.Result{}, fmt.Errorf("removing finalizer from remote assemblage upstream: %w", err)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	var proxy remoteAssemblage
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(upstream.Object, &proxy); err != nil {
+		return ctrl.Result{}, fmt.Errorf("reading remote assemblage upstream: %w", err)
+	}
+
+	mirrors, err := r.mirrors(ctx)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("looking for local assemblage: %w", err)
+	}
+	namespace := r.downstreamNamespace(&proxy, mirrors)
+
+	var asm asmv1.Assemblage
+	asm.Namespace = namespace
+	asm.Name = r.Name
+	asm.Labels = map[string]string{
+		asmv1.UpstreamNamespaceLabel: r.Namespace,
+	}
+	asm.Spec = proxy.Spec.Assemblage
+	op, err := r.applyLocal(ctx, &asm)
+	syncs := asm.Status.Syncs
+	switch {
+	case apply.IsConflict(err):
+		// The assemblage here can't be brought up to date, so none
+		// of the syncs as given upstream will be applied; that's
+		// reported as each of them failing.
+		log.Info("field conflict applying local assemblage", "error", err.Error())
+		syncs = make([]syncapi.SyncStatus, len(proxy.Spec.Assemblage.Syncs))
+		for i, sync := range proxy.Spec.Assemblage.Syncs {
+			syncs[i] = syncapi.SyncStatus{
+				Sync:    sync,
+				State:   syncapi.StateFailed,
+				Message: err.Error(),
+			}
+		}
+	case err != nil:
+		return ctrl.Result{}, fmt.Errorf("applying local assemblage: %w", err)
+	default:
+		log.V(1).Info("applied local assemblage", "operation", op)
+	}
+
+	// If the assemblage is moving to a different namespace, the one
+	// in the old namespace is left running until the syncs in the
+	// new one have all been applied; then it's removed, leaving what
+	// it synced in place for the new one to take over.
+	applied := namespace
+	var others []asmv1.Assemblage
+	for _, mirror := range mirrors {
+		if mirror.Namespace != namespace {
+			others = append(others, mirror)
+			applied = mirror.Namespace
+		}
+	}
+	if len(others) > 0 && err == nil && syncapi.SyncsSettled(asm.Spec.Syncs, asm.Status.Syncs) {
+		for i := range others {
+			if err := r.retireMirror(ctx, &others[i]); err != nil {
+				return ctrl.Result{}, fmt.Errorf("removing local assemblage from previous namespace: %w", err)
+			}
+		}
+		log.V(1).Info("removing local assemblage from previous namespace")
+	}
+
+	// Report back if the status has changed, or it's time to let
+	// upstream know this cluster is still in touch. The heartbeat
+	// is sent if it's due within half an interval, so that it's
+	// sent on each requeue.
+	now := metav1.Now()
+	interval := r.heartbeatInterval()
+	status := remoteAssemblageStatus{
+		Syncs:               syncs,
+		LastContactTime:     proxy.Status.LastContactTime,
+		DownstreamNamespace: applied,
+	}
+	if last := status.LastContactTime; last == nil || now.Sub(last.Time) >= interval/2 {
+		status.LastContactTime = &now
+	}
+	if status.LastContactTime != proxy.Status.LastContactTime ||
+		status.DownstreamNamespace != proxy.Status.DownstreamNamespace ||
+		!equality.Semantic.DeepEqual(status.Syncs, proxy.Status.Syncs) {
+		patch, err := json.Marshal(map[string]interface{}{"status": status})
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if err := r.upstream.Status().Patch(ctx, &upstream, client.RawPatch(types.MergePatchType, patch)); err != nil {
+			return ctrl.Result{}, fmt.Errorf("reporting status upstream: %w", err)
+		}
+	}
+
+	return ctrl.Result{RequeueAfter: interval}, nil
+}
+
+func (r *UpstreamReconciler) heartbeatInterval() time.Duration {
+	if r.HeartbeatInterval == 0 {
+		return DefaultHeartbeatInterval
+	}
+	return r.HeartbeatInterval
+}
+
+// applyLocal applies the assemblage here, creating its namespace if
+// that doesn't exist yet.
+func (r *UpstreamReconciler) applyLocal(ctx context.Context, asm *asmv1.Assemblage) (controllerutil.OperationResult, error) {
+	op, err := apply.Apply(ctx, r.Client, asm, agentFieldManager)
+	if !apierrors.IsNotFound(err) {
+		return op, err
+	}
+	var ns corev1.Namespace
+	ns.Name = asm.Namespace
+	if err := r.Create(ctx, &ns); err != nil && !apierrors.IsAlreadyExists(err) {
+		return op, fmt.Errorf("creating namespace: %w", err)
+	}
+	return apply.Apply(ctx, r.Client, asm, agentFieldManager)
+}
+
+// downstreamNamespace gives the namespace here in which the
+// assemblage is to be. An assemblage already here stays where it is,
+// unless the remote assemblage says to move it; changing the
+// namespace the agent is told to use only affects new assemblages.
+func (r *UpstreamReconciler) downstreamNamespace(proxy *remoteAssemblage, mirrors []asmv1.Assemblage) string {
+	switch {
+	case proxy.Spec.DownstreamNamespace != "":
+		return proxy.Spec.DownstreamNamespace
+	case proxy.Status.DownstreamNamespace != "":
+		return proxy.Status.DownstreamNamespace
+	case len(mirrors) > 0:
+		return mirrors[0].Namespace
+	case r.DownstreamNamespace != "":
+		return r.DownstreamNamespace
+	default:
+		return asmv1.DefaultNamespace
+	}
+}
+
+// mirrors gives the assemblages here that mirror the remote
+// assemblage; usually there's just the one, but there may be another
+// in a namespace it's being moved away from. Those made before the
+// upstream namespace was recorded in a label were always in the same
+// namespace as the remote assemblage, and are included too.
+func (r *UpstreamReconciler) mirrors(ctx context.Context) ([]asmv1.Assemblage, error) {
+	var list asmv1.AssemblageList
+	if err := r.List(ctx, &list, client.MatchingLabels{asmv1.UpstreamNamespaceLabel: r.Namespace}); err != nil {
+		return nil, err
+	}
+	var found []asmv1.Assemblage
+	for _, asm := range list.Items {
+		if asm.Name == r.Name {
+			found = append(found, asm)
+		}
+	}
+	var legacy asmv1.Assemblage
+	if err := r.Get(ctx, types.NamespacedName{Namespace: r.Namespace, Name: r.Name}, &legacy); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+	} else if _, ok := legacy.Labels[asmv1.UpstreamNamespaceLabel]; !ok {
+		found = append(found, legacy)
+	}
+	return found, nil
+}
+
+// removeLocal takes apart the assemblages here that mirror the remote
+// assemblage, except for one in the namespace given, and reports
+// whether they have gone. As when the assemblage is removed from the
+// management cluster, the syncs are removed first, so that the
+// assemblage controller removes them according to their deletion
+// policies.
+func (r *UpstreamReconciler) removeLocal(ctx context.Context, keep string) (bool, error) {
+	mirrors, err := r.mirrors(ctx)
+	if err != nil {
+		return false, err
+	}
+	allGone := true
+	for i := range mirrors {
+		asm := &mirrors[i]
+		if asm.Namespace == keep {
+			continue
+		}
+		allGone = false
+		if err := r.removeMirror(ctx, asm); err != nil {
+			return false, err
+		}
+	}
+	return allGone, nil
+}
+
+// retireMirror takes one step towards removing the assemblage given,
+// as removeMirror does, but leaving what it synced in place. Each sync
+// is set to orphan what it synced, and that has to have reached the
+// assemblage controller before the syncs are removed.
+func (r *UpstreamReconciler) retireMirror(ctx context.Context, asm *asmv1.Assemblage) error {
+	if syncapi.OrphanSyncs(asm.Spec.Syncs) {
+		return r.Update(ctx, asm)
+	}
+	for _, sync := range asm.Spec.Syncs {
+		current := false
+		for _, status := range asm.Status.Syncs {
+			if equality.Semantic.DeepEqual(status.Sync, sync) {
+				current = true
+				break
+			}
+		}
+		if !current {
+			return nil
+		}
+	}
+	return r.removeMirror(ctx, asm)
+}
+
+// removeMirror takes one step towards removing the assemblage given.
+func (r *UpstreamReconciler) removeMirror(ctx context.Context, asm *asmv1.Assemblage) error {
+	// A suspended assemblage doesn't remove syncs, so it's resumed
+	// here, to let it do that.
+	if len(asm.Spec.Syncs) > 0 || asm.Spec.Suspend {
+		asm.Spec.Syncs = []syncapi.NamedSync{}
+		asm.Spec.Suspend = false
+		return r.Update(ctx, asm)
+	}
+	if len(asm.Status.Syncs) > 0 || asm.GetDeletionTimestamp() != nil {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Delete(ctx, asm))
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *UpstreamReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	// The upstream client only ever deals with remote assemblages,
+	// so it's given a mapper for just those, rather than needing
+	// discovery upstream.
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{asmv1.GroupVersion})
+	mapper.Add(remoteAssemblageGVK, meta.RESTScopeNamespace)
+	var err error
+	r.upstream, err = client.New(r.Upstream, client.Options{Scheme: r.Scheme, Mapper: mapper})
+	if err != nil {
+		return fmt.Errorf("creating client for upstream: %w", err)
+	}
+
+	// The credentials for upstream only allow access to the one
+	// remote assemblage, which can be watched only by selecting it
+	// by name; controller-runtime's cache can't do that, so this
+	// uses an informer of its own.
+	dyn, err := dynamic.NewForConfig(r.Upstream)
+	if err != nil {
+		return fmt.Errorf("creating dynamic client for upstream: %w", err)
+	}
+	informers := dynamicinformer.NewFilteredDynamicSharedInformerFactory(dyn, 0, r.Namespace, func(opts *metav1.ListOptions) {
+		opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", r.Name).String()
+	})
+	informer := informers.ForResource(remoteAssemblageGVK.GroupVersion().WithResource(remoteAssemblageResource)).Informer()
+	if err := mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+		informers.Start(ctx.Done())
+		<-ctx.Done()
+		return nil
+	})); err != nil {
+		return err
+	}
+
+	// The assemblage here may be in any namespace; those that
+	// aren't labelled with the upstream namespace were made before
+	// the label was used, when it was the same namespace.
+	isMirror := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		if obj.GetName() != r.Name {
+			return false
+		}
+		if upstream, ok := obj.GetLabels()[asmv1.UpstreamNamespaceLabel]; ok {
+			return upstream == r.Namespace
+		}
+		return obj.GetNamespace() == r.Namespace
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("upstream").
+		For(&asmv1.Assemblage{}, builder.WithPredicates(isMirror)).
+		Watches(&source.Informer{Informer: informer}, &handler.EnqueueRequestForObject{}).
+		Complete(r)
+}
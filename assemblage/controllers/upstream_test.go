@@ -0,0 +1,248 @@
+/*
+Copyright 2021 Michael Bridgen
+*/
+
+package controllers
+
+import (
+	"context"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+
+	asmv1 "github.com/squaremo/fleeet/assemblage/api/v1alpha1"
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+)
+
+var _ = Describe("upstream controller", func() {
+	var (
+		upstreamEnv    *envtest.Environment
+		upstreamClient client.Client
+		stopManager    func()
+		namespace      *corev1.Namespace
+	)
+
+	const clusterName = "downstream"
+
+	BeforeEach(func() {
+		By("bootstrapping upstream cluster environment")
+		upstreamEnv = &envtest.Environment{
+			CRDDirectoryPaths: []string{filepath.Join("..", "..", "module", "config", "crd", "bases")},
+		}
+		var upstreamCfg *rest.Config
+		var err error
+		upstreamCfg, err = upstreamEnv.Start()
+		Expect(err).ToNot(HaveOccurred())
+		upstreamClient, err = client.New(upstreamCfg, client.Options{Scheme: scheme.Scheme})
+		Expect(err).ToNot(HaveOccurred())
+
+		// The namespace is the same upstream and here.
+		namespace = &corev1.Namespace{}
+		namespace.Name = randomStr("test-ns-")
+		Expect(k8sClient.Create(context.Background(), namespace)).To(Succeed())
+		Expect(upstreamClient.Create(context.Background(), namespace.DeepCopy())).To(Succeed())
+
+		manager, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme: scheme.Scheme,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		upstreamReconciler := &UpstreamReconciler{
+			Client: manager.GetClient(),
+			Scheme: scheme.Scheme,
+			Log:    ctrl.Log.WithName("controllers").WithName("Upstream"),
+
+			Upstream:          upstreamCfg,
+			Namespace:         namespace.Name,
+			Name:              clusterName,
+			HeartbeatInterval: 2 * time.Second,
+			// Unless the remote assemblage says otherwise, the
+			// assemblage is put in the same namespace here.
+			DownstreamNamespace: namespace.Name,
+		}
+		Expect(upstreamReconciler.SetupWithManager(manager)).To(Succeed())
+
+		var ctx context.Context
+		ctx, stopManager = context.WithCancel(context.Background())
+		go func() {
+			defer GinkgoRecover()
+			Expect(manager.Start(ctx)).To(Succeed())
+		}()
+	})
+
+	AfterEach(func() {
+		stopManager()
+		Expect(k8sClient.Delete(context.Background(), namespace)).To(Succeed())
+		Expect(upstreamEnv.Stop()).To(Succeed())
+	})
+
+	// makeRemoteAssemblage constructs a RemoteAssemblage for the
+	// cluster, as the module controllers would upstream.
+	makeRemoteAssemblage := func(syncs []syncapi.NamedSync, downstreamNamespace string) *unstructured.Unstructured {
+		proxy := remoteAssemblage{
+			Spec: remoteAssemblageSpec{
+				Assemblage:          asmv1.AssemblageSpec{Syncs: syncs},
+				DownstreamNamespace: downstreamNamespace,
+			},
+		}
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&proxy)
+		Expect(err).ToNot(HaveOccurred())
+		u := &unstructured.Unstructured{Object: obj}
+		Expect(unstructured.SetNestedField(u.Object, clusterName, "spec", "kubeconfigRef", "remoteRef", "name")).To(Succeed())
+		u.SetGroupVersionKind(remoteAssemblageGVK)
+		u.SetNamespace(namespace.Name)
+		u.SetName(clusterName)
+		return u
+	}
+
+	sync := syncapi.NamedSync{
+		Name: "app",
+		Sync: syncapi.Sync{
+			Source: syncapi.SourceSpec{
+				Git: &syncapi.GitSource{
+					URL: "https://github.com/cuttlefacts-app",
+					Version: syncapi.GitVersion{
+						Revision: "bd6ef78",
+					},
+				},
+			},
+			// This is given, since it would be defaulted upstream
+			// otherwise.
+			Package: &syncapi.PackageSpec{
+				Kustomize: &syncapi.KustomizeSpec{
+					Path: "deploy",
+				},
+			},
+		},
+	}
+
+	It("mirrors the remote assemblage, and reports status back", func() {
+		upstream := makeRemoteAssemblage([]syncapi.NamedSync{sync}, "")
+		Expect(upstreamClient.Create(context.Background(), upstream)).To(Succeed())
+
+		var asm asmv1.Assemblage
+		Eventually(func() error {
+			return k8sClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), &asm)
+		}, "5s", "1s").Should(Succeed())
+		Expect(asm.Spec.Syncs).To(Equal([]syncapi.NamedSync{sync}))
+
+		// The heartbeat is reported even before there's any status.
+		Eventually(func() bool {
+			if err := upstreamClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), upstream); err != nil {
+				return false
+			}
+			_, ok, _ := unstructured.NestedString(upstream.Object, "status", "lastContactTime")
+			return ok
+		}, "5s", "1s").Should(BeTrue())
+
+		// There's no assemblage controller running, so the status
+		// is supplied here.
+		asm.Status.Syncs = []syncapi.SyncStatus{{
+			Sync:  sync,
+			State: syncapi.StateSucceeded,
+		}}
+		Expect(k8sClient.Status().Update(context.Background(), &asm)).To(Succeed())
+
+		Eventually(func() bool {
+			if err := upstreamClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), upstream); err != nil {
+				return false
+			}
+			var proxy remoteAssemblage
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(upstream.Object, &proxy); err != nil {
+				return false
+			}
+			return len(proxy.Status.Syncs) == 1 && proxy.Status.Syncs[0].State == syncapi.StateSucceeded
+		}, "5s", "1s").Should(BeTrue())
+	})
+
+	It("puts the assemblage in the namespace given by the remote assemblage", func() {
+		elsewhere := randomStr("elsewhere-")
+		upstream := makeRemoteAssemblage([]syncapi.NamedSync{sync}, elsewhere)
+		Expect(upstreamClient.Create(context.Background(), upstream)).To(Succeed())
+
+		// The namespace doesn't exist here, so it's created.
+		var asm asmv1.Assemblage
+		Eventually(func() error {
+			return k8sClient.Get(context.Background(), types.NamespacedName{
+				Namespace: elsewhere,
+				Name:      clusterName,
+			}, &asm)
+		}, "5s", "1s").Should(Succeed())
+		Expect(asm.Labels).To(HaveKeyWithValue(asmv1.UpstreamNamespaceLabel, namespace.Name))
+
+		Eventually(func() string {
+			if err := upstreamClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), upstream); err != nil {
+				return ""
+			}
+			ns, _, _ := unstructured.NestedString(upstream.Object, "status", "downstreamNamespace")
+			return ns
+		}, "5s", "1s").Should(Equal(elsewhere))
+	})
+
+	It("leaves an assemblage already here where it is, when no namespace is given or recorded", func() {
+		// This is in a namespace other than the agent would use
+		// now, as if the agent had been told to use a different
+		// namespace since it was created.
+		elsewhere := &corev1.Namespace{}
+		elsewhere.Name = randomStr("elsewhere-")
+		Expect(k8sClient.Create(context.Background(), elsewhere)).To(Succeed())
+		var existing asmv1.Assemblage
+		existing.Namespace = elsewhere.Name
+		existing.Name = clusterName
+		existing.Labels = map[string]string{asmv1.UpstreamNamespaceLabel: namespace.Name}
+		existing.Spec.Syncs = []syncapi.NamedSync{sync}
+		Expect(k8sClient.Create(context.Background(), &existing)).To(Succeed())
+
+		upstream := makeRemoteAssemblage([]syncapi.NamedSync{sync}, "")
+		Expect(upstreamClient.Create(context.Background(), upstream)).To(Succeed())
+
+		Eventually(func() string {
+			if err := upstreamClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), upstream); err != nil {
+				return ""
+			}
+			ns, _, _ := unstructured.NestedString(upstream.Object, "status", "downstreamNamespace")
+			return ns
+		}, "5s", "1s").Should(Equal(elsewhere.Name))
+		Consistently(func() bool {
+			var asm asmv1.Assemblage
+			if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&existing), &asm); err != nil {
+				return false
+			}
+			err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), &asm)
+			return apierrors.IsNotFound(err)
+		}, "2s", "500ms").Should(BeTrue())
+	})
+
+	It("deletes the local assemblage, then lets the remote assemblage go", func() {
+		upstream := makeRemoteAssemblage([]syncapi.NamedSync{}, "")
+		upstream.SetFinalizers([]string{remoteAssemblageFinalizer})
+		Expect(upstreamClient.Create(context.Background(), upstream)).To(Succeed())
+
+		var asm asmv1.Assemblage
+		Eventually(func() error {
+			return k8sClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), &asm)
+		}, "5s", "1s").Should(Succeed())
+
+		Expect(upstreamClient.Delete(context.Background(), upstream)).To(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), &asm)
+			return apierrors.IsNotFound(err)
+		}, "5s", "1s").Should(BeTrue())
+		Eventually(func() bool {
+			err := upstreamClient.Get(context.Background(), client.ObjectKeyFromObject(upstream), upstream)
+			return apierrors.IsNotFound(err)
+		}, "5s", "1s").Should(BeTrue())
+	})
+})
@@ -15,3 +15,5 @@ require (
 	k8s.io/client-go v0.20.4
 	sigs.k8s.io/controller-runtime v0.8.3
 )
+
+replace github.com/squaremo/fleeet/pkg => ../pkg
@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -27,6 +28,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -59,11 +61,42 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var upstreamKubeconfig string
+	var upstreamNamespace string
+	var clusterName string
+	var heartbeatInterval time.Duration
+	var downstreamNamespace string
+	var listInventoryObjects bool
+	var driftCheckInterval time.Duration
+	var reportDriftFields bool
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&upstreamKubeconfig, "upstream-kubeconfig", "",
+		"A kubeconfig file for connecting to the management cluster. If given, this runs as the agent for a "+
+			"cluster in pull mode, fetching its assemblage from the management cluster.")
+	flag.StringVar(&upstreamNamespace, "upstream-namespace", "",
+		"The namespace of this cluster's Remote in the management cluster. Defaults to the namespace given in "+
+			"the upstream kubeconfig.")
+	flag.StringVar(&clusterName, "cluster-name", "",
+		"The name of this cluster's Remote in the management cluster; required with --upstream-kubeconfig.")
+	flag.DurationVar(&heartbeatInterval, "heartbeat-interval", time.Minute,
+		"How often to report to the management cluster that this cluster is still in touch, in pull mode.")
+	flag.StringVar(&downstreamNamespace, "downstream-namespace", fleetv1.DefaultNamespace,
+		"The namespace in which to create the assemblage fetched from the management cluster, unless it "+
+			"gives its own, in pull mode.")
+	flag.BoolVar(&listInventoryObjects, "list-inventory-objects", false,
+		"List the objects applied by each sync in the assemblage status, rather than only counting them by kind. "+
+			"Lists are truncated to the first 100 objects.")
+	flag.DurationVar(&driftCheckInterval, "drift-check-interval", 0,
+		"How often to check the objects applied by each sync for drift from what was applied. "+
+			"Zero (the default) switches drift checks off. Checking needs permission to patch "+
+			"anything the syncs apply; see config/rbac/drift.")
+	flag.BoolVar(&reportDriftFields, "report-drift-fields", false,
+		"Give the fields that have drifted in the assemblage status, rather than only counting the objects. "+
+			"These are truncated to the first 20 fields.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -89,10 +122,48 @@ func main() {
 		Client: mgr.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("Assemblage"),
 		Scheme: mgr.GetScheme(),
+
+		ListInventoryObjects: listInventoryObjects,
+		DriftCheckInterval:   driftCheckInterval,
+		ReportDriftFields:    reportDriftFields,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Assemblage")
 		os.Exit(1)
 	}
+	if upstreamKubeconfig != "" {
+		if clusterName == "" {
+			setupLog.Info("--cluster-name must be given with --upstream-kubeconfig")
+			os.Exit(1)
+		}
+		upstreamConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: upstreamKubeconfig},
+			&clientcmd.ConfigOverrides{})
+		config, err := upstreamConfig.ClientConfig()
+		if err != nil {
+			setupLog.Error(err, "unable to load upstream kubeconfig")
+			os.Exit(1)
+		}
+		if upstreamNamespace == "" {
+			if upstreamNamespace, _, err = upstreamConfig.Namespace(); err != nil {
+				setupLog.Error(err, "unable to get namespace from upstream kubeconfig")
+				os.Exit(1)
+			}
+		}
+		if err = (&controllers.UpstreamReconciler{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("Upstream"),
+			Scheme: mgr.GetScheme(),
+
+			Upstream:            config,
+			Namespace:           upstreamNamespace,
+			Name:                clusterName,
+			HeartbeatInterval:   heartbeatInterval,
+			DownstreamNamespace: downstreamNamespace,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Upstream")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -18,6 +18,18 @@ type BootstrapModuleSpec struct {
 	// +optional
 	Selector *metav1.LabelSelector `json:"selector,omitempty"`
 
+	// ClusterSetRef names a ClusterSet whose members are assigned
+	// this module. It is an alternative to Selector; only one of
+	// them may be given.
+	// +optional
+	ClusterSetRef *LocalClusterSetReference `json:"clusterSetRef,omitempty"`
+
+	// Eligibility gives criteria, besides the selector, that a
+	// cluster must meet before the module is applied to it. A
+	// selected cluster that doesn't meet them is waited for.
+	// +optional
+	Eligibility *ClusterEligibility `json:"eligibility,omitempty"`
+
 	// ControlPlaneBindings gives bindings to evaluate in the control
 	// plane, e.g., before applying to a worker cluster.
 	ControlPlaneBindings []syncapi.Binding `json:"controlPlaneBindings,omitempty"`
@@ -25,10 +37,25 @@ type BootstrapModuleSpec struct {
 	// Sync gives the configuration to sync on assigned clusters.
 	// +required
 	Sync syncapi.Sync `json:"sync"`
+
+	// Suspend stops the module from changing what is synced to its
+	// clusters, and suspends the GitRepository and Kustomizations it
+	// created. Status is still reported while the module is
+	// suspended.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
 }
 
 // BootstrapModuleStatus defines the observed state of BootstrapModule
 type BootstrapModuleStatus struct {
+	// ObservedGeneration is the most recent generation of the spec
+	// acted upon.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions gives the Ready, Reconciling and Stalled conditions
+	// for the object.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 	// ObservedSync gives the spec of the Sync as most recently acted
 	// upon.
 	// +optional
@@ -46,6 +73,9 @@ type BootstrapModuleStatus struct {
 //+kubebuilder:printcolumn:name="Updating",type=string,JSONPath=`.status.summary.updating`
 //+kubebuilder:printcolumn:name="Succeeded",type=string,JSONPath=`.status.summary.succeeded`
 //+kubebuilder:printcolumn:name="Failed",type=string,JSONPath=`.status.summary.failed`
+//+kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].message`,priority=1
 
 // BootstrapModule is the Schema for the bootstrapmodules API
 type BootstrapModule struct {
@@ -65,6 +95,12 @@ type BootstrapModuleList struct {
 	Items           []BootstrapModule `json:"items"`
 }
 
+// GetStatusConditions returns a pointer to the conditions in the
+// status, so they can be manipulated in place.
+func (in *BootstrapModule) GetStatusConditions() *[]metav1.Condition {
+	return &in.Status.Conditions
+}
+
 func init() {
 	SchemeBuilder.Register(&BootstrapModule{}, &BootstrapModuleList{})
 }
@@ -0,0 +1,84 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ClusterSetSpec defines the desired state of ClusterSet
+type ClusterSetSpec struct {
+	// Selector gives the criteria for including clusters in the set
+	// by their labels. If missing, no clusters are selected. If
+	// present and empty, all clusters are selected.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+
+	// Clusters gives the names of clusters to include in the set,
+	// whether or not they are selected.
+	// +optional
+	Clusters []string `json:"clusters,omitempty"`
+
+	// Exclude gives the names of clusters to leave out of the set,
+	// even if they are selected or listed in Clusters.
+	// +optional
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// ClusterSetStatus defines the observed state of ClusterSet
+type ClusterSetStatus struct {
+	// ObservedGeneration is the most recent generation of the spec
+	// acted upon.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions gives the Ready, Reconciling and Stalled conditions
+	// for the object.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Members gives the names of the clusters in the set, sorted.
+	// +optional
+	Members []string `json:"members,omitempty"`
+}
+
+// LocalClusterSetReference refers to a ClusterSet in the same
+// namespace.
+type LocalClusterSetReference struct {
+	// Name gives the name of the ClusterSet.
+	// +required
+	Name string `json:"name"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].message`
+
+// ClusterSet is the Schema for the clustersets API
+type ClusterSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ClusterSetSpec   `json:"spec,omitempty"`
+	Status ClusterSetStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ClusterSetList contains a list of ClusterSet
+type ClusterSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterSet `json:"items"`
+}
+
+// GetStatusConditions returns a pointer to the conditions in the
+// status, so they can be manipulated in place.
+func (in *ClusterSet) GetStatusConditions() *[]metav1.Condition {
+	return &in.Status.Conditions
+}
+
+func init() {
+	SchemeBuilder.Register(&ClusterSet{}, &ClusterSetList{})
+}
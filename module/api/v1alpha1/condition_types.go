@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package v1alpha1
+
+// The condition types used are those of kstatus, as given in
+// github.com/fluxcd/pkg/apis/meta: Ready, Reconciling and
+// Stalled; for RemoteAssemblage and Remote, ClusterReachable; and
+// for RemoteAssemblage, FieldConflict and InvalidMaintenanceWindow.
+// These are the reasons given for them.
+
+// ClusterReachableCondition is True when the remote cluster of a
+// RemoteAssemblage or Remote was last contacted successfully, and
+// False when it could not be contacted.
+const ClusterReachableCondition = "ClusterReachable"
+
+// FieldConflictCondition is True when the syncs compiled for a
+// RemoteAssemblage could not be applied to it, because some of its
+// fields are owned by another field manager, with different values.
+const FieldConflictCondition = "FieldConflict"
+
+// InvalidMaintenanceWindowCondition is True when the maintenance
+// window of the cluster for a RemoteAssemblage can't be read. Until
+// it's fixed, the window is treated as closed.
+const InvalidMaintenanceWindowCondition = "InvalidMaintenanceWindow"
+
+const (
+	// SyncSucceededReason means every sync the object is responsible
+	// for has been applied successfully.
+	SyncSucceededReason = "SyncSucceeded"
+	// SyncFailedReason means at least one sync the object is
+	// responsible for has failed.
+	SyncFailedReason = "SyncFailed"
+	// RolloutInProgressReason means the syncs the object is
+	// responsible for are still being applied.
+	RolloutInProgressReason = "RolloutInProgress"
+	// InvalidSelectorReason means the cluster selector could not be
+	// used.
+	InvalidSelectorReason = "InvalidSelector"
+	// BindingFailedReason means a binding could not be evaluated.
+	BindingFailedReason = "BindingFailed"
+	// ClusterUnreachableReason means the remote cluster could not be
+	// contacted.
+	ClusterUnreachableReason = "ClusterUnreachable"
+	// ClusterContactedReason means the remote cluster was contacted
+	// successfully.
+	ClusterContactedReason = "ClusterContacted"
+	// DownstreamUpdateFailedReason means the remote cluster was
+	// reached, but the object there could not be created or updated.
+	DownstreamUpdateFailedReason = "DownstreamUpdateFailed"
+	// DeletingReason means the object is being deleted, and is
+	// waiting for what it synced to be removed.
+	DeletingReason = "Deleting"
+	// SuspendedReason means some or all of the syncs the object is
+	// responsible for are suspended, and the rest have been applied
+	// successfully.
+	SuspendedReason = "Suspended"
+	// ClusterSetNotFoundReason means the ClusterSet referred to does
+	// not exist.
+	ClusterSetNotFoundReason = "ClusterSetNotFound"
+	// MembershipResolvedReason means the members of a ClusterSet have
+	// been worked out.
+	MembershipResolvedReason = "MembershipResolved"
+	// DependencyCycleReason means the module depends, directly or
+	// indirectly, on itself.
+	DependencyCycleReason = "DependencyCycle"
+	// ModulesGeneratedReason means the modules for a ModuleSet have
+	// been created or updated.
+	ModulesGeneratedReason = "ModulesGenerated"
+	// GeneratorFailedReason means a ModuleSet's generators or
+	// template could not be used to make modules.
+	GeneratorFailedReason = "GeneratorFailed"
+	// ArtifactUnavailableReason means a ModuleSet is waiting for the
+	// artifact of a GitRepository it refers to.
+	ArtifactUnavailableReason = "ArtifactUnavailable"
+	// SyncConflictReason means the module's sync applies some of the
+	// same objects as another module's sync, in at least one cluster.
+	SyncConflictReason = "SyncConflict"
+	// DeletionAbandonedReason means the assemblage in a remote
+	// cluster could not be deleted in time, and has been left there;
+	// or, for a module, that it wasn't removed from every cluster in
+	// time, and what it synced may have been left behind.
+	DeletionAbandonedReason = "DeletionAbandoned"
+	// InvalidKubeconfigRefReason means the kubeconfig reference
+	// doesn't identify a secret.
+	InvalidKubeconfigRefReason = "InvalidKubeconfigRef"
+	// ShadowedByClusterReason means a Remote is ignored, because
+	// there's a Cluster with the same name.
+	ShadowedByClusterReason = "ShadowedByCluster"
+	// AgentEnrolledReason means the service account and permissions
+	// for the agent in a pull-mode remote cluster have been created.
+	AgentEnrolledReason = "AgentEnrolled"
+	// FieldConflictReason means an object could not be applied,
+	// because some of its fields are owned by another field
+	// manager, with different values.
+	FieldConflictReason = "FieldConflict"
+	// InvalidMaintenanceWindowReason means the maintenance window
+	// annotations of a cluster could not be parsed.
+	InvalidMaintenanceWindowReason = "InvalidMaintenanceWindow"
+)
@@ -12,6 +12,22 @@ import (
 
 const KindModule = "Module"
 
+// ModuleFinalizer is put on each Module so that it can be removed
+// from all clusters before it goes away.
+const ModuleFinalizer = "fleet.squaremo.dev/module"
+
+const (
+	// MaintenanceScheduleAnnotation is put on a cluster to restrict
+	// when modules may change what is synced to it. The value is a
+	// cron expression (five fields, evaluated in UTC) giving the times
+	// at which a maintenance window opens.
+	MaintenanceScheduleAnnotation = "fleet.squaremo.dev/maintenance-schedule"
+	// MaintenanceDurationAnnotation gives how long the maintenance
+	// window stays open each time, as a duration (e.g., "2h30m"). It
+	// must accompany MaintenanceScheduleAnnotation.
+	MaintenanceDurationAnnotation = "fleet.squaremo.dev/maintenance-duration"
+)
+
 // ModuleSpec defines the desired state of Module
 type ModuleSpec struct {
 	// Selector gives the criteria for assigning this module to a
@@ -20,6 +36,18 @@ type ModuleSpec struct {
 	// +optional
 	Selector *metav1.LabelSelector `json:"selector,omitempty"`
 
+	// ClusterSetRef names a ClusterSet whose members are assigned
+	// this module. It is an alternative to Selector; only one of
+	// them may be given.
+	// +optional
+	ClusterSetRef *LocalClusterSetReference `json:"clusterSetRef,omitempty"`
+
+	// Eligibility gives criteria, besides the selector, that a
+	// cluster must meet before the module is applied to it. A
+	// selected cluster that doesn't meet them is waited for.
+	// +optional
+	Eligibility *ClusterEligibility `json:"eligibility,omitempty"`
+
 	// ControlPlaneBindings gives bindings to evaluate in the control
 	// plane, i.e., before the sync is "sent" to each worker
 	// cluster.
@@ -28,6 +56,101 @@ type ModuleSpec struct {
 	// Sync gives the configuration to sync on assigned clusters.
 	// +required
 	Sync SyncWithBindings `json:"sync"`
+
+	// DeletionPolicy says what happens to what has been synced to a
+	// cluster, when the module is removed from the cluster or
+	// deleted. `Delete` (the default) removes it; `Orphan` leaves it
+	// running.
+	// +optional
+	DeletionPolicy syncapi.DeletionPolicy `json:"deletionPolicy,omitempty"`
+
+	// ConflictPolicy says what happens when the module's sync applies
+	// some of the same objects as another module's sync in a
+	// cluster. `Report` (the default) records the conflict in the
+	// status; `Block` also stops the module's sync from being applied,
+	// if it was added to the cluster after the other.
+	// +optional
+	ConflictPolicy syncapi.ConflictPolicy `json:"conflictPolicy,omitempty"`
+
+	// Drift says what happens when the objects applied by the
+	// module's sync are changed by something else in a
+	// cluster. `Correct` (the default) puts them back; `Report`
+	// leaves them until the next revision is applied, and records
+	// the drift in the status; `IgnoreFields` leaves drift in the
+	// fields given until drift elsewhere is found and corrected,
+	// which puts back the ignored fields too. Policies other than
+	// `Correct` only take effect where the assemblage controller is
+	// checking for drift.
+	// +optional
+	Drift *syncapi.DriftPolicy `json:"drift,omitempty"`
+
+	// Suspend stops the module from changing what is synced to its
+	// clusters, and suspends its syncs downstream. Status is still
+	// reported while the module is suspended.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+
+	// Overrides gives changes to make to the sync for particular
+	// clusters, e.g., to keep a cluster on an older version while the
+	// rest move on. They are applied in order, so where more than one
+	// applies to a cluster, later ones win.
+	// +optional
+	Overrides []ModuleOverride `json:"overrides,omitempty"`
+
+	// DependsOn gives modules that must have synced successfully in
+	// a cluster before this module's sync is added to the cluster,
+	// or changed in it. Dependencies may not form a cycle.
+	// +optional
+	DependsOn []LocalModuleReference `json:"dependsOn,omitempty"`
+}
+
+// LocalModuleReference refers to a Module in the same namespace.
+type LocalModuleReference struct {
+	// Name gives the name of the Module.
+	// +required
+	Name string `json:"name"`
+}
+
+// ModuleOverride gives changes to the module's sync for the clusters
+// it applies to, which are those named in Clusters and those matched
+// by Selector.
+type ModuleOverride struct {
+	// Name identifies the override in the module's status.
+	// +required
+	Name string `json:"name"`
+	// Clusters gives the names of clusters the override applies to.
+	// +optional
+	Clusters []string `json:"clusters,omitempty"`
+	// Selector selects clusters the override applies to, by their
+	// labels. If missing, no clusters are selected.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+	// Version replaces the version of the git source.
+	// +optional
+	Version *syncapi.GitVersion `json:"version,omitempty"`
+	// Bindings are added to the sync's bindings, replacing any with
+	// the same name.
+	// +optional
+	Bindings []syncapi.Binding `json:"bindings,omitempty"`
+	// Substitute is added to the substitutions of the sync's
+	// kustomization, replacing any with the same name.
+	// +optional
+	Substitute map[string]string `json:"substitute,omitempty"`
+}
+
+// ClusterEligibility gives the state a cluster must be in for a
+// module to be applied to it. Clusters that are being deleted are
+// never eligible.
+type ClusterEligibility struct {
+	// Conditions gives the types of Cluster API conditions that must
+	// be True for the cluster, e.g., `ControlPlaneReady` and
+	// `InfrastructureReady`.
+	// +optional
+	Conditions []string `json:"conditions,omitempty"`
+	// Phases gives the Cluster API phases the cluster may be in,
+	// e.g., `Provisioned`. If empty, any phase will do.
+	// +optional
+	Phases []string `json:"phases,omitempty"`
 }
 
 // SyncWithBindings is a pairing of a sync (source and package) with
@@ -39,6 +162,14 @@ type SyncWithBindings struct {
 
 // ModuleStatus defines the observed state of Module
 type ModuleStatus struct {
+	// ObservedGeneration is the most recent generation of the spec
+	// acted upon.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions gives the Ready, Reconciling and Stalled conditions
+	// for the object.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
 	// ObservedSync gives the spec of the Sync as most recently acted
 	// upon.
 	// +optional
@@ -47,6 +178,72 @@ type ModuleStatus struct {
 	// various states at last count.
 	// +optional
 	Summary *SyncSummary `json:"summary,omitempty"`
+	// Clusters gives the state of the module in individual clusters,
+	// with failures first. For large fleets this is truncated to
+	// MaxClusterStatuses entries; Summary always gives the full
+	// count.
+	// +optional
+	Clusters []ClusterSyncStatus `json:"clusters,omitempty"`
+	// Overrides gives the overrides that apply to at least one
+	// cluster, so that departures from the module's sync are
+	// visible.
+	// +optional
+	Overrides []OverrideStatus `json:"overrides,omitempty"`
+}
+
+// OverrideStatus gives the clusters to which an override applies.
+type OverrideStatus struct {
+	// Name gives the name of the override.
+	Name string `json:"name"`
+	// Total gives the number of clusters to which the override
+	// applies.
+	Total int `json:"total"`
+	// Clusters gives the names of the clusters to which the override
+	// applies, sorted. For large fleets this is truncated to
+	// MaxClusterStatuses entries.
+	// +optional
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+// MaxClusterStatuses is the most entries that will be given in
+// ModuleStatus.Clusters.
+const MaxClusterStatuses = 20
+
+// StatePending is used in ClusterSyncStatus for a cluster that is
+// waiting for a maintenance window, to become eligible, or for the
+// module's dependencies, before being updated. The other states are those of syncapi.SyncState.
+const StatePending syncapi.SyncState = "pending"
+
+// StateUnreachable is used in ClusterSyncStatus for a cluster that
+// can't be contacted, so the state of the sync there isn't known.
+const StateUnreachable syncapi.SyncState = "unreachable"
+
+// ClusterSyncStatus gives the state of the module's sync in a
+// particular cluster.
+type ClusterSyncStatus struct {
+	// Cluster gives the name of the cluster.
+	Cluster string `json:"cluster"`
+	// State gives the state of the sync in the cluster.
+	State syncapi.SyncState `json:"state"`
+	// Revision gives the revision (git tag or commit) most recently
+	// reported for the cluster.
+	// +optional
+	Revision string `json:"revision,omitempty"`
+	// LastTransitionTime gives the time at which the state last
+	// changed. This is remembered for every cluster, not only those
+	// listed; but after the controller restarts, it's only known for
+	// clusters that were listed, and is the time of the restart for
+	// the others.
+	// +optional
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Message gives detail about the state, e.g., why the sync
+	// failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// Conflicts gives the names of the other modules whose syncs
+	// apply some of the same objects in the cluster.
+	// +optional
+	Conflicts []string `json:"conflicts,omitempty"`
 }
 
 type SyncSummary struct {
@@ -62,6 +259,23 @@ type SyncSummary struct {
 	// Succeeded gives the number of uses of this module that are in a
 	// succeeded state.
 	Succeeded int `json:"succeeded"`
+	// Pending gives the number of uses of this module that are
+	// waiting for a maintenance window, for the cluster to become
+	// eligible, or for the module's dependencies, before being
+	// updated.
+	Pending int `json:"pending"`
+	// Suspended gives the number of uses of this module that are
+	// suspended.
+	Suspended int `json:"suspended"`
+	// Conflicted gives the number of uses of this module that apply
+	// some of the same objects as another module. These are counted
+	// as well as being counted by state.
+	// +optional
+	Conflicted int `json:"conflicted,omitempty"`
+	// Unreachable gives the number of uses of this module in clusters
+	// that can't be contacted, so the state of the sync isn't known.
+	// +optional
+	Unreachable int `json:"unreachable,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -71,6 +285,10 @@ type SyncSummary struct {
 //+kubebuilder:printcolumn:name="Updating",type=string,JSONPath=`.status.summary.updating`
 //+kubebuilder:printcolumn:name="Succeeded",type=string,JSONPath=`.status.summary.succeeded`
 //+kubebuilder:printcolumn:name="Failed",type=string,JSONPath=`.status.summary.failed`
+//+kubebuilder:printcolumn:name="Pending",type=string,JSONPath=`.status.summary.pending`
+//+kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].message`,priority=1
 
 // Module is the Schema for the modules API
 type Module struct {
@@ -90,6 +308,12 @@ type ModuleList struct {
 	Items           []Module `json:"items"`
 }
 
+// GetStatusConditions returns a pointer to the conditions in the
+// status, so they can be manipulated in place.
+func (in *Module) GetStatusConditions() *[]metav1.Condition {
+	return &in.Status.Conditions
+}
+
 func init() {
 	SchemeBuilder.Register(&Module{}, &ModuleList{})
 }
@@ -0,0 +1,158 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ModuleSetLabel is put on each module created by a ModuleSet, and
+// gives the name of the ModuleSet.
+const ModuleSetLabel = "fleet.squaremo.dev/module-set"
+
+// ModuleSetSpec defines the desired state of ModuleSet
+type ModuleSetSpec struct {
+	// Generators give the sets of parameters for which to create
+	// modules. Each set of parameters from each generator results in
+	// a module.
+	// +required
+	Generators []ModuleSetGenerator `json:"generators"`
+
+	// Template gives the module to create for each set of
+	// parameters. References to parameters, as `$(NAME)`, are
+	// expanded in all the string values in the template; references
+	// to anything else are left as they are.
+	// +required
+	Template ModuleTemplate `json:"template"`
+}
+
+// ModuleSetGenerator is a union of the ways to generate sets of
+// parameters. Exactly one field should be given.
+type ModuleSetGenerator struct {
+	// List gives literal sets of parameters.
+	// +optional
+	List *ListGenerator `json:"list,omitempty"`
+	// Cluster gives a set of parameters for each distinct value of a
+	// label on clusters.
+	// +optional
+	Cluster *ClusterGenerator `json:"cluster,omitempty"`
+	// GitDirectory gives a set of parameters for each matching
+	// directory in a git repository.
+	// +optional
+	GitDirectory *GitDirectoryGenerator `json:"gitDirectory,omitempty"`
+}
+
+// ListGenerator gives literal sets of parameters.
+type ListGenerator struct {
+	// Elements gives each set of parameters, as a map of names to
+	// values.
+	// +required
+	Elements []map[string]string `json:"elements"`
+}
+
+// ClusterGenerator gives a set of parameters for each distinct value
+// of a label on the clusters in the namespace; e.g., for each
+// region. The value is given in the parameter `LABEL_VALUE`.
+type ClusterGenerator struct {
+	// Label gives the key of the label to look at.
+	// +required
+	Label string `json:"label"`
+	// Selector restricts the clusters looked at. If missing, all
+	// clusters are looked at.
+	// +optional
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// GitDirectoryGenerator gives a set of parameters for each directory
+// in a git repository that matches a pattern. The path of the
+// directory is given in the parameter `DIRECTORY_PATH`, and its last
+// element in `DIRECTORY_NAME`.
+type GitDirectoryGenerator struct {
+	// SourceRef names a GitRepository (from the GitOps Toolkit) in
+	// the same namespace, from which to get the directories.
+	// +required
+	SourceRef LocalGitRepositoryReference `json:"sourceRef"`
+	// Path gives a pattern (as for path.Match) for the directories
+	// to include, e.g., `apps/*`.
+	// +required
+	Path string `json:"path"`
+}
+
+// LocalGitRepositoryReference refers to a GitRepository in the same
+// namespace.
+type LocalGitRepositoryReference struct {
+	// Name gives the name of the GitRepository.
+	// +required
+	Name string `json:"name"`
+}
+
+// ModuleTemplate gives the metadata and spec of a module to create.
+type ModuleTemplate struct {
+	// +required
+	Metadata ModuleTemplateMetadata `json:"metadata"`
+	// +required
+	Spec ModuleSpec `json:"spec"`
+}
+
+// ModuleTemplateMetadata gives the metadata for a module created
+// from a template.
+type ModuleTemplateMetadata struct {
+	// Name gives the name of the module. This must refer to
+	// parameters, so that each module gets a different name.
+	// +required
+	Name string `json:"name"`
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+	// +optional
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ModuleSetStatus defines the observed state of ModuleSet
+type ModuleSetStatus struct {
+	// ObservedGeneration is the most recent generation of the spec
+	// acted upon.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions gives the Ready, Reconciling and Stalled conditions
+	// for the object.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Modules gives the names of the modules created, sorted.
+	// +optional
+	Modules []string `json:"modules,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].message`
+
+// ModuleSet is the Schema for the modulesets API
+type ModuleSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ModuleSetSpec   `json:"spec,omitempty"`
+	Status ModuleSetStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ModuleSetList contains a list of ModuleSet
+type ModuleSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ModuleSet `json:"items"`
+}
+
+// GetStatusConditions returns a pointer to the conditions in the
+// status, so they can be manipulated in place.
+func (in *ModuleSet) GetStatusConditions() *[]metav1.Condition {
+	return &in.Status.Conditions
+}
+
+func init() {
+	SchemeBuilder.Register(&ModuleSet{}, &ModuleSetList{})
+}
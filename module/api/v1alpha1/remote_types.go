@@ -0,0 +1,114 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RemoteSpec defines the desired state of Remote
+type RemoteSpec struct {
+	// Mode says whether assemblages are pushed to the remote cluster
+	// from here ("Push", the default), or pulled from here by an
+	// agent running in the remote cluster ("Pull").
+	// +optional
+	Mode RemoteMode `json:"mode,omitempty"`
+	// KubeconfigRef refers to a secret with a kubeconfig for the
+	// remote cluster. It may not itself refer to a Remote. It must be
+	// given when the mode is "Push", and is not used when the mode is
+	// "Pull".
+	// +optional
+	KubeconfigRef LocalKubeconfigReference `json:"kubeconfigRef,omitempty"`
+}
+
+// RemoteMode gives how assemblages get to a remote cluster.
+// +kubebuilder:validation:Enum=Push;Pull
+type RemoteMode string
+
+const (
+	// Connect to the remote cluster, and create or update the
+	// assemblage there
+	RemoteModePush RemoteMode = "Push"
+	// Let an agent in the remote cluster connect here, and fetch the
+	// assemblage and report its status
+	RemoteModePull RemoteMode = "Pull"
+)
+
+// IsPull reports whether the remote cluster pulls its assemblage,
+// rather than having it pushed.
+func (in *Remote) IsPull() bool {
+	return in.Spec.Mode == RemoteModePull
+}
+
+// RemoteStatus defines the observed state of Remote
+type RemoteStatus struct {
+	// ObservedGeneration is the most recent generation of the spec
+	// acted upon.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions gives the Ready, Reconciling, Stalled and
+	// ClusterReachable conditions for the object.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// LastContactTime gives the time at which the remote cluster was
+	// last contacted successfully.
+	// +optional
+	LastContactTime *metav1.Time `json:"lastContactTime,omitempty"`
+	// KubernetesVersion gives the version reported by the remote
+	// cluster's API server when it was last contacted.
+	// +optional
+	KubernetesVersion string `json:"kubernetesVersion,omitempty"`
+	// ServiceAccountName gives the name of the service account
+	// created for the agent in the remote cluster to use, when the
+	// mode is "Pull".
+	// +optional
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+}
+
+// LocalRemoteReference refers to a Remote in the same namespace.
+type LocalRemoteReference struct {
+	// Name gives the name of the Remote.
+	// +required
+	Name string `json:"name"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Mode",type=string,JSONPath=`.spec.mode`
+//+kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.status.kubernetesVersion`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].message`,priority=1
+
+// Remote enrols a cluster that is not provisioned by Cluster API, so
+// that it can be selected by modules. Its labels are used for
+// selection, in the same way as those of a Cluster. A Remote with the
+// same name as a Cluster in the same namespace is ignored in favour
+// of the Cluster.
+type Remote struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RemoteSpec   `json:"spec,omitempty"`
+	Status RemoteStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// RemoteList contains a list of Remote
+type RemoteList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Remote `json:"items"`
+}
+
+// GetStatusConditions returns a pointer to the conditions in the
+// status, so they can be manipulated in place.
+func (in *Remote) GetStatusConditions() *[]metav1.Condition {
+	return &in.Status.Conditions
+}
+
+func init() {
+	SchemeBuilder.Register(&Remote{}, &RemoteList{})
+}
@@ -11,6 +11,11 @@ import (
 	syncapi "github.com/squaremo/fleeet/pkg/api"
 )
 
+// RemoteAssemblageFinalizer is put on each RemoteAssemblage so that
+// the assemblage in the remote cluster can be deleted before it goes
+// away.
+const RemoteAssemblageFinalizer = "fleet.squaremo.dev/remote-assemblage"
+
 // RemoteAssemblageSpec defines the desired state of RemoteAssemblage
 type RemoteAssemblageSpec struct {
 	// KubeconfigRef refers to a secret with a kubeconfig for the
@@ -23,21 +28,83 @@ type RemoteAssemblageSpec struct {
 	// object.
 	// +required
 	Assemblage asmv1.AssemblageSpec `json:"assemblage"`
+
+	// DownstreamNamespace gives the namespace in the remote cluster
+	// in which to create the assemblage. It is created if it doesn't
+	// exist. If not given, the namespace the controller is told to
+	// use for all clusters is used (by default, "fleet-system").
+	// +optional
+	DownstreamNamespace string `json:"downstreamNamespace,omitempty"`
 }
 
+// LocalKubeconfigReference refers to a secret, in the same
+// namespace, holding a kubeconfig for a remote cluster. The secret
+// can be named directly, found from the Cluster API Cluster it was
+// created for, or found from the Remote referring to it.
 type LocalKubeconfigReference struct {
-	// Name gives the name of the secret containing a kubeconfig.
+	// Name gives the name of the secret containing a kubeconfig. If
+	// this is not given, ClusterRef or RemoteRef must be.
+	// +optional
+	Name string `json:"name,omitempty"`
+	// Key gives the key in the secret's data under which the
+	// kubeconfig is found. Defaults to "value", which is the key used
+	// by Cluster API.
+	// +optional
+	Key string `json:"key,omitempty"`
+	// ClusterRef refers to the Cluster API Cluster to which the
+	// kubeconfig pertains. If Name is not given, the secret created
+	// by Cluster API for the cluster is used.
+	// +optional
+	ClusterRef *LocalClusterReference `json:"clusterRef,omitempty"`
+	// RemoteRef refers to the Remote for the cluster. If Name is not
+	// given, the kubeconfig referred to by the Remote is used.
+	// +optional
+	RemoteRef *LocalRemoteReference `json:"remoteRef,omitempty"`
+}
+
+// DefaultKubeconfigKey is the key in a secret's data under which a
+// kubeconfig is expected, if no other key is given. This is the key
+// used by Cluster API.
+const DefaultKubeconfigKey = "value"
+
+// LocalClusterReference refers to a Cluster API Cluster in the same
+// namespace.
+type LocalClusterReference struct {
+	// Name gives the name of the Cluster.
 	// +required
 	Name string `json:"name"`
 }
 
 // RemoteAssemblageStatus defines the observed state of RemoteAssemblage
 type RemoteAssemblageStatus struct {
+	// ObservedGeneration is the most recent generation of the spec
+	// acted upon.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Conditions gives the Ready, Reconciling, Stalled,
+	// ClusterReachable, FieldConflict and InvalidMaintenanceWindow
+	// conditions for the object.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// LastContactTime gives the time at which the remote cluster was
+	// last contacted successfully.
+	// +optional
+	LastContactTime *metav1.Time `json:"lastContactTime,omitempty"`
+	// DownstreamNamespace gives the namespace in the remote cluster
+	// in which the assemblage was last created, so it can be removed
+	// from there if it's moved.
+	// +optional
+	DownstreamNamespace string `json:"downstreamNamespace,omitempty"`
+	// Syncs gives the status of each sync, as reported by the
+	// assemblage downstream.
+	// +optional
 	Syncs []syncapi.SyncStatus `json:"syncs,omitempty"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+//+kubebuilder:printcolumn:name="Status",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].message`,priority=1
 
 // RemoteAssemblage is the Schema for the remoteassemblages API
 type RemoteAssemblage struct {
@@ -57,6 +124,12 @@ type RemoteAssemblageList struct {
 	Items           []RemoteAssemblage `json:"items"`
 }
 
+// GetStatusConditions returns a pointer to the conditions in the
+// status, so they can be manipulated in place.
+func (in *RemoteAssemblage) GetStatusConditions() *[]metav1.Condition {
+	return &in.Status.Conditions
+}
+
 func init() {
 	SchemeBuilder.Register(&RemoteAssemblage{}, &RemoteAssemblageList{})
 }
@@ -82,6 +82,16 @@ func (in *BootstrapModuleSpec) DeepCopyInto(out *BootstrapModuleSpec) {
 		*out = new(v1.LabelSelector)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.ClusterSetRef != nil {
+		in, out := &in.ClusterSetRef, &out.ClusterSetRef
+		*out = new(LocalClusterSetReference)
+		**out = **in
+	}
+	if in.Eligibility != nil {
+		in, out := &in.Eligibility, &out.Eligibility
+		*out = new(ClusterEligibility)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.ControlPlaneBindings != nil {
 		in, out := &in.ControlPlaneBindings, &out.ControlPlaneBindings
 		*out = make([]api.Binding, len(*in))
@@ -105,6 +115,13 @@ func (in *BootstrapModuleSpec) DeepCopy() *BootstrapModuleSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *BootstrapModuleStatus) DeepCopyInto(out *BootstrapModuleStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.ObservedSync != nil {
 		in, out := &in.ObservedSync, &out.ObservedSync
 		*out = new(api.Sync)
@@ -127,9 +144,293 @@ func (in *BootstrapModuleStatus) DeepCopy() *BootstrapModuleStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterEligibility) DeepCopyInto(out *ClusterEligibility) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Phases != nil {
+		in, out := &in.Phases, &out.Phases
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterEligibility.
+func (in *ClusterEligibility) DeepCopy() *ClusterEligibility {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterEligibility)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterGenerator) DeepCopyInto(out *ClusterGenerator) {
+	*out = *in
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterGenerator.
+func (in *ClusterGenerator) DeepCopy() *ClusterGenerator {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterGenerator)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSet) DeepCopyInto(out *ClusterSet) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSet.
+func (in *ClusterSet) DeepCopy() *ClusterSet {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSet)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterSet) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSetList) DeepCopyInto(out *ClusterSetList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ClusterSet, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSetList.
+func (in *ClusterSetList) DeepCopy() *ClusterSetList {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSetList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ClusterSetList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSetSpec) DeepCopyInto(out *ClusterSetSpec) {
+	*out = *in
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Clusters != nil {
+		in, out := &in.Clusters, &out.Clusters
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSetSpec.
+func (in *ClusterSetSpec) DeepCopy() *ClusterSetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSetStatus) DeepCopyInto(out *ClusterSetStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Members != nil {
+		in, out := &in.Members, &out.Members
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSetStatus.
+func (in *ClusterSetStatus) DeepCopy() *ClusterSetStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSetStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ClusterSyncStatus) DeepCopyInto(out *ClusterSyncStatus) {
+	*out = *in
+	if in.LastTransitionTime != nil {
+		in, out := &in.LastTransitionTime, &out.LastTransitionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conflicts != nil {
+		in, out := &in.Conflicts, &out.Conflicts
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ClusterSyncStatus.
+func (in *ClusterSyncStatus) DeepCopy() *ClusterSyncStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ClusterSyncStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *GitDirectoryGenerator) DeepCopyInto(out *GitDirectoryGenerator) {
+	*out = *in
+	out.SourceRef = in.SourceRef
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new GitDirectoryGenerator.
+func (in *GitDirectoryGenerator) DeepCopy() *GitDirectoryGenerator {
+	if in == nil {
+		return nil
+	}
+	out := new(GitDirectoryGenerator)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ListGenerator) DeepCopyInto(out *ListGenerator) {
+	*out = *in
+	if in.Elements != nil {
+		in, out := &in.Elements, &out.Elements
+		*out = make([]map[string]string, len(*in))
+		for i := range *in {
+			if (*in)[i] != nil {
+				in, out := &(*in)[i], &(*out)[i]
+				*out = make(map[string]string, len(*in))
+				for key, val := range *in {
+					(*out)[key] = val
+				}
+			}
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ListGenerator.
+func (in *ListGenerator) DeepCopy() *ListGenerator {
+	if in == nil {
+		return nil
+	}
+	out := new(ListGenerator)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LocalClusterReference) DeepCopyInto(out *LocalClusterReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LocalClusterReference.
+func (in *LocalClusterReference) DeepCopy() *LocalClusterReference {
+	if in == nil {
+		return nil
+	}
+	out := new(LocalClusterReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LocalClusterSetReference) DeepCopyInto(out *LocalClusterSetReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LocalClusterSetReference.
+func (in *LocalClusterSetReference) DeepCopy() *LocalClusterSetReference {
+	if in == nil {
+		return nil
+	}
+	out := new(LocalClusterSetReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LocalGitRepositoryReference) DeepCopyInto(out *LocalGitRepositoryReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LocalGitRepositoryReference.
+func (in *LocalGitRepositoryReference) DeepCopy() *LocalGitRepositoryReference {
+	if in == nil {
+		return nil
+	}
+	out := new(LocalGitRepositoryReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *LocalKubeconfigReference) DeepCopyInto(out *LocalKubeconfigReference) {
 	*out = *in
+	if in.ClusterRef != nil {
+		in, out := &in.ClusterRef, &out.ClusterRef
+		*out = new(LocalClusterReference)
+		**out = **in
+	}
+	if in.RemoteRef != nil {
+		in, out := &in.RemoteRef, &out.RemoteRef
+		*out = new(LocalRemoteReference)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LocalKubeconfigReference.
@@ -142,6 +443,36 @@ func (in *LocalKubeconfigReference) DeepCopy() *LocalKubeconfigReference {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LocalModuleReference) DeepCopyInto(out *LocalModuleReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LocalModuleReference.
+func (in *LocalModuleReference) DeepCopy() *LocalModuleReference {
+	if in == nil {
+		return nil
+	}
+	out := new(LocalModuleReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LocalRemoteReference) DeepCopyInto(out *LocalRemoteReference) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LocalRemoteReference.
+func (in *LocalRemoteReference) DeepCopy() *LocalRemoteReference {
+	if in == nil {
+		return nil
+	}
+	out := new(LocalRemoteReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Module) DeepCopyInto(out *Module) {
 	*out = *in
@@ -201,6 +532,189 @@ func (in *ModuleList) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ModuleOverride) DeepCopyInto(out *ModuleOverride) {
+	*out = *in
+	if in.Clusters != nil {
+		in, out := &in.Clusters, &out.Clusters
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Selector != nil {
+		in, out := &in.Selector, &out.Selector
+		*out = new(v1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Version != nil {
+		in, out := &in.Version, &out.Version
+		*out = new(api.GitVersion)
+		**out = **in
+	}
+	if in.Bindings != nil {
+		in, out := &in.Bindings, &out.Bindings
+		*out = make([]api.Binding, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Substitute != nil {
+		in, out := &in.Substitute, &out.Substitute
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleOverride.
+func (in *ModuleOverride) DeepCopy() *ModuleOverride {
+	if in == nil {
+		return nil
+	}
+	out := new(ModuleOverride)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ModuleSet) DeepCopyInto(out *ModuleSet) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleSet.
+func (in *ModuleSet) DeepCopy() *ModuleSet {
+	if in == nil {
+		return nil
+	}
+	out := new(ModuleSet)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ModuleSet) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ModuleSetGenerator) DeepCopyInto(out *ModuleSetGenerator) {
+	*out = *in
+	if in.List != nil {
+		in, out := &in.List, &out.List
+		*out = new(ListGenerator)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Cluster != nil {
+		in, out := &in.Cluster, &out.Cluster
+		*out = new(ClusterGenerator)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.GitDirectory != nil {
+		in, out := &in.GitDirectory, &out.GitDirectory
+		*out = new(GitDirectoryGenerator)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleSetGenerator.
+func (in *ModuleSetGenerator) DeepCopy() *ModuleSetGenerator {
+	if in == nil {
+		return nil
+	}
+	out := new(ModuleSetGenerator)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ModuleSetList) DeepCopyInto(out *ModuleSetList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]ModuleSet, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleSetList.
+func (in *ModuleSetList) DeepCopy() *ModuleSetList {
+	if in == nil {
+		return nil
+	}
+	out := new(ModuleSetList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *ModuleSetList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ModuleSetSpec) DeepCopyInto(out *ModuleSetSpec) {
+	*out = *in
+	if in.Generators != nil {
+		in, out := &in.Generators, &out.Generators
+		*out = make([]ModuleSetGenerator, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.Template.DeepCopyInto(&out.Template)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleSetSpec.
+func (in *ModuleSetSpec) DeepCopy() *ModuleSetSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(ModuleSetSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ModuleSetStatus) DeepCopyInto(out *ModuleSetStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Modules != nil {
+		in, out := &in.Modules, &out.Modules
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleSetStatus.
+func (in *ModuleSetStatus) DeepCopy() *ModuleSetStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(ModuleSetStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ModuleSpec) DeepCopyInto(out *ModuleSpec) {
 	*out = *in
@@ -209,6 +723,16 @@ func (in *ModuleSpec) DeepCopyInto(out *ModuleSpec) {
 		*out = new(v1.LabelSelector)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.ClusterSetRef != nil {
+		in, out := &in.ClusterSetRef, &out.ClusterSetRef
+		*out = new(LocalClusterSetReference)
+		**out = **in
+	}
+	if in.Eligibility != nil {
+		in, out := &in.Eligibility, &out.Eligibility
+		*out = new(ClusterEligibility)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.ControlPlaneBindings != nil {
 		in, out := &in.ControlPlaneBindings, &out.ControlPlaneBindings
 		*out = make([]api.Binding, len(*in))
@@ -217,6 +741,23 @@ func (in *ModuleSpec) DeepCopyInto(out *ModuleSpec) {
 		}
 	}
 	in.Sync.DeepCopyInto(&out.Sync)
+	if in.Drift != nil {
+		in, out := &in.Drift, &out.Drift
+		*out = new(api.DriftPolicy)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Overrides != nil {
+		in, out := &in.Overrides, &out.Overrides
+		*out = make([]ModuleOverride, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.DependsOn != nil {
+		in, out := &in.DependsOn, &out.DependsOn
+		*out = make([]LocalModuleReference, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleSpec.
@@ -232,6 +773,13 @@ func (in *ModuleSpec) DeepCopy() *ModuleSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ModuleStatus) DeepCopyInto(out *ModuleStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	if in.ObservedSync != nil {
 		in, out := &in.ObservedSync, &out.ObservedSync
 		*out = new(api.Sync)
@@ -242,6 +790,20 @@ func (in *ModuleStatus) DeepCopyInto(out *ModuleStatus) {
 		*out = new(SyncSummary)
 		**out = **in
 	}
+	if in.Clusters != nil {
+		in, out := &in.Clusters, &out.Clusters
+		*out = make([]ClusterSyncStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Overrides != nil {
+		in, out := &in.Overrides, &out.Overrides
+		*out = make([]OverrideStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleStatus.
@@ -254,6 +816,99 @@ func (in *ModuleStatus) DeepCopy() *ModuleStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ModuleTemplate) DeepCopyInto(out *ModuleTemplate) {
+	*out = *in
+	in.Metadata.DeepCopyInto(&out.Metadata)
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleTemplate.
+func (in *ModuleTemplate) DeepCopy() *ModuleTemplate {
+	if in == nil {
+		return nil
+	}
+	out := new(ModuleTemplate)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ModuleTemplateMetadata) DeepCopyInto(out *ModuleTemplateMetadata) {
+	*out = *in
+	if in.Labels != nil {
+		in, out := &in.Labels, &out.Labels
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Annotations != nil {
+		in, out := &in.Annotations, &out.Annotations
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ModuleTemplateMetadata.
+func (in *ModuleTemplateMetadata) DeepCopy() *ModuleTemplateMetadata {
+	if in == nil {
+		return nil
+	}
+	out := new(ModuleTemplateMetadata)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OverrideStatus) DeepCopyInto(out *OverrideStatus) {
+	*out = *in
+	if in.Clusters != nil {
+		in, out := &in.Clusters, &out.Clusters
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OverrideStatus.
+func (in *OverrideStatus) DeepCopy() *OverrideStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(OverrideStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *Remote) DeepCopyInto(out *Remote) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	in.Spec.DeepCopyInto(&out.Spec)
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new Remote.
+func (in *Remote) DeepCopy() *Remote {
+	if in == nil {
+		return nil
+	}
+	out := new(Remote)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *Remote) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RemoteAssemblage) DeepCopyInto(out *RemoteAssemblage) {
 	*out = *in
@@ -316,7 +971,7 @@ func (in *RemoteAssemblageList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RemoteAssemblageSpec) DeepCopyInto(out *RemoteAssemblageSpec) {
 	*out = *in
-	out.KubeconfigRef = in.KubeconfigRef
+	in.KubeconfigRef.DeepCopyInto(&out.KubeconfigRef)
 	in.Assemblage.DeepCopyInto(&out.Assemblage)
 }
 
@@ -333,6 +988,17 @@ func (in *RemoteAssemblageSpec) DeepCopy() *RemoteAssemblageSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *RemoteAssemblageStatus) DeepCopyInto(out *RemoteAssemblageStatus) {
 	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastContactTime != nil {
+		in, out := &in.LastContactTime, &out.LastContactTime
+		*out = (*in).DeepCopy()
+	}
 	if in.Syncs != nil {
 		in, out := &in.Syncs, &out.Syncs
 		*out = make([]api.SyncStatus, len(*in))
@@ -352,6 +1018,80 @@ func (in *RemoteAssemblageStatus) DeepCopy() *RemoteAssemblageStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RemoteList) DeepCopyInto(out *RemoteList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]Remote, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RemoteList.
+func (in *RemoteList) DeepCopy() *RemoteList {
+	if in == nil {
+		return nil
+	}
+	out := new(RemoteList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *RemoteList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RemoteSpec) DeepCopyInto(out *RemoteSpec) {
+	*out = *in
+	in.KubeconfigRef.DeepCopyInto(&out.KubeconfigRef)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RemoteSpec.
+func (in *RemoteSpec) DeepCopy() *RemoteSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(RemoteSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RemoteStatus) DeepCopyInto(out *RemoteStatus) {
+	*out = *in
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.LastContactTime != nil {
+		in, out := &in.LastContactTime, &out.LastContactTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RemoteStatus.
+func (in *RemoteStatus) DeepCopy() *RemoteStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(RemoteStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SyncSummary) DeepCopyInto(out *SyncSummary) {
 	*out = *in
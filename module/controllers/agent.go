@@ -0,0 +1,111 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+// agentObjectName gives the name of the service account, role and
+// role binding for the agent in a pull-mode remote cluster.
+func agentObjectName(rem *fleetv1.Remote) string {
+	return rem.Name + "-agent"
+}
+
+// agentRules gives the permissions for the agent in a pull-mode
+// remote cluster: it can see and update only the remote assemblage
+// for its own cluster, which has the same name as the remote.
+func agentRules(rem *fleetv1.Remote) []rbacv1.PolicyRule {
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups:     []string{fleetv1.GroupVersion.Group},
+			Resources:     []string{"remoteassemblages"},
+			ResourceNames: []string{rem.Name},
+			Verbs:         []string{"get", "list", "watch", "update", "patch"},
+		},
+		{
+			APIGroups:     []string{fleetv1.GroupVersion.Group},
+			Resources:     []string{"remoteassemblages/status"},
+			ResourceNames: []string{rem.Name},
+			Verbs:         []string{"get", "update", "patch"},
+		},
+	}
+}
+
+// enrolAgent makes sure there's a service account for the agent in the
+// remote cluster to use, bound to a role giving it access to its own
+// remote assemblage. These are owned by the remote, so they go when it
+// does.
+func (r *RemoteReconciler) enrolAgent(ctx context.Context, rem *fleetv1.Remote) error {
+	name := agentObjectName(rem)
+
+	var account corev1.ServiceAccount
+	account.Namespace, account.Name = rem.Namespace, name
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, &account, func() error {
+		return controllerutil.SetControllerReference(rem, &account, r.Scheme)
+	}); err != nil {
+		return err
+	}
+
+	var role rbacv1.Role
+	role.Namespace, role.Name = rem.Namespace, name
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, &role, func() error {
+		role.Rules = agentRules(rem)
+		return controllerutil.SetControllerReference(rem, &role, r.Scheme)
+	}); err != nil {
+		return err
+	}
+
+	var binding rbacv1.RoleBinding
+	binding.Namespace, binding.Name = rem.Namespace, name
+	if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, &binding, func() error {
+		// The role referred to can't be changed once the binding is
+		// created; but it's always the same role, so this only
+		// fills it in the first time.
+		binding.RoleRef = rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     role.Name,
+		}
+		binding.Subjects = []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Namespace: account.Namespace,
+			Name:      account.Name,
+		}}
+		return controllerutil.SetControllerReference(rem, &binding, r.Scheme)
+	}); err != nil {
+		return err
+	}
+
+	rem.Status.ServiceAccountName = account.Name
+	return nil
+}
+
+// disenrolAgent removes the service account, role and role binding
+// for the agent, if the remote was in pull mode and is no longer, so
+// that the agent no longer has access.
+func (r *RemoteReconciler) disenrolAgent(ctx context.Context, rem *fleetv1.Remote) error {
+	if rem.Status.ServiceAccountName == "" {
+		return nil
+	}
+	name := agentObjectName(rem)
+	for _, obj := range []client.Object{&rbacv1.RoleBinding{}, &rbacv1.Role{}, &corev1.ServiceAccount{}} {
+		obj.SetNamespace(rem.Namespace)
+		obj.SetName(name)
+		if err := r.Delete(ctx, obj); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+	rem.Status.ServiceAccountName = ""
+	return nil
+}
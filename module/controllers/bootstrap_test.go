@@ -14,6 +14,7 @@ import (
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
 	// corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	// "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
@@ -255,4 +256,21 @@ var _ = Describe("bootstrap module controller", func() {
 		// All the clusters were accounted for.
 		Expect(clusters).To(BeEmpty())
 	})
+
+	It("reports the kustomizations in the module status", func() {
+		// Nothing is running the kustomizations, so they will stay
+		// unready.
+		var m fleetv1.BootstrapModule
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), types.NamespacedName{
+				Namespace: mod.Namespace,
+				Name:      mod.Name,
+			}, &m)
+			return err == nil && m.Status.Summary != nil && m.Status.Summary.Total == len(clusters)
+		}, "5s", "1s").Should(BeTrue())
+		Expect(m.Status.Summary.Updating).To(Equal(len(clusters)))
+		Expect(m.Status.ObservedGeneration).To(Equal(m.Generation))
+		Expect(apimeta.IsStatusConditionTrue(m.Status.Conditions, meta.ReconcilingCondition)).To(BeTrue())
+		Expect(apimeta.IsStatusConditionFalse(m.Status.Conditions, meta.ReadyCondition)).To(BeTrue())
+	})
 })
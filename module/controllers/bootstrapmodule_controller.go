@@ -6,11 +6,13 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
+	"github.com/fluxcd/pkg/apis/meta"
 	"github.com/go-logr/logr"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -23,6 +25,7 @@ import (
 	kustomv1 "github.com/fluxcd/kustomize-controller/api/v1beta1"
 	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	"sigs.k8s.io/cluster-api/util/secret"
 
 	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
 	syncapi "github.com/squaremo/fleeet/pkg/api"
@@ -40,6 +43,8 @@ type BootstrapModuleReconciler struct {
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=bootstrapmodules/finalizers,verbs=update
 
 //+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remotes,verbs=get;list;watch
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=clustersets,verbs=get;list;watch
 
 //+kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=gitrepositories,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=kustomize.toolkit.fluxcd.io,resources=kustomizations,verbs=get;list;watch;create;update;patch;delete
@@ -56,6 +61,10 @@ func (r *BootstrapModuleReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 
 	log.V(1).Info("found BootstrapModule")
 
+	if mod.Spec.Suspend {
+		return r.suspend(ctx, log, &mod)
+	}
+
 	// The job of this controller is to make sure each eligible
 	// cluster has a sync primitive targeting it. That means, in
 	// GitOps Toolkit terms, there is a Kustomization object using the
@@ -74,6 +83,8 @@ func (r *BootstrapModuleReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		}
 		// This is a hack to work around https://github.com/fluxcd/source-controller/issues/315
 		source.Spec.Reference.Branch = "main"
+		// in case the module has just been resumed
+		source.Spec.Suspend = false
 		return controllerutil.SetControllerReference(&mod, &source, r.Scheme)
 	})
 	if err != nil {
@@ -83,23 +94,50 @@ func (r *BootstrapModuleReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 	// TODO set a condition saying the source is created
 
 	// For each eligible cluster, create a kustomization
-	var clusters clusterv1.ClusterList
-	selector, err := metav1.LabelSelectorAsSelector(mod.Spec.Selector)
+	selection, err := selectionFor(ctx, r.Client, mod.Namespace, mod.Spec.Selector, mod.Spec.ClusterSetRef)
 	if err != nil {
-		return ctrl.Result{}, fmt.Errorf("could not make selector from %v: %w", mod.Spec.Selector, err)
+		var selErr *selectionError
+		if !errors.As(err, &selErr) {
+			return ctrl.Result{}, fmt.Errorf("getting cluster selection: %w", err)
+		}
+		markStalled(&mod, selErr.reason, selErr.Error())
+		mod.Status.ObservedGeneration = mod.Generation
+		if err := r.Status().Update(ctx, &mod); err != nil {
+			return ctrl.Result{}, fmt.Errorf("updating status of bootstrap module: %w", err)
+		}
+		log.Error(err, "could not make cluster selection", "selector", mod.Spec.Selector, "clusterSetRef", mod.Spec.ClusterSetRef)
+		return ctrl.Result{}, nil
 	}
-	if err := r.List(ctx, &clusters, &client.ListOptions{
-		LabelSelector: selector,
-		Namespace:     mod.Namespace,
-	}); err != nil {
+	clusters, err := selection.list(ctx, r.Client, mod.Namespace)
+	if err != nil {
 		return ctrl.Result{}, fmt.Errorf("failed to list selected clusters: %w", err)
 	}
 
+	summary := &fleetv1.SyncSummary{}
+
 	namespacedClient := client.NewNamespacedClient(r.Client, mod.Namespace)
-	for _, cluster := range clusters.Items {
+	for _, cluster := range clusters {
+		// A cluster on its way out is no longer counted.
+		if cluster.GetDeletionTimestamp() != nil {
+			continue
+		}
+		summary.Total++
+		// A cluster that isn't eligible yet is waited for; if it
+		// already has a kustomization, that's left as it is.
+		if ok, reason := clusterEligible(cluster, mod.Spec.Eligibility); !ok {
+			log.V(1).Info("waiting for cluster to become eligible", "cluster", cluster.GetName(), "reason", reason)
+			summary.Pending++
+			continue
+		}
+		kubeconfigSecret, err := bootstrapKubeconfigSecret(ctx, r.Client, cluster)
+		if err != nil {
+			log.Error(err, "finding kubeconfig for cluster", "cluster", cluster.GetName())
+			summary.Failed++
+			continue
+		}
 		// start with CLUSTER_NAME available to use in bindings
 		memo := map[string]string{
-			"CLUSTER_NAME": cluster.Name,
+			"CLUSTER_NAME": cluster.GetName(),
 		}
 
 		var bindingErr error
@@ -137,6 +175,12 @@ func (r *BootstrapModuleReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 			return ctrl.Result{}, err
 		}
 		if bindingErr != nil {
+			markStalled(&mod, fleetv1.BindingFailedReason,
+				fmt.Sprintf("evaluating bindings for cluster %s: %s", cluster.GetName(), bindingErr))
+			mod.Status.ObservedGeneration = mod.Generation
+			if err := r.Status().Update(ctx, &mod); err != nil {
+				log.Error(err, "updating status of bootstrap module")
+			}
 			return ctrl.Result{}, bindingErr
 		}
 
@@ -153,12 +197,12 @@ func (r *BootstrapModuleReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 			// each kustomization is also owned by the cluster it
 			// targets, for the sake of good bookkeeping (and
 			// indexing)
-			if err := controllerutil.SetOwnerReference(&cluster, &kustom, r.Scheme); err != nil {
+			if err := controllerutil.SetOwnerReference(cluster, &kustom, r.Scheme); err != nil {
 				return err
 			}
 
 			kustom.Spec.KubeConfig = &kustomv1.KubeConfig{}
-			kustom.Spec.KubeConfig.SecretRef.Name = fmt.Sprintf("%s-kubeconfig", cluster.GetName())
+			kustom.Spec.KubeConfig.SecretRef.Name = kubeconfigSecret
 
 			return nil
 		})
@@ -168,22 +212,140 @@ func (r *BootstrapModuleReconciler) Reconcile(ctx context.Context, req ctrl.Requ
 		}
 
 		log.V(1).Info("created/updated kustomization", "name", kustom.GetName(), "operation", op)
+
+		// If the kustomization was just created or changed, its
+		// status is not for the current spec yet.
+		switch {
+		case op != controllerutil.OperationResultNone:
+			summary.Updating++
+		default:
+			incrementSummary(summary, syncapi.SyncStatus{State: kustomizationState(&kustom)})
+		}
 	}
 	// TODO find any rogue kustomizations and delete them
 
+	mod.Status.Summary = summary
+	mod.Status.ObservedSync = &mod.Spec.Sync
+	mod.Status.ObservedGeneration = mod.Generation
+	markFromSummary(&mod, summary)
+	if err := r.Status().Update(ctx, &mod); err != nil {
+		return ctrl.Result{}, fmt.Errorf("updating status of bootstrap module: %w", err)
+	}
+
 	return ctrl.Result{}, nil
 }
 
+// suspend suspends the GitRepository and Kustomizations created for
+// the module, without otherwise changing them, and reports each
+// Kustomization as suspended. No Kustomizations are created or
+// updated for newly selected clusters while the module is suspended.
+func (r *BootstrapModuleReconciler) suspend(ctx context.Context, log logr.Logger, mod *fleetv1.BootstrapModule) (ctrl.Result, error) {
+	var source sourcev1.GitRepository
+	if err := r.Get(ctx, client.ObjectKeyFromObject(mod), &source); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	} else if err == nil && metav1.IsControlledBy(&source, mod) && !source.Spec.Suspend {
+		patch := client.MergeFrom(source.DeepCopy())
+		source.Spec.Suspend = true
+		if err := r.Patch(ctx, &source, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+		log.Info("suspended GitRepository", "name", source.Name)
+	}
+
+	summary := &fleetv1.SyncSummary{}
+	var kustoms kustomv1.KustomizationList
+	if err := r.List(ctx, &kustoms, client.InNamespace(mod.Namespace)); err != nil {
+		return ctrl.Result{}, err
+	}
+	for i := range kustoms.Items {
+		kustom := &kustoms.Items[i]
+		if !metav1.IsControlledBy(kustom, mod) {
+			continue
+		}
+		summary.Total++
+		summary.Suspended++
+		if kustom.Spec.Suspend {
+			continue
+		}
+		patch := client.MergeFrom(kustom.DeepCopy())
+		kustom.Spec.Suspend = true
+		if err := r.Patch(ctx, kustom, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+		log.V(1).Info("suspended kustomization", "name", kustom.Name)
+	}
+
+	mod.Status.Summary = summary
+	mod.Status.ObservedGeneration = mod.Generation
+	markFromSummary(mod, summary)
+	if err := r.Status().Update(ctx, mod); err != nil {
+		return ctrl.Result{}, fmt.Errorf("updating status of bootstrap module: %w", err)
+	}
+	return ctrl.Result{}, nil
+}
+
+// kustomizationState interprets the Ready condition of a
+// Kustomization as a sync state.
+func kustomizationState(kustom *kustomv1.Kustomization) syncapi.SyncState {
+	c := apimeta.FindStatusCondition(kustom.Status.Conditions, meta.ReadyCondition)
+	switch {
+	case c == nil:
+		return syncapi.StateUpdating
+	case c.Status == metav1.ConditionTrue:
+		return syncapi.StateSucceeded
+	case c.Status == metav1.ConditionFalse && c.Reason == meta.ReconciliationFailedReason:
+		return syncapi.StateFailed
+	default:
+		return syncapi.StateUpdating
+	}
+}
+
+// bootstrapKubeconfigSecret gives the name of the secret holding the
+// kubeconfig for the cluster, which is either a Cluster or a Remote,
+// to be used by a Kustomization. The Kustomization expects the
+// kubeconfig to be under the same key as Cluster API uses, so a
+// Remote referring to a kubeconfig under another key can't be used;
+// nor can a Remote in pull mode, since there's no kubeconfig.
+func bootstrapKubeconfigSecret(ctx context.Context, c client.Reader, cluster client.Object) (string, error) {
+	target, ok := cluster.(*fleetv1.Remote)
+	if !ok {
+		return secret.Name(cluster.GetName(), secret.Kubeconfig), nil
+	}
+	if target.IsPull() {
+		return "", fmt.Errorf("bootstrap modules can't be applied to a remote in pull mode")
+	}
+	key, err := kubeconfigKeyFor(ctx, c, target.Namespace, target.Spec.KubeconfigRef)
+	if err != nil {
+		return "", err
+	}
+	if key.Key != fleetv1.DefaultKubeconfigKey {
+		return "", fmt.Errorf("bootstrap modules can only use a kubeconfig under the key %q", fleetv1.DefaultKubeconfigKey)
+	}
+	return key.Name, nil
+}
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *BootstrapModuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&fleetv1.BootstrapModule{}).
+		// Status changes in the kustomizations are reflected in the
+		// module status
+		Owns(&kustomv1.Kustomization{}).
 
 		// Enqueue all the BootstrapModule objects that pertain to a
 		// particular cluster
 		Watches(
 			&source.Kind{Type: &clusterv1.Cluster{}},
 			handler.EnqueueRequestsFromMapFunc(r.modulesForCluster)).
+		Watches(
+			&source.Kind{Type: &fleetv1.Remote{}},
+			handler.EnqueueRequestsFromMapFunc(r.modulesForCluster)).
+
+		// Enqueue the BootstrapModule objects that refer to a cluster
+		// set, when its membership changes.
+		Watches(
+			&source.Kind{Type: &fleetv1.ClusterSet{}},
+			handler.EnqueueRequestsFromMapFunc(r.modulesForClusterSet)).
 		Complete(r)
 }
 
@@ -198,19 +360,19 @@ func (r *BootstrapModuleReconciler) modulesForCluster(cluster client.Object) []r
 
 	var requests []reconcile.Request
 	for _, mod := range modules.Items {
-		if mod.Spec.Selector == nil {
+		if mod.Spec.Selector == nil && mod.Spec.ClusterSetRef == nil {
 			continue
 		}
 		name := types.NamespacedName{
 			Name:      mod.Name,
 			Namespace: mod.Namespace,
 		}
-		selector, err := metav1.LabelSelectorAsSelector(mod.Spec.Selector)
+		selection, err := selectionFor(ctx, r.Client, mod.Namespace, mod.Spec.Selector, mod.Spec.ClusterSetRef)
 		if err != nil {
-			r.Log.Error(err, "making selector for module", "module", name)
+			r.Log.Error(err, "making cluster selection for module", "module", name)
 			continue
 		}
-		if selector.Matches(labels.Set(cluster.GetLabels())) {
+		if selection.matches(cluster) {
 			requests = append(requests, reconcile.Request{
 				NamespacedName: name,
 			})
@@ -218,3 +380,25 @@ func (r *BootstrapModuleReconciler) modulesForCluster(cluster client.Object) []r
 	}
 	return requests
 }
+
+func (r *BootstrapModuleReconciler) modulesForClusterSet(set client.Object) []reconcile.Request {
+	ctx := context.Background()
+	var modules fleetv1.BootstrapModuleList
+	if err := r.List(ctx, &modules, client.InNamespace(set.GetNamespace())); err != nil {
+		r.Log.Error(err, "getting list of modules")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, mod := range modules.Items {
+		if ref := mod.Spec.ClusterSetRef; ref != nil && ref.Name == set.GetName() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name:      mod.Name,
+					Namespace: mod.Namespace,
+				},
+			})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+// ClusterSetReconciler reconciles a ClusterSet object, by working out
+// its members and recording them in its status.
+type ClusterSetReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=clustersets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=clustersets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=clustersets/finalizers,verbs=update
+//+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remotes,verbs=get;list;watch
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *ClusterSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("clusterset", req.NamespacedName)
+
+	var set fleetv1.ClusterSet
+	if err := r.Get(ctx, req.NamespacedName, &set); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	selector, err := metav1.LabelSelectorAsSelector(set.Spec.Selector)
+	if err != nil {
+		markStalled(&set, fleetv1.InvalidSelectorReason, err.Error())
+		set.Status.ObservedGeneration = set.Generation
+		if err := r.Status().Update(ctx, &set); err != nil {
+			return ctrl.Result{}, fmt.Errorf("updating status of cluster set: %w", err)
+		}
+		log.Error(err, "could not make selector", "selector", set.Spec.Selector)
+		return ctrl.Result{}, nil
+	}
+
+	clusters, err := listTargets(ctx, r.Client, client.InNamespace(set.Namespace))
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	listed := map[string]struct{}{}
+	for _, name := range set.Spec.Clusters {
+		listed[name] = struct{}{}
+	}
+	excluded := map[string]struct{}{}
+	for _, name := range set.Spec.Exclude {
+		excluded[name] = struct{}{}
+	}
+
+	members := []string{}
+	for _, cluster := range clusters {
+		name := cluster.GetName()
+		if _, ok := excluded[name]; ok {
+			continue
+		}
+		_, isListed := listed[name]
+		if isListed || selector.Matches(labels.Set(cluster.GetLabels())) {
+			members = append(members, name)
+		}
+		delete(listed, name)
+	}
+	sort.Strings(members)
+
+	set.Status.Members = members
+	set.Status.ObservedGeneration = set.Generation
+	message := fmt.Sprintf("%d clusters", len(members))
+	// anything left in `listed` was named but doesn't exist (or is
+	// excluded, which is not worth mentioning)
+	var missing int
+	for name := range listed {
+		if _, ok := excluded[name]; !ok {
+			missing++
+		}
+	}
+	if missing > 0 {
+		message = fmt.Sprintf("%s; %d listed clusters not found", message, missing)
+	}
+	markReady(&set, fleetv1.MembershipResolvedReason, message)
+	if err := r.Status().Update(ctx, &set); err != nil {
+		return ctrl.Result{}, fmt.Errorf("updating status of cluster set: %w", err)
+	}
+	log.V(1).Info("resolved cluster set", "members", len(members))
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClusterSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&fleetv1.ClusterSet{}).
+		// Any cluster coming, going or changing its labels may
+		// change the membership of the sets in its namespace.
+		Watches(
+			&source.Kind{Type: &clusterv1.Cluster{}},
+			handler.EnqueueRequestsFromMapFunc(r.setsForCluster)).
+		Watches(
+			&source.Kind{Type: &fleetv1.Remote{}},
+			handler.EnqueueRequestsFromMapFunc(r.setsForCluster)).
+		Complete(r)
+}
+
+func (r *ClusterSetReconciler) setsForCluster(cluster client.Object) []reconcile.Request {
+	ctx := context.Background()
+	var sets fleetv1.ClusterSetList
+	if err := r.List(ctx, &sets, client.InNamespace(cluster.GetNamespace())); err != nil {
+		r.Log.Error(err, "getting list of cluster sets")
+		return nil
+	}
+	requests := make([]reconcile.Request, len(sets.Items))
+	for i := range sets.Items {
+		requests[i] = reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Namespace: sets.Items[i].Namespace,
+				Name:      sets.Items[i].Name,
+			},
+		}
+	}
+	return requests
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/fluxcd/pkg/apis/meta"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+var _ = Describe("cluster sets", func() {
+	var (
+		manager     ctrl.Manager
+		stopManager func()
+		managerDone chan struct{}
+	)
+
+	BeforeEach(func() {
+		By("starting a controller manager")
+		var err error
+		manager, err = ctrl.NewManager(cfg, ctrl.Options{
+			Scheme: scheme.Scheme,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect((&ClusterSetReconciler{
+			Client: manager.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("ClusterSet"),
+			Scheme: manager.GetScheme(),
+		}).SetupWithManager(manager)).To(Succeed())
+		Expect((&ModuleReconciler{
+			Client: manager.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("Module"),
+			Scheme: manager.GetScheme(),
+		}).SetupWithManager(manager)).To(Succeed())
+
+		var ctx context.Context
+		ctx, stopManager = context.WithCancel(signalHandler)
+		managerDone = make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(manager.Start(ctx)).To(Succeed())
+			close(managerDone)
+		}()
+	})
+
+	AfterEach(func() {
+		stopManager()
+		<-managerDone
+	})
+
+	var (
+		namespace *corev1.Namespace
+		clusters  map[string]*clusterv1.Cluster
+	)
+
+	BeforeEach(func() {
+		namespace = &corev1.Namespace{}
+		namespace.Name = "ns-" + randString(5)
+		Expect(k8sClient.Create(context.TODO(), namespace)).To(Succeed())
+
+		clusters = map[string]*clusterv1.Cluster{}
+		for _, env := range []string{"production", "production", "staging"} {
+			cluster := &clusterv1.Cluster{}
+			cluster.Name = env + "-" + randString(5)
+			cluster.Namespace = namespace.Name
+			cluster.SetLabels(map[string]string{
+				"environment": env,
+			})
+			Expect(k8sClient.Create(context.TODO(), cluster)).To(Succeed())
+			clusters[cluster.Name] = cluster
+		}
+	})
+
+	AfterEach(func() {
+		Expect(k8sClient.Delete(context.TODO(), namespace)).To(Succeed())
+	})
+
+	It("combines selected and listed clusters, less exclusions", func() {
+		var production, staging []string
+		for name, cluster := range clusters {
+			if cluster.GetLabels()["environment"] == "production" {
+				production = append(production, name)
+			} else {
+				staging = append(staging, name)
+			}
+		}
+
+		set := fleetv1.ClusterSet{
+			Spec: fleetv1.ClusterSetSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"environment": "production"},
+				},
+				Clusters: []string{staging[0]},
+				Exclude:  []string{production[0]},
+			},
+		}
+		set.Namespace = namespace.Name
+		set.Name = "set-" + randString(5)
+		Expect(k8sClient.Create(context.TODO(), &set)).To(Succeed())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&set), &set)
+			return err == nil && set.Status.ObservedGeneration == set.Generation
+		}, "5s", "1s").Should(BeTrue())
+		Expect(set.Status.Members).To(ConsistOf(production[1], staging[0]))
+
+		// A module referring to the set is assigned to its members
+		mod := fleetv1.Module{
+			Spec: fleetv1.ModuleSpec{
+				ClusterSetRef: &fleetv1.LocalClusterSetReference{Name: set.Name},
+				Sync:          makeSync("https://github.com/cuttlefacts/app", "v0.1.0"),
+			},
+		}
+		mod.Namespace = namespace.Name
+		mod.Name = "mod-" + randString(5)
+		Expect(k8sClient.Create(context.TODO(), &mod)).To(Succeed())
+
+		for _, name := range set.Status.Members {
+			Eventually(func() bool {
+				var asm fleetv1.RemoteAssemblage
+				err := k8sClient.Get(context.TODO(), types.NamespacedName{
+					Namespace: namespace.Name,
+					Name:      name,
+				}, &asm)
+				return err == nil && len(asm.Spec.Assemblage.Syncs) == 1
+			}, "5s", "1s").Should(BeTrue())
+		}
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&mod), &mod)
+			return err == nil && mod.Status.Summary != nil && mod.Status.Summary.Total == 2
+		}, "5s", "1s").Should(BeTrue())
+
+		// Excluding another cluster removes it from the module
+		Eventually(func() error {
+			if err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&set), &set); err != nil {
+				return err
+			}
+			set.Spec.Exclude = append(set.Spec.Exclude, staging[0])
+			return k8sClient.Update(context.TODO(), &set)
+		}, "5s", "1s").Should(Succeed())
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&mod), &mod)
+			return err == nil && mod.Status.Summary != nil && mod.Status.Summary.Total == 1
+		}, "5s", "1s").Should(BeTrue())
+	})
+
+	It("does not allow both a selector and a cluster set", func() {
+		mod := fleetv1.Module{
+			Spec: fleetv1.ModuleSpec{
+				Selector:      &metav1.LabelSelector{},
+				ClusterSetRef: &fleetv1.LocalClusterSetReference{Name: "any"},
+				Sync:          makeSync("https://github.com/cuttlefacts/app", "v0.1.0"),
+			},
+		}
+		mod.Namespace = namespace.Name
+		mod.Name = "mod-" + randString(5)
+		Expect(k8sClient.Create(context.TODO(), &mod)).To(Succeed())
+
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&mod), &mod)
+			return err == nil && mod.Status.ObservedGeneration == mod.Generation
+		}, "5s", "1s").Should(BeTrue())
+		stalled := apimeta.FindStatusCondition(mod.Status.Conditions, meta.StalledCondition)
+		Expect(stalled).ToNot(BeNil())
+		Expect(stalled.Reason).To(Equal(fleetv1.InvalidSelectorReason))
+	})
+})
@@ -0,0 +1,178 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+)
+
+// clusterTransition records the state of a module's sync in a
+// cluster, and when it last changed.
+type clusterTransition struct {
+	state syncapi.SyncState
+	since metav1.Time
+}
+
+// transitionTracker remembers, for each module, the state in every
+// cluster and when it last changed. The status lists only some of the
+// clusters, so without this the transition time of a cluster left
+// out of the list would be lost. It's kept in memory; after a
+// restart, only the transition times of clusters in the status are
+// known.
+type transitionTracker struct {
+	mu      sync.Mutex
+	modules map[types.NamespacedName]map[string]clusterTransition
+}
+
+func newTransitionTracker() *transitionTracker {
+	return &transitionTracker{
+		modules: map[types.NamespacedName]map[string]clusterTransition{},
+	}
+}
+
+func (t *transitionTracker) get(mod types.NamespacedName) map[string]clusterTransition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.modules[mod]
+}
+
+func (t *transitionTracker) set(mod types.NamespacedName, transitions map[string]clusterTransition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.modules[mod] = transitions
+}
+
+func (t *transitionTracker) forget(mod types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.modules, mod)
+}
+
+// clusterStatuses accumulates the per-cluster entries for a module's
+// status. It keeps the transition time of an entry from before if the
+// state hasn't changed.
+type clusterStatuses struct {
+	previous map[string]clusterTransition
+	now      metav1.Time
+	entries  []fleetv1.ClusterSyncStatus
+}
+
+// newClusterStatuses starts the per-cluster entries, given the
+// entries in the previous status, and the transitions remembered for
+// all clusters, which take precedence.
+func newClusterStatuses(previous []fleetv1.ClusterSyncStatus, remembered map[string]clusterTransition, now time.Time) *clusterStatuses {
+	prev := make(map[string]clusterTransition, len(previous)+len(remembered))
+	for _, entry := range previous {
+		if entry.LastTransitionTime != nil {
+			prev[entry.Cluster] = clusterTransition{state: entry.State, since: *entry.LastTransitionTime}
+		}
+	}
+	for cluster, transition := range remembered {
+		prev[cluster] = transition
+	}
+	return &clusterStatuses{
+		previous: prev,
+		now:      metav1.NewTime(now),
+	}
+}
+
+// add records an entry for the cluster given. If `since` is nil, the
+// transition time is kept from before if the state is the same,
+// otherwise it is now.
+func (c *clusterStatuses) add(cluster string, state syncapi.SyncState, revision, message string, since *metav1.Time) {
+	entry := fleetv1.ClusterSyncStatus{
+		Cluster:  cluster,
+		State:    state,
+		Revision: revision,
+		Message:  message,
+	}
+	if since != nil {
+		entry.LastTransitionTime = since
+	} else if prev, ok := c.previous[cluster]; ok && prev.state == state {
+		t := prev.since
+		entry.LastTransitionTime = &t
+	} else {
+		t := c.now
+		entry.LastTransitionTime = &t
+	}
+	c.entries = append(c.entries, entry)
+}
+
+// transitions gives the state and transition time of every entry,
+// including those that won't make it into the list.
+func (c *clusterStatuses) transitions() map[string]clusterTransition {
+	transitions := make(map[string]clusterTransition, len(c.entries))
+	for _, entry := range c.entries {
+		transitions[entry.Cluster] = clusterTransition{state: entry.State, since: *entry.LastTransitionTime}
+	}
+	return transitions
+}
+
+// conflicted records the other syncs given as conflicting, against
+// the entry most recently added.
+func (c *clusterStatuses) conflicted(conflicts []syncapi.SyncConflict) {
+	entry := &c.entries[len(c.entries)-1]
+	for _, conflict := range conflicts {
+		entry.Conflicts = append(entry.Conflicts, conflict.Sync)
+	}
+}
+
+// list returns the entries sorted so that failures come first, then
+// clusters still being updated, then those held back (pending or
+// suspended), then everything else, and truncated
+// to fleetv1.MaxClusterStatuses.
+func (c *clusterStatuses) list() []fleetv1.ClusterSyncStatus {
+	entries := c.entries
+	sort.SliceStable(entries, func(i, j int) bool {
+		oi, oj := stateOrder(entries[i].State), stateOrder(entries[j].State)
+		if oi != oj {
+			return oi < oj
+		}
+		return entries[i].Cluster < entries[j].Cluster
+	})
+	if len(entries) > fleetv1.MaxClusterStatuses {
+		entries = entries[:fleetv1.MaxClusterStatuses]
+	}
+	return entries
+}
+
+func stateOrder(state syncapi.SyncState) int {
+	switch state {
+	case syncapi.StateFailed:
+		return 0
+	case syncapi.StateUpdating:
+		return 1
+	case fleetv1.StatePending, syncapi.StateSuspended:
+		return 2
+	case syncapi.StateSucceeded:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// syncRevision gives the revision applied for a sync, if known;
+// otherwise, the git tag or commit the sync refers to.
+func syncRevision(status *syncapi.SyncStatus) string {
+	if status.LastAppliedRevision != "" {
+		return status.LastAppliedRevision
+	}
+	sync := &status.Sync.Sync
+	if git := sync.Source.Git; git != nil {
+		if git.Version.Tag != "" {
+			return git.Version.Tag
+		}
+		return git.Version.Revision
+	}
+	return ""
+}
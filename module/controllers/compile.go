@@ -0,0 +1,557 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	"github.com/squaremo/fleeet/module/sharding"
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+	"github.com/squaremo/fleeet/pkg/apply"
+)
+
+// assemblageCompiler reconciles a cluster -- either a Cluster API
+// Cluster, or a Remote -- by compiling all the modules assigned to it
+// into the cluster's RemoteAssemblage. Doing
+// this per cluster, rather than per module, means each
+// RemoteAssemblage is written by one reconciliation at a time, and
+// all at once -- otherwise, each module would be racing to update
+// the same objects.
+type assemblageCompiler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+	Shard  *sharding.Shard
+}
+
+// compilerFieldManager is the field manager for the remote
+// assemblages applied by the compiler.
+const compilerFieldManager = "fleet-compiler"
+
+func (r *assemblageCompiler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("cluster", req.NamespacedName)
+
+	cluster, err := getTarget(ctx, r.Client, req.NamespacedName)
+	if err != nil {
+		// If the cluster has gone, the remote assemblage will be
+		// garbage collected, since it's owned by the cluster.
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	// Likewise if the cluster is being deleted; there's no point
+	// changing what's synced to it.
+	if cluster.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, nil
+	}
+
+	// If the cluster has a maintenance window, new or changed syncs
+	// can only be written while it's open. A window that can't be
+	// parsed is treated as closed, until it's fixed; syncs can still
+	// be removed or suspended. The error is recorded in the status of
+	// the remote assemblage.
+	now := time.Now()
+	windowOpen, nextWindow := true, time.Time{}
+	window, windowErr := maintenanceWindowFor(cluster)
+	switch {
+	case windowErr != nil:
+		log.Error(windowErr, "reading maintenance window")
+		windowOpen = false
+	case window != nil:
+		windowOpen, nextWindow = window.isOpen(now)
+	}
+
+	var modules fleetv1.ModuleList
+	if err := r.List(ctx, &modules, client.InNamespace(cluster.GetNamespace())); err != nil {
+		return ctrl.Result{}, fmt.Errorf("listing modules: %w", err)
+	}
+	// Sort the modules by name, so the syncs in the assemblage come
+	// out in the same order every time.
+	sort.Slice(modules.Items, func(i, j int) bool {
+		return modules.Items[i].Name < modules.Items[j].Name
+	})
+	// Modules may select clusters by referring to a cluster set.
+	var sets fleetv1.ClusterSetList
+	if err := r.List(ctx, &sets, client.InNamespace(cluster.GetNamespace())); err != nil {
+		return ctrl.Result{}, fmt.Errorf("listing cluster sets: %w", err)
+	}
+	setsByName := make(map[string]*fleetv1.ClusterSet, len(sets.Items))
+	for i := range sets.Items {
+		setsByName[sets.Items[i].Name] = &sets.Items[i]
+	}
+
+	asm := &fleetv1.RemoteAssemblage{}
+	asm.Namespace = cluster.GetNamespace()
+	asm.Name = cluster.GetName()
+	if err := r.Get(ctx, client.ObjectKeyFromObject(asm), asm); client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, fmt.Errorf("getting remote assemblage: %w", err)
+	}
+	// If the remote assemblage is on its way out, wait until it has
+	// gone (and its counterpart downstream with it) before making a
+	// new one.
+	if asm.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, nil
+	}
+	existing := map[string]syncapi.NamedSync{}
+	for _, sync := range asm.Spec.Assemblage.Syncs {
+		existing[sync.Name] = sync
+	}
+	reported := map[string]struct{}{}
+	for _, status := range asm.Status.Syncs {
+		reported[status.Sync.Name] = struct{}{}
+	}
+
+	var syncs []syncapi.NamedSync
+	// The modules to record as owners: those included, and those
+	// removed but still reported in the status (i.e., still being
+	// deleted downstream), so they hear about it when that's done.
+	var included []*fleetv1.Module
+	var heldBack bool
+	for i := range modules.Items {
+		mod := &modules.Items[i]
+		// A suspended module keeps whatever sync it already has in
+		// the assemblage, marked as suspended, and is not added to
+		// or removed from the cluster.
+		if mod.Spec.Suspend && mod.GetDeletionTimestamp() == nil {
+			if prev, ok := existing[mod.Name]; ok {
+				prev.Suspend = true
+				syncs = append(syncs, prev)
+				included = append(included, mod)
+			} else if _, ok := reported[mod.Name]; ok {
+				included = append(included, mod)
+			}
+			continue
+		}
+		if !moduleSelectsCluster(mod, cluster, setsByName) || mod.GetDeletionTimestamp() != nil {
+			if _, ok := reported[mod.Name]; ok {
+				included = append(included, mod)
+			}
+			continue
+		}
+		// A cluster that isn't eligible for the module yet is waited
+		// for, leaving whatever is already there.
+		if ok, reason := clusterEligible(cluster, mod.Spec.Eligibility); !ok {
+			log.V(1).Info("waiting for cluster to become eligible", "module", mod.Name, "reason", reason)
+			if prev, ok := existing[mod.Name]; ok {
+				syncs = append(syncs, prev)
+				included = append(included, mod)
+			}
+			continue
+		}
+		sync, err := syncForCluster(ctx, r.Client, mod, cluster)
+		if err != nil {
+			// Leave the previous version of the sync in place, if
+			// there is one. The module status will report the error.
+			log.Error(err, "specialising sync for cluster", "module", mod.Name)
+			if prev, ok := existing[mod.Name]; ok {
+				syncs = append(syncs, prev)
+				included = append(included, mod)
+			}
+			continue
+		}
+		// A new or changed sync waits until the module's
+		// dependencies have synced successfully in the cluster.
+		if unready := unreadyDependencies(mod, asm); len(unready) > 0 {
+			if prev, ok := existing[mod.Name]; !ok || !equality.Semantic.DeepEqual(prev, sync) {
+				log.V(1).Info("waiting for dependencies", "module", mod.Name, "dependencies", unready)
+				if ok {
+					syncs = append(syncs, prev)
+					included = append(included, mod)
+				}
+				continue
+			}
+		}
+		if !windowOpen {
+			prev, ok := existing[mod.Name]
+			if !ok || !equality.Semantic.DeepEqual(prev, sync) {
+				heldBack = true
+				log.V(1).Info("waiting for maintenance window", "module", mod.Name, "opens", nextWindow)
+				if ok {
+					syncs = append(syncs, prev)
+					included = append(included, mod)
+				}
+				continue
+			}
+		}
+		syncs = append(syncs, sync)
+		included = append(included, mod)
+	}
+
+	// Don't keep an assemblage with nothing in it, once everything
+	// that was in it has been removed downstream; deleting it removes
+	// its counterpart downstream. Likewise, don't create an
+	// assemblage just to have nothing in it.
+	if len(syncs) == 0 && len(included) == 0 {
+		if asm.GetUID() != "" {
+			log.V(1).Info("deleting empty assemblage", "assemblage", asm.Name)
+			if err := r.Delete(ctx, asm); client.IgnoreNotFound(err) != nil {
+				return ctrl.Result{}, fmt.Errorf("deleting remote assemblage: %w", err)
+			}
+		}
+	} else {
+		// The remote assemblage is constructed afresh and applied,
+		// so that only the fields set here are owned by this
+		// controller, and any set by others are left alone.
+		applied := &fleetv1.RemoteAssemblage{}
+		applied.Namespace = asm.Namespace
+		applied.Name = asm.Name
+		// Each RemoteAssemblage is _specially_ owned by the cluster
+		// to which it pertains. This is so that removing the cluster
+		// will garbage collect the remote assemblage.
+		if err := controllerutil.SetControllerReference(cluster, applied, r.Scheme); err != nil {
+			return ctrl.Result{}, err
+		}
+		// Each RemoteAssemblage is also owned by each of the modules
+		// assigned to it. This is for the sake of indexing. Since the
+		// owner references are applied, those for modules no longer
+		// included are removed.
+		for _, mod := range included {
+			if err := controllerutil.SetOwnerReference(mod, applied, r.Scheme); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		// The cluster's labels are copied to the assemblage, so it
+		// can be sharded the same way as the cluster.
+		if clusterLabels := cluster.GetLabels(); len(clusterLabels) > 0 {
+			applied.Labels = map[string]string{}
+			for k, v := range clusterLabels {
+				applied.Labels[k] = v
+			}
+		}
+		applied.Spec.KubeconfigRef = kubeconfigRefFor(cluster)
+		applied.Spec.Assemblage.Syncs = syncs
+
+		op, err := apply.Apply(ctx, r.Client, applied, compilerFieldManager)
+		// This is the remote assemblage as it stands, to which the
+		// conditions below are written.
+		current := applied
+		var statusChanged bool
+		switch {
+		case apply.IsConflict(err):
+			// This is reported in the status of the remote
+			// assemblage, and thereby of the modules; there's no
+			// point retrying until something changes, and any
+			// change to the remote assemblage will be seen.
+			log.Info("field conflict applying remote assemblage", "assemblage", asm.Name, "error", err.Error())
+			current = asm
+			apimeta.SetStatusCondition(&current.Status.Conditions, metav1.Condition{
+				Type:    fleetv1.FieldConflictCondition,
+				Status:  metav1.ConditionTrue,
+				Reason:  fleetv1.FieldConflictReason,
+				Message: err.Error(),
+			})
+			statusChanged = true
+		case err != nil:
+			return ctrl.Result{}, fmt.Errorf("applying remote assemblage: %w", err)
+		default:
+			log.V(1).Info("compiled assemblage", "assemblage", asm.Name, "operation", op, "syncs", len(syncs))
+			if apimeta.FindStatusCondition(current.Status.Conditions, fleetv1.FieldConflictCondition) != nil {
+				apimeta.RemoveStatusCondition(&current.Status.Conditions, fleetv1.FieldConflictCondition)
+				statusChanged = true
+			}
+		}
+		if setWindowCondition(current, windowErr) {
+			statusChanged = true
+		}
+		if statusChanged {
+			if err := r.Status().Update(ctx, current); err != nil {
+				return ctrl.Result{}, fmt.Errorf("updating status of remote assemblage: %w", err)
+			}
+		}
+	}
+
+	if heldBack && !nextWindow.IsZero() {
+		return ctrl.Result{RequeueAfter: nextWindow.Sub(now)}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// moduleSelectsCluster reports whether the module's selector, or the
+// cluster set it refers to, matches the cluster. A missing or invalid
+// selector matches nothing, as does a missing cluster set.
+func moduleSelectsCluster(mod *fleetv1.Module, cluster metav1.Object, sets map[string]*fleetv1.ClusterSet) bool {
+	if ref := mod.Spec.ClusterSetRef; ref != nil {
+		set, ok := sets[ref.Name]
+		if !ok || mod.Spec.Selector != nil {
+			return false
+		}
+		return setSelection(set).matches(cluster)
+	}
+	if mod.Spec.Selector == nil {
+		return false
+	}
+	selector, err := metav1.LabelSelectorAsSelector(mod.Spec.Selector)
+	if err != nil {
+		return false
+	}
+	return selector.Matches(labels.Set(cluster.GetLabels()))
+}
+
+// fieldConflicted reports whether the syncs compiled for the remote
+// assemblage could not be applied to it because of a field conflict,
+// along with the message saying which fields.
+func fieldConflicted(asm *fleetv1.RemoteAssemblage) (bool, string) {
+	c := apimeta.FindStatusCondition(asm.Status.Conditions, fleetv1.FieldConflictCondition)
+	if c == nil || c.Status != metav1.ConditionTrue {
+		return false, ""
+	}
+	return true, c.Message
+}
+
+// setWindowCondition records in the status of the remote assemblage
+// the error from reading the cluster's maintenance window, if there
+// was one, or removes it if not. It reports whether the status was
+// changed.
+func setWindowCondition(asm *fleetv1.RemoteAssemblage, windowErr error) bool {
+	if windowErr == nil {
+		if apimeta.FindStatusCondition(asm.Status.Conditions, fleetv1.InvalidMaintenanceWindowCondition) == nil {
+			return false
+		}
+		apimeta.RemoveStatusCondition(&asm.Status.Conditions, fleetv1.InvalidMaintenanceWindowCondition)
+		return true
+	}
+	prev := apimeta.FindStatusCondition(asm.Status.Conditions, fleetv1.InvalidMaintenanceWindowCondition)
+	if prev != nil && prev.Status == metav1.ConditionTrue && prev.Message == windowErr.Error() {
+		return false
+	}
+	apimeta.SetStatusCondition(&asm.Status.Conditions, metav1.Condition{
+		Type:    fleetv1.InvalidMaintenanceWindowCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  fleetv1.InvalidMaintenanceWindowReason,
+		Message: windowErr.Error(),
+	})
+	return true
+}
+
+// syncForCluster specialises the module's sync for a particular
+// cluster, by evaluating the control plane bindings and putting the
+// values, along with the sync's own bindings, in the result, then
+// applying any overrides for the cluster.
+func syncForCluster(ctx context.Context, c client.Client, mod *fleetv1.Module, cluster metav1.Object) (syncapi.NamedSync, error) {
+	// Used to get any resources mentioned in controlPlaneBindings
+	namespacedClient := client.NewNamespacedClient(c, mod.Namespace)
+
+	// Evaluate all the control-plane bindings. This is the
+	// naive approach -- better would be to run through the
+	// bindings in the sync and see which control plane
+	// bindings are actually used -- but this will do for now.
+
+	// start with CLUSTER_NAME available to use in bindings
+	memo := map[string]string{
+		"CLUSTER_NAME": cluster.GetName(),
+	}
+
+	var bindingErr error
+	var makeBindingFunc func(stack []string) func(string) string
+	makeBindingFunc = func(stack []string) func(string) string {
+		return func(name string) string {
+			for i := range stack {
+				if stack[i] == name {
+					bindingErr = fmt.Errorf("circular binding %q", name)
+					return ""
+				}
+			}
+
+			if v, ok := memo[name]; ok {
+				return v
+			}
+			for _, b := range mod.Spec.ControlPlaneBindings {
+				if b.Name == name {
+					v, err := syncapi.ResolveBinding(ctx, namespacedClient, b, makeBindingFunc(append(stack, name)))
+					if err != nil {
+						bindingErr = err
+						v = ""
+					}
+					memo[name] = v
+					return v
+				}
+			}
+			memo[name] = ""
+			return ""
+		}
+	}
+
+	// The loop following is for the side-effect of filling out
+	// the map of values (and to see if there are errors). Since
+	// the map will be used to add to target-side bindings, I need
+	// to know if CLUSTER_NAME is explicitly named as a
+	// controlPlaneBinding and therefore should be included.
+	var clusterNameExplicitBinding bool
+	for _, binding := range mod.Spec.ControlPlaneBindings {
+		if binding.Name == "CLUSTER_NAME" {
+			clusterNameExplicitBinding = true
+		}
+		bindingErr = nil
+		// this pulls the binding through memoisation
+		makeBindingFunc(nil)(binding.Name)
+		if bindingErr != nil {
+			return syncapi.NamedSync{}, fmt.Errorf("evaluating binding %q for cluster %s: %w", binding.Name, cluster.GetName(), bindingErr)
+		}
+	}
+
+	var bindingsFromControlPlane []syncapi.Binding
+	for k, v := range memo {
+		if k == "CLUSTER_NAME" && !clusterNameExplicitBinding {
+			continue
+		}
+		bindingsFromControlPlane = append(bindingsFromControlPlane, syncapi.Binding{
+			Name: k,
+			BindingSource: syncapi.BindingSource{
+				StringValue: &syncapi.StringValue{
+					Value: v,
+				},
+			},
+		})
+	}
+	// These are all evaluated ahead of time, so their order doesn't
+	// matter to the result; but sorting them means the sync comes
+	// out the same each time, so it can be compared.
+	sort.Slice(bindingsFromControlPlane, func(i, j int) bool {
+		return bindingsFromControlPlane[i].Name < bindingsFromControlPlane[j].Name
+	})
+
+	sync := syncapi.NamedSync{
+		Name:           mod.Name,
+		Sync:           mod.Spec.Sync.Sync,
+		Bindings:       append(bindingsFromControlPlane, mod.Spec.Sync.Bindings...),
+		DeletionPolicy: mod.Spec.DeletionPolicy,
+		ConflictPolicy: mod.Spec.ConflictPolicy,
+		Drift:          mod.Spec.Drift.DeepCopy(),
+	}
+
+	overrides, err := overridesForCluster(mod, cluster)
+	if err != nil {
+		return syncapi.NamedSync{}, err
+	}
+	if len(overrides) > 0 {
+		// Overrides change the sync in place, so it mustn't share
+		// anything with the module.
+		sync.Sync = *mod.Spec.Sync.Sync.DeepCopy()
+		applyOverrides(&sync, overrides)
+	}
+	return sync, nil
+}
+
+func (r *assemblageCompiler) setupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("assemblagecompiler").
+		For(&clusterv1.Cluster{}, builder.WithPredicates(r.Shard.Predicate())).
+		// Remotes are compiled in the same way as Clusters; they
+		// share names, so a Remote and a Cluster with the same name
+		// are the same request (and the Cluster wins).
+		Watches(
+			&source.Kind{Type: &fleetv1.Remote{}},
+			&handler.EnqueueRequestForObject{},
+			builder.WithPredicates(r.Shard.Predicate())).
+		// The RemoteAssemblage for a cluster is controller-owned
+		// by the cluster; this will put it back if it's changed by
+		// something else.
+		Owns(&fleetv1.RemoteAssemblage{}, builder.WithPredicates(r.Shard.Predicate())).
+		Watches(
+			&source.Kind{Type: &fleetv1.RemoteAssemblage{}},
+			&handler.EnqueueRequestForOwner{
+				OwnerType:    &fleetv1.Remote{},
+				IsController: true,
+			},
+			builder.WithPredicates(r.Shard.Predicate())).
+		// Enqueue the clusters to which a module may now, or may
+		// previously, have been assigned.
+		Watches(
+			&source.Kind{Type: &fleetv1.Module{}},
+			handler.EnqueueRequestsFromMapFunc(r.clustersForModule)).
+		// Enqueue the members of a cluster set. This is called with
+		// both the old and new versions of a changed set, so clusters
+		// that have left the set are included.
+		Watches(
+			&source.Kind{Type: &fleetv1.ClusterSet{}},
+			handler.EnqueueRequestsFromMapFunc(r.clustersForClusterSet)).
+		Complete(r)
+}
+
+// clustersForClusterSet gives the clusters in this shard that are
+// members of the cluster set.
+func (r *assemblageCompiler) clustersForClusterSet(obj client.Object) []reconcile.Request {
+	set, ok := obj.(*fleetv1.ClusterSet)
+	if !ok {
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, name := range set.Status.Members {
+		key := types.NamespacedName{
+			Namespace: set.Namespace,
+			Name:      name,
+		}
+		cluster, err := getTarget(context.Background(), r.Client, key)
+		if err != nil || !r.Shard.Owns(cluster) {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: key})
+	}
+	return requests
+}
+
+// clustersForModule gives the clusters in this shard that are
+// selected by the module, as well as those with an assemblage
+// including it (which may no longer be selected).
+func (r *assemblageCompiler) clustersForModule(obj client.Object) []reconcile.Request {
+	ctx := context.Background()
+	mod, ok := obj.(*fleetv1.Module)
+	if !ok {
+		return nil
+	}
+
+	names := map[string]struct{}{}
+	if selection, err := selectionFor(ctx, r.Client, mod.Namespace, mod.Spec.Selector, mod.Spec.ClusterSetRef); err == nil {
+		clusters, err := selection.list(ctx, r.Client, mod.Namespace)
+		if err != nil {
+			r.Log.Error(err, "listing clusters for module", "module", mod.Name)
+		}
+		for _, cluster := range clusters {
+			if r.Shard.Owns(cluster) {
+				names[cluster.GetName()] = struct{}{}
+			}
+		}
+	}
+
+	var asms fleetv1.RemoteAssemblageList
+	if err := r.List(ctx, &asms, client.InNamespace(mod.Namespace), client.MatchingFields{assemblageOwnerKey: mod.Name}); err != nil {
+		r.Log.Error(err, "listing assemblages for module", "module", mod.Name)
+	}
+	for i := range asms.Items {
+		// the assemblage has the same name as the cluster
+		if r.Shard.Owns(&asms.Items[i]) {
+			names[asms.Items[i].Name] = struct{}{}
+		}
+	}
+
+	var requests []reconcile.Request
+	for name := range names {
+		requests = append(requests, reconcile.Request{
+			NamespacedName: types.NamespacedName{
+				Namespace: mod.Namespace,
+				Name:      name,
+			},
+		})
+	}
+	return requests
+}
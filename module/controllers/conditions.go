@@ -0,0 +1,67 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+// These set the kstatus conditions (Ready, Reconciling, Stalled)
+// together, so that they are always consistent with one another.
+
+// markReady records that the object has reached its desired state.
+func markReady(obj meta.ObjectWithStatusConditions, reason, message string) {
+	meta.SetResourceCondition(obj, meta.ReadyCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.ReconcilingCondition)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.StalledCondition)
+}
+
+// markReconciling records that the object is progressing towards
+// its desired state, but is not there yet.
+func markReconciling(obj meta.ObjectWithStatusConditions, reason, message string) {
+	meta.SetResourceCondition(obj, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	meta.SetResourceCondition(obj, meta.ReconcilingCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.StalledCondition)
+}
+
+// markStalled records that the object cannot make progress towards
+// its desired state, e.g., because of an error in the spec or a
+// failure downstream.
+func markStalled(obj meta.ObjectWithStatusConditions, reason, message string) {
+	meta.SetResourceCondition(obj, meta.ReadyCondition, metav1.ConditionFalse, reason, message)
+	meta.SetResourceCondition(obj, meta.StalledCondition, metav1.ConditionTrue, reason, message)
+	apimeta.RemoveStatusCondition(obj.GetStatusConditions(), meta.ReconcilingCondition)
+}
+
+// markFromSummary sets the conditions according to the states
+// counted in the summary given.
+func markFromSummary(obj meta.ObjectWithStatusConditions, summary *fleetv1.SyncSummary) {
+	switch {
+	case summary.Failed > 0:
+		markStalled(obj, fleetv1.SyncFailedReason,
+			fmt.Sprintf("%d of %d clusters failed", summary.Failed, summary.Total))
+	case summary.Conflicted > 0:
+		markStalled(obj, fleetv1.SyncConflictReason,
+			fmt.Sprintf("%d of %d clusters have conflicting syncs", summary.Conflicted, summary.Total))
+	case summary.Unreachable > 0:
+		markReconciling(obj, fleetv1.ClusterUnreachableReason,
+			fmt.Sprintf("%d of %d clusters unreachable", summary.Unreachable, summary.Total))
+	case summary.Updating > 0 || summary.Pending > 0:
+		markReconciling(obj, fleetv1.RolloutInProgressReason,
+			fmt.Sprintf("%d of %d clusters synced", summary.Succeeded, summary.Total))
+	case summary.Suspended > 0:
+		markReady(obj, fleetv1.SuspendedReason,
+			fmt.Sprintf("%d of %d clusters synced, %d suspended", summary.Succeeded, summary.Total, summary.Suspended))
+	default:
+		markReady(obj, fleetv1.SyncSucceededReason,
+			fmt.Sprintf("%d of %d clusters synced", summary.Succeeded, summary.Total))
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+)
+
+// unreadyDependencies gives the names of the module's dependencies
+// that have not synced successfully, according to the status of the
+// assemblage given (which may be nil, meaning nothing has synced).
+func unreadyDependencies(mod *fleetv1.Module, asm *fleetv1.RemoteAssemblage) []string {
+	succeeded := map[string]struct{}{}
+	if asm != nil {
+		for _, status := range asm.Status.Syncs {
+			if status.State == syncapi.StateSucceeded {
+				succeeded[status.Sync.Name] = struct{}{}
+			}
+		}
+	}
+	var unready []string
+	for _, dep := range mod.Spec.DependsOn {
+		if _, ok := succeeded[dep.Name]; !ok {
+			unready = append(unready, dep.Name)
+		}
+	}
+	return unready
+}
+
+// dependencyCycle looks for a chain of dependencies leading from the
+// module back to itself, among the modules given. It returns the
+// names along the chain, starting and ending with the module, or nil
+// if there is no such chain.
+func dependencyCycle(mod *fleetv1.Module, modules []fleetv1.Module) []string {
+	byName := make(map[string]*fleetv1.Module, len(modules))
+	for i := range modules {
+		byName[modules[i].Name] = &modules[i]
+	}
+	// use the module as given, which may be newer than the one in
+	// the list
+	byName[mod.Name] = mod
+
+	visited := map[string]struct{}{}
+	var visit func(name string, path []string) []string
+	visit = func(name string, path []string) []string {
+		m, ok := byName[name]
+		if !ok {
+			return nil
+		}
+		for _, dep := range m.Spec.DependsOn {
+			if dep.Name == mod.Name {
+				return append(path, dep.Name)
+			}
+			if _, ok := visited[dep.Name]; ok {
+				continue
+			}
+			visited[dep.Name] = struct{}{}
+			if cycle := visit(dep.Name, append(path, dep.Name)); cycle != nil {
+				return cycle
+			}
+		}
+		return nil
+	}
+	return visit(mod.Name, []string{mod.Name})
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+// clusterEligible reports whether the cluster, which is either a
+// Cluster or a Remote, meets the criteria given (which may be nil),
+// and if not, why not. A cluster that is being deleted is never
+// eligible. A Remote has no phase, so is never in one of the phases
+// given.
+func clusterEligible(cluster client.Object, criteria *fleetv1.ClusterEligibility) (bool, string) {
+	if cluster.GetDeletionTimestamp() != nil {
+		return false, "cluster is being deleted"
+	}
+	if criteria == nil {
+		return true, ""
+	}
+	for _, condType := range criteria.Conditions {
+		if !targetConditionTrue(cluster, condType) {
+			return false, fmt.Sprintf("condition %s is not True", condType)
+		}
+	}
+	if len(criteria.Phases) > 0 {
+		var phase string
+		if c, ok := cluster.(*clusterv1.Cluster); ok {
+			phase = c.Status.Phase
+		}
+		for _, p := range criteria.Phases {
+			if p == phase {
+				return true, ""
+			}
+		}
+		return false, fmt.Sprintf("phase %q is not one of %s", phase, strings.Join(criteria.Phases, ", "))
+	}
+	return true, ""
+}
+
+// targetConditionTrue reports whether the Cluster or Remote has the
+// condition given, with a status of True.
+func targetConditionTrue(target client.Object, condType string) bool {
+	switch t := target.(type) {
+	case *clusterv1.Cluster:
+		return clusterConditionTrue(t, condType)
+	case *fleetv1.Remote:
+		return apimeta.IsStatusConditionTrue(t.Status.Conditions, condType)
+	}
+	return false
+}
+
+// clusterConditionTrue reports whether the cluster has the condition
+// given, with a status of True.
+func clusterConditionTrue(cluster *clusterv1.Cluster, condType string) bool {
+	for _, c := range cluster.Status.Conditions {
+		if string(c.Type) == condType {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	// Not every provider sets conditions, but these two are also
+	// recorded as fields in the status.
+	switch clusterv1.ConditionType(condType) {
+	case clusterv1.ControlPlaneReadyCondition:
+		return cluster.Status.ControlPlaneReady
+	case clusterv1.InfrastructureReadyCondition:
+		return cluster.Status.InfrastructureReady
+	}
+	return false
+}
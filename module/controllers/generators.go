@@ -0,0 +1,274 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	"github.com/squaremo/fleeet/pkg/expansion"
+)
+
+// These are the names of the parameters given by the generators.
+const (
+	labelValueParam    = "LABEL_VALUE"
+	directoryPathParam = "DIRECTORY_PATH"
+	directoryNameParam = "DIRECTORY_NAME"
+)
+
+// generatorError is returned when a generator can't produce
+// parameters, and trying again won't help until something changes;
+// either the module set, or (for ArtifactUnavailableReason) the
+// source it refers to.
+type generatorError struct {
+	reason string
+	err    error
+}
+
+func (e *generatorError) Error() string {
+	return e.err.Error()
+}
+
+func (e *generatorError) Unwrap() error {
+	return e.err
+}
+
+// generateParams runs each of the module set's generators, and
+// returns all the sets of parameters they give.
+func generateParams(ctx context.Context, c client.Reader, set *fleetv1.ModuleSet) ([]map[string]string, error) {
+	var params []map[string]string
+	for i, gen := range set.Spec.Generators {
+		var (
+			more []map[string]string
+			err  error
+		)
+		switch {
+		case gen.List != nil:
+			more = gen.List.Elements
+		case gen.Cluster != nil:
+			more, err = clusterParams(ctx, c, set.Namespace, gen.Cluster)
+		case gen.GitDirectory != nil:
+			more, err = gitDirectoryParams(ctx, c, set.Namespace, gen.GitDirectory)
+		default:
+			err = &generatorError{
+				reason: fleetv1.GeneratorFailedReason,
+				err:    fmt.Errorf("generator %d gives none of list, cluster or gitDirectory", i),
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, more...)
+	}
+	return params, nil
+}
+
+// clusterParams gives a set of parameters for each distinct value of
+// the label, among the clusters selected.
+func clusterParams(ctx context.Context, c client.Reader, namespace string, gen *fleetv1.ClusterGenerator) ([]map[string]string, error) {
+	selector := labels.Everything()
+	if gen.Selector != nil {
+		s, err := metav1.LabelSelectorAsSelector(gen.Selector)
+		if err != nil {
+			return nil, &generatorError{
+				reason: fleetv1.GeneratorFailedReason,
+				err:    fmt.Errorf("cluster generator: %w", err),
+			}
+		}
+		selector = s
+	}
+	clusters, err := listTargets(ctx, c, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector})
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]struct{}{}
+	for _, cluster := range clusters {
+		if cluster.GetDeletionTimestamp() != nil {
+			continue
+		}
+		if v, ok := cluster.GetLabels()[gen.Label]; ok {
+			values[v] = struct{}{}
+		}
+	}
+	params := make([]map[string]string, 0, len(values))
+	for v := range values {
+		params = append(params, map[string]string{labelValueParam: v})
+	}
+	sort.Slice(params, func(i, j int) bool {
+		return params[i][labelValueParam] < params[j][labelValueParam]
+	})
+	return params, nil
+}
+
+// gitDirectoryParams gives a set of parameters for each directory
+// matching the pattern, in the artifact of the GitRepository referred
+// to.
+func gitDirectoryParams(ctx context.Context, c client.Reader, namespace string, gen *fleetv1.GitDirectoryGenerator) ([]map[string]string, error) {
+	if _, err := path.Match(gen.Path, ""); err != nil {
+		return nil, &generatorError{
+			reason: fleetv1.GeneratorFailedReason,
+			err:    fmt.Errorf("git directory generator: invalid path %q: %w", gen.Path, err),
+		}
+	}
+
+	var repo sourcev1.GitRepository
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: gen.SourceRef.Name}, &repo); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, &generatorError{
+				reason: fleetv1.ArtifactUnavailableReason,
+				err:    fmt.Errorf("git repository %q not found", gen.SourceRef.Name),
+			}
+		}
+		return nil, err
+	}
+	artifact := repo.GetArtifact()
+	if artifact == nil {
+		return nil, &generatorError{
+			reason: fleetv1.ArtifactUnavailableReason,
+			err:    fmt.Errorf("git repository %q has no artifact yet", gen.SourceRef.Name),
+		}
+	}
+
+	dirs, err := fetchArtifactDirectories(ctx, artifact.URL)
+	if err != nil {
+		return nil, fmt.Errorf("getting artifact for git repository %q: %w", gen.SourceRef.Name, err)
+	}
+	var params []map[string]string
+	for _, dir := range dirs {
+		if ok, _ := path.Match(gen.Path, dir); ok {
+			params = append(params, map[string]string{
+				directoryPathParam: dir,
+				directoryNameParam: path.Base(dir),
+			})
+		}
+	}
+	return params, nil
+}
+
+// fetchArtifactDirectories downloads the artifact (a gzipped
+// tarball) from the URL given, and returns the directories in it.
+func fetchArtifactDirectories(ctx context.Context, url string) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return tarballDirectories(resp.Body)
+}
+
+// tarballDirectories reads a gzipped tarball and returns the paths of
+// all the directories in it, sorted. Tarballs don't always have
+// entries for directories, so the directories of files are included
+// too.
+func tarballDirectories(r io.Reader) ([]string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	found := map[string]struct{}{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "/"))
+		dir := path.Dir(name)
+		if hdr.Typeflag == tar.TypeDir {
+			dir = name
+		}
+		for dir != "." && dir != "/" {
+			found[dir] = struct{}{}
+			dir = path.Dir(dir)
+		}
+	}
+
+	dirs := make([]string, 0, len(found))
+	for dir := range found {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// moduleFromTemplate makes a module from the module set's template,
+// by expanding references to the parameters given in every string
+// value. References to anything other than the parameters are left
+// as they are, so e.g., bindings still work.
+func moduleFromTemplate(set *fleetv1.ModuleSet, params map[string]string) (*fleetv1.Module, error) {
+	// The easiest way to get at every string value is to go via
+	// JSON.
+	data, err := json.Marshal(set.Spec.Template)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	generic = expandStrings(generic, expansion.MappingFuncFor(params))
+	if data, err = json.Marshal(generic); err != nil {
+		return nil, err
+	}
+	var tmpl fleetv1.ModuleTemplate
+	if err := json.Unmarshal(data, &tmpl); err != nil {
+		return nil, err
+	}
+
+	mod := &fleetv1.Module{}
+	mod.Namespace = set.Namespace
+	mod.Name = tmpl.Metadata.Name
+	mod.Labels = tmpl.Metadata.Labels
+	mod.Annotations = tmpl.Metadata.Annotations
+	mod.Spec = tmpl.Spec
+	return mod, nil
+}
+
+func expandStrings(value interface{}, mapping func(string) string) interface{} {
+	switch v := value.(type) {
+	case string:
+		return expansion.Expand(v, mapping)
+	case map[string]interface{}:
+		for k := range v {
+			v[k] = expandStrings(v[k], mapping)
+		}
+		return v
+	case []interface{}:
+		for i := range v {
+			v[i] = expandStrings(v[i], mapping)
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+// InventoryObjectKey is the name of the index on the objects that
+// remote assemblages report as applied downstream. Each object is
+// identified as "Kind/namespace/name", or "Kind/name" for cluster-scoped
+// objects, as in the inventory of each sync's status.
+//
+// The objects are only listed in the status if the assemblage
+// controller downstream is run with --list-inventory-objects, and
+// only up to a limit; otherwise, there's nothing to index.
+const InventoryObjectKey = "inventoryObject"
+
+// indexInventoryObjects gives the objects in the inventory of each
+// sync in the remote assemblage's status.
+func indexInventoryObjects(obj client.Object) []string {
+	asm := obj.(*fleetv1.RemoteAssemblage)
+	var objects []string
+	for _, sync := range asm.Status.Syncs {
+		if sync.Inventory == nil {
+			continue
+		}
+		objects = append(objects, sync.Inventory.Objects...)
+	}
+	return objects
+}
+
+// RemoteAssemblagesApplying lists the remote assemblages that report
+// having applied the object given, identified as for
+// InventoryObjectKey. The client must read from a cache with the
+// index set up, as it is by RemoteAssemblageReconciler.
+func RemoteAssemblagesApplying(ctx context.Context, c client.Reader, objectID string, opts ...client.ListOption) ([]fleetv1.RemoteAssemblage, error) {
+	var asms fleetv1.RemoteAssemblageList
+	opts = append(opts, client.MatchingFields{InventoryObjectKey: objectID})
+	if err := c.List(ctx, &asms, opts...); err != nil {
+		return nil, err
+	}
+	return asms.Items, nil
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"sigs.k8s.io/cluster-api/util/secret"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	"github.com/squaremo/fleeet/module/remote"
+)
+
+// kubeconfigKeyFor works out the secret, and the key in it, holding
+// the kubeconfig referred to from the namespace given. A reference to
+// a Remote is followed to the kubeconfig it refers to; a reference to
+// a Cluster gives the secret created by Cluster API for the cluster.
+func kubeconfigKeyFor(ctx context.Context, c client.Reader, namespace string, ref fleetv1.LocalKubeconfigReference) (remote.KubeconfigKey, error) {
+	if ref.Name == "" && ref.ClusterRef == nil && ref.RemoteRef != nil {
+		var target fleetv1.Remote
+		if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.RemoteRef.Name}, &target); err != nil {
+			return remote.KubeconfigKey{}, fmt.Errorf("getting remote %q: %w", ref.RemoteRef.Name, err)
+		}
+		if target.IsPull() {
+			return remote.KubeconfigKey{}, fmt.Errorf("remote %q is in pull mode", ref.RemoteRef.Name)
+		}
+		if target.Spec.KubeconfigRef.RemoteRef != nil {
+			return remote.KubeconfigKey{}, fmt.Errorf("remote %q refers to another remote", ref.RemoteRef.Name)
+		}
+		ref = target.Spec.KubeconfigRef
+	}
+
+	key := remote.KubeconfigKey{
+		Namespace: namespace,
+		Name:      ref.Name,
+		Key:       ref.Key,
+	}
+	if key.Name == "" && ref.ClusterRef != nil {
+		key.Name = secret.Name(ref.ClusterRef.Name, secret.Kubeconfig)
+	}
+	if key.Name == "" {
+		return remote.KubeconfigKey{}, fmt.Errorf("kubeconfigRef must give a secret name, a clusterRef, or a remoteRef")
+	}
+	if key.Key == "" {
+		key.Key = fleetv1.DefaultKubeconfigKey
+	}
+	return key, nil
+}
+
+// isPulled reports whether the kubeconfig reference is to a Remote in
+// pull mode, in which case there's no kubeconfig to use: the agent in
+// the remote cluster connects here instead.
+func isPulled(ctx context.Context, c client.Reader, namespace string, ref fleetv1.LocalKubeconfigReference) (bool, error) {
+	if ref.Name != "" || ref.ClusterRef != nil || ref.RemoteRef == nil {
+		return false, nil
+	}
+	var target fleetv1.Remote
+	if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: ref.RemoteRef.Name}, &target); err != nil {
+		// If the remote is missing, it'll be reported when looking
+		// for the kubeconfig.
+		return false, client.IgnoreNotFound(err)
+	}
+	return target.IsPull(), nil
+}
+
+// kubeconfigRefFor gives the reference to use in a RemoteAssemblage
+// for the cluster given, which is either a Cluster or a Remote.
+func kubeconfigRefFor(target client.Object) fleetv1.LocalKubeconfigReference {
+	if _, ok := target.(*fleetv1.Remote); ok {
+		return fleetv1.LocalKubeconfigReference{
+			RemoteRef: &fleetv1.LocalRemoteReference{Name: target.GetName()},
+		}
+	}
+	return fleetv1.LocalKubeconfigReference{
+		ClusterRef: &fleetv1.LocalClusterReference{Name: target.GetName()},
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+// maintenanceWindow represents a recurring period during which a
+// cluster may be changed. It opens at each time matched by the
+// schedule, and stays open for the duration given.
+type maintenanceWindow struct {
+	schedule *cronSchedule
+	duration time.Duration
+}
+
+// maintenanceWindowFor returns the maintenance window declared in
+// the annotations of the cluster given, or nil if there is none.
+func maintenanceWindowFor(cluster metav1.Object) (*maintenanceWindow, error) {
+	annotations := cluster.GetAnnotations()
+	scheduleStr, ok := annotations[fleetv1.MaintenanceScheduleAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	schedule, err := parseCronSchedule(scheduleStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance schedule %q: %w", scheduleStr, err)
+	}
+	durationStr, ok := annotations[fleetv1.MaintenanceDurationAnnotation]
+	if !ok {
+		return nil, fmt.Errorf("maintenance schedule given without a duration (annotation %s)", fleetv1.MaintenanceDurationAnnotation)
+	}
+	duration, err := time.ParseDuration(durationStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maintenance duration %q: %w", durationStr, err)
+	}
+	if duration <= 0 {
+		return nil, fmt.Errorf("maintenance duration must be positive, got %q", durationStr)
+	}
+	return &maintenanceWindow{
+		schedule: schedule,
+		duration: duration,
+	}, nil
+}
+
+// isOpen reports whether the window is open at the time given. If
+// not, it also returns the time at which it will next open. A zero
+// time means the window will not open in the foreseeable future.
+func (w *maintenanceWindow) isOpen(now time.Time) (bool, time.Time) {
+	// The window is open if it was last opened less than `duration`
+	// ago; i.e., if there's an activation between (now - duration)
+	// and now.
+	if last := w.schedule.next(now.Add(-w.duration)); !last.IsZero() && !last.After(now) {
+		return true, time.Time{}
+	}
+	return false, w.schedule.next(now)
+}
+
+// cronSchedule is a parsed five-field cron expression (minute, hour,
+// day of month, month, day of week). Each field is a bitset of the
+// values matched. Times are evaluated in UTC.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domStar and dowStar record whether the day fields were
+	// unrestricted, since that determines how they combine.
+	domStar, dowStar bool
+}
+
+type cronField struct {
+	min, max int
+}
+
+var (
+	minuteField = cronField{0, 59}
+	hourField   = cronField{0, 23}
+	domField    = cronField{1, 31}
+	monthField  = cronField{1, 12}
+	dowField    = cronField{0, 7} // 0 and 7 are both Sunday
+)
+
+// parseCronSchedule parses a standard five-field cron
+// expression. Each field may be `*`, a number, a range `a-b`, any of
+// those with a step `/n`, or a comma-separated list of those.
+func parseCronSchedule(expr string) (*cronSchedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected five fields, got %d", len(fields))
+	}
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], minuteField); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], hourField); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if s.dom, err = parseCronField(fields[2], domField); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], monthField); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if s.dow, err = parseCronField(fields[4], dowField); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// Sunday can be given as 7; fold it into 0
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	return &s, nil
+}
+
+func parseCronField(field string, bounds cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i > -1 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		lo, hi := bounds.min, bounds.max
+		switch {
+		case part == "*":
+			break
+		case strings.Contains(part, "-"):
+			ends := strings.SplitN(part, "-", 2)
+			var err1, err2 error
+			lo, err1 = strconv.Atoi(ends[0])
+			hi, err2 = strconv.Atoi(ends[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+		if lo < bounds.min || hi > bounds.max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, bounds.min, bounds.max)
+		}
+		for i := lo; i <= hi; i += step {
+			bits |= 1 << uint(i)
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time matching the schedule strictly after
+// the time given, or the zero time if there is none within a few
+// years (e.g., for February 30th).
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Truncate(time.Hour).Add(time.Hour)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// dayMatches follows the cron convention that if both day of month
+// and day of week are restricted, either may match.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
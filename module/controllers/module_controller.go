@@ -6,11 +6,16 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
@@ -22,6 +27,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	"github.com/squaremo/fleeet/module/sharding"
 	syncapi "github.com/squaremo/fleeet/pkg/api"
 )
 
@@ -30,256 +36,394 @@ type ModuleReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// Shard gives the subset of clusters to compile assemblages
+	// for. If nil, all clusters are included. Module status is only
+	// calculated in the primary shard.
+	Shard *sharding.Shard
+
+	// DeletionTimeout gives how long to wait for a deleted module to
+	// be removed from every cluster, before giving up and letting it
+	// go anyway. If zero, DefaultModuleDeletionTimeout is used.
+	DeletionTimeout time.Duration
+
+	transitions *transitionTracker
 }
 
 const (
 	assemblageOwnerKey = "ownerModule"
 )
 
+// DefaultModuleDeletionTimeout is used when ModuleReconciler is not
+// given a DeletionTimeout.
+const DefaultModuleDeletionTimeout = 10 * time.Minute
+
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=modules,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=modules/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=modules/finalizers,verbs=update
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remoteassemblages,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=clustersets,verbs=get;list;watch
 //+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remotes,verbs=get;list;watch
 //+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
+//
+// The remote assemblages are compiled per cluster, by
+// assemblageCompiler; this calculates the status of the module from
+// the assemblages that include it.
 func (r *ModuleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := r.Log.WithValues("module", req.NamespacedName)
 
 	var mod fleetv1.Module
 	if err := r.Get(ctx, req.NamespacedName, &mod); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.transitions.forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	// --- create/update/delete remote assemblages
-
-	// Make sure there is a remote assemblage which includes this
-	// module, for every cluster that matches the selector.
+	if mod.GetDeletionTimestamp() != nil {
+		return r.finalize(ctx, log, &mod)
+	}
+	if !controllerutil.ContainsFinalizer(&mod, fleetv1.ModuleFinalizer) {
+		controllerutil.AddFinalizer(&mod, fleetv1.ModuleFinalizer)
+		if err := r.Update(ctx, &mod); err != nil {
+			return ctrl.Result{}, fmt.Errorf("adding finalizer to module: %w", err)
+		}
+	}
 
-	var clusters clusterv1.ClusterList
-	// `LabelSelectorAsSelector` correctly handles nil and empty
-	// selector values by selecting nothing and everything,
-	// respectively.
-	selector, err := metav1.LabelSelectorAsSelector(mod.Spec.Selector)
+	selection, err := selectionFor(ctx, r.Client, mod.Namespace, mod.Spec.Selector, mod.Spec.ClusterSetRef)
+	if err == nil {
+		err = checkOverrides(&mod)
+	}
 	if err != nil {
-		return ctrl.Result{}, fmt.Errorf("could not make selector from %v: %w", mod.Spec.Selector, err)
+		var selErr *selectionError
+		if !errors.As(err, &selErr) {
+			return ctrl.Result{}, fmt.Errorf("getting cluster selection: %w", err)
+		}
+		// This won't be fixed by trying again, so record it and wait
+		// for the module (or cluster set) to change.
+		markStalled(&mod, selErr.reason, selErr.Error())
+		mod.Status.ObservedGeneration = mod.Generation
+		if err := r.Status().Update(ctx, &mod); err != nil {
+			return ctrl.Result{}, fmt.Errorf("updating status of module: %w", err)
+		}
+		log.Error(err, "could not make cluster selection", "selector", mod.Spec.Selector, "clusterSetRef", mod.Spec.ClusterSetRef)
+		return ctrl.Result{}, nil
 	}
-	if err := r.List(ctx, &clusters, &client.ListOptions{
-		LabelSelector: selector,
-		Namespace:     mod.Namespace,
-	}); err != nil {
+
+	// A module that depends on itself would never be applied, so
+	// there's no point going any further.
+	var modules fleetv1.ModuleList
+	if err := r.List(ctx, &modules, client.InNamespace(mod.Namespace)); err != nil {
+		return ctrl.Result{}, fmt.Errorf("listing modules: %w", err)
+	}
+	if cycle := dependencyCycle(&mod, modules.Items); cycle != nil {
+		markStalled(&mod, fleetv1.DependencyCycleReason, "dependency cycle: "+strings.Join(cycle, " -> "))
+		mod.Status.ObservedGeneration = mod.Generation
+		if err := r.Status().Update(ctx, &mod); err != nil {
+			return ctrl.Result{}, fmt.Errorf("updating status of module: %w", err)
+		}
+		log.Info("module has a dependency cycle", "cycle", cycle)
+		return ctrl.Result{}, nil
+	}
+
+	clusters, err := selection.list(ctx, r.Client, mod.Namespace)
+	if err != nil {
 		return ctrl.Result{}, fmt.Errorf("failed to list selected clusters: %w", err)
 	}
 
+	// Find all assemblages indexed as owned by (i.e., including) this
+	// module. The assemblage for a cluster has the same name as the
+	// cluster.
+	var asms fleetv1.RemoteAssemblageList
+	if err := r.List(ctx, &asms, client.InNamespace(req.Namespace), client.MatchingFields{assemblageOwnerKey: req.Name}); err != nil {
+		return ctrl.Result{}, fmt.Errorf("listing assemblages for this module: %w", err)
+	}
+	asmsByCluster := map[string]*fleetv1.RemoteAssemblage{}
+	for i := range asms.Items {
+		asmsByCluster[asms.Items[i].Name] = &asms.Items[i]
+	}
+
 	summary := &fleetv1.SyncSummary{}
 
-	// Keep track of the assemblages which did require this module;
-	// afterwards, this will be helpful to determine the assemblages
-	// which need the module removed.
-	requiredAsm := map[string]struct{}{}
+	// If any clusters are waiting for a maintenance window, this will
+	// be set to when the earliest of them opens, so the module can be
+	// looked at again then.
+	now := time.Now()
+	var nextWindow time.Time
+
+	// Per-cluster entries for the status, collected along with the
+	// summary.
+	statuses := newClusterStatuses(mod.Status.Clusters, r.transitions.get(req.NamespacedName), now)
+	// The clusters each override applies to, likewise.
+	overrideStatuses := newOverrideStatuses()
+
+	// If any of the control plane bindings fail to evaluate, this
+	// is the first such error.
+	var bindingErr error
 
 clusters:
-	for _, cluster := range clusters.Items {
+	for _, cluster := range clusters {
+		// A cluster on its way out is no longer counted.
+		if cluster.GetDeletionTimestamp() != nil {
+			continue clusters
+		}
 		summary.Total++
-		// This loop makes sure every cluster that matches the
-		// selector has a remote assemblage with the latest definition
-		// of the module, by either updating an existing assemblage or
-		// creating one.
-		requiredAsm[cluster.GetName()] = struct{}{}
-
-		asm := &fleetv1.RemoteAssemblage{}
-		asm.Namespace = cluster.GetNamespace()
-		asm.Name = cluster.GetName()
-
-		// Used to get any resources mentioned in controlPlaneBindings
-		namespacedClient := client.NewNamespacedClient(r.Client, mod.Namespace)
-
-		// Evaluate all the control-plane bindings. This is the
-		// naive approach -- better would be to run through the
-		// bindings in the sync and see which control plane
-		// bindings are actually used -- but this will do for now.
-
-		// start with CLUSTER_NAME available to use in bindings
-		memo := map[string]string{
-			"CLUSTER_NAME": cluster.Name,
+		// The overrides have been checked above, so this won't fail.
+		if overrides, err := overridesForCluster(&mod, cluster); err == nil {
+			overrideStatuses.add(cluster.GetName(), overrides)
 		}
 
-		var bindingErr error
-		var makeBindingFunc func(stack []string) func(string) string
-		makeBindingFunc = func(stack []string) func(string) string {
-			return func(name string) string {
-				for i := range stack {
-					if stack[i] == name {
-						bindingErr = fmt.Errorf("circular binding %q", name)
-						return ""
-					}
-				}
-
-				if v, ok := memo[name]; ok {
-					return v
-				}
-				for _, b := range mod.Spec.ControlPlaneBindings {
-					if b.Name == name {
-						v, err := syncapi.ResolveBinding(ctx, namespacedClient, b, makeBindingFunc(append(stack, name)))
-						if err != nil {
-							bindingErr = err
-							v = ""
-						}
-						memo[name] = v
-						return v
+		// Nothing changes while the module is suspended, so there's
+		// nothing to compare; just report what's there.
+		if mod.Spec.Suspend {
+			summary.Suspended++
+			var revision string
+			var since *metav1.Time
+			if asm, ok := asmsByCluster[cluster.GetName()]; ok {
+				for i := range asm.Status.Syncs {
+					if status := &asm.Status.Syncs[i]; status.Sync.Name == mod.Name && status.State == syncapi.StateSuspended {
+						revision, since = syncRevision(status), status.LastTransitionTime
+						break
 					}
 				}
-				memo[name] = ""
-				return ""
 			}
+			statuses.add(cluster.GetName(), syncapi.StateSuspended, revision, "", since)
+			continue clusters
 		}
 
-		// The loop following is for the side-effect of filling out
-		// the map of values (and to see if there are errors). Since
-		// the map will be used to add to target-side bindings, I need
-		// to know if CLUSTER_NAME is explicitly named as a
-		// controlPlaneBinding and therefore should be included.
-		var clusterNameExplicitBinding bool
-		for _, binding := range mod.Spec.ControlPlaneBindings {
-			if binding.Name == "CLUSTER_NAME" {
-				clusterNameExplicitBinding = true
-			}
-			bindingErr = nil
-			// this pulls the binding through memoisation
-			makeBindingFunc(nil)(binding.Name)
-			if bindingErr != nil {
-				return ctrl.Result{}, bindingErr
+		// An invalid window holds back changes, as a closed one
+		// would, so it's only reported if there's a change waiting.
+		window, windowErr := maintenanceWindowFor(cluster)
+
+		// This is what the assemblage compiler will have (or will
+		// soon have) put in the assemblage for the cluster.
+		expected, err := syncForCluster(ctx, r.Client, &mod, cluster)
+		if err != nil {
+			summary.Failed++
+			statuses.add(cluster.GetName(), syncapi.StateFailed, "", err.Error(), nil)
+			if bindingErr == nil {
+				bindingErr = err
 			}
+			continue clusters
 		}
 
-		op, err := controllerutil.CreateOrUpdate(ctx, r.Client, asm, func() error {
-			var bindingsFromControlPlane []syncapi.Binding
-			for k, v := range memo {
-				if k == "CLUSTER_NAME" && !clusterNameExplicitBinding {
-					continue
+		var current *syncapi.NamedSync
+		var unreachable bool
+		var unreachableMessage string
+		asm, ok := asmsByCluster[cluster.GetName()]
+		if ok {
+			unreachable, unreachableMessage = clusterUnreachable(asm)
+			for i := range asm.Spec.Assemblage.Syncs {
+				if asm.Spec.Assemblage.Syncs[i].Name == mod.Name {
+					current = &asm.Spec.Assemblage.Syncs[i]
+					break
 				}
-				// NB the order of these is not important, since they
-				// are all evaluated ahead of time.
-				bindingsFromControlPlane = append(bindingsFromControlPlane, syncapi.Binding{
-					Name: k,
-					BindingSource: syncapi.BindingSource{
-						StringValue: &syncapi.StringValue{
-							Value: v,
-						},
-					},
-				})
 			}
+		}
 
-			bindings := append(bindingsFromControlPlane, mod.Spec.Sync.Bindings...)
-
-			// Each RemoteAssemblage is owned by each of the modules
-			// assigned to it. This is for the sake of indexing.
-			if err := controllerutil.SetOwnerReference(&mod, asm, r.Scheme); err != nil {
-				return err
+		if current == nil || !equality.Semantic.DeepEqual(*current, expected) {
+			// The assemblage is not up to date; either it's waiting
+			// for the cluster to become eligible, for the module's
+			// dependencies, for a maintenance window, or for the
+			// compiler.
+			if ok, reason := clusterEligible(cluster, mod.Spec.Eligibility); !ok {
+				summary.Pending++
+				statuses.add(cluster.GetName(), fleetv1.StatePending, "", "waiting for cluster to become eligible: "+reason, nil)
+				continue clusters
 			}
-			// Each RemoteAssemblage is _specially_ owned by the
-			// cluster to which it pertains. This is so that removing
-			// the cluster will garbage collect the remote assemblage.
-			if err := controllerutil.SetControllerReference(&cluster, asm, r.Scheme); err != nil {
-				return err
+			if unready := unreadyDependencies(&mod, asm); len(unready) > 0 {
+				summary.Pending++
+				statuses.add(cluster.GetName(), fleetv1.StatePending, "", "waiting for dependencies: "+strings.Join(unready, ", "), nil)
+				continue clusters
 			}
-
-			asm.Spec.KubeconfigRef = fleetv1.LocalKubeconfigReference{
-				Name: cluster.GetName() + "-kubeconfig", // FIXME refer to cluster instead
+			if windowErr != nil {
+				summary.Failed++
+				statuses.add(cluster.GetName(), syncapi.StateFailed, "", windowErr.Error(), nil)
+				continue clusters
 			}
-
-			// if this module is to be found in the syncs, make sure
-			// it's the up to date definition.
-			syncs := asm.Spec.Assemblage.Syncs
-			for i, sync := range syncs {
-				if sync.Name == mod.Name {
-					// NB: CreateOrUpdate will avoid the update if the mutated object
-					// is deep-equal to the original. That helps this process reach a
-					// fixed point.
-					syncs[i].Sync = mod.Spec.Sync.Sync
-					syncs[i].Bindings = bindings
-					return nil
+			if window != nil {
+				if open, opens := window.isOpen(now); !open {
+					summary.Pending++
+					message := "waiting for maintenance window"
+					if !opens.IsZero() {
+						message = fmt.Sprintf("waiting for maintenance window opening at %s", opens.Format(time.RFC3339))
+					}
+					statuses.add(cluster.GetName(), fleetv1.StatePending, "", message, nil)
+					if !opens.IsZero() && (nextWindow.IsZero() || opens.Before(nextWindow)) {
+						nextWindow = opens
+					}
+					continue clusters
 				}
 			}
-			// not there -- add this module
-			asm.Spec.Assemblage.Syncs = append(syncs, syncapi.NamedSync{
-				Name:     mod.Name,
-				Sync:     mod.Spec.Sync.Sync,
-				Bindings: bindings,
-			})
-			return nil
-		})
-		if err != nil {
-			// if something went wrong with this one, track it as a failure
-			summary.Failed++
-			log.Error(err, "updating remote assemblages", "assemblage", asm.Name)
-		} else {
-			log.V(1).Info("updated assemblage", "assemblage", asm.Name, "operation", op)
-			for _, sync := range asm.Status.Syncs {
-				if sync.Sync.Name == mod.Name {
-					incrementSummary(summary, sync)
-					continue clusters // all done here
+			if unreachable {
+				summary.Unreachable++
+				statuses.add(cluster.GetName(), fleetv1.StateUnreachable, "", unreachableMessage, nil)
+				continue clusters
+			}
+			if ok {
+				if conflicted, message := fieldConflicted(asm); conflicted {
+					summary.Failed++
+					statuses.add(cluster.GetName(), syncapi.StateFailed, "", message, nil)
+					continue clusters
 				}
 			}
-			// no change made, but status not found -> updating
 			summary.Updating++
+			statuses.add(cluster.GetName(), syncapi.StateUpdating, "", "", nil)
+			continue clusters
+		}
+
+		// The last status reported from a cluster that can't be
+		// reached may no longer be true.
+		if unreachable {
+			summary.Unreachable++
+			statuses.add(cluster.GetName(), fleetv1.StateUnreachable, "", unreachableMessage, nil)
+			continue clusters
 		}
+
+		for _, sync := range asm.Status.Syncs {
+			if sync.Sync.Name == mod.Name && equality.Semantic.DeepEqual(sync.Sync, expected) {
+				incrementSummary(summary, sync)
+				statuses.add(cluster.GetName(), sync.State, syncRevision(&sync), sync.Message, sync.LastTransitionTime)
+				if len(sync.Conflicts) > 0 {
+					summary.Conflicted++
+					statuses.conflicted(sync.Conflicts)
+				}
+				continue clusters // all done here
+			}
+		}
+		// up to date, but status not (yet) reported -> updating
+		summary.Updating++
+		statuses.add(cluster.GetName(), syncapi.StateUpdating, "", "", nil)
 	}
 
 	mod.Status.Summary = summary
+	r.transitions.set(req.NamespacedName, statuses.transitions())
+	mod.Status.Clusters = statuses.list()
+	mod.Status.Overrides = overrideStatuses.list(&mod)
+	if !mod.Spec.Suspend {
+		mod.Status.ObservedSync = &mod.Spec.Sync.Sync
+	}
+	mod.Status.ObservedGeneration = mod.Generation
+	markFromSummary(&mod, summary)
+	if bindingErr != nil {
+		markStalled(&mod, fleetv1.BindingFailedReason, bindingErr.Error())
+	}
 	if err := r.Status().Update(ctx, &mod); err != nil {
 		return ctrl.Result{}, fmt.Errorf("updating status of module: %w", err)
 	}
 
-	// Find all assemblages indexed as owned by (i.e., including) this
-	// module
+	// A binding may refer to an object that doesn't exist yet, so
+	// it's worth trying again.
+	if bindingErr != nil {
+		return ctrl.Result{}, bindingErr
+	}
+	if !nextWindow.IsZero() {
+		return ctrl.Result{RequeueAfter: nextWindow.Sub(now)}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// finalize lets a module that is being deleted go, once it has been
+// removed from every remote assemblage and what it synced has been
+// removed downstream. The assemblage compiler does the removing; a
+// removed module stays an owner of each assemblage until the
+// assemblage's status no longer mentions it, so this will be
+// triggered when that happens. If the module hasn't gone from every
+// cluster by the deletion timeout, it's let go anyway.
+func (r *ModuleReconciler) finalize(ctx context.Context, log logr.Logger, mod *fleetv1.Module) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(mod, fleetv1.ModuleFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
 	var asms fleetv1.RemoteAssemblageList
-	if err := r.List(ctx, &asms, client.InNamespace(req.Namespace), client.MatchingFields{assemblageOwnerKey: req.Name}); err != nil {
+	if err := r.List(ctx, &asms, client.InNamespace(mod.Namespace), client.MatchingFields{assemblageOwnerKey: mod.Name}); err != nil {
 		return ctrl.Result{}, fmt.Errorf("listing assemblages for this module: %w", err)
 	}
-
-	// This loop removes the module from any assemblage for a cluster
-	// that wasn't selected. (Remember, these assemblages were
-	// selected because they were owned by this module, implying that
-	// at some point the module was assigned to the cluster)
-	for _, asm := range asms.Items {
-		if _, ok := requiredAsm[asm.GetName()]; !ok {
-			syncs := asm.Spec.Assemblage.Syncs
-			for i, sync := range syncs {
-				if sync.Name == mod.Name {
-					asm.Spec.Assemblage.Syncs = append(syncs[:i], syncs[i+1:]...)
-					removeOwnerRef(&mod, &asm)
-					if err := r.Update(ctx, &asm); err != nil {
-						log.Error(err, "removing module from remote assemblage", "assemblage", asm.Name)
-					}
-					// FIXME: can this `break` from the loop at this point?
-				}
-			}
+	var remaining []string
+	for i := range asms.Items {
+		if assemblageMentions(&asms.Items[i], mod.Name) {
+			remaining = append(remaining, asms.Items[i].Name)
 		}
 	}
+	if len(remaining) > 0 {
+		now := time.Now()
+		deadline := mod.GetDeletionTimestamp().Add(r.deletionTimeout())
+		if !now.Before(deadline) {
+			return ctrl.Result{}, r.abandon(ctx, log, mod, remaining)
+		}
+		log.V(1).Info("waiting for module to be removed", "clusters", len(remaining))
+		markReconciling(mod, fleetv1.DeletingReason, fmt.Sprintf("waiting for removal from %d clusters", len(remaining)))
+		if err := r.Status().Update(ctx, mod); err != nil {
+			return ctrl.Result{}, fmt.Errorf("updating status of module: %w", err)
+		}
+		return ctrl.Result{RequeueAfter: deadline.Sub(now)}, nil
+	}
 
-	// TODO: This should correspond to the summary; figure out if the
-	// summary should be calculated based on changes done above.
-	mod.Status.ObservedSync = &mod.Spec.Sync.Sync
-	if err := r.Status().Update(ctx, &mod); err != nil {
-		return ctrl.Result{}, fmt.Errorf("updating status of module: %w", err)
+	return ctrl.Result{}, r.release(ctx, mod)
+}
+
+func (r *ModuleReconciler) deletionTimeout() time.Duration {
+	if r.DeletionTimeout == 0 {
+		return DefaultModuleDeletionTimeout
 	}
+	return r.DeletionTimeout
+}
 
-	return ctrl.Result{}, nil
+// abandonedListLimit is how many of the assemblages a module was left
+// in are named in the message when giving up on its removal.
+const abandonedListLimit = 10
+
+// abandon gives up on removing the module from the remote assemblages
+// named, records which those are in the status, and lets the module
+// go.
+func (r *ModuleReconciler) abandon(ctx context.Context, log logr.Logger, mod *fleetv1.Module, remaining []string) error {
+	timeout := r.deletionTimeout()
+	sort.Strings(remaining)
+	log.Info("abandoning removal of module", "timeout", timeout, "assemblages", remaining)
+	names := remaining
+	if len(names) > abandonedListLimit {
+		names = names[:abandonedListLimit]
+	}
+	message := fmt.Sprintf("gave up waiting for removal after %s; what was synced may have been left in %d clusters: %s",
+		timeout, len(remaining), strings.Join(names, ", "))
+	if len(remaining) > len(names) {
+		message = fmt.Sprintf("%s, and %d more", message, len(remaining)-len(names))
+	}
+	markStalled(mod, fleetv1.DeletionAbandonedReason, message)
+	if err := r.Status().Update(ctx, mod); err != nil {
+		return fmt.Errorf("updating status of module: %w", err)
+	}
+	return r.release(ctx, mod)
+}
+
+// release removes the finalizer from the module, so it can be
+// deleted.
+func (r *ModuleReconciler) release(ctx context.Context, mod *fleetv1.Module) error {
+	controllerutil.RemoveFinalizer(mod, fleetv1.ModuleFinalizer)
+	if err := r.Update(ctx, mod); err != nil {
+		return fmt.Errorf("removing finalizer from module: %w", err)
+	}
+	return nil
 }
 
-func removeOwnerRef(nonOwner, obj metav1.Object) {
-	owners := obj.GetOwnerReferences()
-	newOwners := make([]metav1.OwnerReference, len(owners))
-	removeUID := nonOwner.GetUID()
-	for i := range owners {
-		if owners[i].UID != removeUID {
-			newOwners = append(newOwners, owners[i])
+// assemblageMentions reports whether the remote assemblage has the
+// named sync in either its spec or its status.
+func assemblageMentions(asm *fleetv1.RemoteAssemblage, name string) bool {
+	for _, sync := range asm.Spec.Assemblage.Syncs {
+		if sync.Name == name {
+			return true
+		}
+	}
+	for _, status := range asm.Status.Syncs {
+		if status.Sync.Name == name {
+			return true
 		}
 	}
-	obj.SetOwnerReferences(newOwners)
+	return false
 }
 
 func incrementSummary(summary *fleetv1.SyncSummary, sync syncapi.SyncStatus) {
@@ -288,6 +432,8 @@ func incrementSummary(summary *fleetv1.SyncSummary, sync syncapi.SyncStatus) {
 		summary.Succeeded++
 	case syncapi.StateFailed:
 		summary.Failed++
+	case syncapi.StateSuspended:
+		summary.Suspended++
 	default:
 		summary.Updating++
 	}
@@ -295,6 +441,8 @@ func incrementSummary(summary *fleetv1.SyncSummary, sync syncapi.SyncStatus) {
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ModuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.transitions = newTransitionTracker()
+
 	// This sets up an index on the Module owners of RemoteAssemblage
 	// objects. This complements the Watch on assemblage owners,
 	// below: that enqueues all the modules related to an assemblage
@@ -316,6 +464,23 @@ func (r *ModuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		return err
 	}
 
+	// The remote assemblages are compiled by a controller of their
+	// own, which relies on the index above.
+	if err := (&assemblageCompiler{
+		Client: r.Client,
+		Log:    r.Log.WithName("compiler"),
+		Scheme: r.Scheme,
+		Shard:  r.Shard,
+	}).setupWithManager(mgr); err != nil {
+		return err
+	}
+
+	// The status of a module depends on all the clusters it's
+	// assigned to, so that is left to one shard.
+	if !r.Shard.IsPrimary() {
+		return nil
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&fleetv1.Module{}).
 
@@ -335,6 +500,21 @@ func (r *ModuleReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		Watches(
 			&source.Kind{Type: &clusterv1.Cluster{}},
 			handler.EnqueueRequestsFromMapFunc(r.modulesForCluster)).
+		Watches(
+			&source.Kind{Type: &fleetv1.Remote{}},
+			handler.EnqueueRequestsFromMapFunc(r.modulesForCluster)).
+
+		// Enqueue the Module objects that refer to a cluster set,
+		// when its membership changes.
+		Watches(
+			&source.Kind{Type: &fleetv1.ClusterSet{}},
+			handler.EnqueueRequestsFromMapFunc(r.modulesForClusterSet)).
+
+		// Enqueue the Module objects that depend on a module, since
+		// a change to its dependencies may make or break a cycle.
+		Watches(
+			&source.Kind{Type: &fleetv1.Module{}},
+			handler.EnqueueRequestsFromMapFunc(r.modulesDependingOn)).
 		Complete(r)
 }
 
@@ -348,19 +528,19 @@ func (r *ModuleReconciler) modulesForCluster(cluster client.Object) []reconcile.
 
 	var requests []reconcile.Request
 	for _, mod := range modules.Items {
-		if mod.Spec.Selector == nil {
+		if mod.Spec.Selector == nil && mod.Spec.ClusterSetRef == nil {
 			continue
 		}
 		name := types.NamespacedName{
 			Name:      mod.Name,
 			Namespace: mod.Namespace,
 		}
-		selector, err := metav1.LabelSelectorAsSelector(mod.Spec.Selector)
+		selection, err := selectionFor(ctx, r.Client, mod.Namespace, mod.Spec.Selector, mod.Spec.ClusterSetRef)
 		if err != nil {
-			r.Log.Error(err, "making selector for module", "module", name)
+			r.Log.Error(err, "making cluster selection for module", "module", name)
 			continue
 		}
-		if selector.Matches(labels.Set(cluster.GetLabels())) {
+		if selection.matches(cluster) {
 			requests = append(requests, reconcile.Request{
 				NamespacedName: name,
 			})
@@ -368,3 +548,65 @@ func (r *ModuleReconciler) modulesForCluster(cluster client.Object) []reconcile.
 	}
 	return requests
 }
+
+func (r *ModuleReconciler) modulesForClusterSet(set client.Object) []reconcile.Request {
+	ctx := context.Background()
+	var modules fleetv1.ModuleList
+	if err := r.List(ctx, &modules, client.InNamespace(set.GetNamespace())); err != nil {
+		r.Log.Error(err, "getting list of modules")
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for _, mod := range modules.Items {
+		if ref := mod.Spec.ClusterSetRef; ref != nil && ref.Name == set.GetName() {
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name:      mod.Name,
+					Namespace: mod.Namespace,
+				},
+			})
+		}
+	}
+	return requests
+}
+
+// modulesDependingOn gives the modules that depend on the module
+// given, directly or indirectly.
+func (r *ModuleReconciler) modulesDependingOn(dep client.Object) []reconcile.Request {
+	ctx := context.Background()
+	var modules fleetv1.ModuleList
+	if err := r.List(ctx, &modules, client.InNamespace(dep.GetNamespace())); err != nil {
+		r.Log.Error(err, "getting list of modules")
+		return nil
+	}
+
+	dependents := map[string][]string{}
+	for _, mod := range modules.Items {
+		for _, ref := range mod.Spec.DependsOn {
+			dependents[ref.Name] = append(dependents[ref.Name], mod.Name)
+		}
+	}
+
+	var requests []reconcile.Request
+	seen := map[string]struct{}{}
+	queue := []string{dep.GetName()}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, dependent := range dependents[name] {
+			if _, ok := seen[dependent]; ok {
+				continue
+			}
+			seen[dependent] = struct{}{}
+			queue = append(queue, dependent)
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name:      dependent,
+					Namespace: dep.GetNamespace(),
+				},
+			})
+		}
+	}
+	return requests
+}
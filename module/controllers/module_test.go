@@ -6,15 +6,19 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"time"
 	//	"fmt"
 	//	"path/filepath"
-	//	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	//	corev1 "k8s.io/api/core/v1"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
@@ -24,8 +28,11 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	ctrlutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 
+	"github.com/fluxcd/pkg/apis/meta"
+
 	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
 	syncapi "github.com/squaremo/fleeet/pkg/api"
+	"github.com/squaremo/fleeet/pkg/apply"
 )
 
 // makeSync is a convenience for testing, which creates a sync with
@@ -79,6 +86,10 @@ var _ = Describe("modules", func() {
 			Client: manager.GetClient(),
 			Log:    ctrl.Log.WithName("controllers").WithName("Module"),
 			Scheme: manager.GetScheme(),
+
+			// Long enough for modules to be removed normally, but
+			// short enough to see the timeout happen.
+			DeletionTimeout: 10 * time.Second,
 		}
 		Expect(moduleReconciler.SetupWithManager(manager)).To(Succeed())
 
@@ -170,6 +181,8 @@ var _ = Describe("modules", func() {
 						Sync: nomatchModule.Spec.Sync.Sync,
 					}))
 					Expect(asm.GetOwnerReferences()).NotTo(ContainElement(ownerRef(nomatchModule)))
+					// the cluster labels are copied, for sharding
+					Expect(asm.GetLabels()).To(HaveKeyWithValue("environment", "production"))
 				}
 
 				// add a cluster and check that it gets matched
@@ -203,6 +216,57 @@ var _ = Describe("modules", func() {
 			})
 		})
 
+		Context("matching remotes", func() {
+			It("creates remote assemblages for remotes, referring to them", func() {
+				rem := &fleetv1.Remote{
+					Spec: fleetv1.RemoteSpec{
+						KubeconfigRef: fleetv1.LocalKubeconfigReference{Name: "remote-kubeconfig"},
+					},
+				}
+				rem.Name = "remote-" + randString(5)
+				rem.Namespace = namespace.Name
+				rem.SetLabels(map[string]string{
+					"environment": "staging",
+				})
+				Expect(k8sClient.Create(context.Background(), rem)).To(Succeed())
+
+				module := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"environment": "staging"},
+						},
+						Sync: makeSync("https://github.com/cuttlefacts/app", "v0.3.4"),
+					},
+				}
+				module.Name = "staging-only"
+				module.Namespace = namespace.Name
+				Expect(k8sClient.Create(context.Background(), module)).To(Succeed())
+
+				var asm fleetv1.RemoteAssemblage
+				Eventually(func() error {
+					return k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(rem), &asm)
+				}, "5s", "1s").Should(Succeed())
+				Expect(asm.Spec.KubeconfigRef).To(Equal(fleetv1.LocalKubeconfigReference{
+					RemoteRef: &fleetv1.LocalRemoteReference{Name: rem.Name},
+				}))
+				Expect(asm.Spec.Assemblage.Syncs).To(ContainElement(syncapi.NamedSync{
+					Name: module.Name,
+					Sync: module.Spec.Sync.Sync,
+				}))
+				// the remote assemblage is owned by the remote
+				remoteOwnerRef := ownerRef(rem)
+				t := true
+				remoteOwnerRef.Controller = &t
+				remoteOwnerRef.BlockOwnerDeletion = &t
+				Expect(asm.GetOwnerReferences()).To(ContainElement(remoteOwnerRef))
+
+				// none of the clusters are selected
+				var asms fleetv1.RemoteAssemblageList
+				Expect(k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))).To(Succeed())
+				Expect(asms.Items).To(HaveLen(1))
+			})
+		})
+
 		Context("module updates", func() {
 			It("updates remote assemblages with new version", func() {
 				module := &fleetv1.Module{
@@ -248,6 +312,241 @@ var _ = Describe("modules", func() {
 			})
 		})
 
+		Context("field conflicts", func() {
+			It("reports fields set by others in remote assemblages, unless co-owned", func() {
+				module := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{}, // all clusters
+						Sync:     makeSync("https://github.com/cuttlefacts/app", "v0.3.4"),
+					},
+				}
+				module.Name = "matches"
+				module.Namespace = namespace.Name
+				Expect(k8sClient.Create(context.TODO(), module)).To(Succeed())
+
+				var asm fleetv1.RemoteAssemblage
+				asmName := types.NamespacedName{Namespace: namespace.Name, Name: clusters[0]}
+				Eventually(func() error {
+					return k8sClient.Get(context.TODO(), asmName, &asm)
+				}, "5s", "1s").Should(Succeed())
+
+				// Someone else takes over the kubeconfig reference,
+				// so it no longer agrees with what's compiled.
+				other := &unstructured.Unstructured{}
+				other.SetGroupVersionKind(fleetv1.GroupVersion.WithKind("RemoteAssemblage"))
+				other.SetNamespace(asmName.Namespace)
+				other.SetName(asmName.Name)
+				Expect(unstructured.SetNestedField(other.Object, "elsewhere", "spec", "kubeconfigRef", "clusterRef", "name")).To(Succeed())
+				Expect(k8sClient.Patch(context.TODO(), other, client.Apply, client.FieldOwner("someone-else"), client.ForceOwnership)).To(Succeed())
+
+				Eventually(func() bool {
+					err := k8sClient.Get(context.TODO(), asmName, &asm)
+					return err == nil && apimeta.IsStatusConditionTrue(asm.Status.Conditions, fleetv1.FieldConflictCondition)
+				}, "5s", "1s").Should(BeTrue())
+
+				// Marking the reference as co-owned lets it be.
+				other.SetAnnotations(map[string]string{
+					apply.CoOwnedFieldsAnnotation: "spec.kubeconfigRef",
+				})
+				Expect(k8sClient.Patch(context.TODO(), other, client.Apply, client.FieldOwner("someone-else"), client.ForceOwnership)).To(Succeed())
+
+				Eventually(func() bool {
+					err := k8sClient.Get(context.TODO(), asmName, &asm)
+					return err == nil && apimeta.FindStatusCondition(asm.Status.Conditions, fleetv1.FieldConflictCondition) == nil
+				}, "5s", "1s").Should(BeTrue())
+				Expect(asm.Spec.KubeconfigRef.ClusterRef.Name).To(Equal("elsewhere"))
+			})
+		})
+
+		Context("module suspension", func() {
+			It("suspends the sync in remote assemblages, and leaves it otherwise unchanged", func() {
+				module := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{}, // all clusters
+						Sync:     makeSync("https://github.com/cuttlefacts/app", "v0.3.4"),
+					},
+				}
+				module.Name = "suspended"
+				module.Namespace = namespace.Name
+				Expect(k8sClient.Create(context.TODO(), module)).To(Succeed())
+
+				var asms fleetv1.RemoteAssemblageList
+				Eventually(func() bool {
+					err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))
+					return err == nil && len(asms.Items) == len(clusters)
+				}, "5s", "1s").Should(BeTrue())
+
+				_, err := ctrlutil.CreateOrPatch(context.TODO(), k8sClient, module, func() error {
+					module.Spec.Suspend = true
+					module.Spec.Sync.Source.Git.Version.Tag = "v0.3.5"
+					return nil
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() bool {
+					err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))
+					if err != nil {
+						return false
+					}
+					for _, asm := range asms.Items {
+						if len(asm.Spec.Assemblage.Syncs) != 1 || !asm.Spec.Assemblage.Syncs[0].Suspend {
+							return false
+						}
+					}
+					return true
+				}, "5s", "1s").Should(BeTrue())
+				for _, asm := range asms.Items {
+					Expect(asm.Spec.Assemblage.Syncs[0].Source.Git.Version.Tag).To(Equal("v0.3.4"))
+				}
+
+				var m fleetv1.Module
+				Eventually(func() bool {
+					err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(module), &m)
+					return err == nil && m.Status.Summary != nil && m.Status.Summary.Suspended == len(clusters)
+				}, "5s", "1s").Should(BeTrue())
+			})
+		})
+
+		Context("drift policy", func() {
+			It("passes the drift policy on with the sync", func() {
+				drift := &syncapi.DriftPolicy{
+					Mode:         syncapi.DriftModeIgnoreFields,
+					IgnoreFields: []string{"spec.replicas"},
+				}
+				module := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{}, // all clusters
+						Sync:     makeSync("https://github.com/cuttlefacts/app", "v0.3.4"),
+						Drift:    drift,
+					},
+				}
+				module.Name = "drifty"
+				module.Namespace = namespace.Name
+				Expect(k8sClient.Create(context.TODO(), module)).To(Succeed())
+
+				var asms fleetv1.RemoteAssemblageList
+				Eventually(func() bool {
+					err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))
+					return err == nil && len(asms.Items) == len(clusters)
+				}, "5s", "1s").Should(BeTrue())
+				for _, asm := range asms.Items {
+					Expect(asm.Spec.Assemblage.Syncs).To(HaveLen(1))
+					Expect(asm.Spec.Assemblage.Syncs[0].Drift).To(Equal(drift))
+				}
+			})
+		})
+
+		Context("module deletion", func() {
+			It("removes the module from remote assemblages before letting it go", func() {
+				module := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{}, // all clusters
+						Sync:     makeSync("https://github.com/cuttlefacts/app", "v0.3.4"),
+					},
+				}
+				module.Name = "deleted"
+				module.Namespace = namespace.Name
+				Expect(k8sClient.Create(context.TODO(), module)).To(Succeed())
+
+				var asms fleetv1.RemoteAssemblageList
+				Eventually(func() bool {
+					err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))
+					return err == nil && len(asms.Items) == len(clusters)
+				}, "5s", "1s").Should(BeTrue())
+
+				// Pretend one of the clusters has synced the module,
+				// so that it has to wait for that to be removed.
+				asm := asms.Items[0]
+				asm.Status.Syncs = []syncapi.SyncStatus{{
+					Sync:  asm.Spec.Assemblage.Syncs[0],
+					State: syncapi.StateSucceeded,
+				}}
+				Expect(k8sClient.Status().Update(context.TODO(), &asm)).To(Succeed())
+
+				Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(module), module)).To(Succeed())
+				Expect(module.GetFinalizers()).To(ContainElement(fleetv1.ModuleFinalizer))
+				Expect(k8sClient.Delete(context.TODO(), module)).To(Succeed())
+
+				// The syncs are removed from the assemblages ..
+				Eventually(func() bool {
+					if err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name)); err != nil {
+						return false
+					}
+					for _, asm := range asms.Items {
+						if len(asm.Spec.Assemblage.Syncs) > 0 {
+							return false
+						}
+					}
+					return true
+				}, "5s", "1s").Should(BeTrue())
+
+				// .. but the module is kept while the cluster still
+				// reports the sync ..
+				Consistently(func() bool {
+					err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(module), module)
+					return err == nil
+				}, "2s", "1s").Should(BeTrue())
+
+				// .. and released once it doesn't.
+				Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&asm), &asm)).To(Succeed())
+				asm.Status.Syncs = nil
+				Expect(k8sClient.Status().Update(context.TODO(), &asm)).To(Succeed())
+				Eventually(func() bool {
+					err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(module), module)
+					return apierrors.IsNotFound(err)
+				}, "5s", "1s").Should(BeTrue())
+			})
+
+			It("gives up waiting after the deletion timeout", func() {
+				module := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{}, // all clusters
+						Sync:     makeSync("https://github.com/cuttlefacts/app", "v0.3.4"),
+					},
+				}
+				module.Name = "stuck"
+				module.Namespace = namespace.Name
+				Expect(k8sClient.Create(context.TODO(), module)).To(Succeed())
+
+				var asms fleetv1.RemoteAssemblageList
+				Eventually(func() bool {
+					err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))
+					return err == nil && len(asms.Items) == len(clusters)
+				}, "5s", "1s").Should(BeTrue())
+
+				// This cluster never gets round to removing the sync.
+				asm := asms.Items[0]
+				asm.Status.Syncs = []syncapi.SyncStatus{{
+					Sync:  asm.Spec.Assemblage.Syncs[0],
+					State: syncapi.StateSucceeded,
+				}}
+				Expect(k8sClient.Status().Update(context.TODO(), &asm)).To(Succeed())
+
+				Eventually(func() bool {
+					err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(module), module)
+					return err == nil && len(module.GetFinalizers()) > 0
+				}, "5s", "1s").Should(BeTrue())
+				Expect(k8sClient.Delete(context.TODO(), module)).To(Succeed())
+
+				// The module is held on to for a while ..
+				Consistently(func() bool {
+					err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(module), module)
+					return err == nil
+				}, "5s", "1s").Should(BeTrue())
+				cond := apimeta.FindStatusCondition(module.Status.Conditions, meta.ReconcilingCondition)
+				Expect(cond).NotTo(BeNil())
+				Expect(cond.Reason).To(Equal(fleetv1.DeletingReason))
+
+				// .. then let go, though the cluster still reports
+				// the sync.
+				Eventually(func() bool {
+					err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(module), module)
+					return apierrors.IsNotFound(err)
+				}, "10s", "1s").Should(BeTrue())
+				Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&asm), &asm)).To(Succeed())
+				Expect(asm.Status.Syncs).To(HaveLen(1))
+			})
+		})
+
 		Context("module specialisation", func() {
 			It("evaluates controlPlaneBindings but not (target cluster) bindings", func() {
 				sync := makeSync("https://github.com/cuttlefacts/app", "v3.0.4")
@@ -314,6 +613,152 @@ var _ = Describe("modules", func() {
 				}
 			})
 		})
+
+		Context("module overrides", func() {
+			It("applies overrides to the clusters named, and reports them", func() {
+				sync := makeSync("https://github.com/cuttlefacts/app", "v0.2.0")
+				sync.Package = &syncapi.PackageSpec{
+					Kustomize: &syncapi.KustomizeSpec{
+						Path:       ".",
+						Substitute: map[string]string{"replicas": "2"},
+					},
+				}
+				mod := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{},
+						Sync:     sync,
+						Overrides: []fleetv1.ModuleOverride{
+							{
+								Name:     "hold-back",
+								Clusters: []string{clusters[0]},
+								Version:  &syncapi.GitVersion{Tag: "v0.1.0"},
+								Substitute: map[string]string{
+									"replicas": "1",
+								},
+							},
+						},
+					},
+				}
+				mod.Name = "mod-" + randString(5)
+				mod.Namespace = namespace.Name
+				Expect(k8sClient.Create(context.TODO(), mod)).To(Succeed())
+
+				var asms fleetv1.RemoteAssemblageList
+				Eventually(func() bool {
+					err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))
+					return err == nil && len(asms.Items) == len(clusters)
+				}, "5s", "1s").Should(BeTrue())
+
+				for _, asm := range asms.Items {
+					Expect(len(asm.Spec.Assemblage.Syncs)).To(Equal(1))
+					sync := asm.Spec.Assemblage.Syncs[0]
+					if asm.Name == clusters[0] {
+						Expect(sync.Source.Git.Version.Tag).To(Equal("v0.1.0"))
+						Expect(sync.Package.Kustomize.Substitute).To(Equal(map[string]string{"replicas": "1"}))
+					} else {
+						Expect(sync.Source.Git.Version.Tag).To(Equal("v0.2.0"))
+						Expect(sync.Package.Kustomize.Substitute).To(Equal(map[string]string{"replicas": "2"}))
+					}
+				}
+
+				Eventually(func() bool {
+					err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(mod), mod)
+					return err == nil && mod.Status.ObservedGeneration == mod.Generation
+				}, "5s", "1s").Should(BeTrue())
+				Expect(mod.Status.Overrides).To(Equal([]fleetv1.OverrideStatus{
+					{Name: "hold-back", Total: 1, Clusters: []string{clusters[0]}},
+				}))
+				// the fleet default is unchanged
+				Expect(mod.Status.ObservedSync.Source.Git.Version.Tag).To(Equal("v0.2.0"))
+			})
+		})
+
+		Context("module dependencies", func() {
+			It("adds a module to a cluster only once its dependencies have succeeded there", func() {
+				platform := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{},
+						Sync:     makeSync("https://github.com/cuttlefacts/cuttlefacts-platform", "v0.1.2"),
+					},
+				}
+				platform.Name = "platform"
+				platform.Namespace = namespace.Name
+				app := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector:  &metav1.LabelSelector{},
+						Sync:      makeSync("https://github.com/cuttlefacts/app", "v0.3.4"),
+						DependsOn: []fleetv1.LocalModuleReference{{Name: platform.Name}},
+					},
+				}
+				app.Name = "app"
+				app.Namespace = namespace.Name
+				Expect(k8sClient.Create(context.TODO(), app)).To(Succeed())
+				Expect(k8sClient.Create(context.TODO(), platform)).To(Succeed())
+
+				var asms fleetv1.RemoteAssemblageList
+				Eventually(func() bool {
+					err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))
+					return err == nil && len(asms.Items) == len(clusters)
+				}, "5s", "1s").Should(BeTrue())
+				for _, asm := range asms.Items {
+					Expect(asm.Spec.Assemblage.Syncs).To(HaveLen(1))
+					Expect(asm.Spec.Assemblage.Syncs[0].Name).To(Equal(platform.Name))
+				}
+
+				Eventually(func() bool {
+					err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(app), app)
+					return err == nil && app.Status.Summary != nil && app.Status.Summary.Pending == len(clusters)
+				}, "5s", "1s").Should(BeTrue())
+
+				// Report the platform as synced in one cluster; the app
+				// should then be added there, and only there.
+				asm := asms.Items[0]
+				asm.Status.Syncs = []syncapi.SyncStatus{
+					{
+						Sync:  asm.Spec.Assemblage.Syncs[0],
+						State: syncapi.StateSucceeded,
+					},
+				}
+				Expect(k8sClient.Status().Update(context.TODO(), &asm)).To(Succeed())
+
+				Eventually(func() bool {
+					err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&asm), &asm)
+					return err == nil && len(asm.Spec.Assemblage.Syncs) == 2
+				}, "5s", "1s").Should(BeTrue())
+				Expect(k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))).To(Succeed())
+				for _, other := range asms.Items {
+					if other.Name != asm.Name {
+						Expect(other.Spec.Assemblage.Syncs).To(HaveLen(1))
+					}
+				}
+			})
+
+			It("rejects a dependency cycle", func() {
+				a := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector:  &metav1.LabelSelector{},
+						Sync:      makeSync("https://github.com/cuttlefacts/app", "v0.3.4"),
+						DependsOn: []fleetv1.LocalModuleReference{{Name: "b"}},
+					},
+				}
+				a.Name = "a"
+				a.Namespace = namespace.Name
+				b := a.DeepCopy()
+				b.Name = "b"
+				b.Spec.DependsOn = []fleetv1.LocalModuleReference{{Name: "a"}}
+				Expect(k8sClient.Create(context.TODO(), a)).To(Succeed())
+				Expect(k8sClient.Create(context.TODO(), b)).To(Succeed())
+
+				for _, mod := range []*fleetv1.Module{a, b} {
+					Eventually(func() bool {
+						err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(mod), mod)
+						return err == nil && apimeta.IsStatusConditionTrue(mod.Status.Conditions, meta.StalledCondition)
+					}, "5s", "1s").Should(BeTrue())
+					stalled := apimeta.FindStatusCondition(mod.Status.Conditions, meta.StalledCondition)
+					Expect(stalled.Reason).To(Equal(fleetv1.DependencyCycleReason))
+				}
+			})
+		})
 	})
 
 	Context("module status", func() {
@@ -349,18 +794,34 @@ var _ = Describe("modules", func() {
 				Sync: module.Spec.Sync.Sync,
 			}))
 
+			// Without a status from the assemblage, the module is
+			// still rolling out.
+			var m fleetv1.Module
+			Eventually(func() bool {
+				err := k8sClient.Get(context.TODO(), types.NamespacedName{
+					Namespace: module.Namespace,
+					Name:      module.Name,
+				}, &m)
+				return err == nil && apimeta.IsStatusConditionTrue(m.Status.Conditions, meta.ReconcilingCondition)
+			}, "5s", "1s").Should(BeTrue())
+			ready := apimeta.FindStatusCondition(m.Status.Conditions, meta.ReadyCondition)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+			Expect(ready.Reason).To(Equal(fleetv1.RolloutInProgressReason))
+
 			// All that is as expected. Now, give the assemblage a status,
 			// and make sure it gets back to the module.
 			syncs := asm.Spec.Assemblage.Syncs
 			for _, s := range syncs {
 				asm.Status.Syncs = append(asm.Status.Syncs, syncapi.SyncStatus{
-					Sync:  s,
-					State: syncapi.StateSucceeded,
+					Sync:                s,
+					State:               syncapi.StateSucceeded,
+					Message:             "Applied revision: v1.1.0/8a3c1e2",
+					LastAppliedRevision: "v1.1.0/8a3c1e2",
 				})
 			}
 			Expect(k8sClient.Status().Update(context.TODO(), &asm)).To(Succeed())
 
-			var m fleetv1.Module
 			Eventually(func() bool {
 				err := k8sClient.Get(context.TODO(), types.NamespacedName{
 					Namespace: module.Namespace,
@@ -373,8 +834,558 @@ var _ = Describe("modules", func() {
 			}, "5s", "1s").Should(BeTrue())
 			Expect(m.Status.Summary.Total).To(Equal(1))
 			Expect(m.Status.Summary.Succeeded).To(Equal(1))
+
+			// .. and the conditions say it's ready
+			Expect(m.Status.ObservedGeneration).To(Equal(m.Generation))
+			Expect(apimeta.IsStatusConditionTrue(m.Status.Conditions, meta.ReadyCondition)).To(BeTrue())
+			Expect(apimeta.FindStatusCondition(m.Status.Conditions, meta.ReconcilingCondition)).To(BeNil())
+			Expect(apimeta.FindStatusCondition(m.Status.Conditions, meta.StalledCondition)).To(BeNil())
+
+			// .. and the cluster is listed individually
+			Expect(m.Status.Clusters).To(HaveLen(1))
+			Expect(m.Status.Clusters[0].Cluster).To(Equal(cluster.Name))
+			Expect(m.Status.Clusters[0].State).To(Equal(syncapi.StateSucceeded))
+			Expect(m.Status.Clusters[0].Revision).To(Equal("v1.1.0/8a3c1e2"))
+			Expect(m.Status.Clusters[0].Message).To(Equal("Applied revision: v1.1.0/8a3c1e2"))
+			Expect(m.Status.Clusters[0].LastTransitionTime).NotTo(BeNil())
+		})
+
+		It("reports conflicts with other modules", func() {
+			namespace := &corev1.Namespace{}
+			namespace.Name = "ns-" + randString(5)
+			Expect(k8sClient.Create(context.TODO(), namespace)).To(Succeed())
+
+			cluster := clusterv1.Cluster{}
+			cluster.Namespace = namespace.Name
+			cluster.Name = "clus-" + randString(5)
+			Expect(k8sClient.Create(context.TODO(), &cluster)).To(Succeed())
+
+			module := fleetv1.Module{
+				Spec: fleetv1.ModuleSpec{
+					Selector:       &metav1.LabelSelector{}, // match all
+					Sync:           makeSync("https://github.com/cuttlefacts/app", "v1.1.0"),
+					ConflictPolicy: syncapi.ConflictPolicyBlock,
+				},
+			}
+			module.Namespace = namespace.Name
+			module.Name = "mod-" + randString(5)
+			Expect(k8sClient.Create(context.TODO(), &module)).To(Succeed())
+
+			var asms fleetv1.RemoteAssemblageList
+			Eventually(func() bool {
+				err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))
+				return err == nil && len(asms.Items) > 0
+			}, "5s", "1s").Should(BeTrue())
+
+			// The conflict policy is passed on with the sync.
+			asm := asms.Items[0]
+			Expect(asm.Spec.Assemblage.Syncs).To(HaveLen(1))
+			Expect(asm.Spec.Assemblage.Syncs[0].ConflictPolicy).To(Equal(syncapi.ConflictPolicyBlock))
+
+			// Pretend the cluster has found a conflict with another
+			// module.
+			asm.Status.Syncs = []syncapi.SyncStatus{{
+				Sync:    asm.Spec.Assemblage.Syncs[0],
+				State:   syncapi.StateFailed,
+				Message: "blocked by conflict with other",
+				Conflicts: []syncapi.SyncConflict{{
+					Sync:    "other",
+					Objects: []string{"Deployment/default/ingress"},
+					Blocked: true,
+				}},
+			}}
+			Expect(k8sClient.Status().Update(context.TODO(), &asm)).To(Succeed())
+
+			var m fleetv1.Module
+			Eventually(func() bool {
+				err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&module), &m)
+				return err == nil && m.Status.Summary != nil && m.Status.Summary.Conflicted == 1
+			}, "5s", "1s").Should(BeTrue())
+			Expect(m.Status.Summary.Failed).To(Equal(1))
+			Expect(m.Status.Clusters).To(HaveLen(1))
+			Expect(m.Status.Clusters[0].Conflicts).To(Equal([]string{"other"}))
+
+			// A conflict that doesn't block still stalls the module,
+			// since it won't resolve itself.
+			Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&asm), &asm)).To(Succeed())
+			asm.Status.Syncs[0].State = syncapi.StateSucceeded
+			asm.Status.Syncs[0].Message = ""
+			asm.Status.Syncs[0].Conflicts[0].Blocked = false
+			Expect(k8sClient.Status().Update(context.TODO(), &asm)).To(Succeed())
+			Eventually(func() bool {
+				err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&module), &m)
+				return err == nil && m.Status.Summary != nil && m.Status.Summary.Succeeded == 1
+			}, "5s", "1s").Should(BeTrue())
+			Expect(m.Status.Summary.Conflicted).To(Equal(1))
+			stalled := apimeta.FindStatusCondition(m.Status.Conditions, meta.StalledCondition)
+			Expect(stalled).NotTo(BeNil())
+			Expect(stalled.Reason).To(Equal(fleetv1.SyncConflictReason))
+		})
+
+		It("counts unreachable clusters separately", func() {
+			namespace := &corev1.Namespace{}
+			namespace.Name = "ns-" + randString(5)
+			Expect(k8sClient.Create(context.TODO(), namespace)).To(Succeed())
+
+			cluster := clusterv1.Cluster{}
+			cluster.Namespace = namespace.Name
+			cluster.Name = "clus-" + randString(5)
+			Expect(k8sClient.Create(context.TODO(), &cluster)).To(Succeed())
+
+			module := fleetv1.Module{
+				Spec: fleetv1.ModuleSpec{
+					Selector: &metav1.LabelSelector{}, // match all
+					Sync:     makeSync("https://github.com/cuttlefacts/app", "v1.1.0"),
+				},
+			}
+			module.Namespace = namespace.Name
+			module.Name = "mod-" + randString(5)
+			Expect(k8sClient.Create(context.TODO(), &module)).To(Succeed())
+
+			var asms fleetv1.RemoteAssemblageList
+			Eventually(func() bool {
+				err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name))
+				return err == nil && len(asms.Items) > 0
+			}, "5s", "1s").Should(BeTrue())
+
+			// Pretend the sync succeeded, and then the cluster went
+			// away.
+			asm := asms.Items[0]
+			asm.Status.Syncs = []syncapi.SyncStatus{{
+				Sync:  asm.Spec.Assemblage.Syncs[0],
+				State: syncapi.StateSucceeded,
+			}}
+			apimeta.SetStatusCondition(&asm.Status.Conditions, metav1.Condition{
+				Type:    fleetv1.ClusterReachableCondition,
+				Status:  metav1.ConditionFalse,
+				Reason:  fleetv1.ClusterUnreachableReason,
+				Message: "connection refused",
+			})
+			Expect(k8sClient.Status().Update(context.TODO(), &asm)).To(Succeed())
+
+			var m fleetv1.Module
+			Eventually(func() bool {
+				err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(&module), &m)
+				return err == nil && m.Status.Summary != nil && m.Status.Summary.Unreachable == 1
+			}, "5s", "1s").Should(BeTrue())
+			Expect(m.Status.Summary.Succeeded).To(Equal(0))
+			Expect(m.Status.Summary.Updating).To(Equal(0))
+			Expect(m.Status.Clusters).To(HaveLen(1))
+			Expect(m.Status.Clusters[0].State).To(Equal(fleetv1.StateUnreachable))
+			Expect(m.Status.Clusters[0].Message).To(Equal("connection refused"))
+			reconciling := apimeta.FindStatusCondition(m.Status.Conditions, meta.ReconcilingCondition)
+			Expect(reconciling).NotTo(BeNil())
+			Expect(reconciling.Reason).To(Equal(fleetv1.ClusterUnreachableReason))
+		})
+
+	})
+
+	Context("maintenance windows", func() {
+		var namespace *corev1.Namespace
+
+		BeforeEach(func() {
+			namespace = &corev1.Namespace{}
+			namespace.Name = "ns-" + randString(5)
+			Expect(k8sClient.Create(context.TODO(), namespace)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(context.TODO(), namespace)).To(Succeed())
+		})
+
+		It("holds back clusters outside their window, and reports them as pending", func() {
+			closed := clusterv1.Cluster{}
+			closed.Namespace = namespace.Name
+			closed.Name = "closed-" + randString(5)
+			closed.SetAnnotations(map[string]string{
+				// a minute at new year; near enough never
+				fleetv1.MaintenanceScheduleAnnotation: "0 0 1 1 *",
+				fleetv1.MaintenanceDurationAnnotation: "1m",
+			})
+			Expect(k8sClient.Create(context.TODO(), &closed)).To(Succeed())
+
+			open := clusterv1.Cluster{}
+			open.Namespace = namespace.Name
+			open.Name = "open-" + randString(5)
+			open.SetAnnotations(map[string]string{
+				// opens every minute, for an hour; i.e., always
+				fleetv1.MaintenanceScheduleAnnotation: "* * * * *",
+				fleetv1.MaintenanceDurationAnnotation: "1h",
+			})
+			Expect(k8sClient.Create(context.TODO(), &open)).To(Succeed())
+
+			module := fleetv1.Module{
+				Spec: fleetv1.ModuleSpec{
+					Selector: &metav1.LabelSelector{}, // match all
+					Sync:     makeSync("https://github.com/cuttlefacts/app", "v1.1.0"),
+				},
+			}
+			module.Namespace = namespace.Name
+			module.Name = "mod-" + randString(5)
+			Expect(k8sClient.Create(context.TODO(), &module)).To(Succeed())
+
+			var m fleetv1.Module
+			Eventually(func() bool {
+				err := k8sClient.Get(context.TODO(), types.NamespacedName{
+					Namespace: module.Namespace,
+					Name:      module.Name,
+				}, &m)
+				return err == nil && m.Status.Summary != nil && m.Status.Summary.Total == 2
+			}, "5s", "1s").Should(BeTrue())
+			Expect(m.Status.Summary.Pending).To(Equal(1))
+			clusterStates := map[string]syncapi.SyncState{}
+			for _, c := range m.Status.Clusters {
+				clusterStates[c.Cluster] = c.State
+			}
+			Expect(clusterStates).To(HaveKeyWithValue(closed.Name, fleetv1.StatePending))
+
+			var asm fleetv1.RemoteAssemblage
+			Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+				Namespace: namespace.Name,
+				Name:      open.Name,
+			}, &asm)).To(Succeed())
+			err := k8sClient.Get(context.TODO(), types.NamespacedName{
+				Namespace: namespace.Name,
+				Name:      closed.Name,
+			}, &asm)
+			Expect(apierrors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("treats a window it can't read as closed, but lets removals and suspensions through", func() {
+			cluster := clusterv1.Cluster{}
+			cluster.Namespace = namespace.Name
+			cluster.Name = "cluster-" + randString(5)
+			Expect(k8sClient.Create(context.TODO(), &cluster)).To(Succeed())
+
+			var modules []*fleetv1.Module
+			for _, name := range []string{"changed", "removed", "suspended"} {
+				mod := &fleetv1.Module{
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{}, // match all
+						Sync:     makeSync("https://github.com/cuttlefacts/app", "v1.1.0"),
+					},
+				}
+				mod.Namespace = namespace.Name
+				mod.Name = name
+				Expect(k8sClient.Create(context.TODO(), mod)).To(Succeed())
+				modules = append(modules, mod)
+			}
+			changed, removed, suspended := modules[0], modules[1], modules[2]
+
+			asmKey := types.NamespacedName{Namespace: namespace.Name, Name: cluster.Name}
+			var asm fleetv1.RemoteAssemblage
+			Eventually(func() bool {
+				err := k8sClient.Get(context.TODO(), asmKey, &asm)
+				return err == nil && len(asm.Spec.Assemblage.Syncs) == 3
+			}, "5s", "1s").Should(BeTrue())
+
+			cluster.SetAnnotations(map[string]string{
+				fleetv1.MaintenanceScheduleAnnotation: "not a schedule",
+				fleetv1.MaintenanceDurationAnnotation: "1h",
+			})
+			Expect(k8sClient.Update(context.TODO(), &cluster)).To(Succeed())
+			Eventually(func() bool {
+				if err := k8sClient.Get(context.TODO(), asmKey, &asm); err != nil {
+					return false
+				}
+				return apimeta.IsStatusConditionTrue(asm.Status.Conditions, fleetv1.InvalidMaintenanceWindowCondition)
+			}, "5s", "1s").Should(BeTrue())
+
+			changed.Spec.Sync = makeSync("https://github.com/cuttlefacts/app", "v1.2.0")
+			Expect(k8sClient.Update(context.TODO(), changed)).To(Succeed())
+			removed.Spec.Selector = &metav1.LabelSelector{
+				MatchLabels: map[string]string{"app": "none"},
+			}
+			Expect(k8sClient.Update(context.TODO(), removed)).To(Succeed())
+			suspended.Spec.Suspend = true
+			Expect(k8sClient.Update(context.TODO(), suspended)).To(Succeed())
+
+			syncsByName := func() map[string]syncapi.NamedSync {
+				if err := k8sClient.Get(context.TODO(), asmKey, &asm); err != nil {
+					return nil
+				}
+				syncs := map[string]syncapi.NamedSync{}
+				for _, sync := range asm.Spec.Assemblage.Syncs {
+					syncs[sync.Name] = sync
+				}
+				return syncs
+			}
+			tagOf := func(name string) string {
+				sync, ok := syncsByName()[name]
+				if !ok || sync.Source.Git == nil {
+					return ""
+				}
+				return sync.Source.Git.Version.Tag
+			}
+			Eventually(func() bool {
+				syncs := syncsByName()
+				_, ok := syncs[removed.Name]
+				return syncs != nil && !ok && syncs[suspended.Name].Suspend
+			}, "5s", "1s").Should(BeTrue())
+			Consistently(func() string {
+				return tagOf(changed.Name)
+			}, "2s", "500ms").Should(Equal("v1.1.0"))
+
+			condition := apimeta.FindStatusCondition(asm.Status.Conditions, fleetv1.InvalidMaintenanceWindowCondition)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Reason).To(Equal(fleetv1.InvalidMaintenanceWindowReason))
+			Expect(condition.Message).To(ContainSubstring("not a schedule"))
+
+			// Fixing the window lets the change through, and clears
+			// the condition.
+			cluster.SetAnnotations(nil)
+			Expect(k8sClient.Update(context.TODO(), &cluster)).To(Succeed())
+			Eventually(func() bool {
+				return tagOf(changed.Name) == "v1.2.0" &&
+					apimeta.FindStatusCondition(asm.Status.Conditions, fleetv1.InvalidMaintenanceWindowCondition) == nil
+			}, "5s", "1s").Should(BeTrue())
+		})
+	})
+})
+
+var _ = Describe("maintenance window schedules", func() {
+	at := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		Expect(err).NotTo(HaveOccurred())
+		return t
+	}
+
+	It("finds the next activation of a schedule", func() {
+		for _, c := range []struct {
+			schedule, from, next string
+		}{
+			{"* * * * *", "2021-05-01T10:00:30Z", "2021-05-01T10:01:00Z"},
+			{"30 2 * * *", "2021-05-01T10:00:00Z", "2021-05-02T02:30:00Z"},
+			{"*/15 * * * *", "2021-05-01T10:16:00Z", "2021-05-01T10:30:00Z"},
+			{"0 22-23 * * 1-5", "2021-05-01T10:00:00Z", "2021-05-03T22:00:00Z"}, // Saturday -> Monday
+			{"0 0 1 * 0", "2021-05-01T10:00:00Z", "2021-05-02T00:00:00Z"},       // 1st _or_ Sunday
+			{"0 0 29 2 *", "2021-05-01T10:00:00Z", "2024-02-29T00:00:00Z"},
+		} {
+			schedule, err := parseCronSchedule(c.schedule)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedule.next(at(c.from))).To(Equal(at(c.next)), c.schedule)
+		}
+	})
+
+	It("rejects invalid schedules", func() {
+		for _, s := range []string{
+			"* * * *",
+			"60 * * * *",
+			"* 5-2 * * *",
+			"*/0 * * * *",
+			"x * * * *",
+		} {
+			_, err := parseCronSchedule(s)
+			Expect(err).To(HaveOccurred(), s)
+		}
+	})
+
+	It("says whether a window is open, and when it next opens", func() {
+		schedule, err := parseCronSchedule("0 1 * * *")
+		Expect(err).NotTo(HaveOccurred())
+		window := &maintenanceWindow{schedule: schedule, duration: 2 * time.Hour}
+
+		open, _ := window.isOpen(at("2021-05-01T02:59:00Z"))
+		Expect(open).To(BeTrue())
+		open, opens := window.isOpen(at("2021-05-01T03:00:00Z"))
+		Expect(open).To(BeFalse())
+		Expect(opens).To(Equal(at("2021-05-02T01:00:00Z")))
+	})
+})
+
+var _ = Describe("cluster eligibility", func() {
+	It("accepts any cluster not being deleted when there are no criteria", func() {
+		var cluster clusterv1.Cluster
+		ok, _ := clusterEligible(&cluster, nil)
+		Expect(ok).To(BeTrue())
+
+		now := metav1.Now()
+		cluster.SetDeletionTimestamp(&now)
+		ok, _ = clusterEligible(&cluster, nil)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("requires the conditions given to be True", func() {
+		criteria := &fleetv1.ClusterEligibility{
+			Conditions: []string{string(clusterv1.ControlPlaneReadyCondition), string(clusterv1.InfrastructureReadyCondition)},
+		}
+		var cluster clusterv1.Cluster
+		ok, reason := clusterEligible(&cluster, criteria)
+		Expect(ok).To(BeFalse())
+		Expect(reason).To(ContainSubstring("ControlPlaneReady"))
+
+		// the status fields stand in for missing conditions
+		cluster.Status.ControlPlaneReady = true
+		cluster.Status.Conditions = clusterv1.Conditions{
+			{Type: clusterv1.InfrastructureReadyCondition, Status: corev1.ConditionTrue},
+		}
+		ok, _ = clusterEligible(&cluster, criteria)
+		Expect(ok).To(BeTrue())
+
+		cluster.Status.Conditions[0].Status = corev1.ConditionFalse
+		ok, reason = clusterEligible(&cluster, criteria)
+		Expect(ok).To(BeFalse())
+		Expect(reason).To(ContainSubstring("InfrastructureReady"))
+	})
+
+	It("requires the cluster to be in one of the phases given", func() {
+		criteria := &fleetv1.ClusterEligibility{
+			Phases: []string{string(clusterv1.ClusterPhaseProvisioned)},
+		}
+		var cluster clusterv1.Cluster
+		cluster.Status.SetTypedPhase(clusterv1.ClusterPhaseProvisioning)
+		ok, _ := clusterEligible(&cluster, criteria)
+		Expect(ok).To(BeFalse())
+
+		cluster.Status.SetTypedPhase(clusterv1.ClusterPhaseProvisioned)
+		ok, _ = clusterEligible(&cluster, criteria)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("uses the conditions of a remote, and never finds it in a phase", func() {
+		var rem fleetv1.Remote
+		ok, _ := clusterEligible(&rem, &fleetv1.ClusterEligibility{
+			Conditions: []string{"Ready"},
+		})
+		Expect(ok).To(BeFalse())
+
+		rem.Status.Conditions = []metav1.Condition{
+			{Type: "Ready", Status: metav1.ConditionTrue},
+		}
+		ok, _ = clusterEligible(&rem, &fleetv1.ClusterEligibility{
+			Conditions: []string{"Ready"},
 		})
+		Expect(ok).To(BeTrue())
+
+		ok, _ = clusterEligible(&rem, &fleetv1.ClusterEligibility{
+			Phases: []string{string(clusterv1.ClusterPhaseProvisioned)},
+		})
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("module overrides", func() {
+	It("applies matching overrides in order, later ones winning", func() {
+		mod := &fleetv1.Module{
+			Spec: fleetv1.ModuleSpec{
+				Sync: makeSync("https://github.com/cuttlefacts/app", "v0.2.0"),
+				Overrides: []fleetv1.ModuleOverride{
+					{
+						Name:     "by-name",
+						Clusters: []string{"canary"},
+						Version:  &syncapi.GitVersion{Tag: "v0.3.0-rc1"},
+					},
+					{
+						Name: "by-label",
+						Selector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"region": "eu"},
+						},
+						Version: &syncapi.GitVersion{Revision: "abc123"},
+						Bindings: []syncapi.Binding{
+							{
+								Name: "REGION",
+								BindingSource: syncapi.BindingSource{
+									StringValue: &syncapi.StringValue{Value: "eu"},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
 
+		var cluster clusterv1.Cluster
+		cluster.Name = "canary"
+		cluster.SetLabels(map[string]string{"region": "eu"})
+		overrides, err := overridesForCluster(mod, &cluster)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(overrides).To(HaveLen(2))
+
+		sync := syncapi.NamedSync{Name: "mod", Sync: *mod.Spec.Sync.Sync.DeepCopy()}
+		applyOverrides(&sync, overrides)
+		Expect(sync.Source.Git.Version).To(Equal(syncapi.GitVersion{Revision: "abc123"}))
+		Expect(sync.Bindings).To(HaveLen(1))
+		Expect(sync.Package.Kustomize).To(BeNil()) // NB no substitutions, so left alone
+		// the module's own sync is untouched
+		Expect(mod.Spec.Sync.Source.Git.Version).To(Equal(syncapi.GitVersion{Tag: "v0.2.0"}))
+
+		cluster.Name = "other"
+		cluster.SetLabels(nil)
+		overrides, err = overridesForCluster(mod, &cluster)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(overrides).To(BeEmpty())
 	})
+})
+
+var _ = Describe("module dependencies", func() {
+	It("finds a cycle through the module", func() {
+		modules := []fleetv1.Module{
+			{Spec: fleetv1.ModuleSpec{DependsOn: []fleetv1.LocalModuleReference{{Name: "b"}}}},
+			{Spec: fleetv1.ModuleSpec{DependsOn: []fleetv1.LocalModuleReference{{Name: "c"}, {Name: "d"}}}},
+			{Spec: fleetv1.ModuleSpec{DependsOn: []fleetv1.LocalModuleReference{{Name: "a"}}}},
+			{},
+		}
+		for i, name := range []string{"a", "b", "c", "d"} {
+			modules[i].Name = name
+		}
+		Expect(dependencyCycle(&modules[0], modules)).To(Equal([]string{"a", "b", "c", "a"}))
+		Expect(dependencyCycle(&modules[3], modules)).To(BeNil())
 
+		// breaking the cycle
+		a := modules[0].DeepCopy()
+		a.Spec.DependsOn = []fleetv1.LocalModuleReference{{Name: "d"}}
+		Expect(dependencyCycle(a, modules)).To(BeNil())
+	})
+
+	It("reports dependencies that haven't succeeded in the assemblage", func() {
+		mod := &fleetv1.Module{
+			Spec: fleetv1.ModuleSpec{
+				DependsOn: []fleetv1.LocalModuleReference{{Name: "a"}, {Name: "b"}},
+			},
+		}
+		Expect(unreadyDependencies(mod, nil)).To(Equal([]string{"a", "b"}))
+
+		asm := &fleetv1.RemoteAssemblage{}
+		asm.Status.Syncs = []syncapi.SyncStatus{
+			{Sync: syncapi.NamedSync{Name: "a"}, State: syncapi.StateSucceeded},
+			{Sync: syncapi.NamedSync{Name: "b"}, State: syncapi.StateFailed},
+		}
+		Expect(unreadyDependencies(mod, asm)).To(Equal([]string{"b"}))
+	})
+})
+
+var _ = Describe("per-cluster status", func() {
+	It("keeps transition times for clusters left out of the list", func() {
+		then := time.Now().Add(-time.Hour).Truncate(time.Second)
+		now := time.Now().Truncate(time.Second)
+
+		// Enough failed clusters to push a succeeded cluster out
+		// of the list.
+		first := newClusterStatuses(nil, nil, then)
+		for i := 0; i < fleetv1.MaxClusterStatuses; i++ {
+			first.add(fmt.Sprintf("failed-%02d", i), syncapi.StateFailed, "", "", nil)
+		}
+		first.add("succeeded", syncapi.StateSucceeded, "v1", "", nil)
+		listed := first.list()
+		Expect(listed).To(HaveLen(fleetv1.MaxClusterStatuses))
+		for _, entry := range listed {
+			Expect(entry.Cluster).ToNot(Equal("succeeded"))
+		}
+
+		// Later, most of the failed clusters are gone and the rest
+		// fixed, so the succeeded cluster is listed; it still has
+		// its original transition time.
+		second := newClusterStatuses(listed, first.transitions(), now)
+		for i := 0; i < 5; i++ {
+			second.add(fmt.Sprintf("failed-%02d", i), syncapi.StateSucceeded, "v1", "", nil)
+		}
+		second.add("succeeded", syncapi.StateSucceeded, "v1", "", nil)
+		for _, entry := range second.list() {
+			if entry.Cluster == "succeeded" {
+				Expect(entry.LastTransitionTime.Time).To(BeTemporally("==", then))
+			} else {
+				Expect(entry.LastTransitionTime.Time).To(BeTemporally("==", now))
+			}
+		}
+	})
 })
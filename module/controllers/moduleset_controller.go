@@ -0,0 +1,225 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+// ModuleSetReconciler reconciles a ModuleSet object, by creating a
+// module for each set of parameters its generators give, and
+// deleting the modules it created that are no longer wanted.
+type ModuleSetReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=modulesets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=modulesets/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=modulesets/finalizers,verbs=update
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=modules,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remotes,verbs=get;list;watch
+//+kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=gitrepositories,verbs=get;list;watch
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *ModuleSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("moduleset", req.NamespacedName)
+
+	var set fleetv1.ModuleSet
+	if err := r.Get(ctx, req.NamespacedName, &set); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	// The modules are owned by the set, so they will be garbage
+	// collected when it goes.
+	if set.GetDeletionTimestamp() != nil {
+		return ctrl.Result{}, nil
+	}
+
+	params, err := generateParams(ctx, r.Client, &set)
+	if err != nil {
+		var genErr *generatorError
+		if !errors.As(err, &genErr) {
+			return ctrl.Result{}, err
+		}
+		// Either way, this is waiting for something to change; the
+		// module set itself, or the source it refers to.
+		if genErr.reason == fleetv1.ArtifactUnavailableReason {
+			markReconciling(&set, genErr.reason, genErr.Error())
+		} else {
+			markStalled(&set, genErr.reason, genErr.Error())
+		}
+		set.Status.ObservedGeneration = set.Generation
+		if err := r.Status().Update(ctx, &set); err != nil {
+			return ctrl.Result{}, fmt.Errorf("updating status of module set: %w", err)
+		}
+		log.Info("could not generate parameters", "reason", genErr.reason, "error", genErr.Error())
+		return ctrl.Result{}, nil
+	}
+
+	wanted := map[string]*fleetv1.Module{}
+	for _, p := range params {
+		mod, err := moduleFromTemplate(&set, p)
+		if err == nil {
+			if _, ok := wanted[mod.Name]; ok {
+				err = fmt.Errorf("more than one module would be named %q; the template's name must refer to parameters", mod.Name)
+			}
+		}
+		if err != nil {
+			markStalled(&set, fleetv1.GeneratorFailedReason, err.Error())
+			set.Status.ObservedGeneration = set.Generation
+			if err := r.Status().Update(ctx, &set); err != nil {
+				return ctrl.Result{}, fmt.Errorf("updating status of module set: %w", err)
+			}
+			log.Error(err, "could not make module from template")
+			return ctrl.Result{}, nil
+		}
+		wanted[mod.Name] = mod
+	}
+
+	names := make([]string, 0, len(wanted))
+	for name := range wanted {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		desired := wanted[name]
+		mod := &fleetv1.Module{}
+		mod.Namespace = desired.Namespace
+		mod.Name = desired.Name
+		op, err := controllerutil.CreateOrUpdate(ctx, r.Client, mod, func() error {
+			if err := controllerutil.SetControllerReference(&set, mod, r.Scheme); err != nil {
+				return err
+			}
+			if mod.Labels == nil {
+				mod.Labels = map[string]string{}
+			}
+			for k, v := range desired.Labels {
+				mod.Labels[k] = v
+			}
+			mod.Labels[fleetv1.ModuleSetLabel] = set.Name
+			if len(desired.Annotations) > 0 && mod.Annotations == nil {
+				mod.Annotations = map[string]string{}
+			}
+			for k, v := range desired.Annotations {
+				mod.Annotations[k] = v
+			}
+			mod.Spec = desired.Spec
+			return nil
+		})
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("creating or updating module %q: %w", name, err)
+		}
+		log.V(1).Info("generated module", "module", name, "operation", op)
+	}
+
+	// Remove the modules this set created, that it no longer wants.
+	var owned fleetv1.ModuleList
+	if err := r.List(ctx, &owned, client.InNamespace(set.Namespace), client.MatchingLabels{fleetv1.ModuleSetLabel: set.Name}); err != nil {
+		return ctrl.Result{}, fmt.Errorf("listing modules for module set: %w", err)
+	}
+	for i := range owned.Items {
+		mod := &owned.Items[i]
+		if _, ok := wanted[mod.Name]; ok || !metav1.IsControlledBy(mod, &set) {
+			continue
+		}
+		if err := r.Delete(ctx, mod); client.IgnoreNotFound(err) != nil {
+			return ctrl.Result{}, fmt.Errorf("deleting module %q: %w", mod.Name, err)
+		}
+		log.V(1).Info("deleted module", "module", mod.Name)
+	}
+
+	set.Status.Modules = names
+	set.Status.ObservedGeneration = set.Generation
+	markReady(&set, fleetv1.ModulesGeneratedReason, fmt.Sprintf("%d modules", len(names)))
+	if err := r.Status().Update(ctx, &set); err != nil {
+		return ctrl.Result{}, fmt.Errorf("updating status of module set: %w", err)
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ModuleSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&fleetv1.ModuleSet{}).
+		// Put generated modules back if they are changed or deleted
+		// by something else.
+		Owns(&fleetv1.Module{}).
+		// A cluster coming, going or changing its labels may change
+		// the values a cluster generator gives.
+		Watches(
+			&source.Kind{Type: &clusterv1.Cluster{}},
+			handler.EnqueueRequestsFromMapFunc(r.setsForCluster)).
+		Watches(
+			&source.Kind{Type: &fleetv1.Remote{}},
+			handler.EnqueueRequestsFromMapFunc(r.setsForCluster)).
+		// A new artifact may change the directories a git directory
+		// generator gives.
+		Watches(
+			&source.Kind{Type: &sourcev1.GitRepository{}},
+			handler.EnqueueRequestsFromMapFunc(r.setsForGitRepository)).
+		Complete(r)
+}
+
+// setsForCluster gives the module sets in the cluster's namespace
+// that have a cluster generator.
+func (r *ModuleSetReconciler) setsForCluster(cluster client.Object) []reconcile.Request {
+	return r.setsWithGenerator(cluster.GetNamespace(), func(gen *fleetv1.ModuleSetGenerator) bool {
+		return gen.Cluster != nil
+	})
+}
+
+// setsForGitRepository gives the module sets with a git directory
+// generator referring to the git repository.
+func (r *ModuleSetReconciler) setsForGitRepository(repo client.Object) []reconcile.Request {
+	return r.setsWithGenerator(repo.GetNamespace(), func(gen *fleetv1.ModuleSetGenerator) bool {
+		return gen.GitDirectory != nil && gen.GitDirectory.SourceRef.Name == repo.GetName()
+	})
+}
+
+func (r *ModuleSetReconciler) setsWithGenerator(namespace string, pred func(*fleetv1.ModuleSetGenerator) bool) []reconcile.Request {
+	var sets fleetv1.ModuleSetList
+	if err := r.List(context.Background(), &sets, client.InNamespace(namespace)); err != nil {
+		r.Log.Error(err, "getting list of module sets")
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range sets.Items {
+		set := &sets.Items[i]
+		for j := range set.Spec.Generators {
+			if pred(&set.Spec.Generators[j]) {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{
+						Namespace: set.Namespace,
+						Name:      set.Name,
+					},
+				})
+				break
+			}
+		}
+	}
+	return requests
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	sourcev1 "github.com/fluxcd/source-controller/api/v1beta1"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+)
+
+// makeTarball is a convenience for testing, which creates a gzipped
+// tarball with an (empty) file at each of the paths given.
+func makeTarball(paths ...string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, p := range paths {
+		Expect(tw.WriteHeader(&tar.Header{
+			Name:     p,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+		})).To(Succeed())
+	}
+	Expect(tw.Close()).To(Succeed())
+	Expect(gz.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+var _ = Describe("module sets", func() {
+	var (
+		manager     ctrl.Manager
+		stopManager func()
+		managerDone chan struct{}
+	)
+
+	BeforeEach(func() {
+		By("starting a controller manager")
+		var err error
+		manager, err = ctrl.NewManager(cfg, ctrl.Options{
+			Scheme: scheme.Scheme,
+		})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect((&ModuleSetReconciler{
+			Client: manager.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("ModuleSet"),
+			Scheme: manager.GetScheme(),
+		}).SetupWithManager(manager)).To(Succeed())
+
+		var ctx context.Context
+		ctx, stopManager = context.WithCancel(signalHandler)
+		managerDone = make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(manager.Start(ctx)).To(Succeed())
+			close(managerDone)
+		}()
+	})
+
+	AfterEach(func() {
+		stopManager()
+		<-managerDone
+	})
+
+	var namespace *corev1.Namespace
+
+	BeforeEach(func() {
+		namespace = &corev1.Namespace{}
+		namespace.Name = "ns-" + randString(5)
+		Expect(k8sClient.Create(context.TODO(), namespace)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		Expect(k8sClient.Delete(context.TODO(), namespace)).To(Succeed())
+	})
+
+	// modulesFor waits for the module set to be reconciled, then
+	// returns the modules it has created.
+	modulesFor := func(set *fleetv1.ModuleSet) []fleetv1.Module {
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(set), set)
+			return err == nil && set.Status.ObservedGeneration == set.Generation
+		}, "5s", "1s").Should(BeTrue())
+		var mods fleetv1.ModuleList
+		Eventually(func() bool {
+			err := k8sClient.List(context.TODO(), &mods, client.InNamespace(set.Namespace), client.MatchingLabels{fleetv1.ModuleSetLabel: set.Name})
+			return err == nil && len(mods.Items) == len(set.Status.Modules)
+		}, "5s", "1s").Should(BeTrue())
+		return mods.Items
+	}
+
+	It("creates and removes modules for a list of parameters", func() {
+		set := &fleetv1.ModuleSet{
+			Spec: fleetv1.ModuleSetSpec{
+				Generators: []fleetv1.ModuleSetGenerator{
+					{
+						List: &fleetv1.ListGenerator{
+							Elements: []map[string]string{
+								{"APP": "frontend", "VERSION": "v1.0.0"},
+								{"APP": "backend", "VERSION": "v2.0.0"},
+							},
+						},
+					},
+				},
+				Template: fleetv1.ModuleTemplate{
+					Metadata: fleetv1.ModuleTemplateMetadata{
+						Name:   "app-$(APP)",
+						Labels: map[string]string{"app": "$(APP)"},
+					},
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{},
+						Sync:     makeSync("https://github.com/cuttlefacts/$(APP)", "$(VERSION)"),
+					},
+				},
+			},
+		}
+		set.Spec.Template.Spec.ControlPlaneBindings = []syncapi.Binding{
+			{
+				Name: "NAME",
+				BindingSource: syncapi.BindingSource{
+					StringValue: &syncapi.StringValue{Value: "$(CLUSTER_NAME)"}, // NB not a parameter
+				},
+			},
+		}
+		set.Namespace = namespace.Name
+		set.Name = "set-" + randString(5)
+		Expect(k8sClient.Create(context.TODO(), set)).To(Succeed())
+
+		mods := modulesFor(set)
+		Expect(set.Status.Modules).To(Equal([]string{"app-backend", "app-frontend"}))
+		for _, mod := range mods {
+			Expect(metav1.IsControlledBy(&mod, set)).To(BeTrue())
+			app := mod.Labels["app"]
+			Expect(mod.Name).To(Equal("app-" + app))
+			Expect(mod.Spec.Sync.Source.Git.URL).To(Equal("https://github.com/cuttlefacts/" + app))
+			Expect(mod.Spec.ControlPlaneBindings[0].StringValue.Value).To(Equal("$(CLUSTER_NAME)"))
+		}
+
+		// dropping a set of parameters removes its module
+		set.Spec.Generators[0].List.Elements = set.Spec.Generators[0].List.Elements[:1]
+		Expect(k8sClient.Update(context.TODO(), set)).To(Succeed())
+		mods = modulesFor(set)
+		Expect(mods).To(HaveLen(1))
+		Expect(mods[0].Name).To(Equal("app-frontend"))
+	})
+
+	It("creates a module per distinct value of a cluster label", func() {
+		for _, region := range []string{"eu", "eu", "us", ""} {
+			cluster := &clusterv1.Cluster{}
+			cluster.Name = "cluster-" + randString(5)
+			cluster.Namespace = namespace.Name
+			if region != "" {
+				cluster.SetLabels(map[string]string{"region": region})
+			}
+			Expect(k8sClient.Create(context.TODO(), cluster)).To(Succeed())
+		}
+
+		set := &fleetv1.ModuleSet{
+			Spec: fleetv1.ModuleSetSpec{
+				Generators: []fleetv1.ModuleSetGenerator{
+					{Cluster: &fleetv1.ClusterGenerator{Label: "region"}},
+				},
+				Template: fleetv1.ModuleTemplate{
+					Metadata: fleetv1.ModuleTemplateMetadata{
+						Name: "ingress-$(LABEL_VALUE)",
+					},
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{
+							MatchLabels: map[string]string{"region": "$(LABEL_VALUE)"},
+						},
+						Sync: makeSync("https://github.com/cuttlefacts/ingress", "v1.0.0"),
+					},
+				},
+			},
+		}
+		set.Namespace = namespace.Name
+		set.Name = "set-" + randString(5)
+		Expect(k8sClient.Create(context.TODO(), set)).To(Succeed())
+
+		modulesFor(set)
+		Expect(set.Status.Modules).To(Equal([]string{"ingress-eu", "ingress-us"}))
+
+		// a cluster in a new region gets a module
+		cluster := &clusterv1.Cluster{}
+		cluster.Name = "cluster-" + randString(5)
+		cluster.Namespace = namespace.Name
+		cluster.SetLabels(map[string]string{"region": "ap"})
+		Expect(k8sClient.Create(context.TODO(), cluster)).To(Succeed())
+		Eventually(func() []string {
+			_ = k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(set), set)
+			return set.Status.Modules
+		}, "5s", "1s").Should(Equal([]string{"ingress-ap", "ingress-eu", "ingress-us"}))
+	})
+
+	It("creates a module per directory in a git repository", func() {
+		tarball := makeTarball("apps/frontend/kustomization.yaml", "apps/backend/deploy.yaml", "README.md", "infra/x/y.yaml")
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write(tarball)
+		}))
+		defer server.Close()
+
+		repo := &sourcev1.GitRepository{
+			Spec: sourcev1.GitRepositorySpec{
+				URL:      "https://github.com/cuttlefacts/apps",
+				Interval: metav1.Duration{Duration: time.Minute},
+			},
+		}
+		repo.Namespace = namespace.Name
+		repo.Name = "apps"
+		Expect(k8sClient.Create(context.TODO(), repo)).To(Succeed())
+
+		set := &fleetv1.ModuleSet{
+			Spec: fleetv1.ModuleSetSpec{
+				Generators: []fleetv1.ModuleSetGenerator{
+					{
+						GitDirectory: &fleetv1.GitDirectoryGenerator{
+							SourceRef: fleetv1.LocalGitRepositoryReference{Name: repo.Name},
+							Path:      "apps/*",
+						},
+					},
+				},
+				Template: fleetv1.ModuleTemplate{
+					Metadata: fleetv1.ModuleTemplateMetadata{
+						Name: "$(DIRECTORY_NAME)",
+					},
+					Spec: fleetv1.ModuleSpec{
+						Selector: &metav1.LabelSelector{},
+						Sync:     makeSync("https://github.com/cuttlefacts/apps", "v1.0.0"),
+					},
+				},
+			},
+		}
+		set.Spec.Template.Spec.Sync.Package = &syncapi.PackageSpec{
+			Kustomize: &syncapi.KustomizeSpec{Path: "$(DIRECTORY_PATH)"},
+		}
+		set.Namespace = namespace.Name
+		set.Name = "set-" + randString(5)
+		Expect(k8sClient.Create(context.TODO(), set)).To(Succeed())
+
+		// no artifact yet, so it waits
+		Eventually(func() bool {
+			err := k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(set), set)
+			return err == nil && set.Status.ObservedGeneration == set.Generation
+		}, "5s", "1s").Should(BeTrue())
+		Expect(set.Status.Modules).To(BeEmpty())
+
+		repo.Status.Artifact = &sourcev1.Artifact{
+			Path:     "gitrepository/apps/abc123.tar.gz",
+			URL:      server.URL + "/gitrepository/apps/abc123.tar.gz",
+			Revision: "main/abc123",
+		}
+		Expect(k8sClient.Status().Update(context.TODO(), repo)).To(Succeed())
+
+		Eventually(func() []string {
+			_ = k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(set), set)
+			return set.Status.Modules
+		}, "5s", "1s").Should(Equal([]string{"backend", "frontend"}))
+		for _, mod := range modulesFor(set) {
+			Expect(mod.Spec.Sync.Package.Kustomize.Path).To(Equal("apps/" + mod.Name))
+		}
+	})
+})
+
+var _ = Describe("module set generators", func() {
+	It("finds all the directories in a tarball", func() {
+		dirs, err := tarballDirectories(bytes.NewReader(makeTarball("a/b/c.yaml", "./d/e.yaml", "f.yaml")))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(dirs).To(Equal([]string{"a", "a/b", "d"}))
+	})
+
+	It("expands parameters in a template, leaving other references", func() {
+		set := &fleetv1.ModuleSet{
+			Spec: fleetv1.ModuleSetSpec{
+				Template: fleetv1.ModuleTemplate{
+					Metadata: fleetv1.ModuleTemplateMetadata{
+						Name: "app-$(APP)",
+					},
+					Spec: fleetv1.ModuleSpec{
+						Sync: makeSync("https://github.com/cuttlefacts/$(APP)", "$(OTHER)"),
+					},
+				},
+			},
+		}
+		set.Namespace = "default"
+		mod, err := moduleFromTemplate(set, map[string]string{"APP": "frontend"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(mod.Namespace).To(Equal("default"))
+		Expect(mod.Name).To(Equal("app-frontend"))
+		Expect(mod.Spec.Sync.Source.Git.URL).To(Equal("https://github.com/cuttlefacts/frontend"))
+		Expect(mod.Spec.Sync.Source.Git.Version.Tag).To(Equal("$(OTHER)"))
+		// the template is not changed
+		Expect(set.Spec.Template.Metadata.Name).To(Equal("app-$(APP)"))
+	})
+})
@@ -0,0 +1,139 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"sort"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+)
+
+// checkOverrides makes sure the selectors in the module's overrides
+// can be used. An error here won't go away until the module changes.
+func checkOverrides(mod *fleetv1.Module) error {
+	for i := range mod.Spec.Overrides {
+		override := &mod.Spec.Overrides[i]
+		if _, err := metav1.LabelSelectorAsSelector(override.Selector); err != nil {
+			return &selectionError{
+				reason: fleetv1.InvalidSelectorReason,
+				err:    fmt.Errorf("override %q: %w", override.Name, err),
+			}
+		}
+	}
+	return nil
+}
+
+// overridesForCluster gives the module's overrides that apply to the
+// cluster, in the order they are given in the module.
+func overridesForCluster(mod *fleetv1.Module, cluster metav1.Object) ([]*fleetv1.ModuleOverride, error) {
+	var result []*fleetv1.ModuleOverride
+overrides:
+	for i := range mod.Spec.Overrides {
+		override := &mod.Spec.Overrides[i]
+		for _, name := range override.Clusters {
+			if name == cluster.GetName() {
+				result = append(result, override)
+				continue overrides
+			}
+		}
+		selector, err := metav1.LabelSelectorAsSelector(override.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("override %q: %w", override.Name, err)
+		}
+		if selector.Matches(labels.Set(cluster.GetLabels())) {
+			result = append(result, override)
+		}
+	}
+	return result, nil
+}
+
+// applyOverrides changes the sync given according to each of the
+// overrides, in order. The sync is expected to have been specialised
+// for a cluster already, and not to share anything with the module
+// it came from.
+func applyOverrides(sync *syncapi.NamedSync, overrides []*fleetv1.ModuleOverride) {
+	for _, override := range overrides {
+		if v := override.Version; v != nil && sync.Source.Git != nil {
+			sync.Source.Git.Version = *v
+		}
+		for _, b := range override.Bindings {
+			sync.Bindings = setBinding(sync.Bindings, b)
+		}
+		if len(override.Substitute) > 0 {
+			// The package is defaulted to a kustomization at the
+			// root of the source, so stand that in if it's missing.
+			if sync.Package == nil {
+				sync.Package = &syncapi.PackageSpec{}
+			}
+			if sync.Package.Kustomize == nil {
+				sync.Package.Kustomize = &syncapi.KustomizeSpec{Path: "."}
+			}
+			if sync.Package.Kustomize.Substitute == nil {
+				sync.Package.Kustomize.Substitute = map[string]string{}
+			}
+			for k, v := range override.Substitute {
+				sync.Package.Kustomize.Substitute[k] = v
+			}
+		}
+	}
+}
+
+// setBinding replaces the binding with the same name as that given,
+// or appends it if there's no such binding.
+func setBinding(bindings []syncapi.Binding, binding syncapi.Binding) []syncapi.Binding {
+	for i := range bindings {
+		if bindings[i].Name == binding.Name {
+			bindings[i] = binding
+			return bindings
+		}
+	}
+	return append(bindings, binding)
+}
+
+// overrideStatuses accumulates the clusters to which each of a
+// module's overrides applies.
+type overrideStatuses struct {
+	clusters map[string][]string
+}
+
+func newOverrideStatuses() *overrideStatuses {
+	return &overrideStatuses{clusters: map[string][]string{}}
+}
+
+func (o *overrideStatuses) add(cluster string, overrides []*fleetv1.ModuleOverride) {
+	for _, override := range overrides {
+		o.clusters[override.Name] = append(o.clusters[override.Name], cluster)
+	}
+}
+
+// list returns an entry for each override that applies to at least
+// one cluster, in the order the overrides are given in the module.
+func (o *overrideStatuses) list(mod *fleetv1.Module) []fleetv1.OverrideStatus {
+	var entries []fleetv1.OverrideStatus
+	for _, override := range mod.Spec.Overrides {
+		clusters, ok := o.clusters[override.Name]
+		if !ok {
+			continue
+		}
+		sort.Strings(clusters)
+		entry := fleetv1.OverrideStatus{
+			Name:     override.Name,
+			Total:    len(clusters),
+			Clusters: clusters,
+		}
+		if len(clusters) > fleetv1.MaxClusterStatuses {
+			entry.Clusters = clusters[:fleetv1.MaxClusterStatuses]
+		}
+		entries = append(entries, entry)
+		// an override name given twice is only reported once
+		delete(o.clusters, override.Name)
+	}
+	return entries
+}
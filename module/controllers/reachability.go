@@ -0,0 +1,127 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/fluxcd/pkg/apis/meta"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+const (
+	// minUnreachableBackoff is how long to wait before trying an
+	// unreachable cluster again, the first time.
+	minUnreachableBackoff = 5 * time.Second
+	// maxUnreachableBackoff is the longest to wait before trying an
+	// unreachable cluster again.
+	maxUnreachableBackoff = 5 * time.Minute
+	// lastContactResolution is how stale the last contact time can
+	// get before it's refreshed. Refreshing it every time would
+	// mean every status update prompted another reconciliation.
+	lastContactResolution = time.Minute
+)
+
+// clusterBackoff counts the consecutive failures to reach each
+// cluster, so that an unreachable cluster is tried less and less
+// often, without affecting how often the others are tried.
+type clusterBackoff struct {
+	mu       sync.Mutex
+	failures map[client.ObjectKey]int
+}
+
+func newClusterBackoff() *clusterBackoff {
+	return &clusterBackoff{
+		failures: map[client.ObjectKey]int{},
+	}
+}
+
+// failed records a failure to reach the cluster, and returns how long
+// to wait before trying it again.
+func (b *clusterBackoff) failed(cluster client.ObjectKey) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := b.failures[cluster]
+	b.failures[cluster] = n + 1
+	delay := minUnreachableBackoff
+	for i := 0; i < n && delay < maxUnreachableBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxUnreachableBackoff {
+		delay = maxUnreachableBackoff
+	}
+	return delay
+}
+
+// reset records that the cluster was reached.
+func (b *clusterBackoff) reset(cluster client.ObjectKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, cluster)
+}
+
+// isUnreachable says whether an error from talking to a remote
+// cluster means it couldn't be reached, as opposed to it refusing the
+// request.
+func isUnreachable(err error) bool {
+	var status apierrors.APIStatus
+	return !errors.As(err, &status)
+}
+
+// markReachable records that the remote cluster was contacted just
+// now, in the conditions of the object and the last contact time
+// given (which is a field in its status).
+func markReachable(obj meta.ObjectWithStatusConditions, lastContact **metav1.Time, now metav1.Time) {
+	if last := *lastContact; last == nil || now.Sub(last.Time) >= lastContactResolution {
+		*lastContact = &now
+	}
+	markContacted(obj)
+}
+
+// markContacted sets the condition saying the remote cluster was
+// contacted, without touching the last contact time; e.g., because
+// it's the agent in the remote cluster that records it.
+func markContacted(obj meta.ObjectWithStatusConditions) {
+	apimeta.SetStatusCondition(obj.GetStatusConditions(), metav1.Condition{
+		Type:    fleetv1.ClusterReachableCondition,
+		Status:  metav1.ConditionTrue,
+		Reason:  fleetv1.ClusterContactedReason,
+		Message: "cluster contacted",
+	})
+}
+
+// markUnreachable records that the remote cluster could not be
+// contacted, and when it last was.
+func markUnreachable(obj meta.ObjectWithStatusConditions, lastContact *metav1.Time, err error) {
+	message := err.Error()
+	if lastContact != nil {
+		message = fmt.Sprintf("%s (last contact at %s)", message, lastContact.UTC().Format(time.RFC3339))
+	}
+	apimeta.SetStatusCondition(obj.GetStatusConditions(), metav1.Condition{
+		Type:    fleetv1.ClusterReachableCondition,
+		Status:  metav1.ConditionFalse,
+		Reason:  fleetv1.ClusterUnreachableReason,
+		Message: message,
+	})
+	markReconciling(obj, fleetv1.ClusterUnreachableReason, message)
+}
+
+// clusterUnreachable reports whether the remote assemblage records its
+// cluster as unreachable, along with the message saying why.
+func clusterUnreachable(asm *fleetv1.RemoteAssemblage) (bool, string) {
+	c := apimeta.FindStatusCondition(asm.Status.Conditions, fleetv1.ClusterReachableCondition)
+	if c == nil || c.Status != metav1.ConditionFalse {
+		return false, ""
+	}
+	return true, c.Message
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/discovery"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	"github.com/squaremo/fleeet/module/remote"
+	"github.com/squaremo/fleeet/module/sharding"
+)
+
+// remoteContactTimeout is how long to wait for a remote cluster's API
+// server to answer, when checking it can be reached.
+const remoteContactTimeout = 10 * time.Second
+
+// RemoteReconciler reconciles a Remote object, by checking that the
+// cluster it refers to can be reached, and reporting that in its
+// status. For a remote in pull mode, it creates the service account
+// and permissions for the agent in the remote cluster instead.
+type RemoteReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// Shard gives the subset of clusters to check. If nil, all
+	// clusters are included.
+	Shard *sharding.Shard
+
+	// ProbeInterval gives how often to contact each remote cluster,
+	// to check it is still reachable. If zero, DefaultProbeInterval
+	// is used.
+	ProbeInterval time.Duration
+
+	// backoff tracks failures to reach each remote cluster
+	backoff *clusterBackoff
+}
+
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remotes,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remotes/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remotes/finalizers,verbs=update
+//+kubebuilder:rbac:groups=cluster.x-k8s.io,resources=clusters,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;
+//+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile is part of the main kubernetes reconciliation loop which aims to
+// move the current state of the cluster closer to the desired state.
+func (r *RemoteReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("remote", req.NamespacedName)
+
+	var rem fleetv1.Remote
+	if err := r.Get(ctx, req.NamespacedName, &rem); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.backoff.reset(req.NamespacedName)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	rem.Status.ObservedGeneration = rem.Generation
+
+	// A Cluster with the same name takes precedence, so there's no
+	// point in checking the cluster this refers to.
+	var cluster clusterv1.Cluster
+	err := r.Get(ctx, req.NamespacedName, &cluster)
+	switch {
+	case err == nil:
+		markStalled(&rem, fleetv1.ShadowedByClusterReason, "there is a Cluster with the same name, which is used instead")
+		return ctrl.Result{}, r.updateStatus(ctx, &rem)
+	case !apierrors.IsNotFound(err):
+		return ctrl.Result{}, err
+	}
+
+	if rem.IsPull() {
+		if err := r.enrolAgent(ctx, &rem); err != nil {
+			return ctrl.Result{}, fmt.Errorf("enrolling agent: %w", err)
+		}
+		// The cluster isn't contacted from here; whether the agent
+		// is in touch is reported in the remote assemblage.
+		r.backoff.reset(req.NamespacedName)
+		apimeta.RemoveStatusCondition(&rem.Status.Conditions, fleetv1.ClusterReachableCondition)
+		markReady(&rem, fleetv1.AgentEnrolledReason, fmt.Sprintf("service account %q created for the agent in the remote cluster", rem.Status.ServiceAccountName))
+		return ctrl.Result{}, r.updateStatus(ctx, &rem)
+	}
+	if err := r.disenrolAgent(ctx, &rem); err != nil {
+		return ctrl.Result{}, fmt.Errorf("removing agent service account: %w", err)
+	}
+
+	if rem.Spec.KubeconfigRef.RemoteRef != nil {
+		markStalled(&rem, fleetv1.InvalidKubeconfigRefReason, "a Remote may not refer to another Remote")
+		return ctrl.Result{}, r.updateStatus(ctx, &rem)
+	}
+	key, err := kubeconfigKeyFor(ctx, r.Client, rem.Namespace, rem.Spec.KubeconfigRef)
+	if err != nil {
+		markStalled(&rem, fleetv1.InvalidKubeconfigRefReason, err.Error())
+		return ctrl.Result{}, r.updateStatus(ctx, &rem)
+	}
+
+	version, err := serverVersion(ctx, r.Client, key)
+	if err != nil {
+		retry := r.backoff.failed(req.NamespacedName)
+		log.Error(err, "remote cluster unreachable", "retry", retry)
+		markUnreachable(&rem, rem.Status.LastContactTime, err)
+		return ctrl.Result{RequeueAfter: retry}, r.updateStatus(ctx, &rem)
+	}
+
+	r.backoff.reset(req.NamespacedName)
+	markReachable(&rem, &rem.Status.LastContactTime, metav1.Now())
+	rem.Status.KubernetesVersion = version
+	markReady(&rem, fleetv1.ClusterContactedReason, fmt.Sprintf("cluster contacted, running Kubernetes %s", version))
+	if err := r.updateStatus(ctx, &rem); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: r.probeInterval()}, nil
+}
+
+func (r *RemoteReconciler) updateStatus(ctx context.Context, rem *fleetv1.Remote) error {
+	if err := r.Status().Update(ctx, rem); err != nil {
+		return fmt.Errorf("updating status of remote: %w", err)
+	}
+	return nil
+}
+
+func (r *RemoteReconciler) probeInterval() time.Duration {
+	if r.ProbeInterval == 0 {
+		return DefaultProbeInterval
+	}
+	return r.ProbeInterval
+}
+
+// serverVersion asks the API server of the cluster whose kubeconfig
+// is given for its version. This uses a client of its own, rather
+// than one kept by a remote.Tracker, so that it tests the kubeconfig
+// as it is now.
+func serverVersion(ctx context.Context, c client.Reader, key remote.KubeconfigKey) (string, error) {
+	config, _, err := remote.RESTConfig(ctx, c, key)
+	if err != nil {
+		return "", err
+	}
+	config.Timeout = remoteContactTimeout
+	disco, err := discovery.NewDiscoveryClientForConfig(config)
+	if err != nil {
+		return "", err
+	}
+	info, err := disco.ServerVersion()
+	if err != nil {
+		return "", err
+	}
+	return info.GitVersion, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RemoteReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.backoff = newClusterBackoff()
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&fleetv1.Remote{}, builder.WithPredicates(r.Shard.Predicate())).
+		Owns(&corev1.ServiceAccount{}).
+		Owns(&rbacv1.Role{}).
+		Owns(&rbacv1.RoleBinding{}).
+		Complete(r)
+}
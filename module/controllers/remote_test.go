@@ -10,9 +10,14 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/fluxcd/pkg/apis/meta"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/clientcmd"
@@ -21,6 +26,7 @@ import (
 	"sigs.k8s.io/cluster-api/util/kubeconfig"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/envtest"
 
 	asmv1 "github.com/squaremo/fleeet/assemblage/api/v1alpha1"
@@ -60,8 +66,18 @@ var _ = Describe("remote assemblages", func() {
 			Client: manager.GetClient(),
 			Log:    ctrl.Log.WithName("controllers").WithName("RemoteAssemblage"),
 			Scheme: manager.GetScheme(),
+
+			DeletionTimeout: 5 * time.Second,
+			// The tests mostly look for assemblages downstream in
+			// the same namespace as upstream.
+			DownstreamNamespace: "default",
 		}
 		Expect(remoteReconciler.SetupWithManager(manager)).To(Succeed())
+		Expect((&RemoteReconciler{
+			Client: manager.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("Remote"),
+			Scheme: manager.GetScheme(),
+		}).SetupWithManager(manager)).To(Succeed())
 
 		var ctx context.Context
 		ctx, stopManager = context.WithCancel(signalHandler)
@@ -122,10 +138,619 @@ var _ = Describe("remote assemblages", func() {
 				return err == nil
 			}, timeout, interval).Should(BeTrue())
 			Expect(asm.Spec.Syncs).To(Equal(proxy.Spec.Assemblage.Syncs))
+
+			// There's no assemblage controller downstream, so the sync
+			// will never get a status; the remote assemblage should
+			// say it's still in progress.
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), types.NamespacedName{
+					Name:      proxy.Name,
+					Namespace: proxy.Namespace,
+				}, &proxy)
+				return err == nil && apimeta.IsStatusConditionTrue(proxy.Status.Conditions, meta.ReconcilingCondition)
+			}, timeout, interval).Should(BeTrue())
+			Expect(proxy.Status.ObservedGeneration).To(Equal(proxy.Generation))
+			Expect(apimeta.IsStatusConditionFalse(proxy.Status.Conditions, meta.ReadyCondition)).To(BeTrue())
+			Expect(apimeta.IsStatusConditionTrue(proxy.Status.Conditions, fleetv1.ClusterReachableCondition)).To(BeTrue())
+			Expect(proxy.Status.LastContactTime).ToNot(BeNil())
+		})
+
+		It("puts the assemblage in the downstream namespace given, and moves it when that changes", func() {
+			sync := syncapi.NamedSync{
+				Name: "app",
+				Sync: syncapi.Sync{
+					Source: syncapi.SourceSpec{
+						Git: &syncapi.GitSource{
+							URL:     "https://github.com/cuttlefacts/cuttlefacts-app",
+							Version: syncapi.GitVersion{Tag: "v0.3.0"},
+						},
+					},
+				},
+			}
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{Name: clusterSecret.Name},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: []syncapi.NamedSync{sync},
+					},
+					DownstreamNamespace: "team-" + randString(5),
+				},
+			}
+			proxy.Name = "test-proxy-namespace"
+			proxy.Namespace = "default"
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			// The namespace doesn't exist downstream, so it's
+			// created.
+			var asm asmv1.Assemblage
+			Eventually(func() error {
+				return downstreamK8sClient.Get(context.Background(), types.NamespacedName{
+					Namespace: proxy.Spec.DownstreamNamespace,
+					Name:      proxy.Name,
+				}, &asm)
+			}, timeout, interval).Should(Succeed())
+			Expect(asm.Labels).To(HaveKeyWithValue(asmv1.UpstreamNamespaceLabel, proxy.Namespace))
+			Eventually(func() string {
+				if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy); err != nil {
+					return ""
+				}
+				return proxy.Status.DownstreamNamespace
+			}, timeout, interval).Should(Equal(proxy.Spec.DownstreamNamespace))
+
+			previous := proxy.Spec.DownstreamNamespace
+			Eventually(func() error {
+				if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy); err != nil {
+					return err
+				}
+				proxy.Spec.DownstreamNamespace = "team-" + randString(5)
+				return k8sClient.Update(context.Background(), &proxy)
+			}, timeout, interval).Should(Succeed())
+			next := proxy.Spec.DownstreamNamespace
+			previousKey := types.NamespacedName{Namespace: previous, Name: proxy.Name}
+			nextKey := types.NamespacedName{Namespace: next, Name: proxy.Name}
+
+			// The assemblage is created in the new namespace, and
+			// the old one is left alone until the new one's syncs
+			// have been applied.
+			var moved asmv1.Assemblage
+			Eventually(func() error {
+				return downstreamK8sClient.Get(context.Background(), nextKey, &moved)
+			}, timeout, interval).Should(Succeed())
+			Consistently(func() bool {
+				err := downstreamK8sClient.Get(context.Background(), previousKey, &asm)
+				return err == nil && len(asm.Spec.Syncs) == 1 && asm.Spec.Syncs[0].DeletionPolicy == ""
+			}, "2s", interval).Should(BeTrue())
+
+			// There's no assemblage controller downstream, so the
+			// statuses are supplied here.
+			moved.Status.Syncs = []syncapi.SyncStatus{{Sync: moved.Spec.Syncs[0], State: syncapi.StateSucceeded}}
+			Expect(downstreamK8sClient.Status().Update(context.Background(), &moved)).To(Succeed())
+
+			// Then the old one is told to leave what it synced in
+			// place ..
+			Eventually(func() bool {
+				err := downstreamK8sClient.Get(context.Background(), previousKey, &asm)
+				return err == nil && len(asm.Spec.Syncs) == 1 && asm.Spec.Syncs[0].DeletionPolicy == syncapi.DeletionPolicyOrphan
+			}, timeout, interval).Should(BeTrue())
+			asm.Status.Syncs = []syncapi.SyncStatus{{Sync: asm.Spec.Syncs[0], State: syncapi.StateSucceeded}}
+			Expect(downstreamK8sClient.Status().Update(context.Background(), &asm)).To(Succeed())
+
+			// .. and its syncs are removed ..
+			Eventually(func() bool {
+				err := downstreamK8sClient.Get(context.Background(), previousKey, &asm)
+				return err == nil && len(asm.Spec.Syncs) == 0
+			}, timeout, interval).Should(BeTrue())
+			asm.Status.Syncs = nil
+			Expect(downstreamK8sClient.Status().Update(context.Background(), &asm)).To(Succeed())
+
+			// .. then it's deleted, and the move is recorded.
+			Eventually(func() bool {
+				err := downstreamK8sClient.Get(context.Background(), previousKey, &asm)
+				return apierrors.IsNotFound(err)
+			}, timeout, interval).Should(BeTrue())
+			Eventually(func() string {
+				if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy); err != nil {
+					return ""
+				}
+				return proxy.Status.DownstreamNamespace
+			}, timeout, interval).Should(Equal(next))
+		})
+
+		It("leaves an assemblage made before the namespace was recorded where it is", func() {
+			// Before the downstream namespace was recorded, the
+			// assemblage was always in the same namespace as the
+			// remote assemblage, which isn't the namespace the
+			// controller would use now.
+			upstreamNamespace := "legacy-" + randString(5)
+			for _, c := range []client.Client{k8sClient, downstreamK8sClient} {
+				ns := corev1.Namespace{}
+				ns.Name = upstreamNamespace
+				Expect(c.Create(context.Background(), &ns)).To(Succeed())
+			}
+			syncs := []syncapi.NamedSync{{
+				Name: "app",
+				Sync: syncapi.Sync{
+					Source: syncapi.SourceSpec{
+						Git: &syncapi.GitSource{
+							URL:     "https://github.com/cuttlefacts/cuttlefacts-app",
+							Version: syncapi.GitVersion{Tag: "v0.3.0"},
+						},
+					},
+				},
+			}}
+			var legacy asmv1.Assemblage
+			legacy.Name = "test-proxy-legacy"
+			legacy.Namespace = upstreamNamespace
+			legacy.Spec.Syncs = syncs
+			Expect(downstreamK8sClient.Create(context.Background(), &legacy)).To(Succeed())
+
+			secret := clusterSecret.DeepCopy()
+			secret.ObjectMeta = metav1.ObjectMeta{Name: clusterSecret.Name, Namespace: upstreamNamespace}
+			Expect(k8sClient.Create(context.Background(), secret)).To(Succeed())
+
+			// This has no status, as it would be just after
+			// upgrading.
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{Name: secret.Name},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: syncs,
+					},
+				},
+			}
+			proxy.Name = legacy.Name
+			proxy.Namespace = upstreamNamespace
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			Eventually(func() string {
+				if err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy); err != nil {
+					return ""
+				}
+				return proxy.Status.DownstreamNamespace
+			}, timeout, interval).Should(Equal(upstreamNamespace))
+			Consistently(func() bool {
+				var asm asmv1.Assemblage
+				if err := downstreamK8sClient.Get(context.Background(), client.ObjectKeyFromObject(&legacy), &asm); err != nil {
+					return false
+				}
+				err := downstreamK8sClient.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: legacy.Name}, &asm)
+				return apierrors.IsNotFound(err)
+			}, "2s", interval).Should(BeTrue())
+			Expect(downstreamK8sClient.Get(context.Background(), client.ObjectKeyFromObject(&legacy), &legacy)).To(Succeed())
+			Expect(legacy.Spec.Syncs).To(HaveLen(1))
+			Expect(legacy.Labels).To(HaveKeyWithValue(asmv1.UpstreamNamespaceLabel, upstreamNamespace))
+		})
+
+		It("reports the downstream status when it changes", func() {
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{Name: clusterSecret.Name},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: []syncapi.NamedSync{
+							{
+								Name: "app",
+								Sync: syncapi.Sync{
+									Source: syncapi.SourceSpec{
+										Git: &syncapi.GitSource{
+											URL:     "https://github.com/cuttlefacts/cuttlefacts-app",
+											Version: syncapi.GitVersion{Tag: "v0.3.0"},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+			proxy.Name = "test-proxy-status"
+			proxy.Namespace = "default"
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			var asm asmv1.Assemblage
+			Eventually(func() error {
+				return downstreamK8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &asm)
+			}, timeout, interval).Should(Succeed())
+
+			// Nothing changes upstream here; the status has to come
+			// from watching the downstream assemblage.
+			asm.Status.Syncs = []syncapi.SyncStatus{{
+				Sync:  asm.Spec.Syncs[0],
+				State: syncapi.StateSucceeded,
+				Inventory: &syncapi.SyncInventory{
+					Total:   1,
+					Kinds:   map[string]int{"Deployment": 1},
+					Objects: []string{"Deployment/default/cuttlefacts-app"},
+				},
+			}}
+			Expect(downstreamK8sClient.Status().Update(context.Background(), &asm)).To(Succeed())
+
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)
+				return err == nil && len(proxy.Status.Syncs) == 1 && proxy.Status.Syncs[0].State == syncapi.StateSucceeded
+			}, timeout, interval).Should(BeTrue())
+			Expect(apimeta.IsStatusConditionTrue(proxy.Status.Conditions, meta.ReadyCondition)).To(BeTrue())
+			Expect(proxy.Status.Syncs[0].Inventory).To(Equal(asm.Status.Syncs[0].Inventory))
+
+			// The remote assemblage can be found by the objects
+			// applied downstream.
+			Eventually(func() []string {
+				asms, err := RemoteAssemblagesApplying(context.Background(), manager.GetClient(), "Deployment/default/cuttlefacts-app")
+				if err != nil {
+					return nil
+				}
+				var names []string
+				for _, a := range asms {
+					names = append(names, a.Name)
+				}
+				return names
+			}, timeout, interval).Should(Equal([]string{proxy.Name}))
+		})
+	})
+
+	Context("kubeconfig references", func() {
+		It("finds the secret for a Cluster API cluster", func() {
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{
+						ClusterRef: &fleetv1.LocalClusterReference{Name: cluster.Name},
+					},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: []syncapi.NamedSync{},
+					},
+				},
+			}
+			proxy.Name = "test-proxy-clusterref"
+			proxy.Namespace = cluster.Namespace
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			var asm asmv1.Assemblage
+			Eventually(func() error {
+				return downstreamK8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &asm)
+			}, timeout, interval).Should(Succeed())
+
+			Expect(k8sClient.Delete(context.Background(), &proxy)).To(Succeed())
+		})
+
+		It("uses a secret not made by Cluster API", func() {
+			// This has the same kubeconfig as the Cluster API secret,
+			// but under a different name and key.
+			handmade := corev1.Secret{
+				Data: map[string][]byte{
+					"kubeconfig": clusterSecret.Data["value"],
+				},
+			}
+			handmade.Name = "handmade-creds"
+			handmade.Namespace = clusterSecret.Namespace
+			Expect(k8sClient.Create(context.Background(), &handmade)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(context.Background(), &handmade)).To(Succeed())
+			}()
+
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{
+						Name: handmade.Name,
+						Key:  "kubeconfig",
+					},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: []syncapi.NamedSync{},
+					},
+				},
+			}
+			proxy.Name = "test-proxy-handmade"
+			proxy.Namespace = handmade.Namespace
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			var asm asmv1.Assemblage
+			Eventually(func() error {
+				return downstreamK8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &asm)
+			}, timeout, interval).Should(Succeed())
+
+			Expect(k8sClient.Delete(context.Background(), &proxy)).To(Succeed())
+		})
+	})
+
+	Context("remotes", func() {
+		var rem *fleetv1.Remote
+
+		BeforeEach(func() {
+			// This uses the same secret as the Cluster API
+			// cluster, but by name.
+			rem = &fleetv1.Remote{
+				Spec: fleetv1.RemoteSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{Name: clusterSecret.Name},
+				},
+			}
+			rem.Name = "downstream-remote"
+			rem.Namespace = clusterSecret.Namespace
+			Expect(k8sClient.Create(context.Background(), rem)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(context.Background(), rem)).To(Succeed())
+		})
+
+		It("reports that the remote cluster can be reached", func() {
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(rem), rem)
+				return err == nil && apimeta.IsStatusConditionTrue(rem.Status.Conditions, meta.ReadyCondition)
+			}, timeout, interval).Should(BeTrue())
+			Expect(apimeta.IsStatusConditionTrue(rem.Status.Conditions, fleetv1.ClusterReachableCondition)).To(BeTrue())
+			Expect(rem.Status.KubernetesVersion).ToNot(BeEmpty())
+			Expect(rem.Status.LastContactTime).ToNot(BeNil())
+		})
+
+		It("ignores a remote with the same name as a cluster", func() {
+			shadowed := fleetv1.Remote{
+				Spec: fleetv1.RemoteSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{Name: clusterSecret.Name},
+				},
+			}
+			shadowed.Name = cluster.Name
+			shadowed.Namespace = cluster.Namespace
+			Expect(k8sClient.Create(context.Background(), &shadowed)).To(Succeed())
+
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&shadowed), &shadowed)
+				return err == nil && apimeta.IsStatusConditionTrue(shadowed.Status.Conditions, meta.StalledCondition)
+			}, timeout, interval).Should(BeTrue())
+			c := apimeta.FindStatusCondition(shadowed.Status.Conditions, meta.StalledCondition)
+			Expect(c.Reason).To(Equal(fleetv1.ShadowedByClusterReason))
+
+			Expect(k8sClient.Delete(context.Background(), &shadowed)).To(Succeed())
+		})
+
+		It("syncs to the cluster referred to by a remote", func() {
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{
+						RemoteRef: &fleetv1.LocalRemoteReference{Name: rem.Name},
+					},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: []syncapi.NamedSync{},
+					},
+				},
+			}
+			proxy.Name = "test-proxy-remoteref"
+			proxy.Namespace = rem.Namespace
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			var asm asmv1.Assemblage
+			Eventually(func() error {
+				return downstreamK8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &asm)
+			}, timeout, interval).Should(Succeed())
+
+			Expect(k8sClient.Delete(context.Background(), &proxy)).To(Succeed())
+		})
+	})
+
+	Context("pull mode", func() {
+		var rem *fleetv1.Remote
+
+		BeforeEach(func() {
+			rem = &fleetv1.Remote{
+				Spec: fleetv1.RemoteSpec{
+					Mode: fleetv1.RemoteModePull,
+				},
+			}
+			rem.Name = "pulled-remote"
+			rem.Namespace = "default"
+			Expect(k8sClient.Create(context.Background(), rem)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			Expect(k8sClient.Delete(context.Background(), rem)).To(Succeed())
+		})
+
+		It("creates a service account for the agent, with access to its remote assemblage", func() {
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(rem), rem)
+				return err == nil && apimeta.IsStatusConditionTrue(rem.Status.Conditions, meta.ReadyCondition)
+			}, timeout, interval).Should(BeTrue())
+			Expect(rem.Status.ServiceAccountName).ToNot(BeEmpty())
+
+			var account corev1.ServiceAccount
+			Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+				Namespace: rem.Namespace,
+				Name:      rem.Status.ServiceAccountName,
+			}, &account)).To(Succeed())
+
+			var binding rbacv1.RoleBinding
+			Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&account), &binding)).To(Succeed())
+			Expect(binding.Subjects).To(ContainElement(rbacv1.Subject{
+				Kind:      rbacv1.ServiceAccountKind,
+				Namespace: account.Namespace,
+				Name:      account.Name,
+			}))
+			var role rbacv1.Role
+			Expect(k8sClient.Get(context.Background(), types.NamespacedName{
+				Namespace: rem.Namespace,
+				Name:      binding.RoleRef.Name,
+			}, &role)).To(Succeed())
+			for _, rule := range role.Rules {
+				Expect(rule.ResourceNames).To(Equal([]string{rem.Name}))
+			}
+		})
+
+		It("leaves the assemblage to the agent, and reports what it says", func() {
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{
+						RemoteRef: &fleetv1.LocalRemoteReference{Name: rem.Name},
+					},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: []syncapi.NamedSync{},
+					},
+				},
+			}
+			proxy.Name = rem.Name
+			proxy.Namespace = rem.Namespace
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			// Until the agent reports, the cluster is counted as
+			// unreachable.
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)
+				return err == nil && apimeta.IsStatusConditionFalse(proxy.Status.Conditions, fleetv1.ClusterReachableCondition)
+			}, timeout, interval).Should(BeTrue())
+
+			// This is what the agent would do.
+			now := metav1.Now()
+			proxy.Status.LastContactTime = &now
+			proxy.Status.Syncs = []syncapi.SyncStatus{}
+			Expect(k8sClient.Status().Update(context.Background(), &proxy)).To(Succeed())
+
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)
+				return err == nil && apimeta.IsStatusConditionTrue(proxy.Status.Conditions, meta.ReadyCondition)
+			}, timeout, interval).Should(BeTrue())
+			Expect(apimeta.IsStatusConditionTrue(proxy.Status.Conditions, fleetv1.ClusterReachableCondition)).To(BeTrue())
+
+			// The agent would let it go, once it's deleted; since
+			// there's no agent here, it's let go after the timeout.
+			Expect(k8sClient.Delete(context.Background(), &proxy)).To(Succeed())
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)
+				return apierrors.IsNotFound(err)
+			}, 2*timeout, interval).Should(BeTrue())
+		})
+	})
+
+	Context("reachability", func() {
+		It("reports a cluster that can't be reached", func() {
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{Name: "nonexistent-kubeconfig"},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: []syncapi.NamedSync{},
+					},
+				},
+			}
+			proxy.Name = "test-proxy-unreachable-status"
+			proxy.Namespace = "default"
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)
+				return err == nil && apimeta.IsStatusConditionFalse(proxy.Status.Conditions, fleetv1.ClusterReachableCondition)
+			}, timeout, interval).Should(BeTrue())
+			Expect(proxy.Status.LastContactTime).To(BeNil())
+			c := apimeta.FindStatusCondition(proxy.Status.Conditions, meta.ReconcilingCondition)
+			Expect(c).ToNot(BeNil())
+			Expect(c.Reason).To(Equal(fleetv1.ClusterUnreachableReason))
+
+			Expect(k8sClient.Delete(context.Background(), &proxy)).To(Succeed())
+		})
+	})
+
+	Context("deletion", func() {
+		It("deletes the downstream assemblage before letting go", func() {
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{Name: clusterSecret.Name},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: []syncapi.NamedSync{
+							{
+								Name: "app",
+								Sync: syncapi.Sync{
+									Source: syncapi.SourceSpec{
+										Git: &syncapi.GitSource{
+											URL:     "https://github.com/cuttlefacts/cuttlefacts-app",
+											Version: syncapi.GitVersion{Tag: "v0.3.0"},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			}
+			proxy.Name = "test-proxy-delete"
+			proxy.Namespace = "default"
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			var asm asmv1.Assemblage
+			Eventually(func() error {
+				return downstreamK8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &asm)
+			}, timeout, interval).Should(Succeed())
+			Expect(k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)).To(Succeed())
+			Expect(proxy.GetFinalizers()).To(ContainElement(fleetv1.RemoteAssemblageFinalizer))
+
+			Expect(k8sClient.Delete(context.Background(), &proxy)).To(Succeed())
+
+			// There's no assemblage controller downstream, so the
+			// syncs are removed from the spec, and since there's no
+			// status to wait for, the assemblage is then deleted ..
+			Eventually(func() bool {
+				err := downstreamK8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &asm)
+				return apierrors.IsNotFound(err)
+			}, timeout, interval).Should(BeTrue())
+			// .. and the remote assemblage let go.
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)
+				return apierrors.IsNotFound(err)
+			}, timeout, interval).Should(BeTrue())
+		})
+
+		It("gives up on an unreachable cluster after the timeout", func() {
+			proxy := fleetv1.RemoteAssemblage{
+				Spec: fleetv1.RemoteAssemblageSpec{
+					KubeconfigRef: fleetv1.LocalKubeconfigReference{Name: "decommissioned-kubeconfig"},
+					Assemblage: asmv1.AssemblageSpec{
+						Syncs: []syncapi.NamedSync{},
+					},
+				},
+			}
+			proxy.Name = "test-proxy-unreachable"
+			proxy.Namespace = "default"
+			Expect(k8sClient.Create(context.Background(), &proxy)).To(Succeed())
+
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)
+				return err == nil && controllerutil.ContainsFinalizer(&proxy, fleetv1.RemoteAssemblageFinalizer)
+			}, timeout, interval).Should(BeTrue())
+			Expect(k8sClient.Delete(context.Background(), &proxy)).To(Succeed())
+
+			// While the timeout hasn't expired, it's kept ..
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)
+				if err != nil {
+					return false
+				}
+				c := apimeta.FindStatusCondition(proxy.Status.Conditions, meta.ReconcilingCondition)
+				return c != nil && c.Reason == fleetv1.ClusterUnreachableReason
+			}, timeout, interval).Should(BeTrue())
+
+			// .. and once it has, it's let go.
+			Eventually(func() bool {
+				err := k8sClient.Get(context.Background(), client.ObjectKeyFromObject(&proxy), &proxy)
+				return apierrors.IsNotFound(err)
+			}, "10s", interval).Should(BeTrue())
 		})
 	})
 })
 
+var _ = Describe("cluster backoff", func() {
+	It("backs off each cluster separately, up to a limit", func() {
+		b := newClusterBackoff()
+		one := client.ObjectKey{Namespace: "default", Name: "one"}
+		two := client.ObjectKey{Namespace: "default", Name: "two"}
+
+		Expect(b.failed(one)).To(Equal(minUnreachableBackoff))
+		Expect(b.failed(one)).To(Equal(2 * minUnreachableBackoff))
+		Expect(b.failed(one)).To(Equal(4 * minUnreachableBackoff))
+		Expect(b.failed(two)).To(Equal(minUnreachableBackoff))
+
+		for i := 0; i < 20; i++ {
+			b.failed(one)
+		}
+		Expect(b.failed(one)).To(Equal(maxUnreachableBackoff))
+
+		b.reset(one)
+		Expect(b.failed(one)).To(Equal(minUnreachableBackoff))
+	})
+})
+
 // This has funcs for creating a downstream cluster, useful for
 // testing remote/proxy syncs.
 
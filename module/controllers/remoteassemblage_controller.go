@@ -7,17 +7,31 @@ package controllers
 import (
 	"context"
 	"fmt"
-	"strings"
+	"time"
 
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"sigs.k8s.io/cluster-api/controllers/remote"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	asmv1 "github.com/squaremo/fleeet/assemblage/api/v1alpha1"
 	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+	"github.com/squaremo/fleeet/module/remote"
+	"github.com/squaremo/fleeet/module/sharding"
+	syncapi "github.com/squaremo/fleeet/pkg/api"
+	"github.com/squaremo/fleeet/pkg/apply"
 )
 
 // RemoteAssemblageReconciler reconciles a RemoteAssemblage object
@@ -26,10 +40,57 @@ type RemoteAssemblageReconciler struct {
 	Log    logr.Logger
 	Scheme *runtime.Scheme
 
+	// Shard gives the subset of clusters to sync to. If nil, all
+	// clusters are included.
+	Shard *sharding.Shard
+
+	// DeletionTimeout gives how long to keep trying to delete the
+	// assemblage downstream, once a remote assemblage is deleted,
+	// before giving up and letting the remote assemblage go. If
+	// zero, DefaultDeletionTimeout is used.
+	DeletionTimeout time.Duration
+
+	// ProbeInterval gives how often to contact each remote cluster
+	// to check it is reachable, and to refresh the status reported
+	// from it, absent any other prompt. If zero,
+	// DefaultProbeInterval is used.
+	ProbeInterval time.Duration
+
+	// DownstreamNamespace gives the namespace in each remote cluster
+	// in which to create assemblages that don't give their own. If
+	// empty, asmv1.DefaultNamespace is used.
+	DownstreamNamespace string
+
 	// cache is a remote cluster client cache
-	cache *remote.ClusterCacheTracker
+	cache *remote.Tracker
+	// controller is kept so that watches on remote clusters can be
+	// added to it
+	controller controller.Controller
+	// backoff tracks failures to reach each remote cluster
+	backoff *clusterBackoff
 }
 
+// fieldManager is the field manager for the assemblages applied in
+// remote clusters.
+const fieldManager = "fleet-remoteassemblage"
+
+// DefaultDeletionTimeout is used when RemoteAssemblageReconciler is
+// not given a DeletionTimeout.
+const DefaultDeletionTimeout = 10 * time.Minute
+
+// DefaultProbeInterval is used when RemoteAssemblageReconciler is
+// not given a ProbeInterval.
+const DefaultProbeInterval = 5 * time.Minute
+
+// deletionRetryInterval is how long to wait before trying again, when
+// the remote cluster refuses to delete an assemblage.
+const deletionRetryInterval = 30 * time.Second
+
+// assemblageWatchName names the watch on Assemblage objects in each
+// remote cluster; the cluster cache tracker uses it to avoid adding
+// the same watch twice.
+const assemblageWatchName = "assemblages"
+
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remoteassemblages,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remoteassemblages/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=fleet.squaremo.dev,resources=remoteassemblages/finalizers,verbs=update
@@ -47,57 +108,553 @@ func (r *RemoteAssemblageReconciler) Reconcile(ctx context.Context, req ctrl.Req
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// A remote cluster in pull mode fetches the assemblage itself,
+	// so there's nothing to push.
+	pulled, err := isPulled(ctx, r.Client, asm.Namespace, asm.Spec.KubeconfigRef)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if asm.GetDeletionTimestamp() != nil {
+		if pulled {
+			return r.finalizePulled(ctx, log, &asm)
+		}
+		return r.finalize(ctx, log, &asm)
+	}
+	if !controllerutil.ContainsFinalizer(&asm, fleetv1.RemoteAssemblageFinalizer) {
+		controllerutil.AddFinalizer(&asm, fleetv1.RemoteAssemblageFinalizer)
+		if err := r.Update(ctx, &asm); err != nil {
+			return ctrl.Result{}, fmt.Errorf("adding finalizer to remote assemblage: %w", err)
+		}
+	}
+
+	if pulled {
+		return r.reconcilePulled(ctx, &asm)
+	}
+
 	// Let's go looking for the corresponding assemblage in the remote
 	// cluster.
-	clusterKey := client.ObjectKey{
-		Namespace: asm.Namespace,
-		// HACK: the client cache accepts cluster keys, but we are
-		// ging straight to the secret; the trim gets the former from
-		// the latter.
-		Name: strings.TrimSuffix(asm.Spec.KubeconfigRef.Name, "-kubeconfig"),
-	}
-	remoteClient, err := r.cache.GetClient(ctx, clusterKey)
+	remoteClient, err := r.remoteClientFor(ctx, &asm)
 	if err != nil {
-		return ctrl.Result{}, fmt.Errorf("could not get client for remote cluster: %w", err)
+		return r.unreachable(ctx, log, &asm, fmt.Errorf("could not get client for remote cluster: %w", err))
 	}
 
-	log.V(1).Info("remote cluster connected", "cluster", clusterKey.Name)
+	log.V(1).Info("remote cluster connected")
+
+	namespace, previous, err := r.downstreamNamespaces(ctx, remoteClient, &asm)
+	if err != nil && isUnreachable(err) {
+		return r.unreachable(ctx, log, &asm, fmt.Errorf("while looking for counterpart downstream: %w", err))
+	}
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("while looking for counterpart downstream: %w", err)
+	}
 
 	var counterpart asmv1.Assemblage
 	counterpart.Name = asm.Name
-	counterpart.Namespace = asm.Namespace
-	op, err := controllerutil.CreateOrUpdate(ctx, remoteClient, &counterpart, func() error {
-		counterpart.Spec = asm.Spec.Assemblage
-		return nil
-	})
+	counterpart.Namespace = namespace
+	// The label records where the remote assemblage is, so that
+	// changes to the counterpart can be mapped back to it.
+	counterpart.Labels = map[string]string{
+		asmv1.UpstreamNamespaceLabel: asm.Namespace,
+	}
+	counterpart.Spec = asm.Spec.Assemblage
+	op, err := r.applyCounterpart(ctx, remoteClient, &counterpart)
+	if err != nil && isUnreachable(err) {
+		return r.unreachable(ctx, log, &asm, fmt.Errorf("while applying counterpart in downstream: %w", err))
+	}
+	r.backoff.reset(client.ObjectKeyFromObject(&asm))
+	markReachable(&asm, &asm.Status.LastContactTime, metav1.Now())
 	if err != nil {
-		return ctrl.Result{}, fmt.Errorf("while create/update counterpart in downstream: %w", err)
+		asm.Status.ObservedGeneration = asm.Generation
+		// A conflict won't go away by trying again; it needs
+		// someone to change the assemblage downstream, which will
+		// be seen by the watch on it.
+		if apply.IsConflict(err) {
+			markStalled(&asm, fleetv1.FieldConflictReason, fmt.Sprintf("applying assemblage downstream: %s", err.Error()))
+			return ctrl.Result{}, r.Status().Update(ctx, &asm)
+		}
+		markReconciling(&asm, fleetv1.DownstreamUpdateFailedReason, err.Error())
+		if err := r.Status().Update(ctx, &asm); err != nil {
+			log.Error(err, "updating status of remote assemblage")
+		}
+		return ctrl.Result{}, fmt.Errorf("while applying counterpart in downstream: %w", err)
 	}
+	log.V(1).Info("applied downstream assemblage", "operation", op)
 
-	switch op {
-	case controllerutil.OperationResultNone,
-		controllerutil.OperationResultUpdated:
-		asm.Status.Syncs = counterpart.Status.Syncs
-	case controllerutil.OperationResultCreated:
-		// TODO set a condition saying the downstream is created
+	// If the assemblage is moving to a different namespace
+	// downstream, the one in the old namespace is left running until
+	// the syncs in the new one have all been applied; then it's
+	// removed, leaving what it synced in place for the new one to
+	// take over. Until it's gone, the old namespace stays recorded,
+	// so it's not forgotten about.
+	asm.Status.DownstreamNamespace = previous
+	if previous != namespace {
+		message := fmt.Sprintf("moving the assemblage downstream from namespace %q to %q", previous, namespace)
+		gone := false
+		if syncapi.SyncsSettled(counterpart.Spec.Syncs, counterpart.Status.Syncs) {
+			gone, err = r.retireCounterpart(ctx, remoteClient, &asm, previous)
+			if err != nil && isUnreachable(err) {
+				return r.unreachable(ctx, log, &asm, fmt.Errorf("while removing counterpart from previous namespace downstream: %w", err))
+			}
+			if err != nil {
+				return ctrl.Result{}, fmt.Errorf("while removing counterpart from previous namespace downstream: %w", err)
+			}
+		} else {
+			message += "; waiting for the syncs there to be applied"
+		}
+		if !gone {
+			asm.Status.Syncs = counterpart.Status.Syncs
+			markReconciling(&asm, fleetv1.RolloutInProgressReason, message)
+			asm.Status.ObservedGeneration = asm.Generation
+			return ctrl.Result{}, r.Status().Update(ctx, &asm)
+		}
+		log.V(1).Info("removed counterpart from previous namespace downstream", "namespace", previous)
+		asm.Status.DownstreamNamespace = namespace
 	}
 
+	// A newly created counterpart has no status yet, which is
+	// accurate too: none of the syncs have been applied.
+	asm.Status.Syncs = counterpart.Status.Syncs
+
+	asm.Status.ObservedGeneration = asm.Generation
+	markFromSyncStatus(&asm)
 	if err = r.Status().Update(ctx, &asm); err != nil {
 		return ctrl.Result{}, err
 	}
 
-	return ctrl.Result{}, nil
+	// Come back to check the cluster is still there, even if
+	// nothing changes in the meantime.
+	return ctrl.Result{RequeueAfter: r.probeInterval()}, nil
+}
+
+// unreachable records that the remote cluster could not be reached,
+// and arranges to try again after a backoff particular to the
+// cluster. The error is not returned, since that would make the
+// retry subject to the controller's backoff, which is shared among
+// all clusters.
+func (r *RemoteAssemblageReconciler) unreachable(ctx context.Context, log logr.Logger, asm *fleetv1.RemoteAssemblage, err error) (ctrl.Result, error) {
+	retry := r.backoff.failed(client.ObjectKeyFromObject(asm))
+	log.Error(err, "remote cluster unreachable", "retry", retry)
+	markUnreachable(asm, asm.Status.LastContactTime, err)
+	asm.Status.ObservedGeneration = asm.Generation
+	if err := r.Status().Update(ctx, asm); err != nil {
+		return ctrl.Result{}, fmt.Errorf("updating status of remote assemblage: %w", err)
+	}
+	return ctrl.Result{RequeueAfter: retry}, nil
+}
+
+// reconcilePulled works out the status of a remote assemblage that is
+// fetched by the agent in the remote cluster. The agent reports the
+// status of each sync, and the time it last did so; if it hasn't
+// reported within the probe interval, the cluster is counted as
+// unreachable.
+func (r *RemoteAssemblageReconciler) reconcilePulled(ctx context.Context, asm *fleetv1.RemoteAssemblage) (ctrl.Result, error) {
+	interval := r.probeInterval()
+	retry := interval
+	now := time.Now()
+	if last := asm.Status.LastContactTime; last == nil || now.Sub(last.Time) >= interval {
+		markUnreachable(asm, last, fmt.Errorf("the agent in the remote cluster has not reported within %s", interval))
+	} else {
+		markContacted(asm)
+		markFromSyncStatus(asm)
+		// Come back when the report would be too old, in case
+		// there isn't another one by then.
+		retry = last.Add(interval).Sub(now)
+	}
+	asm.Status.ObservedGeneration = asm.Generation
+	if err := r.Status().Update(ctx, asm); err != nil {
+		return ctrl.Result{}, fmt.Errorf("updating status of remote assemblage: %w", err)
+	}
+	return ctrl.Result{RequeueAfter: retry}, nil
+}
+
+// applyCounterpart applies the assemblage in the remote cluster,
+// creating its namespace there if that doesn't exist yet.
+func (r *RemoteAssemblageReconciler) applyCounterpart(ctx context.Context, remoteClient client.Client, counterpart *asmv1.Assemblage) (controllerutil.OperationResult, error) {
+	op, err := apply.Apply(ctx, remoteClient, counterpart, fieldManager)
+	if !apierrors.IsNotFound(err) {
+		return op, err
+	}
+	var ns corev1.Namespace
+	ns.Name = counterpart.Namespace
+	if err := remoteClient.Create(ctx, &ns); err != nil && !apierrors.IsAlreadyExists(err) {
+		return op, fmt.Errorf("creating namespace downstream: %w", err)
+	}
+	return apply.Apply(ctx, remoteClient, counterpart, fieldManager)
+}
+
+// downstreamNamespaces gives the namespace in the remote cluster in
+// which the assemblage is to be, and the namespace it was last
+// applied in, if any; they differ while the assemblage is being
+// moved. An assemblage already downstream stays where it is, unless
+// the remote assemblage says to move it; changing the namespace the
+// controller is told to use only affects new assemblages.
+func (r *RemoteAssemblageReconciler) downstreamNamespaces(ctx context.Context, remoteClient client.Client, asm *fleetv1.RemoteAssemblage) (string, string, error) {
+	previous := asm.Status.DownstreamNamespace
+	if previous == "" {
+		// Before the namespace was recorded, the assemblage was
+		// always created in the same namespace as the remote
+		// assemblage.
+		var legacy asmv1.Assemblage
+		err := remoteClient.Get(ctx, client.ObjectKey{Namespace: asm.Namespace, Name: asm.Name}, &legacy)
+		switch {
+		case err == nil:
+			previous = asm.Namespace
+		case apierrors.IsNotFound(err) || apimeta.IsNoMatchError(err):
+			break
+		default:
+			return "", "", err
+		}
+	}
+
+	var namespace string
+	switch {
+	case asm.Spec.DownstreamNamespace != "":
+		namespace = asm.Spec.DownstreamNamespace
+	case previous != "":
+		namespace = previous
+	case r.DownstreamNamespace != "":
+		namespace = r.DownstreamNamespace
+	default:
+		namespace = asmv1.DefaultNamespace
+	}
+	if previous == "" {
+		previous = namespace
+	}
+	return namespace, previous, nil
+}
+
+// appliedNamespaces gives the namespaces in the remote cluster in
+// which the assemblage may have been created: the one recorded, and
+// the one it's being moved to, if it's being moved. If no namespace
+// has been recorded, it may be in the same namespace as the remote
+// assemblage, where it was always created before that was recorded,
+// or where it would be created now.
+func (r *RemoteAssemblageReconciler) appliedNamespaces(asm *fleetv1.RemoteAssemblage) []string {
+	candidates := []string{asm.Status.DownstreamNamespace, asm.Spec.DownstreamNamespace}
+	if asm.Status.DownstreamNamespace == "" {
+		candidates = append(candidates, asm.Namespace, r.DownstreamNamespace, asmv1.DefaultNamespace)
+	}
+	var namespaces []string
+	seen := map[string]struct{}{}
+	for _, ns := range candidates {
+		if _, ok := seen[ns]; ok || ns == "" {
+			continue
+		}
+		seen[ns] = struct{}{}
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
+
+func (r *RemoteAssemblageReconciler) probeInterval() time.Duration {
+	if r.ProbeInterval == 0 {
+		return DefaultProbeInterval
+	}
+	return r.ProbeInterval
+}
+
+// remoteClientFor gets a client for the remote cluster, and makes
+// sure the assemblages there are watched, so that changes to their
+// status are reported promptly. Adding the watch does nothing if
+// there's already one for the cluster.
+func (r *RemoteAssemblageReconciler) remoteClientFor(ctx context.Context, asm *fleetv1.RemoteAssemblage) (client.Client, error) {
+	clusterKey, err := kubeconfigKeyFor(ctx, r.Client, asm.Namespace, asm.Spec.KubeconfigRef)
+	if err != nil {
+		return nil, err
+	}
+	remoteClient, err := r.cache.GetClient(ctx, clusterKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.cache.Watch(ctx, remote.WatchInput{
+		Name:         assemblageWatchName,
+		Kubeconfig:   clusterKey,
+		Watcher:      r.controller,
+		Kind:         &asmv1.Assemblage{},
+		EventHandler: handler.EnqueueRequestsFromMapFunc(remoteAssemblageForAssemblage),
+	}); err != nil {
+		return nil, fmt.Errorf("watching assemblages in remote cluster: %w", err)
+	}
+	return remoteClient, nil
+}
+
+// finalize removes the assemblage from the remote cluster, and lets
+// the remote assemblage go once it has gone. If that can't be done
+// within the deletion timeout -- e.g., because the cluster has been
+// decommissioned -- it gives up, and lets the remote assemblage go
+// anyway.
+func (r *RemoteAssemblageReconciler) finalize(ctx context.Context, log logr.Logger, asm *fleetv1.RemoteAssemblage) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(asm, fleetv1.RemoteAssemblageFinalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	var gone bool
+	remoteClient, err := r.remoteClientFor(ctx, asm)
+	if err == nil {
+		gone = true
+		for _, namespace := range r.appliedNamespaces(asm) {
+			var goneHere bool
+			goneHere, err = r.removeCounterpart(ctx, remoteClient, asm, namespace)
+			if err != nil {
+				gone = false
+				break
+			}
+			gone = gone && goneHere
+		}
+	}
+	reachable := err == nil || !isUnreachable(err)
+	if reachable {
+		r.backoff.reset(client.ObjectKeyFromObject(asm))
+		markReachable(asm, &asm.Status.LastContactTime, metav1.Now())
+	}
+	if gone {
+		log.V(1).Info("downstream assemblage deleted")
+		return ctrl.Result{}, r.release(ctx, asm)
+	}
+
+	now := time.Now()
+	deadline := asm.GetDeletionTimestamp().Add(r.deletionTimeout())
+	if !now.Before(deadline) {
+		return ctrl.Result{}, r.abandon(ctx, log, asm, err)
+	}
+
+	// The watch on the downstream assemblage will notice it going,
+	// but it's necessary to come back by the deadline in any case;
+	// and sooner, if the cluster couldn't be reached.
+	retry := deadline.Sub(now)
+	switch {
+	case !reachable:
+		log.Error(err, "deleting downstream assemblage")
+		markUnreachable(asm, asm.Status.LastContactTime, err)
+		if backoff := r.backoff.failed(client.ObjectKeyFromObject(asm)); retry > backoff {
+			retry = backoff
+		}
+	case err != nil:
+		log.Error(err, "deleting downstream assemblage")
+		markReconciling(asm, fleetv1.DownstreamUpdateFailedReason, err.Error())
+		if retry > deletionRetryInterval {
+			retry = deletionRetryInterval
+		}
+	default:
+		markReconciling(asm, fleetv1.DeletingReason, "waiting for the assemblage downstream to be deleted")
+	}
+	if err := r.Status().Update(ctx, asm); err != nil {
+		return ctrl.Result{}, fmt.Errorf("updating status of remote assemblage: %w", err)
+	}
+	return ctrl.Result{RequeueAfter: retry}, nil
+}
+
+// finalizePulled waits for the agent in a pull-mode remote cluster to
+// remove the assemblage there, and let the remote assemblage go. As
+// with a pushed assemblage, it gives up after the deletion timeout.
+func (r *RemoteAssemblageReconciler) finalizePulled(ctx context.Context, log logr.Logger, asm *fleetv1.RemoteAssemblage) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(asm, fleetv1.RemoteAssemblageFinalizer) {
+		return ctrl.Result{}, nil
+	}
+	now := time.Now()
+	deadline := asm.GetDeletionTimestamp().Add(r.deletionTimeout())
+	if !now.Before(deadline) {
+		return ctrl.Result{}, r.abandon(ctx, log, asm, nil)
+	}
+	markReconciling(asm, fleetv1.DeletingReason, "waiting for the agent in the remote cluster to delete the assemblage there")
+	if err := r.Status().Update(ctx, asm); err != nil {
+		return ctrl.Result{}, fmt.Errorf("updating status of remote assemblage: %w", err)
+	}
+	return ctrl.Result{RequeueAfter: deadline.Sub(now)}, nil
+}
+
+func (r *RemoteAssemblageReconciler) deletionTimeout() time.Duration {
+	if r.DeletionTimeout == 0 {
+		return DefaultDeletionTimeout
+	}
+	return r.DeletionTimeout
+}
+
+// abandon gives up on deleting the assemblage downstream, records
+// that in the status, and lets the remote assemblage go. The error
+// given, if any, is the last one encountered.
+func (r *RemoteAssemblageReconciler) abandon(ctx context.Context, log logr.Logger, asm *fleetv1.RemoteAssemblage, lastErr error) error {
+	timeout := r.deletionTimeout()
+	message := fmt.Sprintf("gave up deleting the assemblage downstream after %s; it may have been left there", timeout)
+	if lastErr != nil {
+		message = fmt.Sprintf("%s (%s)", message, lastErr.Error())
+	}
+	log.Info("abandoning deletion of downstream assemblage", "timeout", timeout, "error", lastErr)
+	markStalled(asm, fleetv1.DeletionAbandonedReason, message)
+	if err := r.Status().Update(ctx, asm); err != nil {
+		return fmt.Errorf("updating status of remote assemblage: %w", err)
+	}
+	return r.release(ctx, asm)
+}
+
+// retireCounterpart takes apart the assemblage in the namespace given
+// in the remote cluster, as removeCounterpart does, but leaving what
+// it synced in place. Each sync is set to orphan what it synced, and
+// that has to have reached the assemblage controller downstream
+// before the syncs are removed.
+func (r *RemoteAssemblageReconciler) retireCounterpart(ctx context.Context, remoteClient client.Client, asm *fleetv1.RemoteAssemblage, namespace string) (bool, error) {
+	var counterpart asmv1.Assemblage
+	if err := remoteClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: asm.Name}, &counterpart); err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	if syncapi.OrphanSyncs(counterpart.Spec.Syncs) {
+		return false, remoteClient.Update(ctx, &counterpart)
+	}
+	if !syncStatusesCurrent(&counterpart) {
+		return false, nil
+	}
+	return r.removeCounterpart(ctx, remoteClient, asm, namespace)
+}
+
+// syncStatusesCurrent says whether the assemblage has a status for
+// each of its syncs as they are now; i.e., whether the assemblage
+// controller has caught up with them.
+func syncStatusesCurrent(asm *asmv1.Assemblage) bool {
+	for _, sync := range asm.Spec.Syncs {
+		current := false
+		for _, status := range asm.Status.Syncs {
+			if equality.Semantic.DeepEqual(status.Sync, sync) {
+				current = true
+				break
+			}
+		}
+		if !current {
+			return false
+		}
+	}
+	return true
+}
+
+// removeCounterpart takes the assemblage in the namespace given in
+// the remote cluster apart, and reports whether it has gone. The syncs are removed first, so
+// that the assemblage controller downstream removes them according
+// to their deletion policies (and reports them as deleting in the
+// meantime); then the assemblage itself is deleted.
+func (r *RemoteAssemblageReconciler) removeCounterpart(ctx context.Context, remoteClient client.Client, asm *fleetv1.RemoteAssemblage, namespace string) (bool, error) {
+	var counterpart asmv1.Assemblage
+	if err := remoteClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: asm.Name}, &counterpart); err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, nil
+		}
+		return false, err
+	}
+	asm.Status.Syncs = counterpart.Status.Syncs
+
+	// A suspended assemblage doesn't remove syncs, so it's resumed
+	// here, to let it do that.
+	if len(counterpart.Spec.Syncs) > 0 || counterpart.Spec.Suspend {
+		counterpart.Spec.Syncs = []syncapi.NamedSync{}
+		counterpart.Spec.Suspend = false
+		return false, remoteClient.Update(ctx, &counterpart)
+	}
+	if len(counterpart.Status.Syncs) > 0 || counterpart.GetDeletionTimestamp() != nil {
+		return false, nil
+	}
+	if err := remoteClient.Delete(ctx, &counterpart); err != nil {
+		return apierrors.IsNotFound(err), client.IgnoreNotFound(err)
+	}
+	return false, nil
+}
+
+// release removes the finalizer from the remote assemblage, so it can
+// be deleted.
+func (r *RemoteAssemblageReconciler) release(ctx context.Context, asm *fleetv1.RemoteAssemblage) error {
+	controllerutil.RemoveFinalizer(asm, fleetv1.RemoteAssemblageFinalizer)
+	if err := r.Update(ctx, asm); err != nil {
+		return fmt.Errorf("removing finalizer from remote assemblage: %w", err)
+	}
+	r.backoff.reset(client.ObjectKeyFromObject(asm))
+	return nil
+}
+
+// markFromSyncStatus sets the conditions of the remote assemblage
+// according to the state of each of its syncs downstream. A sync
+// with no status, or with a status for a different version of the
+// sync, is still updating. If the compiled syncs could not be applied
+// to the remote assemblage, it's stalled regardless.
+func markFromSyncStatus(asm *fleetv1.RemoteAssemblage) {
+	var succeeded, failed, updating, suspended int
+	var failure string // the message from the first failure, to pass on
+	for _, sync := range asm.Spec.Assemblage.Syncs {
+		state := syncapi.StateUpdating
+		var message string
+		for _, status := range asm.Status.Syncs {
+			if status.Sync.Name == sync.Name && equality.Semantic.DeepEqual(status.Sync, sync) {
+				state, message = status.State, status.Message
+				break
+			}
+		}
+		switch state {
+		case syncapi.StateSucceeded:
+			succeeded++
+		case syncapi.StateFailed:
+			if failed == 0 && message != "" {
+				failure = fmt.Sprintf("; %s: %s", sync.Name, message)
+			}
+			failed++
+		case syncapi.StateSuspended:
+			suspended++
+		default:
+			updating++
+		}
+	}
+
+	total := len(asm.Spec.Assemblage.Syncs)
+	conflicted, conflict := fieldConflicted(asm)
+	switch {
+	case conflicted:
+		// The syncs given are not those compiled, so whatever
+		// state they are in is beside the point.
+		markStalled(asm, fleetv1.FieldConflictReason, conflict)
+	case failed > 0:
+		markStalled(asm, fleetv1.SyncFailedReason, fmt.Sprintf("%d of %d syncs failed%s", failed, total, failure))
+	case updating > 0:
+		markReconciling(asm, fleetv1.RolloutInProgressReason, fmt.Sprintf("%d of %d syncs succeeded", succeeded, total))
+	case suspended > 0:
+		markReady(asm, fleetv1.SuspendedReason, fmt.Sprintf("%d of %d syncs succeeded, %d suspended", succeeded, total, suspended))
+	default:
+		markReady(asm, fleetv1.SyncSucceededReason, fmt.Sprintf("%d of %d syncs succeeded", succeeded, total))
+	}
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *RemoteAssemblageReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	c, err := remote.NewClusterCacheTracker(mgr.GetLogger(), mgr)
-	if err != nil {
+	r.cache = remote.NewTracker(mgr.GetLogger().WithName("remote"), mgr.GetClient(), mgr.GetScheme())
+	r.backoff = newClusterBackoff()
+
+	// This indexes remote assemblages by the objects they report
+	// as applied downstream, so they can be looked up by object.
+	if err := mgr.GetFieldIndexer().IndexField(context.TODO(), &fleetv1.RemoteAssemblage{}, InventoryObjectKey, indexInventoryObjects); err != nil {
 		return err
 	}
-	r.cache = c
 
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&fleetv1.RemoteAssemblage{}).
-		Complete(r)
+	// The remote clusters are watched as they are connected to, so
+	// keep hold of the controller to add the watches to.
+	var err error
+	r.controller, err = ctrl.NewControllerManagedBy(mgr).
+		For(&fleetv1.RemoteAssemblage{}, builder.WithPredicates(r.Shard.Predicate())).
+		// A remote assemblage compiled for a Remote has the same
+		// name; and, whether the Remote is in pull mode changes how
+		// it's handled.
+		Watches(&source.Kind{Type: &fleetv1.Remote{}}, &handler.EnqueueRequestForObject{}, builder.WithPredicates(r.Shard.Predicate())).
+		Build(r)
+	return err
+}
+
+// remoteAssemblageForAssemblage gives the remote assemblage upstream
+// that corresponds to an assemblage in a remote cluster. They have
+// the same name; the namespace upstream is given in a label, or if
+// there's no label, is the same.
+func remoteAssemblageForAssemblage(obj client.Object) []reconcile.Request {
+	namespace := obj.GetNamespace()
+	if upstream, ok := obj.GetLabels()[asmv1.UpstreamNamespaceLabel]; ok {
+		namespace = upstream
+	}
+	return []reconcile.Request{{
+		NamespacedName: types.NamespacedName{Namespace: namespace, Name: obj.GetName()},
+	}}
 }
@@ -0,0 +1,295 @@
+//go:build scale
+// +build scale
+
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+// This measures how the compiler copes with many modules and
+// clusters, alongside a baseline of the per-module fan-out it
+// replaced. It takes a while, so it's only built with the `scale`
+// tag; run it with `make test-scale`.
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+// countingClient counts the requests to write remote assemblages,
+// and how many of those failed because of a conflict -- including
+// trying to create one that already exists, which happens when
+// reading from a cache that's behind.
+type countingClient struct {
+	client.Client
+	writes    int64
+	conflicts int64
+}
+
+func (c *countingClient) count(obj client.Object, err error) error {
+	switch o := obj.(type) {
+	case *fleetv1.RemoteAssemblage:
+	case *unstructured.Unstructured: // as applied
+		if o.GetKind() != "RemoteAssemblage" {
+			return err
+		}
+	default:
+		return err
+	}
+	atomic.AddInt64(&c.writes, 1)
+	if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+		atomic.AddInt64(&c.conflicts, 1)
+	}
+	return err
+}
+
+func (c *countingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.count(obj, c.Client.Create(ctx, obj, opts...))
+}
+
+func (c *countingClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.count(obj, c.Client.Update(ctx, obj, opts...))
+}
+
+func (c *countingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return c.count(obj, c.Client.Patch(ctx, obj, patch, opts...))
+}
+
+// fanOutReconciler writes remote assemblages the way the module
+// controller did before there was a compiler: each module adds its
+// own sync to the assemblage of every cluster it selects. It's kept
+// here only as the baseline for the measurements.
+type fanOutReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+func (r *fanOutReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var mod fleetv1.Module
+	if err := r.Get(ctx, req.NamespacedName, &mod); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(mod.Spec.Selector)
+	if err != nil {
+		return ctrl.Result{}, nil
+	}
+	var clusters clusterv1.ClusterList
+	if err := r.List(ctx, &clusters, client.InNamespace(mod.Namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var failed int
+	for i := range clusters.Items {
+		cluster := &clusters.Items[i]
+		sync, err := syncForCluster(ctx, r.Client, &mod, cluster)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		asm := &fleetv1.RemoteAssemblage{}
+		asm.Namespace = cluster.Namespace
+		asm.Name = cluster.Name
+		if _, err := controllerutil.CreateOrUpdate(ctx, r.Client, asm, func() error {
+			if err := controllerutil.SetOwnerReference(&mod, asm, r.Scheme); err != nil {
+				return err
+			}
+			if err := controllerutil.SetControllerReference(cluster, asm, r.Scheme); err != nil {
+				return err
+			}
+			asm.Spec.KubeconfigRef = kubeconfigRefFor(cluster)
+			syncs := asm.Spec.Assemblage.Syncs
+			for i := range syncs {
+				if syncs[i].Name == mod.Name {
+					syncs[i] = sync
+					return nil
+				}
+			}
+			asm.Spec.Assemblage.Syncs = append(syncs, sync)
+			return nil
+		}); err != nil {
+			failed++
+		}
+	}
+	// The module controller used to come back to a module when it
+	// wrote the module's status; returning an error has much the
+	// same effect.
+	if failed > 0 {
+		return ctrl.Result{}, fmt.Errorf("failed to update %d remote assemblages", failed)
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *fanOutReconciler) setupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("fanout").
+		For(&fleetv1.Module{}).
+		Watches(
+			&source.Kind{Type: &fleetv1.RemoteAssemblage{}},
+			&handler.EnqueueRequestForOwner{
+				OwnerType:    &fleetv1.Module{},
+				IsController: false,
+			}).
+		Complete(r)
+}
+
+var _ = Describe("compiling at scale", func() {
+	const (
+		clusterCount = 100
+		moduleCount  = 20
+	)
+
+	var (
+		namespace   *corev1.Namespace
+		counter     *countingClient
+		stopManager func()
+		managerDone chan struct{}
+	)
+
+	// startManager runs a manager with the controllers set up by the
+	// func given, which are to write through the client given, so
+	// that the writes are counted.
+	startManager := func(setup func(ctrl.Manager, client.Client) error) {
+		manager, err := ctrl.NewManager(cfg, ctrl.Options{
+			Scheme: scheme.Scheme,
+		})
+		Expect(err).ToNot(HaveOccurred())
+		counter = &countingClient{Client: manager.GetClient()}
+		Expect(setup(manager, counter)).To(Succeed())
+
+		var ctx context.Context
+		ctx, stopManager = context.WithCancel(signalHandler)
+		managerDone = make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			Expect(manager.Start(ctx)).To(Succeed())
+			close(managerDone)
+		}()
+	}
+
+	BeforeEach(func() {
+		namespace = &corev1.Namespace{}
+		namespace.Name = "ns-" + randString(5)
+		Expect(k8sClient.Create(context.TODO(), namespace)).To(Succeed())
+
+		for i := 0; i < clusterCount; i++ {
+			cluster := &clusterv1.Cluster{}
+			cluster.Name = fmt.Sprintf("cluster-%03d", i)
+			cluster.Namespace = namespace.Name
+			Expect(k8sClient.Create(context.TODO(), cluster)).To(Succeed())
+		}
+	})
+
+	AfterEach(func() {
+		stopManager()
+		<-managerDone
+		Expect(k8sClient.Delete(context.TODO(), namespace)).To(Succeed())
+	})
+
+	// assignModules creates the modules, each selecting every
+	// cluster, then waits for every assemblage to include all of
+	// them. It records the time taken, and the writes made to get
+	// there; and, returns the number of spec changes per assemblage.
+	assignModules := func(b Benchmarker) float64 {
+		start := time.Now()
+		for i := 0; i < moduleCount; i++ {
+			mod := &fleetv1.Module{
+				Spec: fleetv1.ModuleSpec{
+					Selector: &metav1.LabelSelector{}, // all clusters
+					Sync:     makeSync("https://github.com/cuttlefacts/app", "v1.0.0"),
+				},
+			}
+			mod.Name = fmt.Sprintf("mod-%03d", i)
+			mod.Namespace = namespace.Name
+			Expect(k8sClient.Create(context.TODO(), mod)).To(Succeed())
+		}
+
+		var asms fleetv1.RemoteAssemblageList
+		Eventually(func() bool {
+			if err := k8sClient.List(context.TODO(), &asms, client.InNamespace(namespace.Name)); err != nil {
+				return false
+			}
+			if len(asms.Items) < clusterCount {
+				return false
+			}
+			for _, asm := range asms.Items {
+				if len(asm.Spec.Assemblage.Syncs) < moduleCount {
+					return false
+				}
+			}
+			return true
+		}, "120s", "1s").Should(BeTrue())
+		b.RecordValueWithPrecision("time to converge", time.Since(start).Seconds(), "s", 2)
+
+		// The generation of an assemblage counts the changes to its
+		// spec; the requests counted include those that failed, or
+		// changed nothing.
+		var generations int64
+		for _, asm := range asms.Items {
+			generations += asm.Generation
+		}
+		changes := float64(generations) / float64(len(asms.Items))
+		b.RecordValueWithPrecision("spec changes per assemblage", changes, "changes", 1)
+		b.RecordValueWithPrecision("write requests per assemblage",
+			float64(atomic.LoadInt64(&counter.writes))/float64(len(asms.Items)), "requests", 1)
+		b.RecordValue("conflicts", float64(atomic.LoadInt64(&counter.conflicts)))
+		return changes
+	}
+
+	Context("with the per-module fan-out, as a baseline", func() {
+		BeforeEach(func() {
+			startManager(func(mgr ctrl.Manager, c client.Client) error {
+				return (&fanOutReconciler{
+					Client: c,
+					Scheme: mgr.GetScheme(),
+				}).setupWithManager(mgr)
+			})
+		})
+
+		Measure("assigns many modules to many clusters", func(b Benchmarker) {
+			assignModules(b)
+		}, 1)
+	})
+
+	Context("with the compiler", func() {
+		BeforeEach(func() {
+			startManager(func(mgr ctrl.Manager, c client.Client) error {
+				return (&ModuleReconciler{
+					Client: c,
+					Log:    ctrl.Log.WithName("controllers").WithName("Module"),
+					Scheme: mgr.GetScheme(),
+				}).SetupWithManager(mgr)
+			})
+		})
+
+		Measure("assigns many modules to many clusters", func(b Benchmarker) {
+			changes := assignModules(b)
+			// Each assemblage is only written by the compiler, with
+			// server-side apply, so there's nothing to conflict
+			// with.
+			Expect(atomic.LoadInt64(&counter.conflicts)).To(BeZero())
+			// The fan-out changes each assemblage at least once per
+			// module, since each module adds its own sync; the
+			// compiler should take in several modules at a time.
+			Expect(changes).To(BeNumerically("<", moduleCount/2))
+		}, 1)
+	})
+})
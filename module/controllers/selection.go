@@ -0,0 +1,174 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	clusterv1 "sigs.k8s.io/cluster-api/api/v1alpha4"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
+)
+
+// clusterSelection is how a module picks the clusters it is assigned
+// to: either by a label selector, or by the membership of a
+// ClusterSet. The clusters selected from are both Cluster API
+// Clusters and Remotes; see listTargets.
+type clusterSelection struct {
+	selector labels.Selector
+	// members is non-nil if the selection is by cluster set
+	members map[string]struct{}
+}
+
+// selectionError is returned from selectionFor when the selection
+// can't be used as it is; i.e., trying again won't help until the
+// module (or its cluster set) changes.
+type selectionError struct {
+	reason string
+	err    error
+}
+
+func (e *selectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *selectionError) Unwrap() error {
+	return e.err
+}
+
+// selectionFor works out the selection given by a module's selector
+// and cluster set reference, which are alternatives. If neither is
+// given, nothing is selected.
+func selectionFor(ctx context.Context, c client.Reader, namespace string, selector *metav1.LabelSelector, setRef *fleetv1.LocalClusterSetReference) (clusterSelection, error) {
+	if setRef != nil {
+		if selector != nil {
+			return clusterSelection{}, &selectionError{
+				reason: fleetv1.InvalidSelectorReason,
+				err:    fmt.Errorf("only one of selector and clusterSetRef may be given"),
+			}
+		}
+		var set fleetv1.ClusterSet
+		if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: setRef.Name}, &set); err != nil {
+			if apierrors.IsNotFound(err) {
+				return clusterSelection{}, &selectionError{
+					reason: fleetv1.ClusterSetNotFoundReason,
+					err:    fmt.Errorf("cluster set %q not found", setRef.Name),
+				}
+			}
+			return clusterSelection{}, err
+		}
+		return setSelection(&set), nil
+	}
+
+	// `LabelSelectorAsSelector` correctly handles nil and empty
+	// selector values by selecting nothing and everything,
+	// respectively.
+	s, err := metav1.LabelSelectorAsSelector(selector)
+	if err != nil {
+		return clusterSelection{}, &selectionError{
+			reason: fleetv1.InvalidSelectorReason,
+			err:    err,
+		}
+	}
+	return clusterSelection{selector: s}, nil
+}
+
+// setSelection gives the selection of the members of the cluster
+// set, as last recorded in its status.
+func setSelection(set *fleetv1.ClusterSet) clusterSelection {
+	members := make(map[string]struct{}, len(set.Status.Members))
+	for _, name := range set.Status.Members {
+		members[name] = struct{}{}
+	}
+	return clusterSelection{members: members}
+}
+
+// matches reports whether the cluster given is selected.
+func (s clusterSelection) matches(cluster metav1.Object) bool {
+	if s.members != nil {
+		_, ok := s.members[cluster.GetName()]
+		return ok
+	}
+	return s.selector.Matches(labels.Set(cluster.GetLabels()))
+}
+
+// list returns the selected clusters in the namespace given.
+func (s clusterSelection) list(ctx context.Context, c client.Reader, namespace string) ([]client.Object, error) {
+	opts := &client.ListOptions{Namespace: namespace}
+	if s.members == nil {
+		opts.LabelSelector = s.selector
+	}
+	targets, err := listTargets(ctx, c, opts)
+	if err != nil {
+		return nil, err
+	}
+	if s.members == nil {
+		return targets, nil
+	}
+	var selected []client.Object
+	for _, target := range targets {
+		if s.matches(target) {
+			selected = append(selected, target)
+		}
+	}
+	return selected, nil
+}
+
+// listTargets lists the clusters that can be selected: the Cluster
+// API Clusters, and the Remotes enrolling other clusters. A Remote
+// with the same name as a Cluster is left out, since the assemblage
+// for each is named after it, and the Cluster takes precedence. The
+// result is sorted by name.
+func listTargets(ctx context.Context, c client.Reader, opts ...client.ListOption) ([]client.Object, error) {
+	var clusters clusterv1.ClusterList
+	if err := c.List(ctx, &clusters, opts...); err != nil {
+		return nil, fmt.Errorf("listing clusters: %w", err)
+	}
+	var remotes fleetv1.RemoteList
+	if err := c.List(ctx, &remotes, opts...); err != nil {
+		return nil, fmt.Errorf("listing remotes: %w", err)
+	}
+
+	targets := make([]client.Object, 0, len(clusters.Items)+len(remotes.Items))
+	names := make(map[string]struct{}, len(clusters.Items))
+	for i := range clusters.Items {
+		targets = append(targets, &clusters.Items[i])
+		names[clusters.Items[i].Name] = struct{}{}
+	}
+	for i := range remotes.Items {
+		if _, ok := names[remotes.Items[i].Name]; ok {
+			continue
+		}
+		targets = append(targets, &remotes.Items[i])
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		return targets[i].GetName() < targets[j].GetName()
+	})
+	return targets, nil
+}
+
+// getTarget gets the cluster with the key given: the Cluster API
+// Cluster if there is one, otherwise the Remote.
+func getTarget(ctx context.Context, c client.Reader, key client.ObjectKey) (client.Object, error) {
+	var cluster clusterv1.Cluster
+	err := c.Get(ctx, key, &cluster)
+	if err == nil {
+		return &cluster, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+	var remote fleetv1.Remote
+	if err := c.Get(ctx, key, &remote); err != nil {
+		return nil, err
+	}
+	return &remote, nil
+}
@@ -17,3 +17,8 @@ require (
 	sigs.k8s.io/cluster-api v0.3.11-0.20210323155336-f39a263d435c
 	sigs.k8s.io/controller-runtime v0.9.0-alpha.0
 )
+
+replace (
+	github.com/squaremo/fleeet/assemblage => ../assemblage
+	github.com/squaremo/fleeet/pkg => ../pkg
+)
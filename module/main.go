@@ -7,14 +7,17 @@ package main
 import (
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	coordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -26,6 +29,7 @@ import (
 
 	fleetv1 "github.com/squaremo/fleeet/module/api/v1alpha1"
 	"github.com/squaremo/fleeet/module/controllers"
+	"github.com/squaremo/fleeet/module/sharding"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -49,11 +53,40 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var shardCount int
+	var shardSelector string
+	var shardPrimary bool
+	var shardLeaseNamespace string
+	var downstreamDeletionTimeout time.Duration
+	var moduleDeletionTimeout time.Duration
+	var clusterProbeInterval time.Duration
+	var downstreamNamespace string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&shardCount, "shards", 1,
+		"The number of shards to divide clusters between. With more than one, each replica claims a shard "+
+			"using a Lease, and --leader-elect is ignored.")
+	flag.StringVar(&shardSelector, "shard-selector", "",
+		"A label selector restricting the clusters this replica is responsible for.")
+	flag.BoolVar(&shardPrimary, "shard-primary", false,
+		"Make this replica responsible for module status, when using --shard-selector. "+
+			"Otherwise, the replica holding shard 0 is responsible.")
+	flag.StringVar(&shardLeaseNamespace, "shard-lease-namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace for the Lease objects used to claim shards.")
+	flag.DurationVar(&downstreamDeletionTimeout, "downstream-deletion-timeout", 10*time.Minute,
+		"How long to keep trying to delete the assemblage in a remote cluster, when its remote assemblage "+
+			"is deleted, before giving up and leaving it there.")
+	flag.DurationVar(&moduleDeletionTimeout, "module-deletion-timeout", 10*time.Minute,
+		"How long to wait for a deleted module to be removed from every cluster, before giving up and "+
+			"letting it go, possibly leaving what it synced in place.")
+	flag.DurationVar(&clusterProbeInterval, "cluster-probe-interval", 5*time.Minute,
+		"How often to check that each remote cluster can be reached, when nothing else has prompted a look.")
+	flag.StringVar(&downstreamNamespace, "downstream-namespace", asmv1.DefaultNamespace,
+		"The namespace in each remote cluster in which to create assemblages, unless a remote assemblage "+
+			"gives its own.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -62,13 +95,85 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	ctx := ctrl.SetupSignalHandler()
+	config := ctrl.GetConfigOrDie()
+
+	var shard *sharding.Shard
+	if shardCount > 1 || shardSelector != "" {
+		shard = &sharding.Shard{
+			Count:   shardCount,
+			Primary: shardSelector == "" || shardPrimary,
+		}
+		if shardSelector != "" {
+			selector, err := labels.Parse(shardSelector)
+			if err != nil {
+				setupLog.Error(err, "unable to parse shard selector")
+				os.Exit(1)
+			}
+			shard.Selector = selector
+			// Nothing else can tell whether some replica is
+			// primary, so this is a warning rather than an error.
+			if !shardPrimary {
+				setupLog.Info("warning: this replica is not primary; unless another replica is run with " +
+					"--shard-primary, module status will not be calculated")
+			}
+		}
+		if shardCount > 1 {
+			if shardLeaseNamespace == "" {
+				setupLog.Info("--shard-lease-namespace (or POD_NAMESPACE) must be given when using more than one shard")
+				os.Exit(1)
+			}
+			identity, err := os.Hostname()
+			if err != nil {
+				setupLog.Error(err, "unable to get hostname for shard identity")
+				os.Exit(1)
+			}
+			leases, err := coordinationv1.NewForConfig(config)
+			if err != nil {
+				setupLog.Error(err, "unable to create client for shard leases")
+				os.Exit(1)
+			}
+			// Replicas with different selectors divide up different
+			// clusters, so they need leases of their own.
+			leaseName := "fleeet-module-shard"
+			if suffix := shard.Suffix(); suffix != "" {
+				leaseName += "-" + suffix
+			}
+			index, err := sharding.AcquireShard(ctx, setupLog, leases, sharding.LeaseOptions{
+				Namespace: shardLeaseNamespace,
+				Name:      leaseName,
+				Identity:  identity,
+				Count:     shardCount,
+			}, func() {
+				setupLog.Info("lost shard lease")
+				os.Exit(1)
+			})
+			if err != nil {
+				setupLog.Error(err, "unable to acquire shard")
+				os.Exit(1)
+			}
+			shard.Index = index
+			shard.Primary = shard.Primary && index == 0
+			// The shard lease does the job of leader election
+			enableLeaderElection = false
+		}
+	}
+
+	// Replicas with a selector, but without shard leases, elect a
+	// leader among those with the same selector, so each selector
+	// shard has one active replica.
+	leaderElectionID := "020c037d.squaremo.dev"
+	if suffix := shard.Suffix(); suffix != "" {
+		leaderElectionID = "020c037d-" + suffix + ".squaremo.dev"
+	}
+
+	mgr, err := ctrl.NewManager(config, ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
 		Port:                   9443,
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "020c037d.squaremo.dev",
+		LeaderElectionID:       leaderElectionID,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -79,26 +184,67 @@ func main() {
 		Client: mgr.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("RemoteAssemblage"),
 		Scheme: mgr.GetScheme(),
+		Shard:  shard,
+
+		DeletionTimeout:     downstreamDeletionTimeout,
+		ProbeInterval:       clusterProbeInterval,
+		DownstreamNamespace: downstreamNamespace,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "RemoteAssemblage")
 		os.Exit(1)
 	}
-	if err = (&controllers.ModuleReconciler{
+	if err = (&controllers.RemoteReconciler{
 		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("Module"),
+		Log:    ctrl.Log.WithName("controllers").WithName("Remote"),
 		Scheme: mgr.GetScheme(),
+		Shard:  shard,
+
+		ProbeInterval: clusterProbeInterval,
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Module")
+		setupLog.Error(err, "unable to create controller", "controller", "Remote")
 		os.Exit(1)
 	}
-	if err = (&controllers.BootstrapModuleReconciler{
+	if err = (&controllers.ModuleReconciler{
 		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("BootstrapModule"),
+		Log:    ctrl.Log.WithName("controllers").WithName("Module"),
 		Scheme: mgr.GetScheme(),
+		Shard:  shard,
+
+		DeletionTimeout: moduleDeletionTimeout,
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "BootstrapModule")
+		setupLog.Error(err, "unable to create controller", "controller", "Module")
 		os.Exit(1)
 	}
+	// Bootstrap modules don't connect to the clusters themselves, so
+	// they are all handled in the primary shard. Likewise the
+	// membership of cluster sets, and the modules generated by module
+	// sets.
+	if shard.IsPrimary() {
+		if err = (&controllers.ClusterSetReconciler{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("ClusterSet"),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ClusterSet")
+			os.Exit(1)
+		}
+		if err = (&controllers.BootstrapModuleReconciler{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("BootstrapModule"),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "BootstrapModule")
+			os.Exit(1)
+		}
+		if err = (&controllers.ModuleSetReconciler{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("controllers").WithName("ModuleSet"),
+			Scheme: mgr.GetScheme(),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ModuleSet")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -111,7 +257,7 @@ func main() {
 	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
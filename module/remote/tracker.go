@@ -0,0 +1,323 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+// Package remote keeps clients for remote clusters, given the secrets
+// holding their kubeconfigs. It does much the same job as the
+// ClusterCacheTracker from Cluster API, but doesn't assume that a
+// cluster is represented by a Cluster API Cluster, or that its secret
+// is named and laid out as Cluster API would do it.
+package remote
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	healthCheckInterval           = 10 * time.Second
+	healthCheckRequestTimeout     = 5 * time.Second
+	healthCheckUnhealthyThreshold = 3
+)
+
+// KubeconfigKey identifies a kubeconfig, by the secret it's in and
+// the key under which it's in the secret's data.
+type KubeconfigKey struct {
+	Namespace string
+	Name      string
+	Key       string
+}
+
+func (k KubeconfigKey) String() string {
+	return fmt.Sprintf("%s/%s[%s]", k.Namespace, k.Name, k.Key)
+}
+
+// Tracker keeps a client, with a cache, for each remote cluster asked
+// for. Each cluster's API server is checked periodically, and its
+// client dropped if it stops responding; it's also dropped if the
+// secret changes, so that a rotated kubeconfig is picked up. A
+// dropped client is created afresh the next time it's asked for.
+type Tracker struct {
+	log    logr.Logger
+	client client.Reader
+	scheme *runtime.Scheme
+
+	// mu guards the maps of accessors, but isn't held while an
+	// accessor is created, since that means contacting the remote
+	// cluster, which may be slow or not respond at all.
+	mu        sync.Mutex
+	accessors map[KubeconfigKey]*accessor
+	creating  map[KubeconfigKey]*pendingAccessor
+}
+
+// accessor is the client, cache and watches for a remote cluster.
+type accessor struct {
+	client client.Client
+	cache  cache.Cache
+	stop   context.CancelFunc
+
+	mu      sync.Mutex
+	watches map[string]struct{}
+}
+
+// pendingAccessor is an accessor being created. Anyone else asking
+// for the same cluster meanwhile waits for it, rather than creating
+// another.
+type pendingAccessor struct {
+	done     chan struct{}
+	accessor *accessor
+	err      error
+}
+
+// NewTracker creates a Tracker which reads secrets with the client
+// given, and creates clients for remote clusters with the scheme
+// given.
+func NewTracker(log logr.Logger, c client.Reader, scheme *runtime.Scheme) *Tracker {
+	return &Tracker{
+		log:       log,
+		client:    c,
+		scheme:    scheme,
+		accessors: map[KubeconfigKey]*accessor{},
+		creating:  map[KubeconfigKey]*pendingAccessor{},
+	}
+}
+
+// GetClient returns a client for the cluster whose kubeconfig is
+// given. Reads go through a cache, except for ConfigMaps and Secrets.
+func (t *Tracker) GetClient(ctx context.Context, key KubeconfigKey) (client.Client, error) {
+	a, err := t.getAccessor(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return a.client, nil
+}
+
+// Watcher is the part of a controller needed to add a watch to it.
+type Watcher interface {
+	Watch(src source.Source, eventHandler handler.EventHandler, predicates ...predicate.Predicate) error
+}
+
+// WatchInput gives the parameters for watching a kind of object in a
+// remote cluster.
+type WatchInput struct {
+	// Name identifies the watch, so it's not added twice for the same
+	// cluster.
+	Name string
+	// Kubeconfig identifies the remote cluster.
+	Kubeconfig KubeconfigKey
+	// Watcher is the controller to which to add the watch.
+	Watcher Watcher
+	// Kind is the type of object to watch.
+	Kind client.Object
+	// EventHandler is given the events for the objects watched.
+	EventHandler handler.EventHandler
+	// Predicates filter the events for the objects watched.
+	Predicates []predicate.Predicate
+}
+
+// Watch adds a watch on a remote cluster, unless there is one with
+// the same name already.
+func (t *Tracker) Watch(ctx context.Context, input WatchInput) error {
+	if input.Name == "" {
+		return fmt.Errorf("a watch must have a name")
+	}
+
+	a, err := t.getAccessor(ctx, input.Kubeconfig)
+	if err != nil {
+		return err
+	}
+	// Adding a watch waits for the cache to sync, so this holds only
+	// the lock for this cluster.
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.watches[input.Name]; ok {
+		return nil
+	}
+	if err := input.Watcher.Watch(source.NewKindWithCache(input.Kind, a.cache), input.EventHandler, input.Predicates...); err != nil {
+		return fmt.Errorf("adding watch: %w", err)
+	}
+	a.watches[input.Name] = struct{}{}
+	return nil
+}
+
+// getAccessor returns the accessor for the kubeconfig, creating it if
+// necessary. Only one accessor is created at a time for each
+// kubeconfig, but creating one doesn't hold up getting accessors for
+// other kubeconfigs.
+func (t *Tracker) getAccessor(ctx context.Context, key KubeconfigKey) (*accessor, error) {
+	t.mu.Lock()
+	if a, ok := t.accessors[key]; ok {
+		t.mu.Unlock()
+		return a, nil
+	}
+	pending, inFlight := t.creating[key]
+	if !inFlight {
+		pending = &pendingAccessor{done: make(chan struct{})}
+		t.creating[key] = pending
+	}
+	t.mu.Unlock()
+
+	if inFlight {
+		select {
+		case <-pending.done:
+			return pending.accessor, pending.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	a, start, err := t.newAccessor(ctx, key)
+	if err != nil {
+		err = fmt.Errorf("creating client for remote cluster %s: %w", key, err)
+	}
+	t.mu.Lock()
+	delete(t.creating, key)
+	if err == nil {
+		t.accessors[key] = a
+		// This is started only once the accessor is recorded, so
+		// that the health check can remove it.
+		start()
+	}
+	t.mu.Unlock()
+	pending.accessor, pending.err = a, err
+	close(pending.done)
+	return a, err
+}
+
+// RESTConfig reads the kubeconfig identified by the key, and gives
+// the REST client config it describes, along with the resource
+// version of the secret it was read from.
+func RESTConfig(ctx context.Context, c client.Reader, key KubeconfigKey) (*rest.Config, string, error) {
+	var secret corev1.Secret
+	if err := c.Get(ctx, client.ObjectKey{Namespace: key.Namespace, Name: key.Name}, &secret); err != nil {
+		return nil, "", err
+	}
+	data, ok := secret.Data[key.Key]
+	if !ok {
+		return nil, "", fmt.Errorf("secret %s has no key %q", key.Name, key.Key)
+	}
+	config, err := clientcmd.RESTConfigFromKubeConfig(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("reading kubeconfig: %w", err)
+	}
+	return config, secret.ResourceVersion, nil
+}
+
+// newAccessor creates the client and cache for the kubeconfig. It
+// returns a func to start the cache and health check.
+func (t *Tracker) newAccessor(ctx context.Context, key KubeconfigKey) (*accessor, func(), error) {
+	config, secretVersion, err := RESTConfig(ctx, t.client, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mapper, err := apiutil.NewDynamicRESTMapper(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := client.New(config, client.Options{Scheme: t.scheme, Mapper: mapper})
+	if err != nil {
+		return nil, nil, err
+	}
+	remoteCache, err := cache.New(config, cache.Options{Scheme: t.scheme, Mapper: mapper})
+	if err != nil {
+		return nil, nil, err
+	}
+	delegatingClient, err := client.NewDelegatingClient(client.NewDelegatingClientInput{
+		CacheReader: remoteCache,
+		Client:      c,
+		UncachedObjects: []client.Object{
+			&corev1.ConfigMap{},
+			&corev1.Secret{},
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cacheCtx, stop := context.WithCancel(ctx)
+	start := func() {
+		go remoteCache.Start(cacheCtx)
+		go t.healthCheck(cacheCtx, key, config, secretVersion)
+	}
+	return &accessor{
+		client:  delegatingClient,
+		cache:   remoteCache,
+		stop:    stop,
+		watches: map[string]struct{}{},
+	}, start, nil
+}
+
+// remove stops the cache for the kubeconfig, and drops its accessor.
+func (t *Tracker) remove(key KubeconfigKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if a, ok := t.accessors[key]; ok {
+		a.stop()
+		delete(t.accessors, key)
+	}
+}
+
+// healthCheck polls the remote cluster's API server until it fails
+// to respond enough times in a row, or the secret is changed or
+// deleted, then removes the accessor.
+func (t *Tracker) healthCheck(ctx context.Context, key KubeconfigKey, config *rest.Config, secretVersion string) {
+	codec := runtime.NoopEncoder{Decoder: scheme.Codecs.UniversalDecoder()}
+	cfg := rest.CopyConfig(config)
+	cfg.NegotiatedSerializer = serializer.NegotiatedSerializerWrapper(runtime.SerializerInfo{Serializer: codec})
+	restClient, err := rest.UnversionedRESTClientFor(cfg)
+	if err != nil {
+		t.log.Error(err, "creating client for health check", "kubeconfig", key.String())
+		t.remove(key)
+		return
+	}
+
+	var failures int
+	err = wait.PollImmediateUntil(healthCheckInterval, func() (bool, error) {
+		var secret corev1.Secret
+		if err := t.client.Get(ctx, client.ObjectKey{Namespace: key.Namespace, Name: key.Name}, &secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				return false, err
+			}
+			return false, nil
+		}
+		if secret.ResourceVersion != secretVersion {
+			return false, fmt.Errorf("kubeconfig secret has changed")
+		}
+
+		if _, err := restClient.Get().AbsPath("/").Timeout(healthCheckRequestTimeout).DoRaw(ctx); err != nil {
+			failures++
+			if failures >= healthCheckUnhealthyThreshold {
+				return false, err
+			}
+			return false, nil
+		}
+		failures = 0
+		return false, nil
+	}, ctx.Done())
+
+	// The poll only finishes without an error when the context is
+	// cancelled, meaning the accessor has already been removed.
+	if err != nil && err != wait.ErrWaitTimeout {
+		t.log.Info("dropping client for remote cluster", "kubeconfig", key.String(), "reason", err.Error())
+		t.remove(key)
+	}
+}
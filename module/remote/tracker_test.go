@@ -0,0 +1,183 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// discoveryHandler answers just enough of the discovery API for a
+// client to be created, after waiting for the channel given to be
+// closed. It counts the requests for the API versions as they arrive.
+func discoveryHandler(wait <-chan struct{}, count *int32) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			atomic.AddInt32(count, 1)
+		}
+		<-wait
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/api":
+			w.Write([]byte(`{"kind":"APIVersions","versions":["v1"]}`))
+		case "/apis":
+			w.Write([]byte(`{"kind":"APIGroupList","apiVersion":"v1","groups":[]}`))
+		case "/api/v1":
+			w.Write([]byte(`{"kind":"APIResourceList","groupVersion":"v1","resources":[]}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	})
+}
+
+// kubeconfigSecret makes a secret holding a kubeconfig for the server
+// at the URL given.
+func kubeconfigSecret(name, url string) *corev1.Secret {
+	data := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: remote
+  cluster:
+    server: %s
+users:
+- name: remote
+  user: {}
+contexts:
+- name: remote
+  context:
+    cluster: remote
+    user: remote
+current-context: remote
+`, url)
+	secret := &corev1.Secret{}
+	secret.Namespace = "default"
+	secret.Name = name
+	secret.Data = map[string][]byte{"value": []byte(data)}
+	return secret
+}
+
+// secretReader is a client.Reader that only knows about the secrets
+// it's given, which is all the tracker needs to read.
+type secretReader map[client.ObjectKey]*corev1.Secret
+
+func (r secretReader) Get(_ context.Context, key client.ObjectKey, obj client.Object) error {
+	secret, ok := r[key]
+	if !ok {
+		return errors.NewNotFound(schema.GroupResource{Resource: "secrets"}, key.Name)
+	}
+	secret.DeepCopyInto(obj.(*corev1.Secret))
+	return nil
+}
+
+func (r secretReader) List(context.Context, client.ObjectList, ...client.ListOption) error {
+	panic("not implemented")
+}
+
+func newSecretReader(secrets ...*corev1.Secret) secretReader {
+	r := secretReader{}
+	for _, s := range secrets {
+		r[client.ObjectKeyFromObject(s)] = s
+	}
+	return r
+}
+
+var _ = Describe("tracker", func() {
+	var (
+		ctx     context.Context
+		cancel  context.CancelFunc
+		slow    *httptest.Server
+		fast    *httptest.Server
+		release chan struct{}
+		slowGet int32
+		tracker *Tracker
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		release = make(chan struct{})
+		slowGet = 0
+		slow = httptest.NewServer(discoveryHandler(release, &slowGet))
+		ready := make(chan struct{})
+		close(ready)
+		var fastGet int32
+		fast = httptest.NewServer(discoveryHandler(ready, &fastGet))
+
+		c := newSecretReader(
+			kubeconfigSecret("slow", slow.URL),
+			kubeconfigSecret("fast", fast.URL),
+		)
+		tracker = NewTracker(ctrl.Log.WithName("remote"), c, scheme.Scheme)
+	})
+
+	AfterEach(func() {
+		cancel()
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+		slow.Close()
+		fast.Close()
+	})
+
+	slowKey := KubeconfigKey{Namespace: "default", Name: "slow", Key: "value"}
+	fastKey := KubeconfigKey{Namespace: "default", Name: "fast", Key: "value"}
+
+	It("doesn't hold up other clusters while connecting to a slow one", func() {
+		slowDone := make(chan error, 1)
+		go func() {
+			_, err := tracker.GetClient(ctx, slowKey)
+			slowDone <- err
+		}()
+		// wait until it's stuck in discovery
+		Eventually(func() int32 {
+			return atomic.LoadInt32(&slowGet)
+		}, "2s", "10ms").Should(Equal(int32(1)))
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := tracker.GetClient(ctx, fastKey)
+			done <- err
+		}()
+		Eventually(done, "2s").Should(Receive(BeNil()))
+		Consistently(slowDone, "200ms").ShouldNot(Receive())
+
+		close(release)
+		Eventually(slowDone, "2s").Should(Receive(BeNil()))
+	})
+
+	It("creates only one client for a cluster asked for at the same time", func() {
+		results := make(chan client.Client, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				defer GinkgoRecover()
+				c, err := tracker.GetClient(ctx, slowKey)
+				Expect(err).NotTo(HaveOccurred())
+				results <- c
+			}()
+		}
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+
+		var first, second client.Client
+		Eventually(results, "2s").Should(Receive(&first))
+		Eventually(results, "2s").Should(Receive(&second))
+		Expect(second).To(BeIdenticalTo(first))
+		Expect(atomic.LoadInt32(&slowGet)).To(Equal(int32(1)))
+	})
+})
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaseOptions gives the parameters for claiming a shard.
+type LeaseOptions struct {
+	// Namespace is where the Lease objects live.
+	Namespace string
+	// Name is the prefix for the names of the Lease objects; the
+	// lease for shard i is named "<Name>-<i>".
+	Name string
+	// Identity identifies this replica as the holder of a lease.
+	Identity string
+	// Count is the number of shards.
+	Count int
+}
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// AcquireShard blocks until this replica holds the lease for one of
+// the shards, and returns the index of that shard. The lease is held
+// until the context is cancelled; if it is lost before then, onLost
+// is called. Replicas beyond the number of shards will wait here,
+// as standbys.
+func AcquireShard(ctx context.Context, log logr.Logger, leases coordinationv1.LeasesGetter, opts LeaseOptions, onLost func()) (int, error) {
+	if opts.Count < 1 {
+		return 0, fmt.Errorf("number of shards must be at least 1, got %d", opts.Count)
+	}
+
+	// Try for all the leases at once. The first one acquired is
+	// kept; the others are given up, by cancelling their contexts.
+	acquired := make(chan int, opts.Count)
+	kept := int32(-1)
+	cancels := make([]context.CancelFunc, opts.Count)
+	for i := 0; i < opts.Count; i++ {
+		var shardCtx context.Context
+		shardCtx, cancels[i] = context.WithCancel(ctx)
+		lock := &resourcelock.LeaseLock{
+			LeaseMeta: metav1.ObjectMeta{
+				Namespace: opts.Namespace,
+				Name:      fmt.Sprintf("%s-%d", opts.Name, i),
+			},
+			Client: leases,
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: opts.Identity,
+			},
+		}
+		index := i
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            lock.LeaseMeta.Name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(context.Context) {
+					acquired <- index
+				},
+				OnStoppedLeading: func() {
+					// This is called whenever the elector stops,
+					// including when its context is cancelled; it's
+					// only a problem if it's the lease that was kept,
+					// and this isn't a shutdown.
+					if atomic.LoadInt32(&kept) == int32(index) && ctx.Err() == nil {
+						onLost()
+					}
+				},
+			},
+		})
+		if err != nil {
+			for _, cancel := range cancels[:i+1] {
+				cancel()
+			}
+			return 0, err
+		}
+		go elector.Run(shardCtx)
+	}
+
+	select {
+	case index := <-acquired:
+		atomic.StoreInt32(&kept, int32(index))
+		for i, cancel := range cancels {
+			if i != index {
+				cancel()
+			}
+		}
+		log.Info("acquired shard", "shard", index, "of", opts.Count)
+		return index, nil
+	case <-ctx.Done():
+		for _, cancel := range cancels {
+			cancel()
+		}
+		return 0, ctx.Err()
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+var _ = Describe("shard leases", func() {
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+		client *fake.Clientset
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		client = fake.NewSimpleClientset()
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	options := func(identity string, count int) LeaseOptions {
+		return LeaseOptions{
+			Namespace: "default",
+			Name:      "shard",
+			Identity:  identity,
+			Count:     count,
+		}
+	}
+
+	acquire := func(ctx context.Context, identity string, count int) (int, error) {
+		return AcquireShard(ctx, ctrl.Log, client.CoordinationV1(), options(identity, count), func() {})
+	}
+
+	It("rejects fewer than one shard", func() {
+		_, err := acquire(ctx, "replica-0", 0)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("gives each replica a different shard, and holds the lease", func() {
+		first, err := acquire(ctx, "replica-0", 2)
+		Expect(err).NotTo(HaveOccurred())
+		second, err := acquire(ctx, "replica-1", 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect([]int{first, second}).To(ConsistOf(0, 1))
+
+		for index, identity := range map[int]string{first: "replica-0", second: "replica-1"} {
+			lease, err := client.CoordinationV1().Leases("default").Get(ctx, fmt.Sprintf("shard-%d", index), metav1.GetOptions{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lease.Spec.HolderIdentity).ToNot(BeNil())
+			Expect(*lease.Spec.HolderIdentity).To(Equal(identity))
+		}
+	})
+
+	It("keeps a replica waiting when all the shards are held", func() {
+		_, err := acquire(ctx, "replica-0", 1)
+		Expect(err).NotTo(HaveOccurred())
+
+		waitCtx, waitCancel := context.WithTimeout(ctx, 3*time.Second)
+		defer waitCancel()
+		_, err = acquire(waitCtx, "replica-1", 1)
+		Expect(err).To(Equal(context.DeadlineExceeded))
+	})
+})
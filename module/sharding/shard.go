@@ -0,0 +1,84 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+// Package sharding lets the work of the module controllers be split
+// across several replicas, by dividing up the clusters between them.
+package sharding
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// Shard identifies the subset of clusters for which a controller is
+// responsible. A nil *Shard is responsible for all clusters.
+//
+// Objects pertaining to a single cluster (the Cluster itself, and its
+// RemoteAssemblage) have the same namespace and name as the cluster,
+// and carry its labels, so the same test applies to each of them.
+type Shard struct {
+	// Index is the number of this shard, from 0 to Count-1.
+	Index int
+	// Count is the total number of shards. Clusters are assigned to
+	// a shard by hashing their namespace and name.
+	Count int
+	// Selector, if not nil, restricts the shard to clusters with
+	// matching labels.
+	Selector labels.Selector
+	// Primary marks the shard that does the work concerning all
+	// clusters, like calculating the status of modules. Exactly one
+	// shard should be primary.
+	Primary bool
+}
+
+// Owns reports whether the cluster-related object given belongs in
+// this shard.
+func (s *Shard) Owns(obj client.Object) bool {
+	if s == nil {
+		return true
+	}
+	if s.Selector != nil && !s.Selector.Matches(labels.Set(obj.GetLabels())) {
+		return false
+	}
+	if s.Count <= 1 {
+		return true
+	}
+	return shardFor(obj.GetNamespace(), obj.GetName(), s.Count) == s.Index
+}
+
+// IsPrimary reports whether this is the shard responsible for work
+// that concerns all clusters.
+func (s *Shard) IsPrimary() bool {
+	return s == nil || s.Primary
+}
+
+// Predicate gives a predicate for filtering the events for objects
+// outside the shard.
+func (s *Shard) Predicate() predicate.Predicate {
+	return predicate.NewPredicateFuncs(s.Owns)
+}
+
+// Suffix gives a string that distinguishes the clusters selected for
+// this shard from those selected for shards with other selectors, for
+// use in the names of Leases. It's empty if there's no selector.
+func (s *Shard) Suffix() string {
+	if s == nil || s.Selector == nil || s.Selector.Empty() {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s.Selector.String()))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func shardFor(namespace, name string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	h.Write([]byte{'/'})
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(count))
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+package sharding
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+var _ = Describe("shards", func() {
+	makeObject := func(namespace, name string, lbls map[string]string) *corev1.ConfigMap {
+		obj := &corev1.ConfigMap{}
+		obj.Namespace = namespace
+		obj.Name = name
+		obj.Labels = lbls
+		return obj
+	}
+
+	It("assigns each cluster to the same shard every time", func() {
+		for i := 0; i < 100; i++ {
+			name := fmt.Sprintf("cluster-%d", i)
+			index := shardFor("default", name, 7)
+			Expect(index).To(BeNumerically(">=", 0))
+			Expect(index).To(BeNumerically("<", 7))
+			Expect(shardFor("default", name, 7)).To(Equal(index))
+		}
+	})
+
+	It("spreads clusters across the shards", func() {
+		counts := make([]int, 4)
+		for i := 0; i < 400; i++ {
+			counts[shardFor("default", fmt.Sprintf("cluster-%d", i), 4)]++
+		}
+		for _, n := range counts {
+			Expect(n).To(BeNumerically(">", 50))
+		}
+	})
+
+	It("distinguishes namespace from name", func() {
+		// Without a separator, these would hash the same.
+		Expect(shardFor("ab", "c", 1<<16)).ToNot(Equal(shardFor("a", "bc", 1<<16)))
+	})
+
+	It("owns everything when nil, or with a single shard and no selector", func() {
+		var none *Shard
+		obj := makeObject("default", "cluster", nil)
+		Expect(none.Owns(obj)).To(BeTrue())
+		Expect(none.IsPrimary()).To(BeTrue())
+		Expect((&Shard{Count: 1}).Owns(obj)).To(BeTrue())
+	})
+
+	It("owns exactly one shard's worth of clusters", func() {
+		shards := []*Shard{{Index: 0, Count: 3}, {Index: 1, Count: 3}, {Index: 2, Count: 3}}
+		for i := 0; i < 50; i++ {
+			obj := makeObject("default", fmt.Sprintf("cluster-%d", i), nil)
+			var owners int
+			for _, s := range shards {
+				if s.Owns(obj) {
+					owners++
+				}
+			}
+			Expect(owners).To(Equal(1))
+		}
+	})
+
+	It("owns only clusters matching the selector", func() {
+		selector, err := labels.Parse("env=prod")
+		Expect(err).NotTo(HaveOccurred())
+		shard := &Shard{Count: 1, Selector: selector}
+		Expect(shard.Owns(makeObject("default", "a", map[string]string{"env": "prod"}))).To(BeTrue())
+		Expect(shard.Owns(makeObject("default", "b", map[string]string{"env": "dev"}))).To(BeFalse())
+		Expect(shard.Owns(makeObject("default", "c", nil))).To(BeFalse())
+	})
+
+	It("applies the selector before hashing", func() {
+		selector, err := labels.Parse("env=prod")
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 20; i++ {
+			obj := makeObject("default", fmt.Sprintf("cluster-%d", i), map[string]string{"env": "dev"})
+			index := shardFor(obj.Namespace, obj.Name, 2)
+			Expect((&Shard{Index: index, Count: 2, Selector: selector}).Owns(obj)).To(BeFalse())
+			Expect((&Shard{Index: index, Count: 2}).Owns(obj)).To(BeTrue())
+		}
+	})
+
+	It("gives a suffix for each selector, and none without one", func() {
+		prod, err := labels.Parse("env=prod")
+		Expect(err).NotTo(HaveOccurred())
+		dev, err := labels.Parse("env=dev")
+		Expect(err).NotTo(HaveOccurred())
+
+		var none *Shard
+		Expect(none.Suffix()).To(BeEmpty())
+		Expect((&Shard{Count: 2}).Suffix()).To(BeEmpty())
+		Expect((&Shard{Selector: labels.Everything()}).Suffix()).To(BeEmpty())
+		Expect((&Shard{Selector: prod}).Suffix()).To(HaveLen(8))
+		Expect((&Shard{Selector: prod}).Suffix()).To(Equal((&Shard{Selector: prod}).Suffix()))
+		Expect((&Shard{Selector: prod}).Suffix()).ToNot(Equal((&Shard{Selector: dev}).Suffix()))
+	})
+})
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// These help with moving an assemblage from one place to another
+// without taking down what it syncs: the assemblage is created in the
+// new place, and once its syncs have settled, the old one is removed,
+// orphaning what it synced.
+
+// SyncsSettled says whether each of the syncs given has a status, for
+// the same version of the sync, that says it has succeeded or is
+// suspended; i.e., whether everything that is going to be applied,
+// has been.
+func SyncsSettled(syncs []NamedSync, statuses []SyncStatus) bool {
+	for _, sync := range syncs {
+		settled := false
+		for _, status := range statuses {
+			if status.Sync.Name == sync.Name && equality.Semantic.DeepEqual(status.Sync, sync) {
+				settled = status.State == StateSucceeded || status.State == StateSuspended
+				break
+			}
+		}
+		if !settled {
+			return false
+		}
+	}
+	return true
+}
+
+// OrphanSyncs sets each of the syncs given to leave what it synced in
+// place when it's removed, and reports whether any of them changed.
+func OrphanSyncs(syncs []NamedSync) bool {
+	changed := false
+	for i := range syncs {
+		if syncs[i].DeletionPolicy != DeletionPolicyOrphan {
+			syncs[i].DeletionPolicy = DeletionPolicyOrphan
+			changed = true
+		}
+	}
+	return changed
+}
@@ -4,6 +4,10 @@ Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
 
 package api
 
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
 // Sync defines a versioned piece of configuration to be synced, and
 // how to sync it.
 type Sync struct {
@@ -30,6 +34,25 @@ type NamedSync struct {
 	// Bindings gives a list of variable bindings to use when evaluating the package spec in the sync
 	// +optional
 	Bindings []Binding `json:"bindings,omitempty"`
+	// DeletionPolicy says what to do with what has been synced, when
+	// the sync is removed. The default is to delete it.
+	// +optional
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// Suspend tells the assemblage to stop applying this sync, and
+	// to suspend the GitOps Toolkit objects created for it.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+	// ConflictPolicy says what to do when this sync applies some of
+	// the same objects as another sync in the assemblage. The default
+	// is to report the conflict.
+	// +optional
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty"`
+	// Drift says what to do when the objects applied by this sync
+	// are changed by something else. The default is to correct them.
+	// Other policies only take effect if the assemblage controller is
+	// checking for drift.
+	// +optional
+	Drift *DriftPolicy `json:"drift,omitempty"`
 	// +required
 	Sync `json:",inline"`
 }
@@ -77,6 +100,69 @@ type KustomizeSpec struct {
 	Substitute map[string]string `json:"substitute,omitempty"`
 }
 
+// DeletionPolicy gives what happens to the things synced when a
+// sync is removed.
+// +kubebuilder:validation:Enum=Delete;Orphan
+type DeletionPolicy string
+
+const (
+	// Delete everything that was synced
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// Leave everything that was synced in place
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+)
+
+// ConflictPolicy gives what happens when a sync applies objects that
+// another sync also applies.
+// +kubebuilder:validation:Enum=Report;Block
+type ConflictPolicy string
+
+const (
+	// Report the conflict in the status of both syncs, and keep
+	// applying both
+	ConflictPolicyReport ConflictPolicy = "Report"
+	// Stop applying this sync, if it was created after the sync it
+	// conflicts with
+	ConflictPolicyBlock ConflictPolicy = "Block"
+)
+
+// DriftMode gives what happens when the objects applied by a sync
+// drift from what was applied.
+// +kubebuilder:validation:Enum=Correct;Report;IgnoreFields
+type DriftMode string
+
+const (
+	// Put the objects back as they were applied, the next time the
+	// sync is applied
+	DriftModeCorrect DriftMode = "Correct"
+	// Record the drift in the status, and leave the objects as they
+	// are until a new revision is applied
+	DriftModeReport DriftMode = "Report"
+	// Correct drift, except in the fields given, which are neither
+	// reported nor corrected by themselves. Correcting drift
+	// elsewhere, which happens once a check has found it, applies
+	// the whole object again, so it puts back the ignored fields too;
+	// as does applying a new revision
+	DriftModeIgnoreFields DriftMode = "IgnoreFields"
+)
+
+// DriftPolicy says what to do about the objects applied by a sync
+// drifting from what was applied.
+type DriftPolicy struct {
+	// Mode gives what to do when objects drift. The default is
+	// `Correct`.
+	// +optional
+	Mode DriftMode `json:"mode,omitempty"`
+	// IgnoreFields gives the fields in which drift is ignored, in
+	// `IgnoreFields` mode, as paths like `spec.replicas`. A path
+	// covers the fields under it; it can't go into a list. Ignored
+	// fields aren't protected: whenever the object is applied again,
+	// for a new revision or to correct drift in other fields, they
+	// are put back too.
+	// +optional
+	IgnoreFields []string `json:"ignoreFields,omitempty"`
+}
+
 type SyncState string
 
 const (
@@ -86,6 +172,10 @@ const (
 	StateFailed SyncState = "failed"
 	// Updating in progress
 	StateUpdating SyncState = "updating"
+	// Removed, and waiting for what was synced to be deleted
+	StateDeleting SyncState = "deleting"
+	// Suspended, so not being applied
+	StateSuspended SyncState = "suspended"
 )
 
 // SyncStatus gives the status of a specific sync.
@@ -94,4 +184,107 @@ type SyncStatus struct {
 	Sync NamedSync `json:"sync"`
 	// State gives the outcome of last applied sync spec.
 	State SyncState `json:"state"`
+	// Message gives detail about the state, e.g., the reason the sync
+	// failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+	// LastAttemptedRevision gives the revision of the source that was
+	// most recently attempted.
+	// +optional
+	LastAttemptedRevision string `json:"lastAttemptedRevision,omitempty"`
+	// LastAppliedRevision gives the revision of the source that was
+	// most recently applied successfully.
+	// +optional
+	LastAppliedRevision string `json:"lastAppliedRevision,omitempty"`
+	// LastTransitionTime gives the time at which the state last
+	// changed.
+	// +optional
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+	// Conflicts gives the other syncs that have applied some of the
+	// same objects as this sync.
+	// +optional
+	Conflicts []SyncConflict `json:"conflicts,omitempty"`
+	// Inventory summarises the objects the sync has applied.
+	// +optional
+	Inventory *SyncInventory `json:"inventory,omitempty"`
+	// Drift records what was found the last time the objects the
+	// sync has applied were checked for drift.
+	// +optional
+	Drift *SyncDrift `json:"drift,omitempty"`
+}
+
+// MaxConflictObjects is the most objects that will be given in a
+// SyncConflict.
+const MaxConflictObjects = 10
+
+// MaxInventoryObjects is the most objects that will be given in a
+// SyncInventory.
+const MaxInventoryObjects = 100
+
+// SyncInventory summarises the objects a sync has applied.
+type SyncInventory struct {
+	// Total gives the number of objects applied.
+	Total int `json:"total"`
+	// Kinds gives the number of objects applied of each kind.
+	// +optional
+	Kinds map[string]int `json:"kinds,omitempty"`
+	// Objects gives the objects applied, as `Kind/namespace/name` (or
+	// `Kind/name` for cluster-scoped objects), sorted. This is only
+	// given if the assemblage controller is asked to list objects,
+	// and is truncated to MaxInventoryObjects entries.
+	// +optional
+	Objects []string `json:"objects,omitempty"`
+	// Truncated is true if Objects does not give every object
+	// applied.
+	// +optional
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// MaxDriftFields is the most fields that will be given in a
+// SyncDrift.
+const MaxDriftFields = 20
+
+// SyncDrift records what was found when checking the objects a sync
+// has applied against what was applied.
+type SyncDrift struct {
+	// LastCheckTime gives the time at which the objects were last
+	// checked.
+	LastCheckTime metav1.Time `json:"lastCheckTime"`
+	// Objects gives the number of objects found to have drifted at
+	// the last check.
+	Objects int `json:"objects"`
+	// Detections counts the checks at which drift was found, after
+	// none was found at the check before; i.e., how many times the
+	// objects have drifted.
+	Detections int `json:"detections"`
+	// LastDetectionTime gives the time at which drift was last found
+	// after none was found before.
+	// +optional
+	LastDetectionTime *metav1.Time `json:"lastDetectionTime,omitempty"`
+	// Fields gives the fields found to have drifted at the last
+	// check, as `Kind/namespace/name:path`, sorted. This is only
+	// given if the assemblage controller is asked to report fields,
+	// and is truncated to MaxDriftFields entries.
+	// +optional
+	Fields []string `json:"fields,omitempty"`
+	// Truncated is true if Fields does not give every field found
+	// to have drifted.
+	// +optional
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// SyncConflict records that another sync has applied some of the same
+// objects as a sync.
+type SyncConflict struct {
+	// Sync gives the name of the other sync.
+	Sync string `json:"sync"`
+	// Objects gives the objects both syncs have applied, as
+	// `Kind/namespace/name` (or `Kind/name` for cluster-scoped
+	// objects), sorted. This is truncated to MaxConflictObjects
+	// entries.
+	Objects []string `json:"objects"`
+	// Blocked is true if this sync has been stopped because of the
+	// conflict.
+	// +optional
+	Blocked bool `json:"blocked,omitempty"`
 }
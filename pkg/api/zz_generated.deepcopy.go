@@ -51,6 +51,26 @@ func (in *BindingSource) DeepCopy() *BindingSource {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DriftPolicy) DeepCopyInto(out *DriftPolicy) {
+	*out = *in
+	if in.IgnoreFields != nil {
+		in, out := &in.IgnoreFields, &out.IgnoreFields
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DriftPolicy.
+func (in *DriftPolicy) DeepCopy() *DriftPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(DriftPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *GitSource) DeepCopyInto(out *GitSource) {
 	*out = *in
@@ -114,6 +134,11 @@ func (in *NamedSync) DeepCopyInto(out *NamedSync) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.Drift != nil {
+		in, out := &in.Drift, &out.Drift
+		*out = new(DriftPolicy)
+		(*in).DeepCopyInto(*out)
+	}
 	in.Sync.DeepCopyInto(&out.Sync)
 }
 
@@ -218,10 +243,103 @@ func (in *Sync) DeepCopy() *Sync {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SyncConflict) DeepCopyInto(out *SyncConflict) {
+	*out = *in
+	if in.Objects != nil {
+		in, out := &in.Objects, &out.Objects
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SyncConflict.
+func (in *SyncConflict) DeepCopy() *SyncConflict {
+	if in == nil {
+		return nil
+	}
+	out := new(SyncConflict)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SyncDrift) DeepCopyInto(out *SyncDrift) {
+	*out = *in
+	in.LastCheckTime.DeepCopyInto(&out.LastCheckTime)
+	if in.LastDetectionTime != nil {
+		in, out := &in.LastDetectionTime, &out.LastDetectionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Fields != nil {
+		in, out := &in.Fields, &out.Fields
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SyncDrift.
+func (in *SyncDrift) DeepCopy() *SyncDrift {
+	if in == nil {
+		return nil
+	}
+	out := new(SyncDrift)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SyncInventory) DeepCopyInto(out *SyncInventory) {
+	*out = *in
+	if in.Kinds != nil {
+		in, out := &in.Kinds, &out.Kinds
+		*out = make(map[string]int, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Objects != nil {
+		in, out := &in.Objects, &out.Objects
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SyncInventory.
+func (in *SyncInventory) DeepCopy() *SyncInventory {
+	if in == nil {
+		return nil
+	}
+	out := new(SyncInventory)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SyncStatus) DeepCopyInto(out *SyncStatus) {
 	*out = *in
 	in.Sync.DeepCopyInto(&out.Sync)
+	if in.LastTransitionTime != nil {
+		in, out := &in.LastTransitionTime, &out.LastTransitionTime
+		*out = (*in).DeepCopy()
+	}
+	if in.Conflicts != nil {
+		in, out := &in.Conflicts, &out.Conflicts
+		*out = make([]SyncConflict, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Inventory != nil {
+		in, out := &in.Inventory, &out.Inventory
+		*out = new(SyncInventory)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Drift != nil {
+		in, out := &in.Drift, &out.Drift
+		*out = new(SyncDrift)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SyncStatus.
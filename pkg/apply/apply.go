@@ -0,0 +1,181 @@
+/*
+Copyright 2021 Michael Bridgen <mikeb@squaremobius.net>.
+*/
+
+// Package apply writes objects using server-side apply, so that each
+// controller owns only the fields it sets, and leaves alone fields
+// set by anyone else.
+package apply
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// CoOwnedFieldsAnnotation can be put on an object written by a
+// controller, to name fields that fleet operators want to set
+// themselves. The controller applies whatever value each of these
+// fields already has, rather than its own value; so, it shares
+// ownership of the field, and never conflicts with changes made to
+// it. The value is a comma-separated list of field paths, with the
+// path segments separated by dots, e.g., "spec.suspend,spec.interval".
+const CoOwnedFieldsAnnotation = "fleet.squaremo.dev/co-owned-fields"
+
+// legacyFieldManager is the field manager the API server recorded for
+// writes made by the controllers before they used server-side
+// apply. It's derived from the user agent, which is in turn derived
+// from the name of the executable. Conflicts with this field manager
+// are resolved by taking the fields over.
+var legacyFieldManager = filepath.Base(os.Args[0])
+
+// ConflictError is returned from Apply when some of the fields to be
+// applied are owned by another field manager, with different values.
+type ConflictError struct {
+	// Conflicts describes each field in conflict, and the field
+	// manager it's in conflict with, as reported by the API server.
+	Conflicts []string
+	err       error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("field conflict: %s", strings.Join(e.Conflicts, "; "))
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.err
+}
+
+// IsConflict reports whether the error is, or wraps, a ConflictError.
+func IsConflict(err error) bool {
+	var conflict *ConflictError
+	return errors.As(err, &conflict)
+}
+
+// Apply writes the object given with server-side apply, as the field
+// manager named. Only the fields that are set in the object are
+// applied, so the object given should be constructed afresh rather
+// than fetched from the API server. The object is updated with the
+// result, and the operation result says whether it was created or
+// changed.
+func Apply(ctx context.Context, c client.Client, obj client.Object, fieldManager string) (controllerutil.OperationResult, error) {
+	gvk, err := apiutil.GVKForObject(obj, c.Scheme())
+	if err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	fields, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	patch := &unstructured.Unstructured{Object: fields}
+	patch.SetGroupVersionKind(gvk)
+	// These are either written by the API server, or through another
+	// endpoint; and leaving the resource version out means the
+	// patch is not rejected if the object has changed meanwhile.
+	delete(patch.Object, "status")
+	for _, field := range []string{"creationTimestamp", "resourceVersion", "generation", "uid", "managedFields"} {
+		unstructured.RemoveNestedField(patch.Object, "metadata", field)
+	}
+
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(gvk)
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), live); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return controllerutil.OperationResultNone, err
+		}
+		live = nil
+	}
+	if live != nil {
+		coOwn(patch, live)
+	}
+
+	err = c.Patch(ctx, patch, client.Apply, client.FieldOwner(fieldManager))
+	if apierrors.IsConflict(err) {
+		conflicts, legacy := conflictsFrom(err)
+		if !legacy {
+			return controllerutil.OperationResultNone, &ConflictError{Conflicts: conflicts, err: err}
+		}
+		err = c.Patch(ctx, patch, client.Apply, client.FieldOwner(fieldManager), client.ForceOwnership)
+	}
+	if err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(patch.Object, obj); err != nil {
+		return controllerutil.OperationResultNone, err
+	}
+
+	switch {
+	case live == nil:
+		return controllerutil.OperationResultCreated, nil
+	case live.GetResourceVersion() != obj.GetResourceVersion():
+		return controllerutil.OperationResultUpdated, nil
+	default:
+		return controllerutil.OperationResultNone, nil
+	}
+}
+
+// coOwn replaces the value of each field named in the co-owned fields
+// annotation of the live object with the value it has in the live
+// object.
+func coOwn(patch, live *unstructured.Unstructured) {
+	paths, ok := live.GetAnnotations()[CoOwnedFieldsAnnotation]
+	if !ok {
+		return
+	}
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		segments := strings.Split(path, ".")
+		value, found, err := unstructured.NestedFieldCopy(live.Object, segments...)
+		switch {
+		case err != nil:
+			continue
+		case found:
+			// This can only fail if a segment along the way is
+			// not a map, in which case the field is left as it
+			// is.
+			_ = unstructured.SetNestedField(patch.Object, value, segments...)
+		default:
+			unstructured.RemoveNestedField(patch.Object, segments...)
+		}
+	}
+}
+
+// conflictsFrom gives the description of each conflict reported in
+// the error, and whether all the conflicts are with the legacy field
+// manager.
+func conflictsFrom(err error) ([]string, bool) {
+	status, ok := err.(apierrors.APIStatus)
+	if !ok || status.Status().Details == nil {
+		return []string{err.Error()}, false
+	}
+	legacy := true
+	legacyPrefix := fmt.Sprintf("conflict with %q", legacyFieldManager)
+	var conflicts []string
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type != metav1.CauseTypeFieldManagerConflict {
+			continue
+		}
+		conflicts = append(conflicts, cause.Message)
+		if !strings.HasPrefix(cause.Message, legacyPrefix) {
+			legacy = false
+		}
+	}
+	if len(conflicts) == 0 {
+		return []string{err.Error()}, false
+	}
+	return conflicts, legacy
+}